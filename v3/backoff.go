@@ -0,0 +1,113 @@
+package grab
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Backoff determines how long to wait before retrying a failed attempt. The
+// first retry follows attempt 1.
+//
+// Backoff implementations must be safe for concurrent use.
+type Backoff interface {
+	Delay(attempt int) time.Duration
+}
+
+// ConstantBackoff is a Backoff that always waits for the same duration.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Delay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff is a Backoff that waits for Base after the first attempt
+// and multiplies the delay by Factor after each subsequent attempt, up to Max.
+type ExponentialBackoff struct {
+	// Base is the delay after the first attempt.
+	Base time.Duration
+
+	// Max is the maximum delay. Zero means no maximum.
+	Max time.Duration
+
+	// Factor is the multiplier applied to the delay after each attempt.
+	// Default: 2.
+	Factor float64
+}
+
+func (b ExponentialBackoff) Delay(attempt int) time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	return capDelay(float64(b.Base)*math.Pow(factor, float64(attempt-1)), b.Max)
+}
+
+// FullJitterBackoff is a Backoff that waits for a random duration between zero
+// and the delay of an ExponentialBackoff with a Factor of 2, so that clients
+// retrying at the same time spread out their retries.
+type FullJitterBackoff struct {
+	// Base is the maximum delay after the first attempt.
+	Base time.Duration
+
+	// Max is the maximum delay. Zero means no maximum.
+	Max time.Duration
+
+	// Rand returns a pseudo-random number in [0.0, 1.0). Default:
+	// math/rand.Float64.
+	Rand func() float64
+}
+
+func (b FullJitterBackoff) Delay(attempt int) time.Duration {
+	d := ExponentialBackoff{Base: b.Base, Max: b.Max}.Delay(attempt)
+	return time.Duration(randFloat(b.Rand) * float64(d))
+}
+
+// DecorrelatedJitterBackoff is a Backoff that waits for a random duration
+// between Base and three times the previous delay, up to Max. The delay
+// depends on the previous delay, so a DecorrelatedJitterBackoff must not be
+// shared by transfers. The sequence restarts at attempt 1.
+type DecorrelatedJitterBackoff struct {
+	// Base is the minimum delay.
+	Base time.Duration
+
+	// Max is the maximum delay. Zero means no maximum.
+	Max time.Duration
+
+	// Rand returns a pseudo-random number in [0.0, 1.0). Default:
+	// math/rand.Float64.
+	Rand func() float64
+
+	mu   sync.Mutex
+	prev time.Duration
+}
+
+func (b *DecorrelatedJitterBackoff) Delay(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if attempt <= 1 || b.prev < b.Base {
+		b.prev = b.Base
+	}
+	d := float64(b.Base) + randFloat(b.Rand)*float64(3*b.prev-b.Base)
+	b.prev = capDelay(d, b.Max)
+	return b.prev
+}
+
+// capDelay converts d to a time.Duration of at most max, if max is non-zero.
+func capDelay(d float64, max time.Duration) time.Duration {
+	if max > 0 && d > float64(max) {
+		return max
+	}
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+func randFloat(f func() float64) float64 {
+	if f == nil {
+		return rand.Float64()
+	}
+	return f()
+}
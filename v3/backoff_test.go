@@ -0,0 +1,75 @@
+package grab
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	half := func() float64 { return 0.5 }
+	tests := []struct {
+		Name    string
+		Backoff Backoff
+		Expect  []time.Duration
+	}{
+		{
+			Name:    "Constant",
+			Backoff: ConstantBackoff(time.Second),
+			Expect:  []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			Name:    "Exponential",
+			Backoff: ExponentialBackoff{Base: time.Second, Max: 5 * time.Second},
+			Expect:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+		{
+			Name:    "ExponentialWithFactor",
+			Backoff: ExponentialBackoff{Base: time.Second, Factor: 3},
+			Expect:  []time.Duration{time.Second, 3 * time.Second, 9 * time.Second},
+		},
+		{
+			Name:    "FullJitter",
+			Backoff: FullJitterBackoff{Base: time.Second, Max: 6 * time.Second, Rand: half},
+			Expect:  []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			Name:    "DecorrelatedJitter",
+			Backoff: &DecorrelatedJitterBackoff{Base: time.Second, Max: 8 * time.Second, Rand: half},
+			// base + 0.5 * (3 * prev - base)
+			Expect: []time.Duration{2 * time.Second, 3500 * time.Millisecond, 5750 * time.Millisecond, 8 * time.Second},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			for i, expect := range test.Expect {
+				if d := test.Backoff.Delay(i + 1); d != expect {
+					t.Errorf("expected delay after attempt %d: %v, got: %v", i+1, expect, d)
+				}
+			}
+		})
+	}
+
+	t.Run("DecorrelatedJitterRestart", func(t *testing.T) {
+		b := &DecorrelatedJitterBackoff{Base: time.Second, Rand: half}
+		b.Delay(1)
+		b.Delay(2)
+		if d := b.Delay(1); d != 2*time.Second {
+			t.Errorf("expected sequence to restart at attempt 1, got: %v", d)
+		}
+	})
+
+	t.Run("ExponentialOverflow", func(t *testing.T) {
+		if d := (ExponentialBackoff{Base: time.Second}).Delay(1000); d <= 0 {
+			t.Errorf("expected positive delay, got: %v", d)
+		}
+	})
+
+	t.Run("DefaultRand", func(t *testing.T) {
+		b := FullJitterBackoff{Base: time.Second}
+		for i := 0; i < 100; i++ {
+			if d := b.Delay(1); d < 0 || d >= time.Second {
+				t.Fatalf("expected delay in [0, 1s), got: %v", d)
+			}
+		}
+	})
+}
@@ -3,13 +3,22 @@ package grab
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -44,12 +53,196 @@ type Client struct {
 	// to the transfer progress statistics. The BufferSize of each request can
 	// be overridden on each Request object. Default: 32KB.
 	BufferSize int
+
+	// DetailedStats specifies that the time spent blocked on reads and writes
+	// should be measured for every transfer and reported via Response.Stats.
+	// Measuring this adds clock reads to every iteration of the copy loop.
+	DetailedStats bool
+
+	// ProbeCacheTTL specifies how long the response to a HEAD request sent to
+	// probe a remote file, including its size, Accept-Ranges and
+	// Content-Disposition headers, is reused by subsequent transfers of the
+	// same URL instead of sending another HEAD request. A cached response is
+	// discarded early if the validators of a later response for the URL
+	// disagree with it, as the remote file changed. Hits and misses are
+	// reported by Usage.
+	//
+	// Zero disables the cache.
+	ProbeCacheTTL time.Duration
+
+	// MaxConcurrentTransfers limits the number of file transfers that may be
+	// in progress at once, regardless of whether they were started via Do,
+	// DoBatch or DoChannel. Excess transfers are held in StatePending until
+	// another transfer completes. Zero means no limit.
+	//
+	// MaxConcurrentTransfers must not be changed once the Client has been used.
+	MaxConcurrentTransfers int
+
+	// PropagatePanics specifies that panics during a file transfer, such as a
+	// panic in a user provided Hook, should crash the program as usual.
+	// Otherwise, a panic only fails the transfer in which it occurred, with an
+	// error of type *PanicError, and other transfers are unaffected.
+	PropagatePanics bool
+
+	// MaxTotalBytes limits the cumulative number of bytes that may be
+	// downloaded by all transfers of the Client, such as on a metered
+	// connection. Once the limit is reached, transfers in progress fail with
+	// ErrQuotaExceeded at their next write and new transfers fail with
+	// ErrQuotaExceeded before sending any request. Only bytes downloaded by
+	// the Client count towards the limit: the bytes of an existing file that
+	// is resumed do not. Zero means no limit.
+	MaxTotalBytes int64
+
+	// PerTransferTimeout limits the time that each file transfer may take once
+	// it has started, including any time spent resuming an existing file. A
+	// transfer that does not complete in time fails with ErrTransferTimeout,
+	// which wraps context.DeadlineExceeded. Time spent in StatePending does
+	// not count towards the limit. Zero means no limit.
+	PerTransferTimeout time.Duration
+
+	// DetectProxyInterference specifies that responses should be checked for
+	// signs that they were altered by a proxy: a Via or X-Cache header, or a
+	// size, ETag or Accept-Ranges header that differs between the HEAD and GET
+	// responses. Each sign is reported by Response.Warnings with the code
+	// WarnProxyInterference. Transfers do not fail unless
+	// Request.FailOnInterference is set.
+	DetectProxyInterference bool
+
+	// AllowedRoot confines the destinations of all transfers to the given
+	// directory. If AllowedRoot is set, a transfer whose destination resolves
+	// to a path outside of AllowedRoot once all symlinks are followed, fails
+	// with ErrDestinationNotAllowed before it is opened. Transfers that do not
+	// write to the local file system are not affected.
+	AllowedRoot string
+
+	// MaxCrossHostRedirects limits the number of redirects that each HTTP
+	// request may follow to a different host than the URL it was redirected
+	// from, such as a download link that redirects to an unexpected server.
+	// A request that exceeds the limit fails with ErrCrossHostRedirect, naming
+	// the offending host, before any content is downloaded. Redirects within
+	// the same host are not counted and remain subject to the CheckRedirect
+	// policy of HTTPClient, which is applied first.
+	//
+	// Zero forbids any redirect to a different host and a negative value means
+	// no limit. NewClient sets it to -1, so a Client that is not created by
+	// NewClient forbids cross-host redirects unless it is set.
+	//
+	// The limit is enforced by CheckRedirect if HTTPClient is an *http.Client.
+	// For any other HTTPClient, only a response from a different host than
+	// the request URL can be detected, which fails if MaxCrossHostRedirects is
+	// zero.
+	MaxCrossHostRedirects int
+
+	// MetricsCollector, if not nil, is called with the metrics of each
+	// transfer of the Client when it completes.
+	MetricsCollector MetricsCollector
+
+	// Clock, if not nil, is the source of the time at which transfers start
+	// and end and at which their transfer rate is sampled, as reported by
+	// Response.Duration, BytesPerSecond and ETA. It may be replaced with a
+	// grabtest.FakeClock to test progress reporting deterministically.
+	// Default: the system clock.
+	Clock Clock
+
+	// PreresolveTTL is how long the addresses resolved by PreresolveHosts
+	// are used before hosts are resolved as usual again. Default: 5 minutes.
+	PreresolveTTL time.Duration
+
+	// MaxConcurrentDials limits the number of connections that may be in the
+	// process of being established at once, including DNS resolution, across
+	// all transfers of the Client, so that the start of a large batch does not
+	// dial every connection at the same time. Once connected, transfers are
+	// not limited by it. TLS handshakes happen after the dial, and are not
+	// limited.
+	//
+	// The limit applies in addition to the MaxConnsPerHost of the
+	// http.Transport: a connection waiting for a dial already counts towards
+	// MaxConnsPerHost of its host, while a connection held back by
+	// MaxConnsPerHost is not dialing. Zero means no limit.
+	//
+	// The Client.HTTPClient must be an *http.Client that uses an
+	// *http.Transport, as created by NewClient, whose DialContext function is
+	// wrapped when the first request is sent; MaxConcurrentDials is ignored
+	// otherwise. It must not be changed once the Client has been used.
+	MaxConcurrentDials int
+
+	// URLPolicy, if not nil, is called with every URL before it is
+	// requested, including the URL of each redirect and the index pages of
+	// MirrorIndex, to protect against server-side request forgery when
+	// downloading URLs from untrusted sources. If it returns an error, the
+	// request is not sent and fails with an error that wraps ErrForbiddenURL.
+	// DefaultSSRFPolicy returns a policy that forbids URLs that are not HTTPS
+	// and addresses that are not publicly routable.
+	//
+	// As the host of a URL may resolve to any address, URLPolicy is also
+	// called as each connection is dialed, with a URL that has the scheme
+	// of the request and, as its host, the resolved IP address and port.
+	// The host is resolved once and only an address that the policy allows
+	// is dialed, so the host cannot be rebound to another address in
+	// between. Dials are only checked if HTTPClient is an *http.Client that
+	// uses an *http.Transport, as created by NewClient, whose DialContext
+	// function is wrapped when the first request is sent, and not for
+	// requests with Request.Transport set. Redirects followed by any other
+	// HTTPClient are checked once they have been followed.
+	//
+	// A connection through a proxy is made to the address of the proxy
+	// rather than to that of the requested host, so a request that the
+	// Proxy function of that *http.Transport sends through a proxy, as
+	// http.ProxyFromEnvironment of NewClient does if HTTP_PROXY or
+	// HTTPS_PROXY is set, fails with an error that wraps ErrForbiddenURL.
+	// Set Proxy to nil to connect directly.
+	//
+	// URLPolicy must not be changed once the Client has been used.
+	URLPolicy func(u *url.URL) error
+
+	// transferred counts the bytes written by all transfers, if MaxTotalBytes
+	// is set.
+	transferred atomic.Int64
+
+	// active, queued and pending count the transfers that are in progress, the
+	// requests waiting for a DoBatch worker and the transfers waiting for a
+	// transfer slot.
+	active  atomic.Int64
+	queued  atomic.Int64
+	pending atomic.Int64
+
+	// usage counts the bandwidth used by all transfers.
+	usage usage
+
+	// probes caches HEAD responses, if ProbeCacheTTL is set.
+	probes probeCache
+
+	// buffers is reused across transfers to reduce allocations.
+	buffers bufferPool
+
+	// slots is a semaphore of MaxConcurrentTransfers slots.
+	slots     chan struct{}
+	slotsOnce sync.Once
+
+	// queues orders the requests of each channel consumed by DoChannel by
+	// Request.Priority.
+	queues requestQueues
+
+	// hosts holds the addresses resolved by PreresolveHosts, once it has
+	// been called.
+	hosts *hostCache
+
+	// dials is a semaphore of MaxConcurrentDials slots, and dialPolicy is
+	// the URLPolicy that checks each address dialed, once the DialContext
+	// function of HTTPClient has been wrapped.
+	dials      dialLimiter
+	dialPolicy func(u *url.URL) error
+	dialsOnce  sync.Once
+
+	// tags holds the transfers in progress that carry any Request.Tags.
+	tags tagIndex
 }
 
 // NewClient returns a new file download Client, using default configuration.
 func NewClient() *Client {
 	return &Client{
-		UserAgent: "grab",
+		UserAgent:             "grab",
+		MaxCrossHostRedirects: -1,
 		HTTPClient: &http.Client{
 			Transport: &http.Transport{
 				Proxy: http.ProxyFromEnvironment,
@@ -68,39 +261,140 @@ var DefaultClient = NewClient()
 //
 // Like http.Get, Do blocks while the transfer is initiated, but returns as soon
 // as the transfer has started transferring in a background goroutine, or if it
-// failed early.
+// failed early. Once the transfer has started, the metadata of the Response
+// is known: Filename, Size, HTTPResponse, StatusCode, LastModified, ETag,
+// CanResume and DidResume are populated and Response.MetadataReady is closed.
+//
+// If Client.MaxConcurrentTransfers transfers are already in progress, Do
+// returns immediately with a Response in StatePending. The transfer is
+// initiated in a background goroutine once a transfer slot becomes available
+// and its metadata must not be read until Response.MetadataReady is closed.
 //
 // An error is returned via Response.Err if caused by client policy (such as
 // CheckRedirect), or if there was an HTTP protocol or IO error. Response.Err
 // will block the caller until the transfer is completed, successfully or
 // otherwise.
 func (c *Client) Do(req *Request) *Response {
+	return c.do(req, time.Time{}, nil)
+}
+
+// do implements Do. If deadline is not zero, the transfer fails with
+// ErrBatchDeadline if it is not complete by then. If worker is not nil, the
+// transfer is run by a worker of a batch with
+// BatchOptions.SmallFileOptimization.
+func (c *Client) do(req *Request, deadline time.Time, worker *batchWorker) *Response {
 	// cancel will be called on all code-paths via closeResponse
-	ctx, cancel := context.WithCancel(req.Context())
-	req = req.WithContext(ctx)
+	ctx, cancel := context.WithCancelCause(req.Context())
+	submitted := req
+	req = req.seal(ctx)
 	resp := &Response{
-		Request:    req,
-		Start:      time.Now(),
+		Request:    submitted,
+		req:        req,
+		Start:      now(c.Clock),
+		clock:      c.Clock,
 		Done:       make(chan struct{}, 0),
 		Filename:   req.Filename,
+		sizeUnsafe: -1,
+		metadata:   make(chan struct{}),
 		ctx:        ctx,
 		cancel:     cancel,
 		bufferSize: req.BufferSize,
+		worker:     worker,
 	}
 	if resp.bufferSize == 0 {
 		// default to Client.BufferSize
 		resp.bufferSize = c.BufferSize
 	}
+	// removed in closeResponse
+	c.tags.add(resp)
+	if max := req.MaxBufferSize; max > 0 {
+		if resp.bufferSize > max || (resp.bufferSize < 1 && max < 32*1024) {
+			// cap the given or default buffer size
+			resp.bufferSize = max
+		}
+	}
+	if req.Discard {
+		// no file is resolved, opened or resumed
+		req.NoStore = true
+	}
+	if cas := req.ContentAddressed; cas != nil && !req.NoStore {
+		resp.casTemp = casTempName(cas.Dir)
+		resp.casHash = casHash(cas)
+	}
+	resp.Filename = initialFilename(resp)
+	if !deadline.IsZero() {
+		if d := time.Until(deadline); d > 0 {
+			resp.timers = append(resp.timers, time.AfterFunc(d, func() {
+				cancel(ErrBatchDeadline)
+			}))
+		} else {
+			cancel(ErrBatchDeadline)
+		}
+	}
+
+	slots := c.transferSlots()
+	if slots == nil {
+		c.start(resp)
+		return resp
+	}
+	select {
+	case slots <- struct{}{}:
+		resp.slots = slots
+		c.start(resp)
+	default:
+		// wait for a transfer slot without blocking the caller
+		resp.state.Store(int32(StatePending))
+		c.pending.Add(1)
+		go func() {
+			select {
+			case slots <- struct{}{}:
+				resp.slots = slots
+				c.pending.Add(-1)
+				c.start(resp)
+			case <-ctx.Done():
+				c.run(resp, c.closeResponse)
+			}
+		}()
+	}
+	return resp
+}
+
+// start initializes the file transfer and then starts copying the response
+// body in a new goroutine.
+func (c *Client) start(resp *Response) {
+	// decremented in closeResponse
+	c.active.Add(1)
+	resp.state.Store(int32(StateConnecting))
+	if d := c.PerTransferTimeout; d > 0 {
+		resp.timers = append(resp.timers, time.AfterFunc(d, func() {
+			resp.cancel(ErrTransferTimeout)
+		}))
+	}
 
 	// Run state-machine while caller is blocked to initialize the file transfer.
 	// Must never transition to the copyFile state - this happens next in another
 	// goroutine.
-	c.run(resp, c.statFileInfo)
+	f := c.statFileInfo
+	if max := c.MaxTotalBytes; max > 0 && c.transferred.Load() >= max {
+		resp.err = ErrQuotaExceeded
+		f = c.closeResponse
+	}
+	c.run(resp, f)
 
 	// Run copyFile in a new goroutine. copyFile will no-op if the transfer is
 	// already complete or failed.
 	go c.run(resp, c.copyFile)
-	return resp
+}
+
+// transferSlots returns the semaphore used to enforce
+// Client.MaxConcurrentTransfers, or nil if there is no limit.
+func (c *Client) transferSlots() chan struct{} {
+	c.slotsOnce.Do(func() {
+		if c.MaxConcurrentTransfers > 0 {
+			c.slots = make(chan struct{}, c.MaxConcurrentTransfers)
+		}
+	})
+	return c.slots
 }
 
 // DoChannel executes all requests sent through the given Request channel, one
@@ -110,6 +404,14 @@ func (c *Client) Do(req *Request) *Response {
 // received from the remote servers and can be used to track the progress of
 // each download.
 //
+// While every worker is busy, up to one request per worker is received from
+// the channel and queued until a worker is free, when the queued request with
+// the highest Request.Priority is started, in the order they were sent for
+// equal priorities. Further sends block until a queued request starts. All
+// calls to DoChannel with the same Request channel share one queue and its
+// workers. Priority only affects the order in which queued requests start;
+// transfers in progress are never preempted.
+//
 // Slow Response receivers will cause a worker to block and therefore delay the
 // start of the transfer for an already initiated connection - potentially
 // causing a server timeout. It is the caller's responsibility to ensure a
@@ -118,14 +420,59 @@ func (c *Client) Do(req *Request) *Response {
 // If an error occurs during any of the file transfers it will be accessible via
 // the associated Response.Err function.
 func (c *Client) DoChannel(reqch <-chan *Request, respch chan<- *Response) {
+	c.doChannel(reqch, respch, nil, time.Time{})
+}
+
+// doChannel implements DoChannel. If dequeued is not nil, it is called as each
+// request is received from reqch. If deadline is not zero, it is the
+// BatchOptions.Deadline of every transfer.
+func (c *Client) doChannel(reqch <-chan *Request, respch chan<- *Response, dequeued func(), deadline time.Time) {
 	// TODO: enable cancelling of batch jobs
-	for req := range reqch {
-		resp := c.Do(req)
+	q := c.queues.acquire(reqch)
+	defer c.queues.release(reqch)
+	for {
+		req, ok := q.pop()
+		if !ok {
+			return
+		}
+		if dequeued != nil {
+			dequeued()
+		}
+		resp := c.do(req, deadline, nil)
 		respch <- resp
 		<-resp.Done
 	}
 }
 
+// batchWorker is the state shared by the transfers run by one worker of a
+// batch with BatchOptions.SmallFileOptimization, which run one at a time.
+type batchWorker struct {
+	// buf is the transfer buffer of the last transfer, to be reused by the
+	// next.
+	buf []byte
+}
+
+// doHostQueue runs the requests of the given hostQueue as a worker of a batch
+// with BatchOptions.SmallFileOptimization, until none are left.
+func (c *Client) doHostQueue(q *hostQueue, respch chan<- *Response, dequeued func(), deadline time.Time) {
+	w := &batchWorker{}
+	host := ""
+	for {
+		req, next, ok := q.next(host)
+		if !ok {
+			break
+		}
+		host = next
+		dequeued()
+		resp := c.do(req, deadline, w)
+		respch <- resp
+		<-resp.Done
+	}
+	if w.buf != nil {
+		c.buffers.put(w.buf)
+	}
+}
+
 // DoBatch executes all the given requests using the given number of concurrent
 // workers. Control is passed back to the caller as soon as the workers are
 // initiated.
@@ -133,22 +480,85 @@ func (c *Client) DoChannel(reqch <-chan *Request, respch chan<- *Response) {
 // If the requested number of workers is less than one, a worker will be created
 // for every request. I.e. all requests will be executed concurrently.
 //
+// Requests with a higher Request.Priority are started first, in the given order
+// for equal priorities. Priority only affects the order in which requests
+// start; transfers in progress are never preempted.
+//
 // If an error occurs during any of the file transfers it will be accessible via
 // call to the associated Response.Err.
 //
 // The returned Response channel is closed only after all of the given Requests
 // have completed, successfully or otherwise.
 func (c *Client) DoBatch(workers int, requests ...*Request) <-chan *Response {
+	return c.DoBatchWithOptions(BatchOptions{Workers: workers}, requests...)
+}
+
+// BatchOptions configures a batch of transfers started with
+// DoBatchWithOptions.
+type BatchOptions struct {
+	// Workers is the number of concurrent workers. If it is less than one, a
+	// worker is created for every request.
+	Workers int
+
+	// Deadline is the time by which all transfers of the batch must be
+	// complete. Transfers that are still in progress at the deadline fail with
+	// ErrBatchDeadline, which wraps context.DeadlineExceeded, as do any
+	// transfers of the batch that have not yet started. Zero means no
+	// deadline.
+	Deadline time.Time
+
+	// SmallFileOptimization reduces the overhead of batches of many small
+	// files, whose transfers are dominated by the cost of their requests
+	// rather than of their content. Each worker keeps taking requests for the
+	// same host while it has any, so that its connection is reused, and then
+	// moves to the host with the fewest workers, so Request.Priority only
+	// orders the requests of each host. Each worker also reuses a single
+	// transfer buffer, and no HEAD request is sent to check for an existing
+	// file if the destination is a directory that has no file named as in
+	// the URL.
+	//
+	// A file that is nonetheless found to exist once the response is
+	// received, such as one named by a Content-Disposition header, is
+	// downloaded again in full rather than resumed, or fails with
+	// ErrFileExists if Request.SkipExisting is set.
+	SmallFileOptimization bool
+}
+
+// DoBatchWithOptions is the same as DoBatch, but is configured by the given
+// BatchOptions.
+func (c *Client) DoBatchWithOptions(opts BatchOptions, requests ...*Request) <-chan *Response {
+	workers := opts.Workers
 	if workers < 1 {
 		workers = len(requests)
 	}
-	reqch := make(chan *Request, len(requests))
+	requests = append([]*Request(nil), requests...)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Priority > requests[j].Priority
+	})
 	respch := make(chan *Response, len(requests))
+	c.queued.Add(int64(len(requests)))
+	dequeued := func() { c.queued.Add(-1) }
 	wg := sync.WaitGroup{}
+	if opts.SmallFileOptimization {
+		q := newHostQueue(requests)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				c.doHostQueue(q, respch, dequeued, opts.Deadline)
+				wg.Done()
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(respch)
+		}()
+		return respch
+	}
+	reqch := make(chan *Request, len(requests))
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			c.DoChannel(reqch, respch)
+			c.doChannel(reqch, respch, dequeued, opts.Deadline)
 			wg.Done()
 		}()
 	}
@@ -165,6 +575,102 @@ func (c *Client) DoBatch(workers int, requests ...*Request) <-chan *Response {
 	return respch
 }
 
+// ActiveTransfers returns the number of file transfers started by this Client
+// that have not yet completed, successfully or otherwise. It is safe to call
+// concurrently with any running transfers.
+func (c *Client) ActiveTransfers() int {
+	return int(c.active.Load())
+}
+
+// Usage returns a copy of the cumulative bandwidth used by the transfers of
+// this Client since it was created or since ResetUsage was last called. It is
+// safe to call concurrently with any running transfers, though the counters
+// of transfers in progress are not all read at the same instant.
+func (c *Client) Usage() UsageReport {
+	return c.usage.report()
+}
+
+// ResetUsage resets the counters reported by Usage to zero.
+func (c *Client) ResetUsage() {
+	c.usage.reset()
+}
+
+// QueuedTransfers returns the number of requests submitted via DoBatch that are
+// still waiting for a worker to start them, plus the number of transfers
+// waiting for a transfer slot, as reported by QueueLength. It is safe to call
+// concurrently with any running transfers.
+func (c *Client) QueuedTransfers() int {
+	return int(c.queued.Load() + c.pending.Load())
+}
+
+// QueueLength returns the number of transfers in StatePending, waiting for one
+// of the Client.MaxConcurrentTransfers slots to become available. It is safe to
+// call concurrently with any running transfers.
+func (c *Client) QueueLength() int {
+	return int(c.pending.Load())
+}
+
+// SetSocketOptions sets the function used to configure each socket opened by
+// the Client before it connects, as in net.Dialer.Control, for example to set
+// SO_RCVBUF on links where the default socket buffers limit the transfer
+// rate, TCP keepalive intervals or packet marks for QoS. Socket options are
+// platform-specific: use the syscall or golang.org/x/sys packages of the
+// target platform within fn. A nil fn removes any previous function.
+//
+// The Client.HTTPClient must be an *http.Client that uses an *http.Transport,
+// as created by NewClient. Its DialContext function is replaced by a
+// net.Dialer with the same timeouts as http.DefaultTransport. It must not be
+// called while transfers are in progress.
+func (c *Client) SetSocketOptions(fn func(network, address string, conn syscall.RawConn) error) error {
+	t, err := c.httpTransport("set socket options of")
+	if err != nil {
+		return err
+	}
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   fn,
+	}).DialContext
+	if c.hosts != nil {
+		// keep connecting to the hosts resolved by PreresolveHosts
+		t.DialContext = c.hosts.dialer(t.DialContext)
+	}
+	t.DialContext = c.wrapDial(t.DialContext)
+	return nil
+}
+
+// httpTransport returns the *http.Transport of the Client.HTTPClient, which
+// must be an *http.Client, so that the given action can configure it. A nil
+// Transport is replaced by a clone of http.DefaultTransport.
+func (c *Client) httpTransport(action string) (*http.Transport, error) {
+	hc, ok := c.HTTPClient.(*http.Client)
+	if !ok {
+		return nil, fmt.Errorf("grab: cannot %s a custom HTTPClient", action)
+	}
+	switch v := hc.Transport.(type) {
+	case nil:
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		hc.Transport = t
+		return t, nil
+	case *http.Transport:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("grab: cannot %s a custom http.RoundTripper", action)
+	}
+}
+
+// dialContext returns the DialContext function of t, or that of a net.Dialer
+// with the same timeouts as http.DefaultTransport if it is nil.
+func dialContext(t *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext
+	}
+	return (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+}
+
 // An stateFunc is an action that mutates the state of a Response and returns
 // the next stateFunc to be called.
 type stateFunc func(*Response) stateFunc
@@ -174,13 +680,18 @@ type stateFunc func(*Response) stateFunc
 // should mutate the state of the given Response until it has completed
 // downloading or failed.
 func (c *Client) run(resp *Response, f stateFunc) {
+	if c.PropagatePanics {
+		defer c.closeOnPanic(resp)
+	} else {
+		defer c.recoverPanic(resp)
+	}
 	for {
 		select {
 		case <-resp.ctx.Done():
 			if resp.IsComplete() {
 				return
 			}
-			resp.err = resp.ctx.Err()
+			resp.err = resp.ctxErr()
 			f = c.closeResponse
 
 		default:
@@ -192,6 +703,38 @@ func (c *Client) run(resp *Response, f stateFunc) {
 	}
 }
 
+// recoverPanic recovers from a panic in a stateFunc, such as a panic in a user
+// provided hook, and completes the Response with a *PanicError.
+func (c *Client) recoverPanic(resp *Response) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if resp.IsComplete() {
+		// Request.OnFinish panicked once the transfer was complete
+		resp.warn(WarnOnFinishPanic, &PanicError{Value: v, Stack: debug.Stack()},
+			"Request.OnFinish panicked")
+		return
+	}
+	resp.err = &PanicError{Value: v, Stack: debug.Stack()}
+	c.closeResponse(resp)
+}
+
+// closeOnPanic completes the Response with a *PanicError if a stateFunc
+// panics while Client.PropagatePanics is set, so that Request.OnFinish is
+// called, and then panics again with the same value.
+func (c *Client) closeOnPanic(resp *Response) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if !resp.IsComplete() {
+		resp.err = &PanicError{Value: v, Stack: debug.Stack()}
+		c.closeResponse(resp)
+	}
+	panic(v)
+}
+
 // statFileInfo retrieves FileInfo for any local file matching
 // Response.Filename.
 //
@@ -203,44 +746,99 @@ func (c *Client) run(resp *Response, f stateFunc) {
 //
 // If an error occurs, the next stateFunc is closeResponse.
 func (c *Client) statFileInfo(resp *Response) stateFunc {
-	if resp.Request.NoStore || resp.Filename == "" {
+	if resp.req.NoStore || resp.Filename == "" {
 		return c.headRequest
 	}
+	if resp.Filename == "-" {
+		// standard output is written sequentially, without resuming
+		resp.stream = true
+		if resp.req.byteRange() != nil {
+			return c.rangeRequest
+		}
+		return c.getRequest
+	}
+	resp.Filename = longPath(resp.Filename)
+	if resp.err = c.checkDestination(resp); resp.err != nil {
+		return c.closeResponse
+	}
 	fi, err := os.Stat(resp.Filename)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if os.IsNotExist(err) && resp.req.WriteOffset == 0 {
 			return c.headRequest
 		}
 		resp.err = err
 		return c.closeResponse
 	}
 	if fi.IsDir() {
+		if resp.req.FilenameFunc != nil || resp.req.WriteOffset > 0 {
+			// the path was already resolved by FilenameFunc
+			resp.err = &os.PathError{Op: "open", Path: resp.Filename, Err: syscall.EISDIR}
+			return c.closeResponse
+		}
 		resp.Filename = ""
 		return c.headRequest
 	}
+	if isStream(fi) {
+		// named pipes and devices are written sequentially, without resuming
+		resp.stream = true
+		if resp.req.byteRange() != nil {
+			return c.rangeRequest
+		}
+		return c.getRequest
+	}
 	resp.fi = fi
+	if resp.req.WriteOffset > 0 {
+		return c.validateWriteOffset
+	}
+	if resp.req.Range != nil {
+		return c.rangeRequest
+	}
 	return c.validateLocal
 }
 
+// validateWriteOffset prepares to write a range of the remote file over the
+// existing file at Request.WriteOffset, requesting the range from the same
+// offset to the end of the existing file unless the Request has a Range
+// header. The next stateFunc is getRequest.
+func (c *Client) validateWriteOffset(resp *Response) stateFunc {
+	offset := resp.req.WriteOffset
+	if offset >= resp.fi.Size() {
+		resp.err = fmt.Errorf("%w: offset %d, file has %d bytes",
+			ErrBadWriteOffset, offset, resp.fi.Size())
+		return c.closeResponse
+	}
+	hreq := resp.req.HTTPRequest
+	if hreq.Header.Get("Range") == "" {
+		hreq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, resp.fi.Size()-1))
+	}
+	resp.inPlace = true
+	resp.optionsKnown = true
+	return c.getRequest
+}
+
 // validateLocal compares a local copy of the downloaded file to the remote
 // file.
 //
-// An error is returned if the local file is larger than the remote file, or
+// An error is returned if the local file is larger than the remote file, if
+// Request.ResumeFrom is beyond the end of the remote file, or if
 // Request.SkipExisting is true.
 //
 // If the existing file matches the length of the remote file, the next
 // stateFunc is checksumFile.
 //
 // If the local file is smaller than the remote file and the remote server is
-// known to support ranged requests, the next stateFunc is getRequest.
+// known to support ranged requests, the next stateFunc is getRequest. If the
+// size of the remote file is unknown, the local file is resumed according to
+// Request.UnknownSizeResume.
 func (c *Client) validateLocal(resp *Response) stateFunc {
-	if resp.Request.SkipExisting {
+	if resp.req.SkipExisting {
+		resp.skip(SkipFileExists)
 		resp.err = ErrFileExists
 		return c.closeResponse
 	}
 
 	// determine target file size
-	expectedSize := resp.Request.Size
+	expectedSize := resp.req.Size
 	if expectedSize == 0 && resp.HTTPResponse != nil {
 		expectedSize = resp.HTTPResponse.ContentLength
 	}
@@ -252,85 +850,293 @@ func (c *Client) validateLocal(resp *Response) stateFunc {
 		return c.headRequest
 	}
 
-	if expectedSize == resp.fi.Size() {
+	// determine resume offset
+	offset := resp.fi.Size()
+	noResume := resp.req.NoResume || resp.req.SingleUse
+	if f := resp.req.ResumeOffsetFunc; f != nil && !noResume {
+		offset, resp.err = f(resp.Filename, resp.fi)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+		if offset < 0 {
+			// the local file should be overwritten
+			return c.getRequest
+		}
+		resp.customOffset = true
+	} else if resp.req.ResumeFrom > 0 && !noResume {
+		offset = resp.req.ResumeFrom
+	}
+	if offset != resp.fi.Size() && expectedSize > 0 && offset > expectedSize {
+		// an offset that is not the local size is beyond the remote file
+		resp.err = ErrBadResumeOffset
+		return c.closeResponse
+	}
+
+	if expectedSize == offset {
 		// local file matches remote file size - wrap it up
+		resp.skip(SkipComplete)
+		atomic.StoreInt64(&resp.sizeUnsafe, expectedSize)
+		resp.sizeKnown.Store(true)
 		resp.DidResume = true
-		resp.bytesResumed = resp.fi.Size()
+		resp.bytesResumed.Store(offset)
 		return c.checksumFile
 	}
 
-	if resp.Request.NoResume {
+	if noResume {
 		// local file should be overwritten
 		return c.getRequest
 	}
 
-	if expectedSize >= 0 && expectedSize < resp.fi.Size() {
+	if expectedSize >= 0 && expectedSize < offset && resp.req.AppendGrowing {
+		// the remote file was truncated or replaced, as when a log is rotated
+		resp.warn(WarnRemoteShrank, nil,
+			"remote file has %d bytes, fewer than the existing %d bytes, restarting",
+			expectedSize, offset)
+		return c.getRequest
+	}
+
+	if expectedSize >= 0 && expectedSize < offset {
 		// remote size is known, is smaller than local size and we want to resume
 		resp.err = ErrBadLength
 		return c.closeResponse
 	}
 
+	if expectedSize < 0 && offset > 0 {
+		// the existing file may or may not be complete
+		switch resp.req.UnknownSizeResume {
+		case UnknownSizeFail:
+			resp.warn(WarnUnknownSize, nil,
+				"size of remote file is unknown, not resuming existing %d bytes", offset)
+			resp.err = ErrUnknownSize
+			return c.closeResponse
+		case UnknownSizeAppend:
+			if !rangesUnsupported(resp.HTTPResponse) {
+				resp.warn(WarnUnknownSize, nil,
+					"size of remote file is unknown, appending to existing %d bytes", offset)
+				resp.CanResume = true
+				break
+			}
+			fallthrough
+		default:
+			resp.warn(WarnUnknownSize, nil,
+				"size of remote file is unknown, restarting existing %d bytes", offset)
+			return c.getRequest
+		}
+	}
+
 	if resp.CanResume {
 		// set resume range on GET request
-		resp.Request.HTTPRequest.Header.Set(
+		resp.req.HTTPRequest.Header.Set(
 			"Range",
-			fmt.Sprintf("bytes=%d-", resp.fi.Size()))
+			fmt.Sprintf("bytes=%d-", offset))
+		lastModified := resp.LastModified
+		if !lastModified.IsZero() && !resp.req.IgnoreRemoteTime {
+			// the partial file has the time of the remote file it was
+			// downloaded from, so any change since is detected
+			lastModified = resp.fi.ModTime()
+		}
+		if !resp.req.AppendGrowing {
+			// the remote file of AppendGrowing changes as it grows
+			setPreconditions(resp.req.HTTPRequest, resp.ETag, lastModified)
+		}
 		resp.DidResume = true
-		resp.bytesResumed = resp.fi.Size()
+		resp.bytesResumed.Store(offset)
 		return c.getRequest
 	}
 	return c.headRequest
 }
 
 func (c *Client) checksumFile(resp *Response) stateFunc {
-	if resp.Request.hash == nil {
-		return c.closeResponse
+	if resp.req.hash == nil || resp.req.AppendGrowing {
+		return c.validateFile
 	}
-	if resp.Filename == "" {
+	req := resp.req
+	if resp.Filename == "" && !req.Discard {
 		panic("grab: developer error: filename not set")
 	}
 	if resp.Size() < 0 {
 		panic("grab: developer error: size unknown")
 	}
-	req := resp.Request
 
 	// compute checksum
 	var sum []byte
-	sum, resp.err = resp.checksumUnsafe()
-	if resp.err != nil {
-		return c.closeResponse
+	if resp.stream || req.Discard || resp.hashState != nil {
+		// hashed by the transfer
+		sum = req.hash.Sum(nil)
+	} else {
+		sum, resp.err = resp.checksumUnsafe()
+		if resp.err != nil {
+			return c.closeResponse
+		}
 	}
 
 	// compare checksum
 	if !bytes.Equal(sum, req.checksum) {
 		resp.err = ErrBadChecksum
-		if !resp.Request.NoStore && req.deleteOnError {
+		if !resp.req.NoStore && !resp.stream && req.deleteOnError {
 			if err := os.Remove(resp.Filename); err != nil {
 				// err should be os.PathError and include file path
 				resp.err = fmt.Errorf(
 					"cannot remove downloaded file with checksum mismatch: %v",
 					err)
+			} else {
+				resp.CreatedFile = false
 			}
 		}
+		return c.closeResponse
+	}
+	return c.validateFile
+}
+
+// validateFile calls Request.Validate with the path of the downloaded file,
+// once its checksum has been verified.
+func (c *Client) validateFile(resp *Response) stateFunc {
+	req := resp.req
+	if req.Validate == nil || req.NoStore || resp.stream {
+		return c.storeContentAddressed
+	}
+	if resp.err = req.Validate(resp.Filename); resp.err != nil {
+		if req.deleteOnError {
+			if err := os.Remove(resp.Filename); err != nil {
+				resp.err = fmt.Errorf(
+					"cannot remove downloaded file that failed validation: %v",
+					err)
+			}
+		}
+		return c.closeResponse
+	}
+	return c.storeContentAddressed
+}
+
+// storeContentAddressed renames the temporary file of a transfer to a
+// content-addressed store to the path derived from its checksum, unless that
+// path already exists.
+func (c *Client) storeContentAddressed(resp *Response) stateFunc {
+	if resp.casTemp == "" {
+		return c.setFileTime
+	}
+	cas := resp.req.ContentAddressed
+	layout := cas.Layout
+	if layout == nil {
+		layout = casLayout
+	}
+	filename := filepath.Join(cas.Dir, layout(resp.casHash.Sum(nil)))
+	if resp.err = c.checkDestinationPath(resp.req, filename); resp.err != nil {
+		return c.closeResponse
+	}
+
+	// the file must be closed before it is renamed on some platforms
+	closeWriter(resp)
+	if _, err := os.Stat(filename); err == nil {
+		// the content is already stored
+		resp.err = os.Remove(resp.casTemp)
+		resp.Filename = filename
+		resp.CreatedFile = false
+		return c.closeResponse
+	}
+	if resp.err = mkdirp(filename); resp.err != nil {
+		return c.closeResponse
+	}
+	if resp.err = os.Rename(resp.casTemp, filename); resp.err != nil {
+		return c.closeResponse
+	}
+	resp.Filename = filename
+	return c.setFileTime
+}
+
+// setFileTime sets the modification time of the downloaded file to that of
+// the remote file, once the transfer has been verified. Existing files that
+// were already complete are left untouched.
+func (c *Client) setFileTime(resp *Response) stateFunc {
+	if resp.transfer.Load() != nil {
+		resp.err = setRemoteTime(resp)
 	}
 	return c.closeResponse
 }
 
-// doHTTPRequest sends a HTTP Request and returns the response
-func (c *Client) doHTTPRequest(req *http.Request) (*http.Response, error) {
+// doHTTPRequest sends a HTTP Request for the given Response and returns the
+// response, using Request.Transport if set. Both are dumped to
+// Request.DebugDump if set.
+func (c *Client) doHTTPRequest(resp *Response, req *http.Request) (*http.Response, error) {
+	c.wrapDials()
+	if err := c.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	req = c.withDialScheme(req)
 	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
 		req.Header.Set("User-Agent", c.UserAgent)
 	}
-	return c.HTTPClient.Do(req)
+	if w := resp.req.DebugDump; w != nil {
+		if resp.dump == nil {
+			resp.dump = newDumper(w, resp.req.DebugDumpUnsafe)
+		}
+		resp.dump.request(resp, req)
+	}
+	host := resp.req.URL().Host
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			resp.gotConn(ConnInfo{
+				Method:   req.Method,
+				Reused:   info.Reused,
+				WasIdle:  info.WasIdle,
+				IdleTime: info.IdleTime,
+			})
+			c.usage.conn(host, info.Reused)
+		},
+	}))
+	var hresp *http.Response
+	var err error
+	v, ok := c.HTTPClient.(*http.Client)
+	if rt := resp.req.Transport; rt != nil || (ok && (c.MaxCrossHostRedirects >= 0 || c.URLPolicy != nil)) {
+		hc := &http.Client{}
+		if ok {
+			*hc = *v
+		}
+		if rt != nil {
+			hc.Transport = rt
+		}
+		if c.MaxCrossHostRedirects >= 0 {
+			hc.CheckRedirect = limitCrossHostRedirects(hc.CheckRedirect, c.MaxCrossHostRedirects)
+		}
+		if c.URLPolicy != nil {
+			hc.CheckRedirect = c.checkRedirect(hc.CheckRedirect)
+		}
+		hresp, err = hc.Do(req)
+	} else {
+		hresp, err = c.HTTPClient.Do(req)
+		if err == nil && hresp.Request != nil && hresp.Request.URL != req.URL {
+			// redirected by a custom HTTPClient, which cannot be stopped
+			// before it connects
+			if perr := c.checkURL(hresp.Request.URL); perr != nil {
+				hresp.Body.Close()
+				hresp, err = nil, perr
+			}
+		}
+		if err == nil && c.MaxCrossHostRedirects == 0 && hresp.Request != nil &&
+			!strings.EqualFold(hresp.Request.URL.Host, req.URL.Host) {
+			// redirected by a custom HTTPClient
+			hresp.Body.Close()
+			hresp, err = nil, fmt.Errorf("%w: %s", ErrCrossHostRedirect, hresp.Request.URL.Host)
+		}
+	}
+	if resp.dump != nil {
+		resp.dump.response(resp, hresp, err)
+	}
+	return hresp, err
 }
 
 func (c *Client) headRequest(resp *Response) stateFunc {
+	if resp.req.byteRange() != nil && (resp.Filename != "" || resp.req.NoStore) {
+		// only the range is requested, and its destination is known
+		return c.rangeRequest
+	}
 	if resp.optionsKnown {
 		return c.getRequest
 	}
 	resp.optionsKnown = true
 
-	if resp.Request.NoResume {
+	if resp.req.NoResume || resp.req.SingleUse || resp.req.NoStore {
+		// there is no local file to resume
 		return c.getRequest
 	}
 
@@ -339,143 +1145,658 @@ func (c *Client) headRequest(resp *Response) stateFunc {
 		return c.getRequest
 	}
 
+	if resp.worker != nil && resp.Filename == "" && resp.req.FilenameFunc == nil {
+		// the destination is most likely named as in the URL, so a file
+		// of any other name is checked once the response is received
+		guess, err := resolveFilename(resp.req.Filename, &http.Response{Request: resp.req.HTTPRequest})
+		if err == nil {
+			if _, err := os.Stat(longPath(guess)); os.IsNotExist(err) {
+				return c.getRequest
+			}
+		}
+	}
+
+	if c.ProbeCacheTTL > 0 {
+		host := resp.req.URL().Host
+		resp.probeKey = probeKey(resp.req.URL())
+		if hresp := c.probes.get(resp.probeKey); hresp != nil {
+			c.usage.probe(host, true)
+			resp.HTTPResponse = hresp
+			return c.readProbe
+		}
+		c.usage.probe(host, false)
+	}
+
 	hreq := new(http.Request)
-	*hreq = *resp.Request.HTTPRequest
+	*hreq = *resp.req.HTTPRequest
 	hreq.Method = "HEAD"
 
-	resp.HTTPResponse, resp.err = c.doHTTPRequest(hreq)
+	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp, hreq)
 	if resp.err != nil {
 		return c.closeResponse
 	}
 	resp.HTTPResponse.Body.Close()
 
 	if resp.HTTPResponse.StatusCode != http.StatusOK {
+		if rangesUnsupported(resp.HTTPResponse) {
+			// a ranged probe would only return the full file
+			return c.getRequest
+		}
+		return c.probeRequest
+	}
+	if resp.req.FollowMetaRefresh && isHTML(resp.HTTPResponse) {
+		// the page may refresh to the requested file, which is only known
+		// once the page is downloaded
 		return c.getRequest
 	}
+	if resp.probeKey != "" {
+		c.probes.put(resp.probeKey, resp.HTTPResponse, c.ProbeCacheTTL)
+	}
+	return c.readProbe
+}
+
+// readProbe reads the response to a HEAD request, which may be cached.
+func (c *Client) readProbe(resp *Response) stateFunc {
+	resp.probe = true
+	resp.probeResponse = resp.HTTPResponse
+	resp.readValidators(resp.HTTPResponse)
 
 	// In case of redirects during HEAD, record the final URL and use it
 	// instead of the original URL when sending future requests.
 	// This way we avoid sending potentially unsupported requests to
 	// the original URL, e.g. "Range", since it was the final URL
 	// that advertised its support.
-	resp.Request.HTTPRequest.URL = resp.HTTPResponse.Request.URL
-	resp.Request.HTTPRequest.Host = resp.HTTPResponse.Request.Host
+	resp.req.HTTPRequest.URL = resp.HTTPResponse.Request.URL
+	resp.req.HTTPRequest.Host = resp.HTTPResponse.Request.Host
 
 	return c.readResponse
 }
 
+// probeRequest is the fallback for remote servers that do not support HEAD
+// requests. It requests the first byte of the remote file to learn its size
+// and whether ranged requests are supported from the Content-Range header of
+// the response.
+//
+// If the remote server does not respond with partial content, the next
+// stateFunc is getRequest and the file is transferred in a single request.
+func (c *Client) probeRequest(resp *Response) stateFunc {
+	preq := new(http.Request)
+	*preq = *resp.req.HTTPRequest
+	preq.Header = preq.Header.Clone()
+	preq.Header.Set("Range", "bytes=0-0")
+
+	hresp, err := c.doHTTPRequest(resp, preq)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	hresp.Body.Close()
+
+	size := contentRangeSize(hresp)
+	if hresp.StatusCode != http.StatusPartialContent || size < 0 {
+		return c.getRequest
+	}
+	if resp.req.FollowMetaRefresh && isHTML(hresp) {
+		return c.getRequest
+	}
+
+	// describe the remote file as a HEAD request would have
+	hresp.ContentLength = size
+	resp.HTTPResponse = hresp
+	resp.CanResume = true
+	resp.probe = true
+	resp.readValidators(hresp)
+	resp.req.HTTPRequest.URL = hresp.Request.URL
+	resp.req.HTTPRequest.Host = hresp.Request.Host
+	return c.readResponse
+}
+
 func (c *Client) getRequest(resp *Response) stateFunc {
-	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp.Request.HTTPRequest)
+	resp.probe = false
+	// decode the response here to measure the compression ratio or to
+	// support registered content codings
+	hreq := negotiateEncoding(resp.req.HTTPRequest, resp.req.MaxCompressionRatio)
+	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp, hreq)
 	if resp.err != nil {
 		return c.closeResponse
 	}
+	resp.HTTPResponse.Body = c.usage.body(resp.HTTPResponse.Body, resp.req.URL().Host)
+	resp.ContentEncoding = ""
+	if hreq != resp.req.HTTPRequest || (resp.req.RequireDecoding && !resp.HTTPResponse.Uncompressed) {
+		resp.ContentEncoding, resp.err = decodeBody(resp.HTTPResponse,
+			resp.req.MaxCompressionRatio, resp.req.RequireDecoding)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+	} else if resp.HTTPResponse.Uncompressed {
+		// decompressed transparently by http.Transport
+		resp.ContentEncoding = "gzip"
+	}
+	if resp.probeKey != "" {
+		c.probes.validate(resp.probeKey, resp.HTTPResponse)
+	}
+	resp.readValidators(resp.HTTPResponse)
+	resp.StatusCode = resp.HTTPResponse.StatusCode
 
 	// TODO: check Content-Range
 
+	// check that the remote file did not change since it was last inspected
+	if resp.DidResume && resp.StatusCode == http.StatusPreconditionFailed {
+		if resp.probeKey != "" {
+			c.probes.invalidate(resp.probeKey)
+		}
+		resp.err = ErrRemoteChanged
+		return c.closeResponse
+	}
+
+	// restart if the remote server ignored the range of a resumed transfer
+	if resp.DidResume && resp.StatusCode == http.StatusOK {
+		resp.warn(WarnRangeIgnored, nil,
+			"remote server ignored range request, discarding %d bytes resumed",
+			resp.bytesResumed.Load())
+		resp.DidResume = false
+		resp.bytesResumed.Store(0)
+	}
+
 	// check status code
-	if !resp.Request.IgnoreBadStatusCodes {
-		if resp.HTTPResponse.StatusCode < 200 || resp.HTTPResponse.StatusCode > 299 {
-			resp.err = StatusCodeError(resp.HTTPResponse.StatusCode)
-			return c.closeResponse
+	if !resp.req.IgnoreBadStatusCodes && resp.IsErrorStatus() {
+		resp.err = StatusCodeError(resp.StatusCode)
+		return c.closeResponse
+	}
+
+	// a range written in place must not be replaced by the whole file
+	if resp.inPlace && resp.StatusCode != http.StatusPartialContent {
+		resp.err = ErrRangeIgnored
+		return c.closeResponse
+	}
+
+	// nor must a range, unless it can be read from the whole file
+	if resp.req.byteRange() != nil && resp.StatusCode != http.StatusPartialContent && !resp.req.RangeFallback {
+		resp.err = ErrRangeIgnored
+		return c.closeResponse
+	}
+
+	// check for changes made by a proxy
+	if c.DetectProxyInterference || resp.req.FailOnInterference {
+		for _, s := range proxyInterference(resp) {
+			if resp.req.FailOnInterference {
+				resp.err = fmt.Errorf("%w: %s", ErrProxyInterference, s)
+				return c.closeResponse
+			}
+			resp.warn(WarnProxyInterference, nil, "%s", s)
 		}
 	}
 
+	// check required headers
+	if resp.err = checkRequiredHeaders(resp.req.RequireHeaders, resp.HTTPResponse); resp.err != nil {
+		return c.closeResponse
+	}
+
+	if resp.req.FollowMetaRefresh {
+		return c.followMetaRefresh
+	}
 	return c.readResponse
 }
 
+// followMetaRefresh inspects an HTML response for a meta refresh to another
+// URL.
+//
+// If the response is not an HTML page that refreshes to another URL, the next
+// stateFunc is readResponse and the page is transferred as the requested file.
+//
+// Otherwise, the state of the transfer is reset and the next stateFunc is
+// statFileInfo, so the transfer starts over with the URL of the refresh.
+func (c *Client) followMetaRefresh(resp *Response) stateFunc {
+	if !isHTML(resp.HTTPResponse) {
+		return c.readResponse
+	}
+	body := resp.HTTPResponse.Body
+	page, err := io.ReadAll(io.LimitReader(body, maxMetaRefreshPageSize))
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	target := metaRefreshURL(page)
+	if target == "" {
+		// put back what was read of the page
+		resp.HTTPResponse.Body = &struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(page), body), body}
+		return c.readResponse
+	}
+	u, err := resp.HTTPResponse.Request.URL.Parse(target)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	body.Close()
+
+	max := resp.req.MaxMetaRefreshes
+	if max == 0 {
+		max = 10
+	}
+	if resp.metaRefreshes >= max {
+		resp.err = ErrTooManyMetaRefreshes
+		return c.closeResponse
+	}
+	resp.metaRefreshes++
+
+	// start over, as nothing learned about the page applies to the
+	// refreshed URL
+	hreq := resp.req.HTTPRequest
+	if resp.DidResume {
+		hreq.Header.Del("Range")
+		hreq.Header.Del("If-Match")
+		hreq.Header.Del("If-Unmodified-Since")
+	}
+	hreq.URL = u
+	hreq.Host = ""
+	resp.HTTPResponse = nil
+	resp.StatusCode = 0
+	resp.ETag = ""
+	resp.LastModified = time.Time{}
+	resp.CanResume = false
+	resp.DidResume = false
+	resp.bytesResumed.Store(0)
+	resp.optionsKnown = false
+	resp.probeKey = ""
+	resp.probeResponse = nil
+	resp.inPlace = false
+	resp.customOffset = false
+	resp.fi = nil
+	resp.Filename = initialFilename(resp)
+	return c.statFileInfo
+}
+
+// initialFilename returns the Response.Filename of a transfer before any
+// response is received.
+func initialFilename(resp *Response) string {
+	req := resp.req
+	switch {
+	case resp.casTemp != "":
+		return resp.casTemp
+	case req.Discard:
+		// no file is resolved, opened or resumed
+		return ""
+	case req.FilenameFunc != nil && req.Filename != "-":
+		// the filename is resolved once response headers are known
+		return ""
+	}
+	return req.Filename
+}
+
 func (c *Client) readResponse(resp *Response) stateFunc {
 	if resp.HTTPResponse == nil {
 		panic("grab: developer error: Response.HTTPResponse is nil")
 	}
 
+	if !resp.probe {
+		resp.mediaType, resp.mediaParams = contentType(resp.HTTPResponse)
+	}
+
 	// check expected size
-	resp.sizeUnsafe = resp.HTTPResponse.ContentLength
-	if resp.sizeUnsafe >= 0 {
+	expected := resp.req.Size
+	size := resp.HTTPResponse.ContentLength
+	if size >= 0 {
 		// remote size is known
-		resp.sizeUnsafe += resp.bytesResumed
-		if resp.Request.Size > 0 && resp.Request.Size != resp.sizeUnsafe {
-			resp.err = ErrBadLength
+		size += resp.bytesResumed.Load()
+	}
+	if resp.HTTPResponse.StatusCode == http.StatusPartialContent {
+		if total := contentRangeSize(resp.HTTPResponse); total >= 0 {
+			size = total
+		}
+	}
+	if resp.req.byteRange() != nil && !resp.probe {
+		// only the range is stored
+		if resp.err = readRange(resp); resp.err != nil {
+			return c.closeResponse
+		}
+		size = resp.req.Range.Len()
+	}
+	if resp.inPlace {
+		// only the requested range is transferred
+		expected, size = 0, resp.HTTPResponse.ContentLength
+		if end := resp.req.WriteOffset + size; size >= 0 && end > resp.fi.Size() {
+			resp.err = fmt.Errorf("%w: range ends at %d, file has %d bytes",
+				ErrBadWriteOffset, end, resp.fi.Size())
 			return c.closeResponse
 		}
 	}
+	resp.sizeKnown.Store(size >= 0)
+	if size >= 0 && expected > 0 && expected != size {
+		atomic.StoreInt64(&resp.sizeUnsafe, size)
+		resp.err = SizeMismatchError{Expected: expected, Reported: size}
+		return c.closeResponse
+	}
+	if size < 0 && expected > 0 {
+		// report progress against the expected size
+		size = expected
+	}
+	atomic.StoreInt64(&resp.sizeUnsafe, size)
+
+	// limit transfer size, counting decompressed bytes if the response is
+	// decompressed
+	if max := resp.req.MaxBytes; max > 0 && !resp.probe {
+		n := max - resp.bytesResumed.Load()
+		if size > max || n < 0 {
+			resp.err = ErrMaxBytes
+			return c.closeResponse
+		}
+		resp.HTTPResponse.Body = &maxBytesBody{ReadCloser: resp.HTTPResponse.Body, n: n}
+	}
+
+	// check Content-MD5
+	if resp.req.VerifyContentMD5 && resp.req.hash == nil {
+		if sum := contentMD5(resp.HTTPResponse); sum != nil {
+			resp.req.setChecksum(md5.New(), sum, false)
+		}
+	}
 
 	// check filename
-	if resp.Filename == "" {
-		filename, err := guessFilename(resp.HTTPResponse)
-		if err != nil {
-			resp.err = err
+	if resp.Filename == "" && !resp.req.Discard {
+		if resp.req.FilenameFunc != nil {
+			resp.Filename, resp.err = callFilenameFunc(resp)
+		} else {
+			resp.Filename, resp.err = resolveFilename(resp.req.Filename, resp.HTTPResponse)
+		}
+		if resp.err != nil {
 			return c.closeResponse
 		}
-		// Request.Filename will be empty or a directory
-		resp.Filename = filepath.Join(resp.Request.Filename, filename)
+		if !resp.req.NoStore {
+			resp.Filename = longPath(resp.Filename)
+		}
+		if !resp.req.NoStore && !resp.probe {
+			// the destination was not known before this GET request, so make
+			// sure any existing file is truncated rather than written over
+			if fi, err := os.Stat(resp.Filename); err == nil && isStream(fi) {
+				resp.stream = true
+			} else if err == nil && !fi.IsDir() {
+				if resp.worker != nil && resp.req.SkipExisting {
+					// not checked by a HEAD request
+					resp.skip(SkipFileExists)
+					resp.err = ErrFileExists
+					return c.closeResponse
+				}
+				resp.fi = fi
+			}
+		}
 	}
 
-	if !resp.Request.NoStore && resp.requestMethod() == "HEAD" {
+	if !resp.req.NoStore && resp.probe {
 		if resp.HTTPResponse.Header.Get("Accept-Ranges") == "bytes" {
 			resp.CanResume = true
 		}
 		return c.statFileInfo
 	}
+	if resp.req.RequireResumable && !c.resumable(resp) {
+		resp.err = ErrNotResumable
+		return c.closeResponse
+	}
 	return c.openWriter
 }
 
+// resumable returns true if the remote server supports ranged requests, as
+// advertised by the response or by a partial response to a ranged request for
+// the first byte of the remote file, and sets Response.CanResume.
+func (c *Client) resumable(resp *Response) bool {
+	hresp := resp.HTTPResponse
+	if resp.CanResume || hresp.StatusCode == http.StatusPartialContent ||
+		hresp.Header.Get("Accept-Ranges") == "bytes" {
+		resp.CanResume = true
+		return true
+	}
+	if rangesUnsupported(hresp) {
+		return false
+	}
+	preq := new(http.Request)
+	*preq = *resp.req.HTTPRequest
+	preq.Header = preq.Header.Clone()
+	preq.Header.Set("Range", "bytes=0-0")
+	presp, err := c.doHTTPRequest(resp, preq)
+	if err != nil {
+		return false
+	}
+	presp.Body.Close()
+	resp.CanResume = presp.StatusCode == http.StatusPartialContent
+	return resp.CanResume
+}
+
+// resolveFilename returns the destination path for the given response, given
+// the Request.Filename, which must be empty or a directory.
+func resolveFilename(dir string, resp *http.Response) (string, error) {
+	filename, err := guessFilename(resp)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filename), nil
+}
+
+// callFilenameFunc returns the destination path for the given Response as
+// determined by Request.FilenameFunc.
+func callFilenameFunc(resp *Response) (string, error) {
+	req := resp.req
+	suggested := req.Filename
+	if fi, err := os.Stat(suggested); suggested == "" || (err == nil && fi.IsDir()) {
+		suggested, _ = resolveFilename(suggested, resp.HTTPResponse)
+	}
+	filename, err := req.FilenameFunc(resp.HTTPResponse, suggested)
+	if err != nil {
+		return "", err
+	}
+	if filename == "" {
+		return "", ErrNoFilename
+	}
+	if filename != suggested && !req.NoSanitizeFilename {
+		return sanitizePath(filename)
+	}
+	return filename, nil
+}
+
+// beforeCopy calls the BeforeCopy hook of the given Response, before its
+// destination is opened, and validates any destination set by the hook.
+func (c *Client) beforeCopy(resp *Response) error {
+	filename := resp.Filename
+	if err := resp.req.BeforeCopy(resp); err != nil {
+		return err
+	}
+	if resp.Filename == filename {
+		return nil
+	}
+	if resp.DidResume || resp.inPlace || resp.stream || resp.casTemp != "" {
+		// the response to the GET request depends on the destination
+		return ErrDestinationChanged
+	}
+	if resp.Filename == "" {
+		return ErrNoFilename
+	}
+	if resp.req.NoStore || resp.req.Discard {
+		return nil
+	}
+	if !resp.req.NoSanitizeFilename {
+		name, err := sanitizePath(resp.Filename)
+		if err != nil {
+			return err
+		}
+		resp.Filename = name
+	}
+	resp.Filename = longPath(resp.Filename)
+	resp.fi = nil
+	fi, err := os.Stat(resp.Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return &os.PathError{Op: "open", Path: resp.Filename, Err: syscall.EISDIR}
+	}
+	if isStream(fi) {
+		return ErrDestinationChanged
+	}
+	if resp.req.SkipExisting {
+		resp.skip(SkipFileExists)
+		return ErrFileExists
+	}
+	// the existing file is overwritten
+	resp.fi = fi
+	return nil
+}
+
 // openWriter opens the destination file for writing and seeks to the location
 // from whence the file transfer will resume.
 //
 // Requires that Response.Filename and resp.DidResume are already be set.
 func (c *Client) openWriter(resp *Response) stateFunc {
-	if !resp.Request.NoStore && !resp.Request.NoCreateDirectories {
+	// run BeforeCopy hook before the destination is opened, so that it may
+	// abort the transfer or change the destination
+	if resp.req.BeforeCopy != nil {
+		if resp.err = c.beforeCopy(resp); resp.err != nil {
+			return c.closeResponse
+		}
+	}
+
+	// the destination may have been resolved or changed since it was checked
+	if resp.err = c.checkDestination(resp); resp.err != nil {
+		return c.closeResponse
+	}
+	if !resp.req.NoStore && !resp.req.NoCreateDirectories {
 		resp.err = mkdirp(resp.Filename)
 		if resp.err != nil {
 			return c.closeResponse
 		}
 	}
 
-	if resp.Request.NoStore {
+	if resp.req.Discard {
+		resp.writer = io.Discard
+	} else if resp.req.NoStore {
 		resp.writer = &resp.storeBuffer
+	} else if resp.Filename == "-" {
+		// hide Close, so standard output remains open
+		resp.writer = struct{ io.Writer }{os.Stdout}
+	} else if resp.inPlace {
+		// write over the existing file without truncating it
+		flag := os.O_WRONLY
+		if resp.req.NoFollowSymlinks {
+			flag |= oNoFollow
+		}
+		f, err := os.OpenFile(resp.Filename, flag, 0)
+		if err != nil {
+			resp.err = err
+			return c.closeResponse
+		}
+		resp.writer = &offsetWriter{f: f, off: resp.req.WriteOffset, end: resp.fi.Size()}
+	} else if resp.stream {
+		// open an existing named pipe or device without truncating or seeking
+		f, err := os.OpenFile(resp.Filename, os.O_WRONLY, 0)
+		if err != nil {
+			resp.err = err
+			return c.closeResponse
+		}
+		resp.writer = f
 	} else {
 		// compute write flags
+		sparse := resp.req.SparseWrites && !resp.req.DirectIO
 		flag := os.O_CREATE | os.O_WRONLY
 		if resp.fi != nil {
-			if resp.DidResume {
+			if resp.DidResume && !sparse {
 				flag = os.O_APPEND | os.O_WRONLY
 			} else {
-				// truncate later in copyFile, if not cancelled
-				// by BeforeCopy hook
+				// truncate later in copyFile, unless resumed
+				// with sparse writes, which write at the resume
+				// offset
 				flag = os.O_WRONLY
 			}
 		}
+		if resp.req.NoFollowSymlinks {
+			flag |= oNoFollow
+		}
 
 		// open file
-		f, err := os.OpenFile(resp.Filename, flag, 0666)
+		f, direct, err := openFile(resp, flag)
 		if err != nil {
 			resp.err = err
 			return c.closeResponse
 		}
 		resp.writer = f
+		resp.CreatedFile = resp.fi == nil
 
 		// seek to start or end
 		whence := io.SeekStart
-		if resp.bytesResumed > 0 {
+		if resp.localOffset() > 0 {
 			whence = io.SeekEnd
 		}
 		_, resp.err = f.Seek(0, whence)
 		if resp.err != nil {
 			return c.closeResponse
 		}
+		if direct {
+			size := (resp.bufferSize + directIOAlign - 1) &^ (directIOAlign - 1)
+			if size == 0 {
+				size = 32 * 1024
+			}
+			resp.writer = newDirectWriter(
+				f,
+				resp.localOffset(),
+				c.buffers.getAligned(size),
+				c.buffers.putAligned)
+		} else if sparse {
+			resp.writer = newSparseWriter(f, resp.localOffset())
+		}
+	}
+	if !resp.req.Discard && !resp.req.NoStore && resp.Filename != "-" && !resp.stream {
+		path := resp.Filename
+		resp.partialPath.Store(&path)
 	}
+	resp.metadataOnce.Do(func() { close(resp.metadata) })
 
 	// init transfer
-	if resp.bufferSize < 1 {
+	defaultBuffer := resp.bufferSize < 1
+	if defaultBuffer {
 		resp.bufferSize = 32 * 1024
 	}
-	b := make([]byte, resp.bufferSize)
-	resp.transfer = newTransfer(
-		resp.Request.Context(),
-		resp.Request.RateLimiter,
-		resp.writer,
+	var b []byte
+	if w := resp.worker; w != nil && len(w.buf) == resp.bufferSize {
+		b, w.buf = w.buf, nil
+	} else {
+		b = c.buffers.get(resp.bufferSize)
+	}
+	dst := resp.writer
+	if (resp.stream || resp.req.Discard) && resp.req.hash != nil {
+		// a stream or discarded transfer cannot be read back, so hash it as it
+		// is written
+		dst = io.MultiWriter(dst, resp.req.hash)
+	} else if resp.hashState = newHashState(resp); resp.hashState != nil {
+		dst = io.MultiWriter(dst, resp.hashState)
+	}
+	if resp.casHash != nil {
+		dst = io.MultiWriter(dst, resp.casHash)
+	}
+	dst = newFlushWriter(resp, dst, c.Clock)
+	dst = c.usage.writer(dst, resp.req.URL().Host)
+	if c.MaxTotalBytes > 0 {
+		dst = &quotaWriter{w: dst, total: &c.transferred, max: c.MaxTotalBytes}
+	}
+	// the destination may copy the body itself if nothing needs to see each
+	// write
+	_, readFrom := dst.(io.ReaderFrom)
+	readFrom = readFrom && defaultBuffer && resp.req.RateLimiter == nil &&
+		!c.DetailedStats && c.MaxTotalBytes <= 0
+	t := newTransfer(
+		resp.req.Context(),
+		resp.req.RateLimiter,
+		dst,
 		resp.HTTPResponse.Body,
 		b)
+	t.quantum = rateLimitQuantum(
+		resp.req.RateLimiter,
+		resp.req.RateLimitQuantum,
+		len(b))
+	t.timed = c.DetailedStats
+	t.readFrom = readFrom
+	t.clock = c.Clock
+	resp.transfer.Store(t)
 
 	// next step is copyFile, but this will be called later in another goroutine
 	return nil
@@ -487,52 +1808,75 @@ func (c *Client) copyFile(resp *Response) stateFunc {
 		return nil
 	}
 
-	// run BeforeCopy hook
-	if f := resp.Request.BeforeCopy; f != nil {
-		resp.err = f(resp)
-		if resp.err != nil {
-			return c.closeResponse
-		}
+	// a deferred transfer must not touch the destination
+	resp.deferMu.Lock()
+	deferred := resp.deferred
+	if !deferred {
+		resp.state.Store(int32(StateTransferring))
+	}
+	resp.deferMu.Unlock()
+	if deferred {
+		resp.err = resp.ctxErr()
+		return c.closeResponse
 	}
 
 	var bytesCopied int64
-	if resp.transfer == nil {
+	t := resp.transfer.Load()
+	if t == nil {
 		panic("grab: developer error: Response.transfer is nil")
 	}
 
-	// We waited to truncate the file in openWriter() to make sure
-	// the BeforeCopy didn't cancel the copy. If this was an existing
-	// file that is not going to be resumed, truncate the contents.
-	if t, ok := resp.writer.(truncater); ok && resp.fi != nil && !resp.DidResume {
-		t.Truncate(0)
+	// If this was an existing file that is not going to be resumed,
+	// truncate the contents.
+	if t, ok := resp.writer.(truncater); ok && resp.fi != nil {
+		if !resp.DidResume {
+			t.Truncate(0)
+			resp.bytesDiscarded.Store(resp.fi.Size())
+		} else if offset := resp.localOffset(); offset != resp.fi.Size() {
+			// resuming from Request.ResumeFrom rather than the end of the file
+			resp.err = t.Truncate(offset)
+			if resp.err != nil {
+				return c.closeResponse
+			}
+			if n := resp.fi.Size() - offset; n > 0 {
+				resp.bytesDiscarded.Store(n)
+			}
+		}
 	}
 
-	bytesCopied, resp.err = resp.transfer.copy()
+	bytesCopied, resp.err = t.copy()
+	for resp.err != nil && c.reconnect(resp, t) {
+		bytesCopied, resp.err = t.copy()
+	}
 	if resp.err != nil {
+		resp.partial = true
+		if resp.req.SingleUse && resp.ctx.Err() == nil {
+			resp.err = fmt.Errorf("%w: %w", ErrSingleUseExhausted, resp.err)
+		}
 		return c.closeResponse
 	}
-	closeWriter(resp)
-
-	// set file timestamp
-	if !resp.Request.NoStore && !resp.Request.IgnoreRemoteTime {
-		resp.err = setLastModified(resp.HTTPResponse, resp.Filename)
-		if resp.err != nil {
+	if w, ok := resp.writer.(*directWriter); ok {
+		// write the unaligned tail
+		if resp.err = w.Flush(); resp.err != nil {
+			resp.partial = true
 			return c.closeResponse
 		}
 	}
+	closeWriter(resp)
 
-	// update transfer size if previously unknown
-	if resp.Size() < 0 {
-		discoveredSize := resp.bytesResumed + bytesCopied
+	// update transfer size if not reported by the remote server
+	if resp.HTTPResponse.ContentLength < 0 {
+		discoveredSize := resp.bytesResumed.Load() + bytesCopied
 		atomic.StoreInt64(&resp.sizeUnsafe, discoveredSize)
-		if resp.Request.Size > 0 && resp.Request.Size != discoveredSize {
-			resp.err = ErrBadLength
+		resp.sizeKnown.Store(true)
+		if expected := resp.req.Size; expected > 0 && expected != discoveredSize {
+			resp.err = SizeMismatchError{Expected: expected, Reported: discoveredSize}
 			return c.closeResponse
 		}
 	}
 
 	// run AfterCopy hook
-	if f := resp.Request.AfterCopy; f != nil {
+	if f := resp.req.AfterCopy; f != nil {
 		resp.err = f(resp)
 		if resp.err != nil {
 			return c.closeResponse
@@ -542,6 +1886,102 @@ func (c *Client) copyFile(resp *Response) stateFunc {
 	return c.checksumFile
 }
 
+// reconnect replaces the response body of a transfer that failed reading from
+// the remote server with the body of a ranged request from the current offset,
+// up to Request.MaxReconnects times, so that the transfer can continue as if
+// the connection had not dropped. A remote server that responds with 503
+// Service Unavailable or 429 Too Many Requests is asked again after its
+// Retry-After delay, up to maxRetryAfter, if longer than the Backoff delay.
+// It returns false if the transfer cannot be reconnected, in which case
+// resp.err is the error that failed the transfer.
+func (c *Client) reconnect(resp *Response, t *transfer) bool {
+	req := resp.req
+	if !t.readFailed || resp.ctx.Err() != nil || req.SingleUse || resp.inPlace || resp.rangeSliced {
+		return false
+	}
+	if resp.ContentEncoding != "" || errors.Is(resp.err, ErrMaxBytes) {
+		// the offset in a decoded body cannot be requested, and exceeding the
+		// maximum size is not a connection failure
+		return false
+	}
+
+	// attempts answered by an unavailable remote server count towards
+	// MaxReconnects, but are not reported by Response.Reconnects
+	var unavailable int
+	var retryAfter time.Duration
+	var hresp *http.Response
+	offset := resp.bytesResumed.Load() + t.N()
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if r := req.byteRange(); r != nil {
+		// the offset is within the range
+		offset += r.Start
+		rng = fmt.Sprintf("bytes=%d-%d", offset, r.End)
+	}
+	for {
+		n := int(resp.reconnects.Load()) + unavailable
+		if n >= req.MaxReconnects {
+			return false
+		}
+		var delay time.Duration
+		if req.Backoff != nil {
+			delay = req.Backoff.Delay(n + 1)
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-resp.ctx.Done():
+				timer.Stop()
+				return false
+			}
+		}
+
+		rreq := new(http.Request)
+		*rreq = *req.HTTPRequest
+		rreq.Header = rreq.Header.Clone()
+		rreq.Header.Set("Range", rng)
+		if !req.AppendGrowing {
+			setPreconditions(rreq, resp.ETag, resp.LastModified)
+		}
+		var err error
+		hresp, err = c.doHTTPRequest(resp, rreq)
+		if err != nil {
+			return false
+		}
+		if hresp.StatusCode != http.StatusServiceUnavailable && hresp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		// try again once the remote server is available
+		hresp.Body.Close()
+		retryAfter = parseRetryAfter(hresp.Header.Get("Retry-After"), resp.now())
+		unavailable++
+	}
+	if hresp.StatusCode == http.StatusPreconditionFailed {
+		hresp.Body.Close()
+		resp.err = ErrRemoteChanged
+		return false
+	}
+	if hresp.StatusCode != http.StatusPartialContent || contentRangeStart(hresp) != offset {
+		hresp.Body.Close()
+		return false
+	}
+	resp.reconnects.Add(1)
+
+	// continue reading through the same limits as the original body
+	resp.HTTPResponse.Body.Close()
+	body := c.usage.body(hresp.Body, req.URL().Host)
+	if mb, ok := resp.HTTPResponse.Body.(*maxBytesBody); ok {
+		mb.ReadCloser = body
+	} else {
+		resp.HTTPResponse.Body = body
+	}
+	t.r = resp.HTTPResponse.Body
+	return true
+}
+
 func closeWriter(resp *Response) {
 	if closer, ok := resp.writer.(io.Closer); ok {
 		closer.Close()
@@ -549,20 +1989,159 @@ func closeWriter(resp *Response) {
 	resp.writer = nil
 }
 
+// removePartial removes the partially downloaded file of a failed transfer if
+// requested by Request.RemovePartialOnCancel or Request.RemovePartialOnError.
+// A resumed file is truncated back to its length before the transfer started
+// instead. The writer must already be closed.
+func removePartial(resp *Response) {
+	req := resp.req
+	if resp.err == nil || req.NoStore || resp.stream || resp.Filename == "" || resp.transfer.Load() == nil {
+		// transfer succeeded or never opened the destination
+		return
+	}
+	if resp.inPlace {
+		// the existing file is not the transfer's to remove
+		return
+	}
+	resp.deferMu.Lock()
+	deferred := resp.deferred
+	resp.deferMu.Unlock()
+	if deferred {
+		// nothing was written, so only a file created for the transfer is
+		// removed
+		if resp.fi == nil {
+			os.Remove(resp.Filename)
+			resp.CreatedFile = false
+		}
+		return
+	}
+	if resp.ctx.Err() != nil {
+		if !req.RemovePartialOnCancel {
+			return
+		}
+	} else if !req.RemovePartialOnError {
+		return
+	}
+
+	// errors are ignored in favor of the error that failed the transfer
+	if resp.fi != nil && resp.DidResume {
+		os.Truncate(resp.Filename, resp.localOffset())
+		return
+	}
+	os.Remove(resp.Filename)
+	resp.CreatedFile = false
+}
+
+// observeTransfer passes the metrics of the completed transfer of the given
+// Response to Client.MetricsCollector. It is called once the Response is
+// complete, so a panic in the collector cannot finalize the Response again; it
+// is recorded as a WarnMetricsPanic Warning unless Client.PropagatePanics is
+// set, in which case it continues once Response.Done is closed.
+func (c *Client) observeTransfer(resp *Response) {
+	m := c.MetricsCollector
+	if m == nil {
+		return
+	}
+	if !c.PropagatePanics {
+		defer func() {
+			if v := recover(); v != nil {
+				resp.warn(WarnMetricsPanic, &PanicError{Value: v, Stack: debug.Stack()},
+					"Client.MetricsCollector panicked")
+			}
+		}()
+	}
+	m.ObserveTransfer(TransferMetrics{
+		Host:             resp.req.URL().Host,
+		Duration:         resp.End.Sub(resp.Start),
+		BytesTransferred: resp.transfer.Load().N(),
+		Reconnects:       resp.Reconnects(),
+		Err:              resp.err,
+	})
+}
+
 // close finalizes the Response
 func (c *Client) closeResponse(resp *Response) stateFunc {
 	if resp.IsComplete() {
 		panic("grab: developer error: response already closed")
 	}
 
-	resp.fi = nil
+	// report cancelation rather than any error it caused along the way
+	if resp.err != nil && resp.ctx.Err() != nil {
+		resp.err = resp.ctxErr()
+	}
+
 	closeWriter(resp)
+	removePartial(resp)
+	if resp.err != nil && resp.casTemp != "" {
+		// the temporary file cannot be resumed, so it is always removed.
+		// Errors are ignored in favor of the error that failed the transfer.
+		os.Remove(resp.casTemp)
+		resp.partial = false
+		resp.CreatedFile = false
+	}
+	saveHashState(resp)
+	if p := resp.partialPath.Load(); p != nil {
+		if _, err := os.Stat(*p); resp.err == nil || err != nil {
+			// completed, or no partial file was left
+			resp.partialPath.Store(nil)
+		}
+	}
+	if resp.partial && !resp.inPlace {
+		// a partial file keeps the time of the remote file, so it can be
+		// checked for changes when it is resumed. Errors are only warnings,
+		// in favor of the error that failed the transfer.
+		if err := setRemoteTime(resp); err != nil {
+			resp.warn(WarnRemoteTime, err,
+				"cannot set timestamp of partially downloaded file")
+		}
+	}
+	resp.fi = nil
 	resp.closeResponseBody()
+	if resp.dump != nil {
+		resp.dump.close()
+	}
+	if t := resp.transfer.Load(); t != nil && t.b != nil {
+		// the copy loop has returned and will not touch the buffer again
+		if w := resp.worker; w != nil {
+			// kept for the next transfer of the worker
+			if w.buf != nil {
+				c.buffers.put(w.buf)
+			}
+			w.buf = t.b
+		} else {
+			c.buffers.put(t.b)
+		}
+	}
 
-	resp.End = time.Now()
-	close(resp.Done)
-	if resp.cancel != nil {
-		resp.cancel()
+	resp.End = resp.now()
+	c.usage.done(resp.req.URL().Host, resp.err)
+	if resp.State() == StatePending {
+		c.pending.Add(-1)
+	} else {
+		c.active.Add(-1)
+	}
+	if resp.slots != nil {
+		<-resp.slots
+	}
+	c.tags.remove(resp)
+	resp.state.Store(int32(StateComplete))
+	func() {
+		// the Response is finalized even if the collector panics while
+		// Client.PropagatePanics is set
+		defer func() {
+			resp.metadataOnce.Do(func() { close(resp.metadata) })
+			close(resp.Done)
+			for _, t := range resp.timers {
+				t.Stop()
+			}
+			if resp.cancel != nil {
+				resp.cancel(nil)
+			}
+		}()
+		c.observeTransfer(resp)
+	}()
+	if f := resp.req.OnFinish; f != nil {
+		f(resp)
 	}
 
 	return nil
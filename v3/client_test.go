@@ -10,12 +10,18 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/3JoB/grab/v3/pkg/grabtest"
@@ -75,6 +81,99 @@ func TestFilenameResolution(t *testing.T) {
 	}
 }
 
+// TestFilenameFunc tests that the destination filename can be determined by a
+// user provided callback.
+func TestFilenameFunc(t *testing.T) {
+	dir := ".testFilenameFunc"
+	if err := os.Mkdir(dir, 0777); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	size := 4096
+
+	t.Run("Rename", func(t *testing.T) {
+		expect := filepath.Join(dir, "renamed")
+		defer os.Remove(expect)
+		grabtest.WithTestServer(t, func(url string) {
+			calls := 0
+			req := mustNewRequest(dir, url+"/url-filename")
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				calls++
+				if want := filepath.Join(dir, "header-filename"); suggested != want {
+					t.Errorf("expected suggested filename: %s, got: %s", want, suggested)
+				}
+				return expect, nil
+			}
+			resp := mustDo(req)
+			if resp.Filename != expect {
+				t.Errorf("expected filename: %s, got: %s", expect, resp.Filename)
+			}
+			if calls != 1 {
+				t.Errorf("expected FilenameFunc to be called once, got %d calls", calls)
+			}
+			if _, err := os.Stat(expect); err != nil {
+				t.Error(err)
+			}
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size), grabtest.AttachmentFilename("header-filename"))
+	})
+
+	t.Run("WithResume", func(t *testing.T) {
+		expect := filepath.Join(dir, "resumed")
+		defer os.Remove(expect)
+		if err := os.WriteFile(expect, make([]byte, size/2), 0666); err != nil {
+			panic(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filepath.Join(dir, "explicit"), url)
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				if resp.Request.Method != "HEAD" {
+					t.Errorf("expected FilenameFunc to be called for HEAD request, got: %s", resp.Request.Method)
+				}
+				if want := req.Filename; suggested != want {
+					t.Errorf("expected suggested filename: %s, got: %s", want, suggested)
+				}
+				return expect, nil
+			}
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		testError := errors.New("test")
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(dir, url+"/url-filename")
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				return "", testError
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != testError {
+				t.Errorf("expected error: %v, got: %v", testError, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "url-filename")); !os.IsNotExist(err) {
+				t.Errorf("expected no file to be created, got: %v", err)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithSanitization", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(dir, url+"/url-filename")
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				return dir + "/..", nil
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrNoFilename {
+				t.Errorf("expected error: %v, got: %v", ErrNoFilename, err)
+			}
+		}, grabtest.ContentLength(size))
+	})
+}
+
 // TestChecksums checks that checksum validation behaves as expected for valid
 // and corrupted downloads.
 func TestChecksums(t *testing.T) {
@@ -147,6 +246,136 @@ func TestChecksums(t *testing.T) {
 	}
 }
 
+// TestValidate ensures that Request.Validate is called with the path of the
+// downloaded file after checksum validation and that invalid files are deleted
+// if requested.
+func TestValidate(t *testing.T) {
+	errInvalid := errors.New("invalid file")
+	sum := grabtest.DefaultHandlerSHA256ChecksumBytes
+
+	tests := []struct {
+		Name          string
+		Sum           []byte
+		Valid         bool
+		DeleteOnError bool
+		ExpectCalled  bool
+		ExpectErr     error
+	}{
+		{Name: "WithValidFile", Sum: sum, Valid: true, ExpectCalled: true},
+		{Name: "WithInvalidFile", Sum: sum, ExpectCalled: true, ExpectErr: errInvalid},
+		{Name: "WithDeleteOnError", Sum: sum, DeleteOnError: true, ExpectCalled: true, ExpectErr: errInvalid},
+		{Name: "WithNoChecksum", DeleteOnError: true, ExpectCalled: true, ExpectErr: errInvalid},
+		{Name: "WithBadChecksum", Sum: []byte("bad"), ExpectErr: ErrBadChecksum},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filename := ".testValidate"
+			defer os.Remove(filename)
+
+			grabtest.WithTestServer(t, func(url string) {
+				called := false
+				req := mustNewRequest(filename, url)
+				if test.Sum != nil {
+					req.SetChecksum(sha256.New(), test.Sum, test.DeleteOnError)
+				} else {
+					req.SetChecksum(nil, nil, test.DeleteOnError)
+				}
+				req.Validate = func(path string) error {
+					called = true
+					if path != filename {
+						t.Errorf("expected path: %q, got: %q", filename, path)
+					}
+					if _, err := os.Stat(path); err != nil {
+						t.Errorf("expected downloaded file: %v", err)
+					}
+					if !test.Valid {
+						return errInvalid
+					}
+					return nil
+				}
+
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.ExpectErr {
+					t.Errorf("expected error: %v, got: %v", test.ExpectErr, err)
+				}
+				if called != test.ExpectCalled {
+					t.Errorf("expected Validate called: %v, got: %v", test.ExpectCalled, called)
+				}
+				_, err := os.Stat(filename)
+				if deleted := os.IsNotExist(err); deleted != test.DeleteOnError {
+					t.Errorf("expected file deleted: %v, got: %v", test.DeleteOnError, deleted)
+				}
+				testComplete(t, resp)
+			})
+		})
+	}
+}
+
+// TestContentMD5 ensures that downloads are validated using the Content-MD5
+// header if Request.VerifyContentMD5 is enabled, including resumed downloads.
+func TestContentMD5(t *testing.T) {
+	filename := ".testContentMD5"
+	size := 4096
+
+	t.Run("Match", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.VerifyContentMD5 = true
+			resp := mustDo(req)
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size), grabtest.ContentMD5(true))
+	})
+
+	// corrupt a partial download, which is then resumed
+	corrupt := func() {
+		if err := os.WriteFile(filename, bytes.Repeat([]byte("x"), size/2), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	t.Run("WithCorruptResume", func(t *testing.T) {
+		defer os.Remove(filename)
+		corrupt()
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.VerifyContentMD5 = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size), grabtest.ContentMD5(true))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		defer os.Remove(filename)
+		corrupt()
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size), grabtest.ContentMD5(true))
+	})
+
+	t.Run("WithChecksum", func(t *testing.T) {
+		// explicit checksums take precedence
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.VerifyContentMD5 = true
+			req.SetChecksum(sha256.New(), []byte{0x01, 0x02, 0x03, 0x04}, false)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+		}, grabtest.ContentLength(size), grabtest.ContentMD5(true))
+	})
+}
+
 // TestContentLength ensures that ErrBadLength is returned if a server response
 // does not match the requested length.
 func TestContentLength(t *testing.T) {
@@ -180,7 +409,7 @@ func TestContentLength(t *testing.T) {
 				defer os.Remove(resp.Filename)
 				err := resp.Err()
 				if test.Match {
-					if err == ErrBadLength {
+					if errors.Is(err, ErrBadLength) {
 						t.Errorf("error: %v", err)
 					} else if err != nil {
 						panic(err)
@@ -190,7 +419,7 @@ func TestContentLength(t *testing.T) {
 				} else {
 					if err == nil {
 						t.Errorf("expected: %v, got %v", ErrBadLength, err)
-					} else if err != ErrBadLength {
+					} else if !errors.Is(err, ErrBadLength) {
 						panic(err)
 					}
 				}
@@ -200,6 +429,80 @@ func TestContentLength(t *testing.T) {
 	}
 }
 
+// TestSizeMismatch ensures that a SizeMismatchError describes sizes reported
+// by the remote server that do not match Request.Size.
+func TestSizeMismatch(t *testing.T) {
+	filename := ".testSizeMismatch"
+	defer os.Remove(filename)
+	size := 1024
+
+	// check returns an error if err is not a SizeMismatchError with the given
+	// sizes
+	check := func(t *testing.T, err error, expected, reported int) {
+		var serr SizeMismatchError
+		if !errors.As(err, &serr) {
+			t.Fatalf("expected SizeMismatchError, got: %v", err)
+		}
+		if serr.Expected != int64(expected) || serr.Reported != int64(reported) {
+			t.Errorf("expected sizes %d and %d, got: %+v", expected, reported, serr)
+		}
+		if !errors.Is(err, ErrBadLength) {
+			t.Errorf("expected errors.Is(err, ErrBadLength) to be true")
+		}
+	}
+
+	t.Run("WithContentRange", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Size = int64(size * 2)
+			resp := DefaultClient.Do(req)
+			check(t, resp.Err(), size*2, size)
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected no file to be written, got: %v", err)
+			}
+		},
+			grabtest.ContentLength(size),
+			// size must be probed with a ranged request
+			grabtest.MethodWhitelist("GET"),
+		)
+	})
+
+	t.Run("WithoutContentLength", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Size = int64(size * 2)
+			req.BeforeCopy = func(resp *Response) error {
+				if resp.Size() != int64(size*2) {
+					t.Errorf("expected Request.Size to be reported, got: %d", resp.Size())
+				}
+				return nil
+			}
+			resp := DefaultClient.Do(req)
+			check(t, resp.Err(), size*2, size)
+			if resp.Size() != int64(size) {
+				t.Errorf("expected discovered size to be reported, got: %d", resp.Size())
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.HeaderBlacklist("Content-Length"),
+		)
+	})
+
+	t.Run("WithMatchingSizeWithoutContentLength", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Size = int64(size)
+			testComplete(t, mustDo(req))
+		},
+			grabtest.ContentLength(size),
+			grabtest.HeaderBlacklist("Content-Length"),
+		)
+	})
+}
+
 // TestAutoResume tests segmented downloading of a large file.
 func TestAutoResume(t *testing.T) {
 	segs := 8
@@ -276,6 +579,7 @@ func TestAutoResume(t *testing.T) {
 	t.Run("WithNoContentLengthHeader", func(t *testing.T) {
 		grabtest.WithTestServer(t, func(url string) {
 			req := mustNewRequest(filename, url)
+			req.UnknownSizeResume = UnknownSizeAppend
 			req.SetChecksum(sha256.New(), sum, false)
 			resp := mustDo(req)
 			if !resp.DidResume {
@@ -296,6 +600,7 @@ func TestAutoResume(t *testing.T) {
 		size := size * 2
 		grabtest.WithTestServer(t, func(url string) {
 			req := mustNewRequest(filename, url)
+			req.UnknownSizeResume = UnknownSizeAppend
 			req.SetChecksum(sha256.New(), sum, false)
 			resp := DefaultClient.Do(req)
 			if err := resp.Err(); err != ErrBadChecksum {
@@ -319,595 +624,3581 @@ func TestAutoResume(t *testing.T) {
 	// TODO: test when existing file is corrupted
 }
 
-func TestSkipExisting(t *testing.T) {
-	filename := ".testSkipExisting"
+// TestUnknownSizeResume ensures that an existing file is resumed according to
+// Request.UnknownSizeResume when the remote server does not report the size of
+// the remote file, and that the policy is reported as a Warning.
+func TestUnknownSizeResume(t *testing.T) {
+	filename := ".testUnknownSizeResume"
 	defer os.Remove(filename)
+	size := 1024
+	partial := size / 4
 
-	// download a file
-	grabtest.WithTestServer(t, func(url string) {
-		resp := mustDo(mustNewRequest(filename, url))
-		testComplete(t, resp)
-	})
+	tests := []struct {
+		Name      string
+		Policy    UnknownSizePolicy
+		Err       error
+		DidResume bool
+		Message   string
+	}{
+		{Name: "WithRestart", Policy: UnknownSizeRestart, Message: "restarting"},
+		{Name: "WithAppend", Policy: UnknownSizeAppend, DidResume: true, Message: "appending"},
+		{Name: "WithFail", Policy: UnknownSizeFail, Err: ErrUnknownSize, Message: "not resuming"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := os.WriteFile(filename, testContent(size)[:partial], 0644); err != nil {
+				t.Fatal(err)
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.UnknownSizeResume = test.Policy
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Fatalf("expected error: %v, got: %v", test.Err, err)
+				}
+				warnings := resp.Warnings()
+				if len(warnings) != 1 || warnings[0].Code != WarnUnknownSize {
+					t.Fatalf("expected a %s warning, got: %v", WarnUnknownSize, warnings)
+				}
+				if !strings.Contains(warnings[0].Message, test.Message) {
+					t.Errorf("expected warning to contain %q, got: %q", test.Message, warnings[0].Message)
+				}
+				if resp.DidResume != test.DidResume {
+					t.Errorf("expected Response.DidResume: %v, got: %v", test.DidResume, resp.DidResume)
+				}
+				if test.Err != nil {
+					return
+				}
+				testComplete(t, resp)
+				b, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, testContent(size)) {
+					t.Errorf("expected file content to match remote file")
+				}
+			},
+				grabtest.ContentLength(size),
+				grabtest.HeaderBlacklist("Content-Length"),
+			)
+		})
+	}
+}
 
-	// redownload
-	grabtest.WithTestServer(t, func(url string) {
-		resp := mustDo(mustNewRequest(filename, url))
-		testComplete(t, resp)
+// TestAcceptRangesNone ensures that no ranged requests are sent to a remote
+// server that advertises 'Accept-Ranges: none' and that an existing file is
+// restarted instead.
+func TestAcceptRangesNone(t *testing.T) {
+	filename := ".testAcceptRangesNone"
+	defer os.Remove(filename)
+	size := 1024
+	partial := make([]byte, size/4)
+	for i := range partial {
+		partial[i] = byte(i)
+	}
 
-		// ensure download was resumed
-		if !resp.DidResume {
-			t.Fatalf("Expected download to skip existing file, but it did not")
+	tests := []struct {
+		Name    string
+		Methods []string
+	}{
+		{Name: "WithHEAD", Methods: []string{"GET", "HEAD"}},
+		{Name: "WithoutHEAD", Methods: []string{"GET"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := os.WriteFile(filename, partial, 0666); err != nil {
+				t.Fatal(err)
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				ranged := 0
+				client := NewClient()
+				client.HTTPClient = &http.Client{
+					Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+						if req.Header.Get("Range") != "" {
+							ranged++
+						}
+						return http.DefaultTransport.RoundTrip(req)
+					}),
+				}
+				resp := client.Do(mustNewRequest(filename, url))
+				if err := resp.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if ranged != 0 {
+					t.Errorf("expected no ranged requests, got %d", ranged)
+				}
+				if resp.CanResume || resp.DidResume {
+					t.Errorf("expected CanResume and DidResume to be false")
+				}
+				if n := resp.Stats().BytesDiscarded; n != int64(len(partial)) {
+					t.Errorf("expected %d bytes discarded, got %d", len(partial), n)
+				}
+				testComplete(t, resp)
+			},
+				grabtest.ContentLength(size),
+				grabtest.AcceptRangesNone(),
+				grabtest.MethodWhitelist(test.Methods...),
+			)
+		})
+	}
+}
+
+// TestProbeCache ensures that HEAD responses are reused by transfers of the
+// same URL for Client.ProbeCacheTTL, unless the remote file changes.
+func TestProbeCache(t *testing.T) {
+	etag := atomic.Value{}
+	etag.Store(`"v1"`)
+	grabtest.WithTestServer(t, func(url string) {
+		heads := 0
+		newClient := func(ttl time.Duration) *Client {
+			client := NewClient()
+			client.ProbeCacheTTL = ttl
+			client.HTTPClient = &http.Client{
+				Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					if req.Method == "HEAD" {
+						heads++
+					}
+					return http.DefaultTransport.RoundTrip(req)
+				}),
+			}
+			return client
 		}
 
-		// ensure all bytes were resumed
-		if resp.Size() == 0 || resp.Size() != resp.bytesResumed {
-			t.Fatalf("Expected to skip %d bytes in redownload; got %d", resp.Size(), resp.bytesResumed)
+		// download the file with an unknown filename, which is probed with a
+		// HEAD request
+		download := func(client *Client) {
+			resp := client.Do(mustNewRequest("", url+"/.testProbeCache"))
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(resp.Filename)
+		}
+		expect := func(expectHeads int, expectHits, expectMisses int64, client *Client) {
+			t.Helper()
+			if heads != expectHeads {
+				t.Errorf("expected %d HEAD requests, got %d", expectHeads, heads)
+			}
+			u := client.Usage()
+			if u.ProbeCacheHits != expectHits || u.ProbeCacheMisses != expectMisses {
+				t.Errorf("expected %d hits and %d misses, got %d and %d",
+					expectHits, expectMisses, u.ProbeCacheHits, u.ProbeCacheMisses)
+			}
 		}
-	})
 
-	// ensure checksum is performed on pre-existing file
+		client := newClient(time.Minute)
+		download(client)
+		expect(1, 0, 1, client)
+		download(client)
+		expect(1, 1, 1, client)
+
+		// the GET request reveals that the file changed
+		etag.Store(`"v2"`)
+		download(client)
+		expect(1, 2, 1, client)
+		download(client)
+		expect(2, 2, 2, client)
+
+		// zero disables the cache
+		heads = 0
+		client = newClient(0)
+		download(client)
+		download(client)
+		expect(2, 0, 0, client)
+	},
+		grabtest.LastModified(time.Now().Add(-time.Hour)),
+		grabtest.ETagFunc(func(req *http.Request) string { return etag.Load().(string) }),
+	)
+}
+
+// TestRequestTransport ensures that every request of a transfer is sent with
+// Request.Transport if set, instead of the transport of Client.HTTPClient.
+func TestRequestTransport(t *testing.T) {
+	filename := ".testRequestTransport"
+	defer os.Remove(filename)
+	size := 1024
+	if err := os.WriteFile(filename, testContent(size/2), 0666); err != nil {
+		t.Fatal(err)
+	}
+
 	grabtest.WithTestServer(t, func(url string) {
+		var clientCalls, requestCalls []string
+		client := NewClient()
+		client.HTTPClient = &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				clientCalls = append(clientCalls, req.Method)
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		}
 		req := mustNewRequest(filename, url)
-		req.SetChecksum(sha256.New(), []byte{0x01, 0x02, 0x03, 0x04}, true)
-		resp := DefaultClient.Do(req)
-		if err := resp.Err(); err != ErrBadChecksum {
-			t.Fatalf("Expected checksum error, got: %v", err)
+		req.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requestCalls = append(requestCalls, req.Method)
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		resp := client.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
 		}
-	})
+		if !resp.DidResume {
+			t.Errorf("expected transfer to resume")
+		}
+		if len(clientCalls) != 0 {
+			t.Errorf("expected no requests with the client transport, got: %v", clientCalls)
+		}
+		if strings.Join(requestCalls, ",") != "HEAD,GET" {
+			t.Errorf("expected HEAD and GET requests with the request transport, got: %v", requestCalls)
+		}
+		testComplete(t, resp)
+	}, grabtest.ContentLength(size))
 }
 
-// TestBatch executes multiple requests simultaneously and validates the
-// responses.
-func TestBatch(t *testing.T) {
-	tests := 32
-	size := 32768
-	sum := grabtest.MustHexDecodeString("e11360251d1173650cdcd20f111d8f1ca2e412f572e8b36a4dc067121c1799b8")
+// roundTripperFunc is a http.RoundTripper implemented by a function.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
 
-	// test with 4 workers and with one per request
-	grabtest.WithTestServer(t, func(url string) {
-		for _, workerCount := range []int{4, 0} {
-			// create requests
-			reqs := make([]*Request, tests)
-			for i := 0; i < len(reqs); i++ {
-				filename := fmt.Sprintf(".testBatch.%d", i+1)
-				reqs[i] = mustNewRequest(filename, url+fmt.Sprintf("/request_%d?", i+1))
-				reqs[i].Label = fmt.Sprintf("Test %d", i+1)
-				reqs[i].SetChecksum(sha256.New(), sum, false)
-			}
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
 
-			// batch run
-			responses := DefaultClient.DoBatch(workerCount, reqs...)
+// TestResumeFrom ensures that Request.ResumeFrom overrides the size of an
+// existing file when resuming a transfer.
+func TestResumeFrom(t *testing.T) {
+	size := 1024
+	offset := 512
+	filename := ".testResumeFrom"
+	defer os.Remove(filename)
 
-			// listen for responses
-		Loop:
-			for i := 0; i < len(reqs); {
-				select {
-				case resp := <-responses:
-					if resp == nil {
-						break Loop
-					}
-					testComplete(t, resp)
-					if err := resp.Err(); err != nil {
-						t.Errorf("%s: %v", resp.Filename, err)
-					}
+	// the first half of the local file is valid, the rest is garbage
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	want := md5.Sum(b)
+	for i := offset; i < size; i++ {
+		b[i] = 0xff
+	}
 
-					// remove test file
-					if resp.IsComplete() {
-						os.Remove(resp.Filename) // ignore errors
-					}
-					i++
-				}
-			}
+	t.Run("WithValidOffset", func(t *testing.T) {
+		if err := os.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
 		}
-	},
-		grabtest.ContentLength(size),
-	)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeFrom = int64(offset)
+			req.SetChecksum(md5.New(), want[:], false)
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if n := resp.bytesResumed.Load(); n != int64(offset) {
+				t.Errorf("expected %d bytes resumed, got %d", offset, n)
+			}
+			if n := resp.Stats().BytesDiscarded; n != int64(size-offset) {
+				t.Errorf("expected %d bytes discarded, got %d", size-offset, n)
+			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+		)
+	})
+
+	t.Run("WithOffsetBeyondRemoteSize", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeFrom = int64(size + 1)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadResumeOffset {
+				t.Errorf("expected error: %v, got: %v", ErrBadResumeOffset, err)
+			}
+		},
+			grabtest.ContentLength(size),
+		)
+	})
 }
 
-// TestCancelContext tests that a batch of requests can be cancel using a
-// context.Context cancellation. Requests are cancelled in multiple states:
-// in-progress and unstarted.
-func TestCancelContext(t *testing.T) {
-	fileSize := 134217728
-	tests := 256
-	client := NewClient()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// TestResumeOffsetFunc ensures that Request.ResumeOffsetFunc computes the
+// offset in the remote file from which a transfer resumes, while writing
+// continues at the end of the local file.
+func TestResumeOffsetFunc(t *testing.T) {
+	size := 1024
+	header := []byte("local header\n")
+	filename := ".testResumeOffsetFunc"
+	defer os.Remove(filename)
 
-	grabtest.WithTestServer(t, func(url string) {
-		reqs := make([]*Request, tests)
-		for i := 0; i < tests; i++ {
-			req := mustNewRequest("", fmt.Sprintf("%s/.testCancelContext%d", url, i))
-			reqs[i] = req.WithContext(ctx)
+	// the local file is a header followed by a prefix of the remote file
+	local := append(append([]byte{}, header...), testContent(size)[:size/2]...)
+	want := md5.Sum(append(append([]byte{}, header...), testContent(size)...))
+	offsetFunc := func(localPath string, info os.FileInfo) (int64, error) {
+		if localPath != filename {
+			t.Errorf("expected path %q, got %q", filename, localPath)
 		}
+		return info.Size() - int64(len(header)), nil
+	}
 
-		respch := client.DoBatch(8, reqs...)
-		time.Sleep(time.Millisecond * 500)
-		cancel()
-		for resp := range respch {
-			defer os.Remove(resp.Filename)
+	t.Run("WithHeader", func(t *testing.T) {
+		if err := os.WriteFile(filename, local, 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeOffsetFunc = offsetFunc
+			req.SetChecksum(md5.New(), want[:], false)
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if n := resp.bytesResumed.Load(); n != int64(size/2) {
+				t.Errorf("expected %d bytes resumed, got %d", size/2, n)
+			}
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := fi.Size(); n != int64(len(header)+size) {
+				t.Errorf("expected file size %d, got %d", len(header)+size, n)
+			}
+		},
+			grabtest.ContentLength(size),
+		)
+	})
 
-			// err should be context.Canceled or http.errRequestCanceled
-			if resp.Err() == nil || !strings.Contains(resp.Err().Error(), "canceled") {
-				t.Errorf("expected '%v', got '%v'", context.Canceled, resp.Err())
+	t.Run("WithRestart", func(t *testing.T) {
+		if err := os.WriteFile(filename, local, 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeOffsetFunc = func(string, os.FileInfo) (int64, error) {
+				return -1, nil
 			}
-			if resp.BytesComplete() >= int64(fileSize) {
-				t.Errorf("expected Response.BytesComplete: < %d, got: %d", fileSize, resp.BytesComplete())
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
 			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+		)
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		if err := os.WriteFile(filename, local, 0644); err != nil {
+			t.Fatal(err)
 		}
-	},
-		grabtest.ContentLength(fileSize),
-	)
+		errBadHeader := errors.New("bad header")
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeOffsetFunc = func(string, os.FileInfo) (int64, error) {
+				return 0, errBadHeader
+			}
+			if err := DefaultClient.Do(req).Err(); err != errBadHeader {
+				t.Errorf("expected error: %v, got: %v", errBadHeader, err)
+			}
+		},
+			grabtest.ContentLength(size),
+		)
+	})
 }
 
-// TestCancelHangingResponse tests that a never ending request is terminated
-// when the response is cancelled.
-func TestCancelHangingResponse(t *testing.T) {
-	fileSize := 10
-	client := NewClient()
-
-	grabtest.WithTestServer(t, func(url string) {
-		req := mustNewRequest("", fmt.Sprintf("%s/.testCancelHangingResponse", url))
+// TestAppendGrowing ensures that Request.AppendGrowing fetches only the bytes
+// appended to a remote file since it was last downloaded, and restarts if the
+// remote file shrank.
+func TestAppendGrowing(t *testing.T) {
+	filename := ".testAppendGrowing"
+	defer os.Remove(filename)
 
-		resp := client.Do(req)
-		defer os.Remove(resp.Filename)
+	var mu sync.Mutex
+	var content []byte
+	var modTime time.Time
+	setContent := func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		content, modTime = b, modTime.Add(time.Hour)
+	}
+	modTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b, t := content, modTime
+		mu.Unlock()
+		http.ServeContent(w, r, "", t, bytes.NewReader(b))
+	}))
+	defer ts.Close()
 
-		// Wait for some bytes to be transferred
-		for resp.BytesComplete() == 0 {
-			time.Sleep(50 * time.Millisecond)
+	fetch := func(t *testing.T, want []byte) *Response {
+		t.Helper()
+		req := mustNewRequest(filename, ts.URL)
+		req.AppendGrowing = true
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
 		}
-
-		done := make(chan error)
-		go func() {
-			done <- resp.Cancel()
-		}()
-
-		select {
-		case err := <-done:
-			if err != context.Canceled {
-				t.Errorf("Expected context.Canceled error, go: %v", err)
-			}
-		case <-time.After(time.Second):
-			t.Fatal("response was not cancelled within 1s")
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.BytesComplete() == int64(fileSize) {
-			t.Error("download was not supposed to be complete")
+		if !bytes.Equal(b, want) {
+			t.Errorf("expected %d bytes of remote file, got %d bytes", len(want), len(b))
 		}
-	},
-		grabtest.RateLimiter(1),
-		grabtest.ContentLength(fileSize),
-	)
-}
+		return resp
+	}
 
-// TestNestedDirectory tests that missing subdirectories are created.
-func TestNestedDirectory(t *testing.T) {
-	dir := "./.testNested/one/two/three"
-	filename := ".testNestedFile"
-	expect := dir + "/" + filename
+	log := testContent(1500)
+	setContent(log[:1000])
+	fetch(t, log[:1000])
 
-	t.Run("Create", func(t *testing.T) {
-		grabtest.WithTestServer(t, func(url string) {
-			resp := mustDo(mustNewRequest(expect, url+"/"+filename))
-			defer os.RemoveAll("./.testNested/")
-			if resp.Filename != expect {
-				t.Errorf("expected nested Request.Filename to be %v, got %v", expect, resp.Filename)
-			}
-		})
+	t.Run("WithGrowth", func(t *testing.T) {
+		setContent(log)
+		resp := fetch(t, log)
+		if !resp.DidResume || resp.BytesResumed() != 1000 {
+			t.Errorf("expected 1000 bytes resumed, got %d (resumed: %v)",
+				resp.BytesResumed(), resp.DidResume)
+		}
 	})
 
-	t.Run("No create", func(t *testing.T) {
-		grabtest.WithTestServer(t, func(url string) {
-			req := mustNewRequest(expect, url+"/"+filename)
-			req.NoCreateDirectories = true
-			resp := DefaultClient.Do(req)
-			err := resp.Err()
-			if !os.IsNotExist(err) {
-				t.Errorf("expected: %v, got: %v", os.ErrNotExist, err)
-			}
-		})
+	t.Run("WithShrink", func(t *testing.T) {
+		rotated := testContent(300)
+		setContent(rotated)
+		resp := fetch(t, rotated)
+		if resp.DidResume {
+			t.Errorf("expected Response.DidResume to be false")
+		}
+		warnings := resp.Warnings()
+		if len(warnings) != 1 || warnings[0].Code != WarnRemoteShrank {
+			t.Errorf("expected a single %s warning, got: %v", WarnRemoteShrank, warnings)
+		}
 	})
 }
 
-// TestRemoteTime tests that the timestamp of the downloaded file can be set
-// according to the timestamp of the remote file.
-func TestRemoteTime(t *testing.T) {
-	filename := "./.testRemoteTime"
+// TestRemoteChanged ensures that resumed transfers fail with ErrRemoteChanged if
+// the remote file changes between requests.
+func TestRemoteChanged(t *testing.T) {
+	size := 1024
+	filename := ".testRemoteChanged"
 	defer os.Remove(filename)
 
-	// random time between epoch and now
-	expect := time.Unix(rand.Int63n(time.Now().Unix()), 0)
-	grabtest.WithTestServer(t, func(url string) {
-		resp := mustDo(mustNewRequest(filename, url))
-		fi, err := os.Stat(resp.Filename)
-		if err != nil {
-			panic(err)
-		}
-		actual := fi.ModTime()
-		if !actual.Equal(expect) {
-			t.Errorf("expected %v, got %v", expect, actual)
-		}
-	},
-		grabtest.LastModified(expect),
-	)
-}
+	// etags returns an entity tag function that returns the given tags for
+	// successive requests, repeating the last tag.
+	etags := func(tags ...string) grabtest.HandlerOption {
+		var n int32
+		return grabtest.ETagFunc(func(req *http.Request) string {
+			i := int(atomic.AddInt32(&n, 1)) - 1
+			if i >= len(tags) {
+				i = len(tags) - 1
+			}
+			return tags[i]
+		})
+	}
 
-func TestResponseCode(t *testing.T) {
-	filename := "./.testResponseCode"
+	partial := make([]byte, size/2)
+	for i := range partial {
+		partial[i] = byte(i)
+	}
 
-	t.Run("With404", func(t *testing.T) {
-		defer os.Remove(filename)
+	t.Run("WithUnchangedETag", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
 		grabtest.WithTestServer(t, func(url string) {
-			req := mustNewRequest(filename, url)
-			resp := DefaultClient.Do(req)
-			expect := StatusCodeError(http.StatusNotFound)
-			err := resp.Err()
-			if err != expect {
-				t.Errorf("expected %v, got '%v'", expect, err)
+			resp := mustDo(mustNewRequest(filename, url))
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
 			}
-			if !IsStatusCodeError(err) {
-				t.Errorf("expected IsStatusCodeError to return true for %T: %v", err, err)
+			if v := resp.HTTPResponse.Request.Header.Get("If-Match"); v != `"v1"` {
+				t.Errorf("expected If-Match header: %q, got: %q", `"v1"`, v)
 			}
+			testComplete(t, resp)
 		},
-			grabtest.StatusCodeStatic(http.StatusNotFound),
+			grabtest.ContentLength(size),
+			etags(`"v1"`),
 		)
 	})
 
-	t.Run("WithIgnoreNon2XX", func(t *testing.T) {
-		defer os.Remove(filename)
+	t.Run("WithChangedETag", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
 		grabtest.WithTestServer(t, func(url string) {
-			req := mustNewRequest(filename, url)
-			req.IgnoreBadStatusCodes = true
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != nil {
-				t.Errorf("expected nil, got '%v'", err)
+			resp := DefaultClient.Do(mustNewRequest(filename, url))
+			if err := resp.Err(); err != ErrRemoteChanged {
+				t.Errorf("expected error: %v, got: %v", ErrRemoteChanged, err)
+			}
+			if fi, err := os.Stat(filename); err != nil {
+				t.Error(err)
+			} else if fi.Size() != int64(len(partial)) {
+				t.Errorf("expected partial file to be unchanged, got %d bytes", fi.Size())
 			}
 		},
-			grabtest.StatusCodeStatic(http.StatusNotFound),
+			grabtest.ContentLength(size),
+			etags(`"v1"`, `"v2"`),
 		)
 	})
-}
 
-func TestBeforeCopyHook(t *testing.T) {
-	filename := "./.testBeforeCopy"
-	t.Run("Noop", func(t *testing.T) {
-		defer os.RemoveAll(filename)
-		grabtest.WithTestServer(t, func(url string) {
-			called := false
+	lastMod := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("WithLastModified", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, lastMod, lastMod); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			expect := lastMod.Format(http.TimeFormat)
+			if v := resp.HTTPResponse.Request.Header.Get("If-Unmodified-Since"); v != expect {
+				t.Errorf("expected If-Unmodified-Since header: %q, got: %q", expect, v)
+			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+			grabtest.LastModified(lastMod),
+		)
+	})
+
+	t.Run("WithChangedLastModified", func(t *testing.T) {
+		// the partial file has the time of a previous version of the file
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, lastMod, lastMod); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			err := DefaultClient.Do(mustNewRequest(filename, url)).Err()
+			if err != ErrRemoteChanged {
+				t.Errorf("expected error: %v, got: %v", ErrRemoteChanged, err)
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.LastModified(lastMod.Add(time.Hour)),
+		)
+	})
+}
+
+// TestRemovePartial ensures that Request.RemovePartialOnCancel and
+// Request.RemovePartialOnError remove partially downloaded files, and that
+// resumed files are truncated back to their original length instead.
+func TestRemovePartial(t *testing.T) {
+	size := 1024
+	filename := ".testRemovePartial"
+	defer os.Remove(filename)
+
+	// cancel returns a new Response that is canceled after the first bytes are
+	// transferred.
+	cancel := func(req *Request) *Response {
+		resp := DefaultClient.Do(req)
+		for resp.BytesComplete() == 0 && !resp.IsComplete() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := resp.Cancel(nil); err != context.Canceled {
+			t.Errorf("expected error: %v, got: %v", context.Canceled, err)
+		}
+		return resp
+	}
+
+	t.Run("KeepOnCancel", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			cancel(mustNewRequest(filename, url))
+			if _, err := os.Stat(filename); err != nil {
+				t.Errorf("expected partial file to be kept: %v", err)
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.RateLimiter(256),
+		)
+	})
+
+	t.Run("RemoveOnCancel", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.RemovePartialOnCancel = true
+			cancel(req)
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected partial file to be removed, got: %v", err)
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.RateLimiter(256),
+		)
+	})
+
+	t.Run("RemoveOnError", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Size = int64(size + 1)
+			req.RemovePartialOnCancel = true
+			req.RemovePartialOnError = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); !errors.Is(err, ErrBadLength) {
+				t.Errorf("expected error: %v, got: %v", ErrBadLength, err)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected partial file to be removed, got: %v", err)
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.HeaderBlacklist("Content-Length"),
+		)
+	})
+
+	t.Run("TruncateResumedOnCancel", func(t *testing.T) {
+		offset := size / 2
+		b := make([]byte, offset)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		if err := os.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.RemovePartialOnCancel = true
+			req.RemovePartialOnError = true
+			resp := cancel(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatalf("expected resumed file to be kept: %v", err)
+			}
+			if fi.Size() != int64(offset) {
+				t.Errorf("expected resumed file to be truncated to %d bytes, got %d", offset, fi.Size())
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.RateLimiter(256),
+		)
+	})
+}
+
+// failingTransport is a http.RoundTripper whose response bodies fail after n
+// bytes.
+type failingTransport struct {
+	http.RoundTripper
+	n int64
+}
+
+func (c *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(
+			io.LimitReader(resp.Body, c.n),
+			iotest.ErrReader(io.ErrUnexpectedEOF)),
+		Closer: resp.Body,
+	}
+	return resp, nil
+}
+
+// TestSingleUse ensures that a Request with SingleUse enabled sends exactly
+// one request to the remote server.
+func TestSingleUse(t *testing.T) {
+	size := 1024
+	filename := ".testSingleUse"
+	defer os.Remove(filename)
+
+	// singleUse returns a status code function that rejects all but the first
+	// request.
+	singleUse := func() grabtest.HandlerOption {
+		var n int32
+		return grabtest.StatusCode(func(req *http.Request) int {
+			if atomic.AddInt32(&n, 1) > 1 {
+				return http.StatusForbidden
+			}
+			return http.StatusOK
+		})
+	}
+
+	t.Run("WithNewFile", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SingleUse = true
+			testComplete(t, mustDo(req))
+		},
+			grabtest.ContentLength(size),
+			singleUse(),
+		)
+	})
+
+	t.Run("WithExistingFile", func(t *testing.T) {
+		// existing file is longer than the remote file and must be restarted
+		if err := os.WriteFile(filename, make([]byte, size*2), 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(".", url+"/"+filename)
+			req.SingleUse = true
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
+			}
+			testComplete(t, resp)
+			if fi, err := os.Stat(filename); err != nil {
+				t.Error(err)
+			} else if fi.Size() != int64(size) {
+				t.Errorf("expected file size: %d, got: %d", size, fi.Size())
+			}
+		},
+			grabtest.ContentLength(size),
+			singleUse(),
+		)
+	})
+
+	t.Run("WithFailure", func(t *testing.T) {
+		os.Remove(filename)
+		client := NewClient()
+		client.HTTPClient = &http.Client{
+			Transport: &failingTransport{
+				RoundTripper: http.DefaultTransport,
+				n:            int64(size / 2),
+			},
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SingleUse = true
+			err := client.Do(req).Err()
+			if !errors.Is(err, ErrSingleUseExhausted) {
+				t.Errorf("expected error: %v, got: %v", ErrSingleUseExhausted, err)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("expected error to wrap: %v, got: %v", io.ErrUnexpectedEOF, err)
+			}
+		},
+			grabtest.ContentLength(size),
+			singleUse(),
+		)
+	})
+}
+
+func TestSkipExisting(t *testing.T) {
+	filename := ".testSkipExisting"
+	defer os.Remove(filename)
+
+	// download a file
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		testComplete(t, resp)
+	})
+
+	// redownload
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		testComplete(t, resp)
+
+		// ensure download was resumed
+		if !resp.DidResume {
+			t.Fatalf("Expected download to skip existing file, but it did not")
+		}
+
+		// ensure all bytes were resumed
+		if resp.Size() == 0 || resp.Size() != resp.bytesResumed.Load() {
+			t.Fatalf("Expected to skip %d bytes in redownload; got %d", resp.Size(), resp.bytesResumed.Load())
+		}
+	})
+
+	// ensure checksum is performed on pre-existing file
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.SetChecksum(sha256.New(), []byte{0x01, 0x02, 0x03, 0x04}, true)
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != ErrBadChecksum {
+			t.Fatalf("Expected checksum error, got: %v", err)
+		}
+	})
+}
+
+// TestResponseSkipped ensures that Response.Skipped and SkipReason are set by
+// each path that skips downloading, and that nothing is transferred.
+func TestResponseSkipped(t *testing.T) {
+	filename := ".testResponseSkipped"
+	other := ".testResponseSkippedOther"
+	defer os.Remove(filename)
+	defer os.Remove(other)
+	size := 1024
+	for _, name := range []string{filename, other} {
+		if err := os.WriteFile(name, testContent(size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		tests := []struct {
+			Name    string
+			Request func() *Request
+			Reason  SkipReason
+			Err     error
+		}{
+			{
+				Name: "Default",
+				Request: func() *Request {
+					req := mustNewRequest("", url)
+					req.NoStore = true
+					return req
+				},
+			},
+			{
+				Name:    "WithCompleteFile",
+				Request: func() *Request { return mustNewRequest(filename, url) },
+				Reason:  SkipComplete,
+			},
+			{
+				Name: "WithCompleteRange",
+				Request: func() *Request {
+					req, err := NewRangeRequest(filename, url, 100, int64(size)+99)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return req
+				},
+				Reason: SkipComplete,
+			},
+			{
+				Name: "WithSkipExisting",
+				Request: func() *Request {
+					req := mustNewRequest(filename, url)
+					req.SkipExisting = true
+					return req
+				},
+				Reason: SkipFileExists,
+				Err:    ErrFileExists,
+			},
+			{
+				Name: "WithSkipExistingFromBeforeCopy",
+				Request: func() *Request {
+					req := mustNewRequest(filename+".missing", url)
+					req.SkipExisting = true
+					req.BeforeCopy = func(resp *Response) error {
+						resp.Filename = other
+						return nil
+					}
+					return req
+				},
+				Reason: SkipFileExists,
+				Err:    ErrFileExists,
+			},
+		}
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				resp := DefaultClient.Do(test.Request())
+				if err := resp.Err(); err != test.Err {
+					t.Fatalf("expected error: %v, got: %v", test.Err, err)
+				}
+				if resp.Skipped != (test.Reason != "") || resp.SkipReason != test.Reason {
+					t.Errorf("expected skip reason: %q, got: %v, %q", test.Reason, resp.Skipped, resp.SkipReason)
+				}
+				if test.Reason != "" && resp.transfer.Load().N() != 0 {
+					t.Errorf("expected no bytes transferred, got %d", resp.transfer.Load().N())
+				}
+			})
+		}
+	}, grabtest.ContentLength(size))
+}
+
+// TestBatch executes multiple requests simultaneously and validates the
+// responses.
+func TestBatch(t *testing.T) {
+	tests := 32
+	size := 32768
+	sum := grabtest.MustHexDecodeString("e11360251d1173650cdcd20f111d8f1ca2e412f572e8b36a4dc067121c1799b8")
+
+	// test with 4 workers and with one per request
+	grabtest.WithTestServer(t, func(url string) {
+		for _, workerCount := range []int{4, 0} {
+			// create requests
+			reqs := make([]*Request, tests)
+			for i := 0; i < len(reqs); i++ {
+				filename := fmt.Sprintf(".testBatch.%d", i+1)
+				reqs[i] = mustNewRequest(filename, url+fmt.Sprintf("/request_%d?", i+1))
+				reqs[i].Label = fmt.Sprintf("Test %d", i+1)
+				reqs[i].SetChecksum(sha256.New(), sum, false)
+			}
+
+			// batch run
+			responses := DefaultClient.DoBatch(workerCount, reqs...)
+
+			// listen for responses
+		Loop:
+			for i := 0; i < len(reqs); {
+				select {
+				case resp := <-responses:
+					if resp == nil {
+						break Loop
+					}
+					testComplete(t, resp)
+					if err := resp.Err(); err != nil {
+						t.Errorf("%s: %v", resp.Filename, err)
+					}
+
+					// remove test file
+					if resp.IsComplete() {
+						os.Remove(resp.Filename) // ignore errors
+					}
+					i++
+				}
+			}
+		}
+	},
+		grabtest.ContentLength(size),
+	)
+}
+
+// TestBatchSmallFileOptimization ensures that a batch with
+// BatchOptions.SmallFileOptimization downloads the same files without sending
+// HEAD requests for destinations that do not exist, and that each worker keeps
+// to one host while it has requests left.
+func TestBatchSmallFileOptimization(t *testing.T) {
+	tests := 16
+	size := 32768
+	sum := grabtest.MustHexDecodeString("e11360251d1173650cdcd20f111d8f1ca2e412f572e8b36a4dc067121c1799b8")
+	dir := ".testBatchSmallFileOptimization"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var heads, gets int32
+	count := grabtest.StatusCode(func(r *http.Request) int {
+		if r.Method == "HEAD" {
+			atomic.AddInt32(&heads, 1)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		return http.StatusOK
+	})
+	grabtest.WithTestServer(t, func(url1 string) {
+		grabtest.WithTestServer(t, func(url2 string) {
+			reqs := make([]*Request, tests)
+			for i := range reqs {
+				url := url1
+				if i%2 == 1 {
+					url = url2
+				}
+				reqs[i] = mustNewRequest(dir, fmt.Sprintf("%s/file_%d", url, i))
+				reqs[i].SetChecksum(sha256.New(), sum, false)
+			}
+			opts := BatchOptions{Workers: 2, SmallFileOptimization: true}
+			for resp := range DefaultClient.DoBatchWithOptions(opts, reqs...) {
+				testComplete(t, resp)
+				if err := resp.Err(); err != nil {
+					t.Errorf("%s: %v", resp.Filename, err)
+				}
+			}
+			if n := atomic.LoadInt32(&heads); n != 0 {
+				t.Errorf("expected no HEAD requests, got %d", n)
+			}
+			if n := atomic.LoadInt32(&gets); n != int32(tests) {
+				t.Errorf("expected %d GET requests, got %d", tests, n)
+			}
+			for i := range reqs {
+				fi, err := os.Stat(filepath.Join(dir, fmt.Sprintf("file_%d", i)))
+				if err != nil || fi.Size() != int64(size) {
+					t.Errorf("expected file %d of %d bytes, got: %v", i, size, err)
+				}
+			}
+
+			// existing files are checked once they are known
+			atomic.StoreInt32(&heads, 0)
+			req := mustNewRequest(dir, url1+"/file_0")
+			req.SkipExisting = true
+			for resp := range DefaultClient.DoBatchWithOptions(opts, req) {
+				if err := resp.Err(); err != ErrFileExists {
+					t.Errorf("expected %v, got: %v", ErrFileExists, err)
+				}
+			}
+			if n := atomic.LoadInt32(&heads); n != 1 {
+				t.Errorf("expected a HEAD request for an existing file, got %d", n)
+			}
+		}, grabtest.ContentLength(size), count)
+	}, grabtest.ContentLength(size), count)
+
+	t.Run("WithContentDisposition", func(t *testing.T) {
+		// the file that exists is only known from the response
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(dir, url+"/other")
+			req.SkipExisting = true
+			opts := BatchOptions{SmallFileOptimization: true}
+			for resp := range DefaultClient.DoBatchWithOptions(opts, req) {
+				if err := resp.Err(); err != ErrFileExists || resp.SkipReason != SkipFileExists {
+					t.Errorf("expected %v, got: %v", ErrFileExists, err)
+				}
+			}
+		}, grabtest.ContentLength(size), grabtest.AttachmentFilename("file_1"))
+	})
+
+	t.Run("HostAffinity", func(t *testing.T) {
+		var reqs []*Request
+		for i := 0; i < 6; i++ {
+			reqs = append(reqs, mustNewRequest("", fmt.Sprintf("http://host%d/file_%d", i%2, i)))
+		}
+		q := newHostQueue(reqs)
+		hosts := make([]string, 2)
+		for i := 0; i < 6; i++ {
+			w := i % 2
+			req, host, ok := q.next(hosts[w])
+			if !ok {
+				t.Fatalf("expected request %d", i)
+			}
+			if hosts[w] != "" && host != hosts[w] {
+				t.Errorf("expected worker %d to keep to %s, got %s", w, hosts[w], host)
+			}
+			if req.URL().Host != host {
+				t.Errorf("expected request for %s, got %s", host, req.URL())
+			}
+			hosts[w] = host
+		}
+		if hosts[0] == hosts[1] {
+			t.Errorf("expected workers to use different hosts, got %s", hosts[0])
+		}
+		if _, _, ok := q.next(hosts[0]); ok {
+			t.Errorf("expected no requests left")
+		}
+	})
+}
+
+// TestBatchPriority ensures that DoBatch and DoChannel start queued requests
+// with the highest Request.Priority first, in the order they were queued for
+// equal priorities.
+func TestBatchPriority(t *testing.T) {
+	priorities := []int{0, 5, -1, 10, 5, 0}
+	expect := []string{"3", "1", "4", "0", "5", "2"}
+
+	newRequests := func(url string) []*Request {
+		reqs := make([]*Request, len(priorities))
+		for i := range reqs {
+			reqs[i] = mustNewRequest("", fmt.Sprintf("%s/.testBatchPriority%d", url, i))
+			reqs[i].Label = fmt.Sprintf("%d", i)
+			reqs[i].Priority = priorities[i]
+			reqs[i].NoStore = true
+		}
+		return reqs
+	}
+	checkOrder := func(t *testing.T, labels []string) {
+		t.Helper()
+		if fmt.Sprint(labels) != fmt.Sprint(expect) {
+			t.Errorf("expected start order: %v, got: %v", expect, labels)
+		}
+	}
+
+	t.Run("DoBatch", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var labels []string
+			for resp := range DefaultClient.DoBatch(1, newRequests(url)...) {
+				if err := resp.Err(); err != nil {
+					t.Errorf("%s: %v", resp.Request.URL(), err)
+				}
+				labels = append(labels, resp.Request.Label)
+			}
+			checkOrder(t, labels)
+		})
+	})
+
+	t.Run("DoChannel", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			// one worker for each request, so that every request can be
+			// queued while the workers are busy
+			workers := len(priorities)
+			client := NewClient()
+			reqch := make(chan *Request)
+			respch := make(chan *Response, 2*workers)
+			wg := sync.WaitGroup{}
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					client.DoChannel(reqch, respch)
+					wg.Done()
+				}()
+			}
+			go func() {
+				wg.Wait()
+				close(respch)
+			}()
+
+			// block every worker until all requests are queued
+			release := make(chan struct{})
+			blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "1")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+				w.Write([]byte{0})
+			}))
+			defer blocked.Close()
+			for i := 0; i < workers; i++ {
+				req := mustNewRequest("", fmt.Sprintf("%s/.testBatchPriorityBlocked%d", blocked.URL, i))
+				req.NoStore = true
+				reqch <- req
+				<-(<-respch).MetadataReady()
+			}
+			for _, req := range newRequests(url) {
+				reqch <- req
+			}
+			close(reqch)
+
+			// free a single worker, which starts all queued requests
+			release <- struct{}{}
+			var labels []string
+			for len(labels) < len(priorities) {
+				resp := <-respch
+				if err := resp.Err(); err != nil {
+					t.Errorf("%s: %v", resp.Request.URL(), err)
+				}
+				labels = append(labels, resp.Request.Label)
+			}
+			close(release)
+			for range respch {
+			}
+			checkOrder(t, labels)
+		})
+	})
+}
+
+// TestDoChannelBackpressure ensures that DoChannel only receives one request
+// per worker while its workers are busy.
+func TestDoChannelBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte{0})
+	}))
+	defer blocked.Close()
+
+	client := NewClient()
+	reqch := make(chan *Request)
+	respch := make(chan *Response, 3)
+	done := make(chan struct{})
+	go func() {
+		client.DoChannel(reqch, respch)
+		close(done)
+	}()
+	newRequest := func(i int) *Request {
+		req := mustNewRequest("", fmt.Sprintf("%s/.testDoChannelBackpressure%d", blocked.URL, i))
+		req.NoStore = true
+		return req
+	}
+
+	// the first request keeps the only worker busy and the second is queued
+	reqch <- newRequest(0)
+	<-(<-respch).MetadataReady()
+	reqch <- newRequest(1)
+	select {
+	case reqch <- newRequest(2):
+		t.Errorf("expected send to block while the worker is busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	reqch <- newRequest(2)
+	close(reqch)
+	<-done
+	close(respch)
+	n := 1
+	for resp := range respch {
+		n++
+		if err := resp.Err(); err != nil {
+			t.Errorf("%s: %v", resp.Request.URL(), err)
+		}
+	}
+	if n != 3 {
+		t.Errorf("expected 3 responses, got %d", n)
+	}
+}
+
+// TestBatchPanic ensures that a panic in a hook fails only the transfer in
+// which it occurred, unless Client.PropagatePanics is set.
+func TestBatchPanic(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, 4)
+		for i := 0; i < len(reqs); i++ {
+			reqs[i] = mustNewRequest("", fmt.Sprintf("%s/.testBatchPanic%d", url, i))
+			reqs[i].Label = fmt.Sprintf("%d", i)
+			reqs[i].NoStore = true
+		}
+		reqs[1].BeforeCopy = func(resp *Response) error {
+			panic("boom")
+		}
+
+		// a single worker must survive the panic to transfer the rest
+		for resp := range NewClient().DoBatch(1, reqs...) {
+			err := resp.Err()
+			if resp.Request.Label != "1" {
+				if err != nil {
+					t.Errorf("%s: %v", resp.Request.URL(), err)
+				}
+				continue
+			}
+			var perr *PanicError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected *PanicError, got: %v", err)
+			}
+			if perr.Value != "boom" {
+				t.Errorf("expected panic value: %q, got: %v", "boom", perr.Value)
+			}
+			if !bytes.Contains(perr.Stack, []byte("TestBatchPanic")) {
+				t.Errorf("expected stack to include the panicking hook:\n%s", perr.Stack)
+			}
+		}
+	})
+
+	t.Run("WithPropagatePanics", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			client := NewClient()
+			client.PropagatePanics = true
+			req := mustNewRequest("", url+"/.testBatchPanic")
+			req.NoStore = true
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				panic("boom")
+			}
+			defer func() {
+				if v := recover(); v != "boom" {
+					t.Errorf("expected panic value: %q, got: %v", "boom", v)
+				}
+			}()
+			client.Do(req)
+			t.Errorf("expected panic")
+		})
+	})
+}
+
+// TestOnFinish ensures that Request.OnFinish is called exactly once when a
+// transfer completes, however it completes.
+func TestOnFinish(t *testing.T) {
+	// onFinish returns a Request with an OnFinish callback that counts its
+	// calls and checks that the Response is complete.
+	onFinish := func(t *testing.T, url string, calls *int32) *Request {
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		req.OnFinish = func(resp *Response) {
+			atomic.AddInt32(calls, 1)
+			if !resp.IsComplete() {
+				t.Errorf("expected Response to be complete")
+			}
+		}
+		return req
+	}
+	check := func(t *testing.T, calls *int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(calls); n != 1 {
+			t.Errorf("expected OnFinish to be called once, got %d calls", n)
+		}
+	}
+
+	t.Run("WithSuccess", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var calls int32
+			testComplete(t, mustDo(onFinish(t, url+"/.testOnFinish", &calls)))
+			check(t, &calls)
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		var calls int32
+		req := onFinish(t, "http://127.0.0.1:0/.testOnFinish", &calls)
+		if err := DefaultClient.Do(req).Err(); err == nil {
+			t.Errorf("expected error")
+		}
+		check(t, &calls)
+	})
+
+	t.Run("WithCancel", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var calls int32
+			ctx, cancel := context.WithCancel(context.Background())
+			req := onFinish(t, url+"/.testOnFinish", &calls).WithContext(ctx)
+			req.BeforeCopy = func(*Response) error {
+				cancel()
+				return nil
+			}
+			if err := DefaultClient.Do(req).Err(); !errors.Is(err, context.Canceled) {
+				t.Errorf("expected error: %v, got: %v", context.Canceled, err)
+			}
+			check(t, &calls)
+		})
+	})
+
+	t.Run("WithPropagatePanics", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var calls int32
+			client := NewClient()
+			client.PropagatePanics = true
+			req := onFinish(t, url+"/.testOnFinish", &calls)
+			req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+				panic("boom")
+			}
+			func() {
+				defer func() {
+					if v := recover(); v != "boom" {
+						t.Errorf("expected panic value: %q, got: %v", "boom", v)
+					}
+				}()
+				client.Do(req)
+				t.Errorf("expected panic")
+			}()
+			check(t, &calls)
+		})
+	})
+
+	t.Run("WithPanicInOnFinish", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/.testOnFinish")
+			req.NoStore = true
+			req.OnFinish = func(*Response) {
+				panic("boom")
+			}
+			resp := mustDo(req)
+			testComplete(t, resp)
+
+			// the warning is recorded once the transfer is complete
+			var warnings []Warning
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				if warnings = resp.Warnings(); len(warnings) > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if len(warnings) != 1 || warnings[0].Code != WarnOnFinishPanic {
+				t.Errorf("expected a single %s warning, got: %v", WarnOnFinishPanic, warnings)
+			}
+		})
+	})
+}
+
+// TestActiveAndQueuedTransfers ensures that the number of active and queued
+// transfers reported by a Client reflect the state of a running batch.
+func TestActiveAndQueuedTransfers(t *testing.T) {
+	tests := 6
+	workers := 2
+	client := NewClient()
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, tests)
+		for i := 0; i < tests; i++ {
+			reqs[i] = mustNewRequest("", fmt.Sprintf("%s/.testActiveTransfers%d", url, i))
+		}
+		respch := client.DoBatch(workers, reqs...)
+
+		// wait for all workers to have received a request
+		time.Sleep(100 * time.Millisecond)
+		if n := client.ActiveTransfers(); n != workers {
+			t.Errorf("expected %d active transfers, got %d", workers, n)
+		}
+		if n := client.QueuedTransfers(); n != tests-workers {
+			t.Errorf("expected %d queued transfers, got %d", tests-workers, n)
+		}
+		for resp := range respch {
+			if err := resp.Err(); err != nil {
+				t.Error(err)
+			}
+			os.Remove(resp.Filename)
+			if n := client.ActiveTransfers(); n > workers {
+				t.Errorf("expected at most %d active transfers, got %d", workers, n)
+			}
+		}
+		if n := client.ActiveTransfers(); n != 0 {
+			t.Errorf("expected no active transfers, got %d", n)
+		}
+		if n := client.QueuedTransfers(); n != 0 {
+			t.Errorf("expected no queued transfers, got %d", n)
+		}
+	},
+		grabtest.ContentLength(1024),
+		grabtest.TimeToFirstByte(200*time.Millisecond),
+	)
+}
+
+// TestMaxConcurrentTransfers ensures that transfers in excess of
+// Client.MaxConcurrentTransfers are held in StatePending until a transfer slot
+// becomes available, and that pending transfers can be canceled.
+func TestMaxConcurrentTransfers(t *testing.T) {
+	max := 2
+	tests := 5
+	client := NewClient()
+	client.MaxConcurrentTransfers = max
+
+	grabtest.WithTestServer(t, func(url string) {
+		resps := make([]*Response, tests)
+		for i := 0; i < tests; i++ {
+			filename := fmt.Sprintf(".testMaxConcurrentTransfers%d", i)
+			resps[i] = client.Do(mustNewRequest(filename, url))
+			defer os.Remove(filename)
+		}
+		if n := client.ActiveTransfers(); n != max {
+			t.Errorf("expected %d active transfers, got %d", max, n)
+		}
+		if n := client.QueueLength(); n != tests-max {
+			t.Errorf("expected %d pending transfers, got %d", tests-max, n)
+		}
+		for _, resp := range resps[max:] {
+			if state := resp.State(); state != StatePending {
+				t.Errorf("expected state: %v, got: %v", StatePending, state)
+			}
+			if resp.IsComplete() {
+				t.Errorf("expected pending transfer to be incomplete")
+			}
+			if n := resp.BytesComplete(); n != 0 {
+				t.Errorf("expected 0 bytes completed for pending transfer, got %d", n)
+			}
+		}
+
+		// cancel the last pending transfer
+		done := make(chan error)
+		go func() {
+			done <- resps[tests-1].Cancel(nil)
+		}()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("expected error: %v, got: %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("pending response was not cancelled within 1s")
+		}
+		if n := client.QueueLength(); n != tests-max-1 {
+			t.Errorf("expected %d pending transfers, got %d", tests-max-1, n)
+		}
+
+		// remaining transfers should complete
+		for _, resp := range resps[:tests-1] {
+			if err := resp.Err(); err != nil {
+				t.Error(err)
+			}
+			if state := resp.State(); state != StateComplete {
+				t.Errorf("expected state: %v, got: %v", StateComplete, state)
+			}
+			if n := client.ActiveTransfers(); n > max {
+				t.Errorf("expected at most %d active transfers, got %d", max, n)
+			}
+		}
+		if n := client.ActiveTransfers() + client.QueueLength(); n != 0 {
+			t.Errorf("expected no active or pending transfers, got %d", n)
+		}
+	},
+		grabtest.ContentLength(1024),
+		grabtest.RateLimiter(8192),
+	)
+}
+
+// TestMetadataReady ensures that the metadata of a Response is known when Do
+// returns, or once Response.MetadataReady is closed for pending transfers.
+func TestMetadataReady(t *testing.T) {
+	size := 1024
+	client := NewClient()
+	client.MaxConcurrentTransfers = 1
+
+	grabtest.WithTestServer(t, func(url string) {
+		resps := make([]*Response, 2)
+		for i := range resps {
+			req := mustNewRequest(".", fmt.Sprintf("%s/.testMetadataReady%d", url, i))
+			resps[i] = client.Do(req)
+		}
+		select {
+		case <-resps[0].MetadataReady():
+		default:
+			t.Fatal("expected metadata to be ready when Do returns")
+		}
+		if state := resps[1].State(); state != StatePending {
+			t.Fatalf("expected state: %v, got: %v", StatePending, state)
+		}
+		for i, resp := range resps {
+			select {
+			case <-resp.MetadataReady():
+			case <-time.After(5 * time.Second):
+				t.Fatal("metadata was not ready within 5s")
+			}
+			expect := fmt.Sprintf(".testMetadataReady%d", i)
+			defer os.Remove(expect)
+			if resp.Filename != expect {
+				t.Errorf("expected Response.Filename: %q, got: %q", expect, resp.Filename)
+			}
+			if resp.Size() != int64(size) {
+				t.Errorf("expected Response.Size: %d, got: %d", size, resp.Size())
+			}
+			if err := resp.Err(); err != nil {
+				t.Error(err)
+			}
+		}
+	},
+		grabtest.ContentLength(size),
+		grabtest.RateLimiter(8192),
+	)
+}
+
+// TestCancelContext tests that a batch of requests can be cancel using a
+// context.Context cancellation. Requests are cancelled in multiple states:
+// in-progress and unstarted.
+func TestCancelContext(t *testing.T) {
+	fileSize := 134217728
+	tests := 256
+	client := NewClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, tests)
+		for i := 0; i < tests; i++ {
+			req := mustNewRequest("", fmt.Sprintf("%s/.testCancelContext%d", url, i))
+			reqs[i] = req.WithContext(ctx)
+		}
+
+		respch := client.DoBatch(8, reqs...)
+		time.Sleep(time.Millisecond * 500)
+		cancel()
+		for resp := range respch {
+			defer os.Remove(resp.Filename)
+
+			// err should be context.Canceled or http.errRequestCanceled
+			if resp.Err() == nil || !strings.Contains(resp.Err().Error(), "canceled") {
+				t.Errorf("expected '%v', got '%v'", context.Canceled, resp.Err())
+			}
+			if resp.BytesComplete() >= int64(fileSize) {
+				t.Errorf("expected Response.BytesComplete: < %d, got: %d", fileSize, resp.BytesComplete())
+			}
+		}
+	},
+		grabtest.ContentLength(fileSize),
+	)
+}
+
+// TestCancelHangingResponse tests that a never ending request is terminated
+// when the response is cancelled.
+func TestCancelHangingResponse(t *testing.T) {
+	fileSize := 10
+	client := NewClient()
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", fmt.Sprintf("%s/.testCancelHangingResponse", url))
+
+		resp := client.Do(req)
+		defer os.Remove(resp.Filename)
+
+		// Wait for some bytes to be transferred
+		for resp.BytesComplete() == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- resp.Cancel(nil)
+		}()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("Expected context.Canceled error, go: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("response was not cancelled within 1s")
+		}
+		if resp.BytesComplete() == int64(fileSize) {
+			t.Error("download was not supposed to be complete")
+		}
+	},
+		grabtest.RateLimiter(1),
+		grabtest.ContentLength(fileSize),
+	)
+}
+
+// TestCancelStalledResponse tests that a transfer blocked reading a stalled
+// response body is terminated promptly when the response is cancelled, and that
+// the partial file is closed before Response.Done is closed.
+func TestCancelStalledResponse(t *testing.T) {
+	client := NewClient()
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(".testCancelStalledResponse", url)
+		resp := client.Do(req)
+		defer os.Remove(resp.Filename)
+
+		// give the transfer time to block on the stalled body
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		done := make(chan error)
+		go func() {
+			done <- resp.Cancel(nil)
+		}()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("expected error: %v, got: %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("stalled response was not cancelled within 1s")
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("expected cancellation within 500ms, took %v", d)
+		}
+		if resp.writer != nil {
+			t.Error("expected destination file to be closed")
+		}
+		if _, err := os.Stat(resp.Filename); err != nil {
+			t.Errorf("expected partial file to exist: %v", err)
+		}
+	},
+		grabtest.HeaderBodyDelay(time.Minute),
+	)
+}
+
+// TestCancelReason tests that a single transfer of a batch can be canceled with
+// a reason, and that canceling is idempotent.
+func TestCancelReason(t *testing.T) {
+	reason := errors.New("skipped by user")
+	tests := 3
+	client := NewClient()
+
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, tests)
+		for i := 0; i < tests; i++ {
+			reqs[i] = mustNewRequest("", fmt.Sprintf("%s/.testCancelReason%d", url, i))
+		}
+		// the other transfers are only waited for once the batch is drained, so
+		// that the first is still in progress when it is canceled
+		canceled := 0
+		respch := client.DoBatch(tests, reqs...)
+		for resp := range respch {
+			if resp.Request.URL().String() != reqs[0].URL().String() {
+				defer func(resp *Response) {
+					if err := resp.Err(); err != nil {
+						t.Errorf("expected transfer to complete, got: %v", err)
+					}
+					os.Remove(resp.Filename)
+				}(resp)
+				continue
+			}
+
+			canceled++
+			err := resp.Cancel(reason)
+			defer os.Remove(resp.Filename)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected error to wrap: %v, got: %v", context.Canceled, err)
+			}
+			if !errors.Is(err, reason) {
+				t.Errorf("expected error to wrap: %v, got: %v", reason, err)
+			}
+
+			// subsequent calls are no-ops
+			if err2 := resp.Cancel(errors.New("other")); err2 != err {
+				t.Errorf("expected error: %v, got: %v", err, err2)
+			}
+		}
+		if canceled != 1 {
+			t.Errorf("expected 1 canceled transfer, got: %d", canceled)
+		}
+	},
+		grabtest.ContentLength(1024),
+		grabtest.RateLimiter(4096),
+	)
+}
+
+// TestPerTransferTimeout ensures that transfers which take longer than
+// Client.PerTransferTimeout fail with ErrTransferTimeout.
+func TestPerTransferTimeout(t *testing.T) {
+	client := NewClient()
+	client.PerTransferTimeout = 100 * time.Millisecond
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(".testPerTransferTimeout", url)
+		req.RemovePartialOnCancel = true
+		err := client.Do(req).Err()
+		if !errors.Is(err, ErrTransferTimeout) {
+			t.Errorf("expected error: %v, got: %v", ErrTransferTimeout, err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error to wrap: %v, got: %v", context.DeadlineExceeded, err)
+		}
+	},
+		grabtest.HeaderBodyDelay(time.Minute),
+	)
+
+	t.Run("WithFastTransfer", func(t *testing.T) {
+		client := NewClient()
+		client.PerTransferTimeout = time.Minute
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/.testPerTransferTimeoutFast")
+			resp := client.Do(req)
+			defer os.Remove(resp.Filename)
+			if err := resp.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+}
+
+// TestBatchDeadline ensures that transfers of a batch that are in progress or
+// not yet started at BatchOptions.Deadline fail with ErrBatchDeadline.
+func TestBatchDeadline(t *testing.T) {
+	tests := 3
+	client := NewClient()
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, tests)
+		for i := 0; i < tests; i++ {
+			reqs[i] = mustNewRequest("", fmt.Sprintf("%s/.testBatchDeadline%d", url, i))
+			reqs[i].RemovePartialOnCancel = true
+		}
+		start := time.Now()
+		respch := client.DoBatchWithOptions(BatchOptions{
+			Workers:  1,
+			Deadline: start.Add(100 * time.Millisecond),
+		}, reqs...)
+		n := 0
+		for resp := range respch {
+			n++
+			err := resp.Err()
+			if !errors.Is(err, ErrBatchDeadline) {
+				t.Errorf("expected error: %v, got: %v", ErrBatchDeadline, err)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected error to wrap: %v, got: %v", context.DeadlineExceeded, err)
+			}
+		}
+		if n != tests {
+			t.Errorf("expected %d responses, got: %d", tests, n)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("expected batch to stop at its deadline, took %v", d)
+		}
+	},
+		grabtest.HeaderBodyDelay(time.Minute),
+	)
+}
+
+// TestDetectProxyInterference ensures that responses that may have been
+// altered by a proxy raise warnings, or fail if Request.FailOnInterference is
+// set.
+func TestDetectProxyInterference(t *testing.T) {
+	client := NewClient()
+	client.DetectProxyInterference = true
+	etagByMethod := grabtest.ETagFunc(func(req *http.Request) string {
+		return `"` + req.Method + `"`
+	})
+	tests := []struct {
+		Name     string
+		Options  []grabtest.HandlerOption
+		Warnings int
+	}{
+		{"NoProxy", nil, 0},
+		{"WithVia", []grabtest.HandlerOption{grabtest.Header("Via", "1.1 proxy")}, 1},
+		{"WithXCache", []grabtest.HandlerOption{grabtest.Header("X-Cache", "HIT")}, 1},
+		{"WithChangedETag", []grabtest.HandlerOption{etagByMethod}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url+"/.testDetectProxyInterference")
+				resp := client.Do(req)
+				defer os.Remove(resp.Filename)
+				if err := resp.Err(); err != nil {
+					t.Fatal(err)
+				}
+				warnings := resp.Warnings()
+				if len(warnings) != test.Warnings {
+					t.Fatalf("expected %d warnings, got: %v", test.Warnings, warnings)
+				}
+				for _, w := range warnings {
+					if w.Code != WarnProxyInterference {
+						t.Errorf("expected warning code: %s, got: %s", WarnProxyInterference, w.Code)
+					}
+				}
+
+				// escalate to an error
+				req = mustNewRequest("", url+"/.testDetectProxyInterferenceFail")
+				req.FailOnInterference = true
+				resp = client.Do(req)
+				defer os.Remove(resp.Filename)
+				err := resp.Err()
+				if test.Warnings > 0 && !errors.Is(err, ErrProxyInterference) {
+					t.Errorf("expected error: %v, got: %v", ErrProxyInterference, err)
+				}
+			}, test.Options...)
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest("", url+"/.testDetectProxyInterferenceDisabled"))
+			defer os.Remove(resp.Filename)
+			if w := resp.Warnings(); len(w) != 0 {
+				t.Errorf("expected no warnings, got: %v", w)
+			}
+		}, grabtest.Header("Via", "1.1 proxy"))
+	})
+}
+
+// newDroppingServer returns a server of the given content that drops the
+// connection after sending chunk bytes of each of the first drops responses.
+// Ranged requests are supported.
+func newDroppingServer(content []byte, chunk, drops int) (*httptest.Server, *int32) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if int(n) > drops {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		// send the headers of the full response, but only part of the body
+		rec := httptest.NewRecorder()
+		rec.Header().Set("ETag", `"v1"`)
+		http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(content))
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		body := rec.Body.Bytes()
+		if len(body) > chunk {
+			body = body[:chunk]
+		}
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	return s, &requests
+}
+
+// TestMaxReconnects ensures that transfers reconnect and continue from the
+// current offset if the connection drops while the body is being read.
+func TestMaxReconnects(t *testing.T) {
+	filename := ".testMaxReconnects"
+	defer os.Remove(filename)
+	size := 1 << 16
+	content := testContent(size)
+
+	tests := []struct {
+		Name          string
+		Drops         int
+		MaxReconnects int
+		Err           bool
+	}{
+		{"NoDrops", 0, 3, false},
+		{"WithDrops", 3, 3, false},
+		{"WithTooManyDrops", 4, 3, true},
+		{"WithoutReconnects", 1, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			s, requests := newDroppingServer(content, size/8, test.Drops)
+			defer s.Close()
+
+			req := mustNewRequest(filename, s.URL)
+			req.NoResume = true
+			req.MaxReconnects = test.MaxReconnects
+			req.Backoff = ConstantBackoff(time.Millisecond)
+			resp := DefaultClient.Do(req)
+			err := resp.Err()
+			if test.Err {
+				if err == nil {
+					t.Error("expected error after too many connection failures")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := resp.Reconnects(); n != test.Drops {
+				t.Errorf("expected %d reconnects, got: %d", test.Drops, n)
+			}
+			if n := atomic.LoadInt32(requests); int(n) != test.Drops+1 {
+				t.Errorf("expected %d requests, got: %d", test.Drops+1, n)
+			}
+			if n := resp.BytesComplete(); n != int64(size) {
+				t.Errorf("expected %d bytes complete, got: %d", size, n)
+			}
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Error("downloaded file does not match the remote file")
+			}
+		})
+	}
+}
+
+// TestSetSocketOptions ensures that the function set by SetSocketOptions is
+// called for the sockets of the Client.
+func TestSetSocketOptions(t *testing.T) {
+	client := NewClient()
+	var calls int32
+	err := client.SetSocketOptions(func(network, address string, conn syscall.RawConn) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		if err := client.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&calls) == 0 {
+			t.Error("expected socket options function to be called")
+		}
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		client := NewClient()
+		expect := errors.New("socket options")
+		if err := client.SetSocketOptions(func(string, string, syscall.RawConn) error {
+			return expect
+		}); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			if err := client.Do(req).Err(); !errors.Is(err, expect) {
+				t.Errorf("expected error: %v, got: %v", expect, err)
+			}
+		})
+	})
+
+	t.Run("WithCustomHTTPClient", func(t *testing.T) {
+		client := &Client{HTTPClient: &http.Client{Transport: roundTripperFunc(nil)}}
+		if err := client.SetSocketOptions(nil); err == nil {
+			t.Error("expected error setting socket options of a custom transport")
+		}
+	})
+}
+
+// TestNestedDirectory tests that missing subdirectories are created.
+func TestNestedDirectory(t *testing.T) {
+	dir := "./.testNested/one/two/three"
+	filename := ".testNestedFile"
+	expect := dir + "/" + filename
+
+	t.Run("Create", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(expect, url+"/"+filename))
+			defer os.RemoveAll("./.testNested/")
+			if resp.Filename != expect {
+				t.Errorf("expected nested Request.Filename to be %v, got %v", expect, resp.Filename)
+			}
+		})
+	})
+
+	t.Run("No create", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(expect, url+"/"+filename)
+			req.NoCreateDirectories = true
+			resp := DefaultClient.Do(req)
+			err := resp.Err()
+			if !os.IsNotExist(err) {
+				t.Errorf("expected: %v, got: %v", os.ErrNotExist, err)
+			}
+		})
+	})
+
+	t.Run("WithMaxCreateDirDepth", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(expect, url+"/"+filename)
+			req.MaxCreateDirDepth = 3
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); !errors.Is(err, ErrDirDepth) {
+				t.Errorf("expected: %v, got: %v", ErrDirDepth, err)
+			}
+			if _, err := os.Stat("./.testNested"); !os.IsNotExist(err) {
+				t.Errorf("expected no directories to be created, got: %v", err)
+			}
+
+			req = mustNewRequest(expect, url+"/"+filename)
+			req.MaxCreateDirDepth = 4
+			defer os.RemoveAll("./.testNested/")
+			testComplete(t, mustDo(req))
+		})
+	})
+}
+
+// TestRemoteTime tests that the timestamp of the downloaded file can be set
+// according to the timestamp of the remote file.
+func TestRemoteTime(t *testing.T) {
+	filename := "./.testRemoteTime"
+	defer os.Remove(filename)
+
+	// random time between epoch and now
+	expect := time.Unix(rand.Int63n(time.Now().Unix()), 0)
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		fi, err := os.Stat(resp.Filename)
+		if err != nil {
+			panic(err)
+		}
+		actual := fi.ModTime()
+		if !actual.Equal(expect) {
+			t.Errorf("expected %v, got %v", expect, actual)
+		}
+	},
+		grabtest.LastModified(expect),
+	)
+
+	t.Run("WithIgnoreRemoteTime", func(t *testing.T) {
+		os.Remove(filename)
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.IgnoreRemoteTime = true
+			resp := mustDo(req)
+			fi, err := os.Stat(resp.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.ModTime().Before(resp.Start.Add(-time.Second)) {
+				t.Errorf("expected local time, got %v", fi.ModTime())
+			}
+		},
+			grabtest.LastModified(expect),
+		)
+	})
+
+	t.Run("WithBadChecksum", func(t *testing.T) {
+		os.Remove(filename)
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), make([]byte, sha256.Size), false)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Fatalf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+			fi, err := os.Stat(resp.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.ModTime().Equal(expect) {
+				t.Errorf("expected local time for file that failed verification")
+			}
+		},
+			grabtest.LastModified(expect),
+		)
+	})
+
+	t.Run("WithPartialFile", func(t *testing.T) {
+		os.Remove(filename)
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			// cancel once the first bytes are written
+			resp := DefaultClient.Do(mustNewRequest(filename, url))
+			for resp.BytesComplete() == 0 && !resp.IsComplete() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := resp.Cancel(nil); err != context.Canceled {
+				t.Fatalf("expected error: %v, got: %v", context.Canceled, err)
+			}
+			fi, err := os.Stat(resp.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fi.ModTime().Equal(expect) {
+				t.Errorf("expected partial file time %v, got %v", expect, fi.ModTime())
+			}
+		},
+			grabtest.ContentLength(1024),
+			grabtest.RateLimiter(256),
+			grabtest.LastModified(expect),
+		)
+	})
+}
+
+func TestResponseCode(t *testing.T) {
+	filename := "./.testResponseCode"
+
+	t.Run("With404", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			resp := DefaultClient.Do(req)
+			expect := StatusCodeError(http.StatusNotFound)
+			err := resp.Err()
+			if err != expect {
+				t.Errorf("expected %v, got '%v'", expect, err)
+			}
+			if !IsStatusCodeError(err) {
+				t.Errorf("expected IsStatusCodeError to return true for %T: %v", err, err)
+			}
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("expected Response.StatusCode: %d, got: %d", http.StatusNotFound, resp.StatusCode)
+			}
+		},
+			grabtest.StatusCodeStatic(http.StatusNotFound),
+		)
+	})
+
+	t.Run("With200", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected Response.StatusCode: %d, got: %d", http.StatusOK, resp.StatusCode)
+			}
+			if resp.IsErrorStatus() {
+				t.Error("expected Response.IsErrorStatus to return false")
+			}
+		})
+	})
+
+	t.Run("WithIgnoreNon2XX", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.IgnoreBadStatusCodes = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Errorf("expected nil, got '%v'", err)
+			}
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("expected Response.StatusCode: %d, got: %d", http.StatusNotFound, resp.StatusCode)
+			}
+			if !resp.IsErrorStatus() {
+				t.Error("expected Response.IsErrorStatus to return true")
+			}
+			if resp.BytesComplete() == 0 {
+				t.Error("expected error response body to be downloaded")
+			}
+		},
+			grabtest.StatusCodeStatic(http.StatusNotFound),
+		)
+	})
+}
+
+// TestRequireHeaders ensures that transfers fail before anything is written if
+// the remote server does not send the headers in Request.RequireHeaders.
+func TestRequireHeaders(t *testing.T) {
+	filename := ".testRequireHeaders"
+	tests := []struct {
+		Name    string
+		Require map[string]string
+		Err     bool
+	}{
+		{"Present", map[string]string{"X-Content-Type-Options": "nosniff"}, false},
+		{"AnyValue", map[string]string{"x-signature": ""}, false},
+		{"Missing", map[string]string{"X-Missing": ""}, true},
+		{"Mismatched", map[string]string{"X-Signature": "def"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.RequireHeaders = test.Require
+				err := DefaultClient.Do(req).Err()
+				if !test.Err {
+					if err != nil {
+						t.Errorf("expected no error, got: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrBadHeader) {
+					t.Errorf("expected error: %v, got: %v", ErrBadHeader, err)
+				}
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("expected no file to be written, got: %v", err)
+				}
+			},
+				grabtest.Header("X-Content-Type-Options", "nosniff"),
+				grabtest.Header("X-Signature", "abc"),
+			)
+		})
+	}
+}
+
+// TestMaxBytes ensures that Request.MaxBytes limits the size of a transfer,
+// including the decompressed size of a compressed response.
+func TestMaxBytes(t *testing.T) {
+	filename := ".testMaxBytes"
+	defer os.Remove(filename)
+
+	t.Run("WithinLimit", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxBytes = 1024
+			testComplete(t, mustDo(req))
+		},
+			grabtest.ContentLength(1024),
+		)
+	})
+
+	t.Run("WithContentLength", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxBytes = 1023
+			req.NoResume = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrMaxBytes {
+				t.Errorf("expected error: %v, got: %v", ErrMaxBytes, err)
+			}
+			if n := resp.BytesComplete(); n != 0 {
+				t.Errorf("expected no bytes to be transferred, got %d", n)
+			}
+		},
+			grabtest.ContentLength(1024),
+		)
+	})
+
+	t.Run("WithTransparentDecompression", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxBytes = 65536
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrMaxBytes {
+				t.Errorf("expected error: %v, got: %v", ErrMaxBytes, err)
+			}
+			if !resp.HTTPResponse.Uncompressed {
+				t.Errorf("expected response to be decompressed")
+			}
+			if n := resp.BytesComplete(); n != 65536 {
+				t.Errorf("expected %d bytes to be transferred, got %d", 65536, n)
+			}
+		},
+			grabtest.Gzip(true),
+		)
+	})
+}
+
+// TestMaxCompressionRatio ensures that transfers fail if a compressed response
+// expands by more than Request.MaxCompressionRatio.
+func TestMaxCompressionRatio(t *testing.T) {
+	filename := ".testMaxCompressionRatio"
+	defer os.Remove(filename)
+
+	t.Run("WithinRatio", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxCompressionRatio = 10000
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if !resp.HTTPResponse.Uncompressed {
+				t.Errorf("expected response to be decompressed")
+			}
+			testComplete(t, resp)
+		},
+			grabtest.Gzip(true),
+		)
+	})
+
+	t.Run("ExceedsRatio", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxCompressionRatio = 10
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrCompressionRatio {
+				t.Errorf("expected error: %v, got: %v", ErrCompressionRatio, err)
+			}
+			if n := resp.BytesComplete(); n >= int64(grabtest.DefaultHandlerContentLength) {
+				t.Errorf("expected transfer to be aborted, got %d bytes", n)
+			}
+		},
+			grabtest.Gzip(true),
+		)
+	})
+
+	t.Run("WithoutCompression", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxCompressionRatio = 10
+			testComplete(t, mustDo(req))
+		})
+	})
+}
+
+func TestBeforeCopyHook(t *testing.T) {
+	filename := "./.testBeforeCopy"
+	t.Run("Noop", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			called := false
+			req := mustNewRequest(filename, url)
+			req.BeforeCopy = func(resp *Response) error {
+				called = true
+				if resp.IsComplete() {
+					t.Error("Response object passed to BeforeCopy hook has already been closed")
+				}
+				if resp.Progress() != 0 {
+					t.Error("Download progress already > 0 when BeforeCopy hook was called")
+				}
+				if resp.Duration() == 0 {
+					t.Error("Duration was zero when BeforeCopy was called")
+				}
+				if resp.BytesComplete() != 0 {
+					t.Error("BytesComplete already > 0 when BeforeCopy hook was called")
+				}
+				return nil
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error using BeforeCopy hook: %v", err)
+			}
+			testComplete(t, resp)
+			if !called {
+				t.Error("BeforeCopy hook was never called")
+			}
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			testError := errors.New("test")
+			req := mustNewRequest(filename, url)
+			req.BeforeCopy = func(resp *Response) error {
+				return testError
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != testError {
+				t.Errorf("expected error '%v', got '%v'", testError, err)
+			}
+			if resp.BytesComplete() != 0 {
+				t.Errorf("expected 0 bytes completed for canceled BeforeCopy hook, got %d",
+					resp.BytesComplete())
+			}
+			testComplete(t, resp)
+		})
+	})
+
+	t.Run("WithAbort", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			errQuota := errors.New("quota exceeded")
+			req := mustNewRequest(filename, url)
+			req.BeforeCopy = func(resp *Response) error {
+				return errQuota
+			}
+			if err := DefaultClient.Do(req).Err(); err != errQuota {
+				t.Errorf("expected error '%v', got '%v'", errQuota, err)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected no destination file to be created, got: %v", err)
+			}
+		})
+	})
+
+	t.Run("WithRedirect", func(t *testing.T) {
+		dir := ".testBeforeCopyRedirect"
+		defer os.RemoveAll(dir)
+		for _, test := range []struct {
+			Name                string
+			NoCreateDirectories bool
+		}{
+			{"Default", false},
+			{"WithNoCreateDirectories", true},
+		} {
+			t.Run(test.Name, func(t *testing.T) {
+				os.RemoveAll(dir)
+				grabtest.WithTestServer(t, func(url string) {
+					req := mustNewRequest(filename, url)
+					req.NoCreateDirectories = test.NoCreateDirectories
+					req.BeforeCopy = func(resp *Response) error {
+						// shard by prefix
+						resp.Filename = filepath.Join(dir, "ab", "file")
+						return nil
+					}
+					resp := DefaultClient.Do(req)
+					if test.NoCreateDirectories {
+						if err := resp.Err(); !os.IsNotExist(err) {
+							t.Errorf("expected not exist error, got: %v", err)
+						}
+						return
+					}
+					testComplete(t, resp)
+					if expect := filepath.Join(dir, "ab", "file"); resp.Filename != expect {
+						t.Errorf("expected Filename: %q, got: %q", expect, resp.Filename)
+					}
+					if _, err := os.Stat(filename); !os.IsNotExist(err) {
+						t.Errorf("expected original destination not to be created, got: %v", err)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("WithRedirectOfResumedTransfer", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		if err := os.WriteFile(filename, testContent(16), 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.BeforeCopy = func(resp *Response) error {
+				resp.Filename += ".other"
+				return nil
+			}
+			if err := DefaultClient.Do(req).Err(); err != ErrDestinationChanged {
+				t.Errorf("expected error '%v', got '%v'", ErrDestinationChanged, err)
+			}
+		})
+	})
+
+	// Assert that an existing local file will not be truncated prior to the
+	// BeforeCopy hook has a chance to cancel the request
+	t.Run("NoTruncate", func(t *testing.T) {
+		tfile, err := os.CreateTemp("", "grab_client_test.*.file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tfile.Name())
+
+		const size = 128
+		_, err = tfile.Write(bytes.Repeat([]byte("x"), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		grabtest.WithTestServer(t, func(url string) {
+			called := false
+			req := mustNewRequest(tfile.Name(), url)
+			req.NoResume = true
+			req.BeforeCopy = func(resp *Response) error {
+				called = true
+				fi, err := tfile.Stat()
+				if err != nil {
+					t.Errorf("failed to stat temp file: %v", err)
+					return nil
+				}
+				if fi.Size() != size {
+					t.Errorf("expected existing file size of %d bytes "+
+						"prior to BeforeCopy hook, got %d", size, fi.Size())
+				}
+				return nil
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error using BeforeCopy hook: %v", err)
+			}
+			testComplete(t, resp)
+			if !called {
+				t.Error("BeforeCopy hook was never called")
+			}
+		})
+	})
+}
+
+func TestAfterCopyHook(t *testing.T) {
+	filename := "./.testAfterCopy"
+	t.Run("Noop", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			called := false
 			req := mustNewRequest(filename, url)
-			req.BeforeCopy = func(resp *Response) error {
+			req.AfterCopy = func(resp *Response) error {
 				called = true
 				if resp.IsComplete() {
-					t.Error("Response object passed to BeforeCopy hook has already been closed")
+					t.Error("Response object passed to AfterCopy hook has already been closed")
 				}
-				if resp.Progress() != 0 {
-					t.Error("Download progress already > 0 when BeforeCopy hook was called")
+				if resp.Progress() <= 0 {
+					t.Error("Download progress was 0 when AfterCopy hook was called")
 				}
 				if resp.Duration() == 0 {
-					t.Error("Duration was zero when BeforeCopy was called")
+					t.Error("Duration was zero when AfterCopy was called")
 				}
-				if resp.BytesComplete() != 0 {
-					t.Error("BytesComplete already > 0 when BeforeCopy hook was called")
+				if resp.BytesComplete() <= 0 {
+					t.Error("BytesComplete was 0 when AfterCopy hook was called")
+				}
+				return nil
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error using AfterCopy hook: %v", err)
+			}
+			testComplete(t, resp)
+			if !called {
+				t.Error("AfterCopy hook was never called")
+			}
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			testError := errors.New("test")
+			req := mustNewRequest(filename, url)
+			req.AfterCopy = func(resp *Response) error {
+				return testError
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != testError {
+				t.Errorf("expected error '%v', got '%v'", testError, err)
+			}
+			if resp.BytesComplete() <= 0 {
+				t.Errorf("ByteCompleted was %d after AfterCopy hook was called",
+					resp.BytesComplete())
+			}
+			testComplete(t, resp)
+		})
+	})
+}
+
+func TestIssue37(t *testing.T) {
+	// ref: https://github.com/3JoB/grab/v3/issues/37
+	filename := "./.testIssue37"
+	largeSize := int64(2097152)
+	smallSize := int64(1048576)
+	defer os.RemoveAll(filename)
+
+	// download large file
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		if resp.Size() != largeSize {
+			t.Errorf("expected response size: %d, got: %d", largeSize, resp.Size())
+		}
+	}, grabtest.ContentLength(int(largeSize)))
+
+	// download new, smaller version of same file
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.NoResume = true
+		resp := mustDo(req)
+		if resp.Size() != smallSize {
+			t.Errorf("expected response size: %d, got: %d", smallSize, resp.Size())
+		}
+
+		// local file should have truncated and not resumed
+		if resp.DidResume {
+			t.Errorf("expected download to truncate, resumed instead")
+		}
+	}, grabtest.ContentLength(int(smallSize)))
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(smallSize) {
+		t.Errorf("expected file size %d, got %d", smallSize, fi.Size())
+	}
+}
+
+// TestHeadBadStatus validates that HEAD requests that return non-200 can be
+// ignored and succeed if the GET requests succeeeds.
+//
+// Fixes: https://github.com/3JoB/grab/v3/issues/43
+func TestHeadBadStatus(t *testing.T) {
+	expect := http.StatusOK
+	filename := ".testIssue43"
+
+	statusFunc := func(r *http.Request) int {
+		if r.Method == "HEAD" {
+			return http.StatusForbidden
+		}
+		return http.StatusOK
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		testURL := fmt.Sprintf("%s/%s", url, filename)
+		resp := mustDo(mustNewRequest("", testURL))
+		if resp.HTTPResponse.StatusCode != expect {
+			t.Errorf(
+				"expected status code: %d, got:% d",
+				expect,
+				resp.HTTPResponse.StatusCode)
+		}
+	},
+		grabtest.StatusCode(statusFunc),
+	)
+}
+
+// TestHeadNotAllowed ensures that the size and resumability of a remote file
+// are probed with a ranged request if the remote server does not support HEAD
+// requests, and that transfers fall back to a single request if ranges are not
+// supported either.
+func TestHeadNotAllowed(t *testing.T) {
+	size := 1024
+	filename := ".testHeadNotAllowed"
+	defer os.Remove(filename)
+
+	partial := make([]byte, size/2)
+	for i := range partial {
+		partial[i] = byte(i)
+	}
+
+	t.Run("WithRanges", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if !resp.CanResume {
+				t.Errorf("expected Response.CanResume to be true")
+			}
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if n := resp.bytesResumed.Load(); n != int64(len(partial)) {
+				t.Errorf("expected %d bytes resumed, got %d", len(partial), n)
+			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+			grabtest.MethodWhitelist("GET"),
+		)
+	})
+
+	t.Run("WithoutRanges", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
+			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+			grabtest.MethodWhitelist("GET"),
+			grabtest.AcceptRanges(false),
+		)
+	})
+}
+
+// TestMissingContentLength ensures that the Response.Size is correct for
+// transfers where the remote server does not send a Content-Length header.
+//
+// TestAutoResume also covers cases with checksum validation.
+//
+// Kudos to Setnička Jiří <Jiri.Setnicka@ysoft.com> for identifying and raising
+// a solution to this issue. Ref: https://github.com/3JoB/grab/v3/pull/27
+func TestMissingContentLength(t *testing.T) {
+	// expectSize must be sufficiently large that DefaultClient.Do won't prefetch
+	// the entire body and compute ContentLength before returning a Response.
+	expectSize := 1048576
+	opts := []grabtest.HandlerOption{
+		grabtest.ContentLength(expectSize),
+		grabtest.HeaderBlacklist("Content-Length"),
+		grabtest.TimeToFirstByte(time.Millisecond * 100), // delay for initial read
+	}
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(".testMissingContentLength", url)
+		req.SetChecksum(
+			md5.New(),
+			grabtest.DefaultHandlerMD5ChecksumBytes,
+			false)
+		resp := DefaultClient.Do(req)
+
+		// ensure remote server is not sending content-length header
+		if v := resp.HTTPResponse.Header.Get("Content-Length"); v != "" {
+			panic(fmt.Sprintf("http header content length must be empty, got: %s", v))
+		}
+		if v := resp.HTTPResponse.ContentLength; v != -1 {
+			panic(fmt.Sprintf("http response content length must be -1, got: %d", v))
+		}
+
+		// before completion, response size should be -1
+		if resp.Size() != -1 {
+			t.Errorf("expected response size: -1, got: %d", resp.Size())
+		}
+
+		// block for completion
+		if err := resp.Err(); err != nil {
+			panic(err)
+		}
+
+		// on completion, response size should be actual transfer size
+		if resp.Size() != int64(expectSize) {
+			t.Errorf("expected response size: %d, got: %d", expectSize, resp.Size())
+		}
+	}, opts...)
+}
+
+// TestContentAddressed ensures that transfers to a content-addressed store are
+// stored at the path derived from their checksum.
+func TestContentAddressed(t *testing.T) {
+	dir := ".testContentAddressed"
+	defer os.RemoveAll(dir)
+	sum := grabtest.DefaultHandlerSHA256Checksum
+	expect := filepath.Join(dir, sum[:2], sum[2:])
+
+	// assertNoTemp ensures that no temporary files are left in dir
+	assertNoTemp := func(t *testing.T) {
+		matches, err := filepath.Glob(filepath.Join(dir, ".grab-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) > 0 {
+			t.Errorf("expected temporary files to be removed, got: %v", matches)
+		}
+	}
+
+	newRequest := func(url string) *Request {
+		req := mustNewRequest("ignored", url)
+		req.ContentAddressed = &ContentAddress{Dir: dir}
+		return req
+	}
+
+	t.Run("WithNewContent", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(newRequest(url))
+			if resp.Filename != expect {
+				t.Errorf("expected Filename: %q, got: %q", expect, resp.Filename)
+			}
+			testComplete(t, resp)
+			assertNoTemp(t)
+		})
+	})
+
+	t.Run("WithExistingContent", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(newRequest(url))
+			if resp.Filename != expect {
+				t.Errorf("expected Filename: %q, got: %q", expect, resp.Filename)
+			}
+			assertNoTemp(t)
+		})
+	})
+
+	t.Run("WithCustomLayout", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := newRequest(url)
+			req.ContentAddressed.Hash = md5.New
+			req.ContentAddressed.Layout = func(sum []byte) string {
+				return fmt.Sprintf("md5-%x", sum)
+			}
+			resp := mustDo(req)
+			expect := filepath.Join(dir, "md5-"+grabtest.DefaultHandlerMD5Checksum)
+			if resp.Filename != expect {
+				t.Errorf("expected Filename: %q, got: %q", expect, resp.Filename)
+			}
+			assertNoTemp(t)
+		})
+	})
+
+	t.Run("WithFailedTransfer", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := newRequest(url)
+			req.SetChecksum(sha256.New(), []byte("bad"), false)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+			assertNoTemp(t)
+		})
+	})
+}
+
+func TestNoStore(t *testing.T) {
+	filename := ".testSubdir/testNoStore"
+	t.Run("DefaultCase", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.NoStore = true
+			req.SetChecksum(md5.New(), grabtest.DefaultHandlerMD5ChecksumBytes, true)
+			resp := mustDo(req)
+
+			// ensure Response.Bytes is correct and can be reread
+			b, err := resp.Bytes()
+			if err != nil {
+				panic(err)
+			}
+			grabtest.AssertSHA256Sum(
+				t,
+				grabtest.DefaultHandlerSHA256ChecksumBytes,
+				bytes.NewReader(b),
+			)
+
+			// ensure Response.Open stream is correct and can be reread
+			r, err := resp.Open()
+			if err != nil {
+				panic(err)
+			}
+			defer r.Close()
+			grabtest.AssertSHA256Sum(
+				t,
+				grabtest.DefaultHandlerSHA256ChecksumBytes,
+				r,
+			)
+
+			// Response.Filename should still be set
+			if resp.Filename != filename {
+				t.Errorf("expected Response.Filename: %s, got: %s", filename, resp.Filename)
+			}
+
+			// ensure no files were written
+			paths := []string{
+				filename,
+				filepath.Base(filename),
+				filepath.Dir(filename),
+				resp.Filename,
+				filepath.Base(resp.Filename),
+				filepath.Dir(resp.Filename),
+			}
+			for _, path := range paths {
+				_, err := os.Stat(path)
+				if !os.IsNotExist(err) {
+					t.Errorf(
+						"expect error: %v, got: %v, for path: %s",
+						os.ErrNotExist,
+						err,
+						path)
 				}
-				return nil
 			}
+		})
+	})
+
+	t.Run("ChecksumValidation", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			req.SetChecksum(
+				md5.New(),
+				grabtest.MustHexDecodeString("deadbeefcafebabe"),
+				true)
 			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != nil {
-				t.Errorf("unexpected error using BeforeCopy hook: %v", err)
-			}
-			testComplete(t, resp)
-			if !called {
-				t.Error("BeforeCopy hook was never called")
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
 			}
 		})
 	})
+}
 
-	t.Run("WithError", func(t *testing.T) {
-		defer os.RemoveAll(filename)
+// TestDiscard ensures that the bytes of a transfer with Request.Discard set are
+// discarded without resolving a filename, while still being counted and
+// verified.
+func TestDiscard(t *testing.T) {
+	filename := ".testSubdir/testDiscard"
+	size := 1 << 16
+	t.Run("DefaultCase", func(t *testing.T) {
 		grabtest.WithTestServer(t, func(url string) {
-			testError := errors.New("test")
 			req := mustNewRequest(filename, url)
-			req.BeforeCopy = func(resp *Response) error {
-				return testError
+			req.Discard = true
+			resp := mustDo(req)
+			if resp.Filename != "" {
+				t.Errorf("expected no Response.Filename, got: %s", resp.Filename)
 			}
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != testError {
-				t.Errorf("expected error '%v', got '%v'", testError, err)
+			if n := resp.BytesComplete(); n != int64(size) {
+				t.Errorf("expected %d bytes complete, got: %d", size, n)
 			}
-			if resp.BytesComplete() != 0 {
-				t.Errorf("expected 0 bytes completed for canceled BeforeCopy hook, got %d",
-					resp.BytesComplete())
+			if b, err := resp.Bytes(); err != nil || len(b) != 0 {
+				t.Errorf("expected no bytes, got: %d, %v", len(b), err)
 			}
-			testComplete(t, resp)
+			for _, path := range []string{filename, filepath.Dir(filename)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("expected error: %v, got: %v, for path: %s", os.ErrNotExist, err, path)
+				}
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithoutFilename", func(t *testing.T) {
+		// the URL has no path from which to guess a filename
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/")
+			req.Discard = true
+			req.FilenameFunc = func(*http.Response, string) (string, error) {
+				t.Error("FilenameFunc was called")
+				return "", nil
+			}
+			mustDo(req)
 		})
 	})
 
-	// Assert that an existing local file will not be truncated prior to the
-	// BeforeCopy hook has a chance to cancel the request
-	t.Run("NoTruncate", func(t *testing.T) {
-		tfile, err := os.CreateTemp("", "grab_client_test.*.file")
+	t.Run("ChecksumValidation", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.Discard = true
+			req.SetChecksum(md5.New(), grabtest.DefaultHandlerMD5ChecksumBytes, true)
+			mustDo(req)
+
+			req = mustNewRequest("", url)
+			req.Discard = true
+			req.SetChecksum(
+				md5.New(),
+				grabtest.MustHexDecodeString("deadbeefcafebabe"),
+				true)
+			if err := DefaultClient.Do(req).Err(); err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+		})
+	})
+}
+
+// TestFollowMetaRefresh ensures that HTML pages which refresh to the requested
+// file are followed if Request.FollowMetaRefresh is set.
+func TestFollowMetaRefresh(t *testing.T) {
+	h, err := grabtest.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dl/file.bin", h)
+	mux.Handle("/page", page(`<html><head><meta http-equiv="refresh" content="0; url=/redirect"></head></html>`))
+	mux.Handle("/redirect", page(`<meta http-equiv="refresh" content="0; url=dl/file.bin">`))
+	mux.Handle("/loop", page(`<meta http-equiv="refresh" content="0; url=/loop">`))
+	mux.Handle("/plain", page(`<p>hello</p>`))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	t.Run("Follow", func(t *testing.T) {
+		filename := ".testFollowMetaRefresh"
+		defer os.Remove(filename)
+		req := mustNewRequest(filename, s.URL+"/page")
+		req.FollowMetaRefresh = true
+		resp := mustDo(req)
+		testComplete(t, resp)
+		if v := resp.HTTPResponse.Request.URL.Path; v != "/dl/file.bin" {
+			t.Errorf("expected final path: %q, got: %q", "/dl/file.bin", v)
+		}
+		if n := resp.BytesComplete(); n != int64(grabtest.DefaultHandlerContentLength) {
+			t.Errorf("expected %d bytes, got %d", grabtest.DefaultHandlerContentLength, n)
+		}
+	})
+
+	t.Run("ResolveFilename", func(t *testing.T) {
+		defer os.Remove("file.bin")
+		req := mustNewRequest("", s.URL+"/page")
+		req.FollowMetaRefresh = true
+		resp := mustDo(req)
+		if resp.Filename != "file.bin" {
+			t.Errorf("expected Filename: %q, got: %q", "file.bin", resp.Filename)
+		}
+	})
+
+	t.Run("WithDiscard", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/page")
+		req.FollowMetaRefresh = true
+		req.Discard = true
+		resp := mustDo(req)
+		if resp.Filename != "" {
+			t.Errorf("expected no Response.Filename, got: %s", resp.Filename)
+		}
+		if n := resp.BytesComplete(); n != int64(grabtest.DefaultHandlerContentLength) {
+			t.Errorf("expected %d bytes, got %d", grabtest.DefaultHandlerContentLength, n)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		filename := ".testFollowMetaRefresh"
+		defer os.Remove(filename)
+		mustDo(mustNewRequest(filename, s.URL+"/page"))
+		b, err := os.ReadFile(filename)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer os.Remove(tfile.Name())
+		if !strings.Contains(string(b), "url=/redirect") {
+			t.Errorf("expected page to be downloaded, got: %q", b)
+		}
+	})
 
-		const size = 128
-		_, err = tfile.Write(bytes.Repeat([]byte("x"), size))
+	t.Run("NoRefresh", func(t *testing.T) {
+		filename := ".testFollowMetaRefresh"
+		defer os.Remove(filename)
+		req := mustNewRequest(filename, s.URL+"/plain")
+		req.FollowMetaRefresh = true
+		mustDo(req)
+		b, err := os.ReadFile(filename)
 		if err != nil {
 			t.Fatal(err)
 		}
+		if string(b) != "<p>hello</p>" {
+			t.Errorf("expected page to be downloaded, got: %q", b)
+		}
+	})
 
-		grabtest.WithTestServer(t, func(url string) {
-			called := false
-			req := mustNewRequest(tfile.Name(), url)
-			req.NoResume = true
-			req.BeforeCopy = func(resp *Response) error {
-				called = true
-				fi, err := tfile.Stat()
-				if err != nil {
-					t.Errorf("failed to stat temp file: %v", err)
-					return nil
-				}
-				if fi.Size() != size {
-					t.Errorf("expected existing file size of %d bytes "+
-						"prior to BeforeCopy hook, got %d", size, fi.Size())
+	t.Run("TooMany", func(t *testing.T) {
+		filename := ".testFollowMetaRefresh"
+		defer os.Remove(filename)
+		req := mustNewRequest(filename, s.URL+"/loop")
+		req.FollowMetaRefresh = true
+		req.MaxMetaRefreshes = 3
+		err := DefaultClient.Do(req).Err()
+		if err != ErrTooManyMetaRefreshes {
+			t.Errorf("expected error: %v, got: %v", ErrTooManyMetaRefreshes, err)
+		}
+	})
+}
+
+// TestStdout ensures that a Filename of "-" writes the transfer to standard
+// output.
+func TestStdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("-", url)
+		req.FilenameFunc = func(resp *http.Response, suggested string) (string, error) {
+			t.Error("expected FilenameFunc not to be called")
+			return suggested, nil
+		}
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, true)
+		resp := mustDo(req)
+		if resp.Filename != "-" {
+			t.Errorf("expected Filename: %q, got: %q", "-", resp.Filename)
+		}
+		if resp.DidResume {
+			t.Errorf("expected transfer not to resume")
+		}
+	})
+
+	// the pipe must not have been closed by grab
+	if _, err := w.Write([]byte{0}); err != nil {
+		t.Errorf("expected standard output to remain open, got: %v", err)
+	}
+	w.Close()
+	b := <-done
+	if len(b) != grabtest.DefaultHandlerContentLength+1 {
+		t.Fatalf("expected %d bytes, got %d", grabtest.DefaultHandlerContentLength+1, len(b))
+	}
+	if _, err := os.Stat("-"); !os.IsNotExist(err) {
+		t.Errorf("expected no file named \"-\", got: %v", err)
+	}
+}
+
+// TestMaxTotalBytes ensures that Client.MaxTotalBytes limits the cumulative
+// bytes downloaded by a Client, not counting resumed bytes.
+func TestMaxTotalBytes(t *testing.T) {
+	size := 1024
+	filenames := []string{".testMaxTotalBytes1", ".testMaxTotalBytes2", ".testMaxTotalBytes3"}
+	for _, filename := range filenames {
+		os.Remove(filename)
+		defer os.Remove(filename)
+	}
+
+	// partially download the first file
+	partial := make([]byte, size/2)
+	for i := range partial {
+		partial[i] = byte(i)
+	}
+	if err := os.WriteFile(filenames[0], partial, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		client := NewClient()
+		client.MaxTotalBytes = int64(size)
+
+		// resumed bytes do not count
+		resp := client.Do(mustNewRequest(filenames[0], url))
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+
+		// the remaining bytes are downloaded before the quota is exceeded
+		resp = client.Do(mustNewRequest(filenames[1], url))
+		if err := resp.Err(); err != ErrQuotaExceeded {
+			t.Errorf("expected error: %v, got: %v", ErrQuotaExceeded, err)
+		}
+		if fi, err := os.Stat(filenames[1]); err != nil {
+			t.Error(err)
+		} else if fi.Size() != int64(size/2) {
+			t.Errorf("expected %d bytes to be written, got %d", size/2, fi.Size())
+		}
+
+		// new transfers fail fast
+		resp = client.Do(mustNewRequest(filenames[2], url))
+		if err := resp.Err(); err != ErrQuotaExceeded {
+			t.Errorf("expected error: %v, got: %v", ErrQuotaExceeded, err)
+		}
+		if _, err := os.Stat(filenames[2]); !os.IsNotExist(err) {
+			t.Errorf("expected no file to be written, got: %v", err)
+		}
+	},
+		grabtest.ContentLength(size),
+	)
+}
+
+// TestRequestSealed ensures that a Request cannot be modified through its
+// setters once it is passed to Client.Do, that changes to its headers do not
+// race with the transfer and that a modified Request can be derived with
+// Request.Clone.
+func TestRequestSealed(t *testing.T) {
+	filename := ".testRequestSealed"
+	defer os.Remove(filename)
+	size := 1 << 16
+
+	grabtest.WithTestServer(t, func(url string) {
+		// resuming sets the Range header of the transfer, which must not
+		// leak into the submitted Request while the caller changes it
+		if err := os.WriteFile(filename, testContent(size)[:size/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+		req := mustNewRequest(filename, url)
+		resp := DefaultClient.Do(req)
+		for i := 0; i < 100; i++ {
+			req.HTTPRequest.Header.Set("X-Test", fmt.Sprint(i))
+		}
+		testComplete(t, resp)
+		if resp.Request != req {
+			t.Errorf("expected Response.Request to be the submitted Request")
+		}
+		if v := req.HTTPRequest.Header.Get("Range"); v != "" {
+			t.Errorf("expected Range header of submitted Request to be unchanged, got: %q", v)
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected SetChecksum on a submitted Request to panic")
 				}
-				return nil
+			}()
+			req.SetChecksum(sha256.New(), nil, false)
+		}()
+
+		clone := req.Clone()
+		clone.HTTPRequest.Header.Set("X-Test", "clone")
+		if v := req.HTTPRequest.Header.Get("X-Test"); v == "clone" {
+			t.Errorf("expected headers of clone to be copied")
+		}
+		clone.NoResume = true
+		sum := sha256.Sum256(testContent(size))
+		clone.SetChecksum(sha256.New(), sum[:], false)
+		testComplete(t, mustDo(clone))
+	}, grabtest.ContentLength(size))
+
+	t.Run("WithBatch", func(t *testing.T) {
+		// clones of one template are sent concurrently while the template
+		// is changed
+		grabtest.WithTestServer(t, func(url string) {
+			template := mustNewRequest("", url)
+			template.NoStore = true
+			template.RequireHeaders = map[string]string{"Content-Type": ""}
+			reqs := make([]*Request, 16)
+			for i := range reqs {
+				reqs[i] = template.Clone()
+				reqs[i].SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
 			}
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != nil {
-				t.Errorf("unexpected error using BeforeCopy hook: %v", err)
+			respch := DefaultClient.DoBatch(4, reqs...)
+			for i := 0; i < 100; i++ {
+				template.HTTPRequest.Header.Set("X-Test", fmt.Sprint(i))
+				template.RequireHeaders["X-Test"] = fmt.Sprint(i)
 			}
-			testComplete(t, resp)
-			if !called {
-				t.Error("BeforeCopy hook was never called")
+			for resp := range respch {
+				if err := resp.Err(); err != nil {
+					t.Error(err)
+				}
 			}
 		})
 	})
 }
 
-func TestAfterCopyHook(t *testing.T) {
-	filename := "./.testAfterCopy"
-	t.Run("Noop", func(t *testing.T) {
-		defer os.RemoveAll(filename)
+// TestWriteOffset ensures that a range of the remote file is written over an
+// existing file at Request.WriteOffset, leaving the rest of the file intact.
+func TestWriteOffset(t *testing.T) {
+	filename := ".testWriteOffset"
+	defer os.Remove(filename)
+	size := 1024
+	remote := testContent(size)
+
+	reset := func(t *testing.T) []byte {
+		b := bytes.Repeat([]byte{0xff}, size)
+		if err := os.WriteFile(filename, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	check := func(t *testing.T, expect []byte) {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expect) {
+			t.Errorf("expected destination file to be patched in place")
+		}
+	}
+
+	t.Run("WithDefaultRange", func(t *testing.T) {
+		expect := reset(t)
+		copy(expect[100:], remote[100:])
 		grabtest.WithTestServer(t, func(url string) {
-			called := false
 			req := mustNewRequest(filename, url)
-			req.AfterCopy = func(resp *Response) error {
-				called = true
-				if resp.IsComplete() {
-					t.Error("Response object passed to AfterCopy hook has already been closed")
-				}
-				if resp.Progress() <= 0 {
-					t.Error("Download progress was 0 when AfterCopy hook was called")
-				}
-				if resp.Duration() == 0 {
-					t.Error("Duration was zero when AfterCopy was called")
-				}
-				if resp.BytesComplete() <= 0 {
-					t.Error("BytesComplete was 0 when AfterCopy hook was called")
-				}
-				return nil
-			}
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != nil {
-				t.Errorf("unexpected error using AfterCopy hook: %v", err)
+			req.WriteOffset = 100
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
 			}
-			testComplete(t, resp)
-			if !called {
-				t.Error("AfterCopy hook was never called")
+			if v := resp.BytesComplete(); v != int64(size-100) {
+				t.Errorf("expected %d bytes transferred, got: %d", size-100, v)
 			}
-		})
+			check(t, expect)
+		}, grabtest.ContentLength(size))
 	})
 
-	t.Run("WithError", func(t *testing.T) {
-		defer os.RemoveAll(filename)
+	t.Run("WithRangeHeader", func(t *testing.T) {
+		expect := reset(t)
+		copy(expect[500:510], remote[10:20])
 		grabtest.WithTestServer(t, func(url string) {
-			testError := errors.New("test")
 			req := mustNewRequest(filename, url)
-			req.AfterCopy = func(resp *Response) error {
-				return testError
+			req.HTTPRequest.Header.Set("Range", "bytes=10-19")
+			req.WriteOffset = 500
+			mustDo(req)
+			check(t, expect)
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithRangeBeyondFile", func(t *testing.T) {
+		expect := reset(t)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.HTTPRequest.Header.Set("Range", "bytes=0-99")
+			req.WriteOffset = int64(size - 50)
+			req.RemovePartialOnError = true
+			if err := DefaultClient.Do(req).Err(); !errors.Is(err, ErrBadWriteOffset) {
+				t.Errorf("expected error: %v, got: %v", ErrBadWriteOffset, err)
 			}
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != testError {
-				t.Errorf("expected error '%v', got '%v'", testError, err)
+			check(t, expect)
+
+			req = mustNewRequest(filename, url)
+			req.WriteOffset = int64(size)
+			if err := DefaultClient.Do(req).Err(); !errors.Is(err, ErrBadWriteOffset) {
+				t.Errorf("expected error: %v, got: %v", ErrBadWriteOffset, err)
 			}
-			if resp.BytesComplete() <= 0 {
-				t.Errorf("ByteCompleted was %d after AfterCopy hook was called",
-					resp.BytesComplete())
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithRangeIgnored", func(t *testing.T) {
+		expect := reset(t)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.WriteOffset = 100
+			if err := DefaultClient.Do(req).Err(); err != ErrRangeIgnored {
+				t.Errorf("expected error: %v, got: %v", ErrRangeIgnored, err)
+			}
+			check(t, expect)
+		}, grabtest.ContentLength(size), grabtest.AcceptRanges(false))
+	})
+
+	t.Run("WithMissingFile", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.WriteOffset = 100
+			if err := DefaultClient.Do(req).Err(); !os.IsNotExist(err) {
+				t.Errorf("expected error: %v, got: %v", os.ErrNotExist, err)
 			}
-			testComplete(t, resp)
 		})
 	})
 }
 
-func TestIssue37(t *testing.T) {
-	// ref: https://github.com/3JoB/grab/v3/issues/37
-	filename := "./.testIssue37"
-	largeSize := int64(2097152)
-	smallSize := int64(1048576)
-	defer os.RemoveAll(filename)
+// TestResumeLargeOffset ensures that a file larger than 2 GiB is resumed from
+// the correct offset, including on 32-bit platforms.
+func TestResumeLargeOffset(t *testing.T) {
+	filename := ".testResumeLargeOffset"
+	defer os.Remove(filename)
+	offset := int64(3 << 30)
+	size := offset + 1024
+
+	// fake a partial file without writing 3 GiB
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(offset)
+	f.Close()
+	if err != nil {
+		t.Skipf("cannot create large file: %v", err)
+	}
 
-	// download large file
 	grabtest.WithTestServer(t, func(url string) {
 		resp := mustDo(mustNewRequest(filename, url))
-		if resp.Size() != largeSize {
-			t.Errorf("expected response size: %d, got: %d", largeSize, resp.Size())
+		if v := resp.req.HTTPRequest.Header.Get("Range"); v != "bytes=3221225472-" {
+			t.Errorf("expected Range header: %q, got: %q", "bytes=3221225472-", v)
 		}
-	}, grabtest.ContentLength(int(largeSize)))
-
-	// download new, smaller version of same file
-	grabtest.WithTestServer(t, func(url string) {
-		req := mustNewRequest(filename, url)
-		req.NoResume = true
-		resp := mustDo(req)
-		if resp.Size() != smallSize {
-			t.Errorf("expected response size: %d, got: %d", smallSize, resp.Size())
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
 		}
-
-		// local file should have truncated and not resumed
-		if resp.DidResume {
-			t.Errorf("expected download to truncate, resumed instead")
+		if v := resp.Size(); v != size {
+			t.Errorf("expected Response.Size: %d, got: %d", size, v)
+		}
+		if v := resp.BytesComplete(); v != size {
+			t.Errorf("expected Response.BytesComplete: %d, got: %d", size, v)
+		}
+		if v := resp.Stats().BytesResumed; v != offset {
+			t.Errorf("expected %d bytes resumed, got: %d", offset, v)
 		}
-	}, grabtest.ContentLength(int(smallSize)))
 
-	fi, err := os.Stat(filename)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if fi.Size() != int64(smallSize) {
-		t.Errorf("expected file size %d, got %d", smallSize, fi.Size())
-	}
+		// the resumed bytes continue the content from the offset
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b := make([]byte, 4)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, []byte{0, 1, 2, 3}) {
+			t.Errorf("expected content at offset %d: % x, got: % x", offset, []byte{0, 1, 2, 3}, b)
+		}
+	}, grabtest.ContentLength64(size))
 }
 
-// TestHeadBadStatus validates that HEAD requests that return non-200 can be
-// ignored and succeed if the GET requests succeeeds.
-//
-// Fixes: https://github.com/3JoB/grab/v3/issues/43
-func TestHeadBadStatus(t *testing.T) {
-	expect := http.StatusOK
-	filename := ".testIssue43"
-
-	statusFunc := func(r *http.Request) int {
-		if r.Method == "HEAD" {
-			return http.StatusForbidden
+// TestMaxCrossHostRedirects ensures that redirects to other hosts are limited
+// by Client.MaxCrossHostRedirects, while redirects within a host are not.
+func TestMaxCrossHostRedirects(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		// redirect returns a server that redirects every request to the given
+		// URL, once to itself first
+		redirect := func(target string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("self") == "" {
+					http.Redirect(w, r, r.URL.Path+"?self=1", http.StatusFound)
+					return
+				}
+				http.Redirect(w, r, target+r.URL.Path, http.StatusFound)
+			}))
 		}
-		return http.StatusOK
-	}
+		b := redirect(url)
+		defer b.Close()
+		a := redirect(b.URL)
+		defer a.Close()
 
-	grabtest.WithTestServer(t, func(url string) {
-		testURL := fmt.Sprintf("%s/%s", url, filename)
-		resp := mustDo(mustNewRequest("", testURL))
-		if resp.HTTPResponse.StatusCode != expect {
-			t.Errorf(
-				"expected status code: %d, got:% d",
-				expect,
-				resp.HTTPResponse.StatusCode)
+		tests := []struct {
+			Name string
+			Max  int
+			URL  string
+			Host string
+		}{
+			{"Unlimited", -1, a.URL, ""},
+			{"WithinLimit", 2, a.URL, ""},
+			{"Forbidden", 0, b.URL, mustParseURL(t, url).Host},
+			{"ExceedsLimit", 1, a.URL, mustParseURL(t, url).Host},
 		}
-	},
-		grabtest.StatusCode(statusFunc),
-	)
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				client := NewClient()
+				client.MaxCrossHostRedirects = test.Max
+				req := mustNewRequest("", test.URL+"/.testMaxCrossHostRedirects")
+				req.NoStore = true
+				err := client.Do(req).Err()
+				if test.Host == "" {
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrCrossHostRedirect) || !strings.Contains(err.Error(), test.Host) {
+					t.Errorf("expected %v naming %s, got: %v", ErrCrossHostRedirect, test.Host, err)
+				}
+			})
+		}
+
+		t.Run("WithSameHost", func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("self") == "" {
+					http.Redirect(w, r, r.URL.Path+"?self=1", http.StatusFound)
+					return
+				}
+				w.Write(testContent(16))
+			}))
+			defer s.Close()
+			client := NewClient()
+			client.MaxCrossHostRedirects = 0
+			req := mustNewRequest("", s.URL+"/.testMaxCrossHostRedirects")
+			req.NoStore = true
+			if err := client.Do(req).Err(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	})
 }
 
-// TestMissingContentLength ensures that the Response.Size is correct for
-// transfers where the remote server does not send a Content-Length header.
-//
-// TestAutoResume also covers cases with checksum validation.
-//
-// Kudos to Setnička Jiří <Jiri.Setnicka@ysoft.com> for identifying and raising
-// a solution to this issue. Ref: https://github.com/3JoB/grab/v3/pull/27
-func TestMissingContentLength(t *testing.T) {
-	// expectSize must be sufficiently large that DefaultClient.Do won't prefetch
-	// the entire body and compute ContentLength before returning a Response.
-	expectSize := 1048576
-	opts := []grabtest.HandlerOption{
-		grabtest.ContentLength(expectSize),
-		grabtest.HeaderBlacklist("Content-Length"),
-		grabtest.TimeToFirstByte(time.Millisecond * 100), // delay for initial read
+// TestRequireResumable ensures that Request.RequireResumable fails a transfer
+// before its body is written if the remote server does not support ranged
+// requests, whether or not it advertises them.
+func TestRequireResumable(t *testing.T) {
+	filename := ".testRequireResumable"
+	defer os.Remove(filename)
+	tests := []struct {
+		Name    string
+		Options []grabtest.HandlerOption
+		Err     error
+	}{
+		{Name: "Default"},
+		{Name: "WithUnadvertisedRanges", Options: []grabtest.HandlerOption{grabtest.HeaderBlacklist("Accept-Ranges")}},
+		{Name: "WithoutRanges", Options: []grabtest.HandlerOption{grabtest.AcceptRanges(false)}, Err: ErrNotResumable},
+		{Name: "WithAcceptRangesNone", Options: []grabtest.HandlerOption{grabtest.AcceptRangesNone()}, Err: ErrNotResumable},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.RequireResumable = true
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); !errors.Is(err, test.Err) {
+					t.Fatalf("expected error: %v, got: %v", test.Err, err)
+				}
+				if test.Err != nil {
+					if _, err := os.Stat(filename); !os.IsNotExist(err) {
+						t.Errorf("expected no file to be created, got: %v", err)
+					}
+					return
+				}
+				testComplete(t, resp)
+				if !resp.CanResume {
+					t.Errorf("expected Response.CanResume to be true")
+				}
+			}, test.Options...)
+		})
 	}
+}
+
+// TestCancelByTag ensures that Client.CancelByTag cancels only the transfers in
+// progress that carry the given tag, and reports how many were canceled.
+func TestCancelByTag(t *testing.T) {
 	grabtest.WithTestServer(t, func(url string) {
-		req := mustNewRequest(".testMissingContentLength", url)
-		req.SetChecksum(
-			md5.New(),
-			grabtest.DefaultHandlerMD5ChecksumBytes,
-			false)
-		resp := DefaultClient.Do(req)
+		client := NewClient()
+		tags := [][]string{{"a"}, {"a", "b"}, {"b"}}
+		resps := make([]*Response, len(tags))
+		for i, tags := range tags {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			req.Tags = tags
+			resps[i] = client.Do(req)
+		}
 
-		// ensure remote server is not sending content-length header
-		if v := resp.HTTPResponse.Header.Get("Content-Length"); v != "" {
-			panic(fmt.Sprintf("http header content length must be empty, got: %s", v))
+		if n := client.CancelByTag("c"); n != 0 {
+			t.Errorf("expected no transfers canceled by unknown tag, got %d", n)
 		}
-		if v := resp.HTTPResponse.ContentLength; v != -1 {
-			panic(fmt.Sprintf("http response content length must be -1, got: %d", v))
+		if n := client.CancelByTag("a"); n != 2 {
+			t.Errorf("expected 2 transfers canceled, got %d", n)
 		}
-
-		// before completion, response size should be -1
-		if resp.Size() != -1 {
-			t.Errorf("expected response size: -1, got: %d", resp.Size())
+		for _, resp := range resps[:2] {
+			if err := resp.Err(); !errors.Is(err, context.Canceled) || !errors.Is(err, ErrCanceledByTag) {
+				t.Errorf("expected ErrCanceledByTag, got: %v", err)
+			}
 		}
-
-		// block for completion
-		if err := resp.Err(); err != nil {
-			panic(err)
+		if resps[2].IsComplete() {
+			t.Fatalf("expected untagged transfer to be in progress, got: %v", resps[2].Err())
 		}
 
-		// on completion, response size should be actual transfer size
-		if resp.Size() != int64(expectSize) {
-			t.Errorf("expected response size: %d, got: %d", expectSize, resp.Size())
+		// the transfer canceled by "a" is no longer tracked by "b"
+		if n := client.CancelByTag("b"); n != 1 {
+			t.Errorf("expected 1 transfer canceled, got %d", n)
 		}
-	}, opts...)
+		if err := resps[2].Err(); !errors.Is(err, ErrCanceledByTag) {
+			t.Errorf("expected ErrCanceledByTag, got: %v", err)
+		}
+		if n := len(client.tags.m); n != 0 {
+			t.Errorf("expected no tags tracked, got %d", n)
+		}
+	}, grabtest.InfiniteBody(1024, 10*time.Millisecond))
 }
 
-func TestNoStore(t *testing.T) {
-	filename := ".testSubdir/testNoStore"
-	t.Run("DefaultCase", func(t *testing.T) {
-		grabtest.WithTestServer(t, func(url string) {
-			req := mustNewRequest(filename, url)
-			req.NoStore = true
-			req.SetChecksum(md5.New(), grabtest.DefaultHandlerMD5ChecksumBytes, true)
-			resp := mustDo(req)
-
-			// ensure Response.Bytes is correct and can be reread
-			b, err := resp.Bytes()
-			if err != nil {
-				panic(err)
-			}
-			grabtest.AssertSHA256Sum(
-				t,
-				grabtest.DefaultHandlerSHA256ChecksumBytes,
-				bytes.NewReader(b),
-			)
+// TestResponseDefer ensures that Response.Defer cancels a transfer that has not
+// started copying, without leaving a file or changing an existing file, and
+// returns its Request, and that it fails once copying has started.
+func TestResponseDefer(t *testing.T) {
+	filename := ".testResponseDefer"
+	defer os.Remove(filename)
 
-			// ensure Response.Open stream is correct and can be reread
-			r, err := resp.Open()
-			if err != nil {
-				panic(err)
-			}
-			defer r.Close()
-			grabtest.AssertSHA256Sum(
-				t,
-				grabtest.DefaultHandlerSHA256ChecksumBytes,
-				r,
-			)
+	// defer is called from BeforeCopy, once the response headers are known
+	deferFromBeforeCopy := func(t *testing.T, url string) {
+		t.Helper()
+		deferred := make(chan *Request, 1)
+		req := mustNewRequest(filename, url)
+		req.NoResume = true
+		req.BeforeCopy = func(resp *Response) error {
+			go func() {
+				r, err := resp.Defer()
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				deferred <- r
+			}()
+			<-resp.req.Context().Done()
+			return nil
+		}
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); !errors.Is(err, context.Canceled) || !errors.Is(err, ErrDeferred) {
+			t.Errorf("expected ErrDeferred, got: %v", err)
+		}
+		if r := <-deferred; r != req {
+			t.Errorf("expected the submitted Request")
+		}
+	}
 
-			// Response.Filename should still be set
-			if resp.Filename != filename {
-				t.Errorf("expected Response.Filename: %s, got: %s", filename, resp.Filename)
+	grabtest.WithTestServer(t, func(url string) {
+		t.Run("Connecting", func(t *testing.T) {
+			deferFromBeforeCopy(t, url)
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected no file to be created, got: %v", err)
 			}
+		})
 
-			// ensure no files were written
-			paths := []string{
-				filename,
-				filepath.Base(filename),
-				filepath.Dir(filename),
-				resp.Filename,
-				filepath.Base(resp.Filename),
-				filepath.Dir(resp.Filename),
+		t.Run("WithExistingFile", func(t *testing.T) {
+			if err := os.WriteFile(filename, []byte("existing"), 0644); err != nil {
+				t.Fatal(err)
 			}
-			for _, path := range paths {
-				_, err := os.Stat(path)
-				if !os.IsNotExist(err) {
-					t.Errorf(
-						"expect error: %v, got: %v, for path: %s",
-						os.ErrNotExist,
-						err,
-						path)
-				}
+			deferFromBeforeCopy(t, url)
+			if b, err := os.ReadFile(filename); err != nil || string(b) != "existing" {
+				t.Errorf("expected existing file to be unchanged, got: %q, %v", b, err)
 			}
 		})
 	})
 
-	t.Run("ChecksumValidation", func(t *testing.T) {
+	t.Run("Pending", func(t *testing.T) {
 		grabtest.WithTestServer(t, func(url string) {
+			client := NewClient()
+			client.MaxConcurrentTransfers = 1
 			req := mustNewRequest("", url)
 			req.NoStore = true
-			req.SetChecksum(
-				md5.New(),
-				grabtest.MustHexDecodeString("deadbeefcafebabe"),
-				true)
-			resp := DefaultClient.Do(req)
-			if err := resp.Err(); err != ErrBadChecksum {
-				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			active := client.Do(req)
+			defer active.Cancel(nil)
+
+			req = mustNewRequest("", url)
+			req.NoStore = true
+			pending := client.Do(req)
+			if s := pending.State(); s != StatePending {
+				t.Fatalf("expected %v, got: %v", StatePending, s)
 			}
-		})
+			r, err := pending.Defer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r != req {
+				t.Errorf("expected the submitted Request")
+			}
+			if err := pending.Err(); !errors.Is(err, ErrDeferred) {
+				t.Errorf("expected ErrDeferred, got: %v", err)
+			}
+			if n := client.QueueLength(); n != 0 {
+				t.Errorf("expected no pending transfers, got %d", n)
+			}
+
+			// the active transfer is copying its body
+			deadline := time.Now().Add(5 * time.Second)
+			for active.BytesComplete() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if _, err := active.Defer(); err != ErrNotDeferrable {
+				t.Errorf("expected ErrNotDeferrable, got: %v", err)
+			}
+			if active.IsComplete() {
+				t.Errorf("expected transfer to be unaffected, got: %v", active.Err())
+			}
+		}, grabtest.InfiniteBody(1024, 10*time.Millisecond))
 	})
 }
@@ -0,0 +1,219 @@
+//go:build unix
+
+package grab
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestNamedPipe ensures that transfers are written sequentially to an existing
+// named pipe.
+func TestNamedPipe(t *testing.T) {
+	filename := ".testNamedPipe"
+	os.Remove(filename)
+	if err := syscall.Mkfifo(filename, 0666); err != nil {
+		t.Skipf("cannot create named pipe: %v", err)
+	}
+	defer os.Remove(filename)
+
+	done := make(chan []byte)
+	go func() {
+		f, err := os.Open(filename)
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		done <- b
+	}()
+
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		if resp.DidResume {
+			t.Errorf("expected transfer not to resume")
+		}
+	})
+	b := <-done
+	if len(b) != grabtest.DefaultHandlerContentLength {
+		t.Fatalf("expected %d bytes, got %d", grabtest.DefaultHandlerContentLength, len(b))
+	}
+	for i := range b {
+		if b[i] != byte(i) {
+			t.Fatalf("unexpected byte at offset %d", i)
+		}
+	}
+	if fi, err := os.Stat(filename); err != nil {
+		t.Error(err)
+	} else if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("expected named pipe to remain, got mode: %v", fi.Mode())
+	}
+}
+
+// TestNoFollowSymlinks ensures that transfers with Request.NoFollowSymlinks set
+// are not written through a symlink at the destination or in its directories.
+func TestNoFollowSymlinks(t *testing.T) {
+	dir := ".testNoFollowSymlinks"
+	defer os.RemoveAll(dir)
+	outside := dir + "/outside"
+	if err := os.MkdirAll(outside, 0777); err != nil {
+		t.Fatal(err)
+	}
+	target := outside + "/target"
+	if err := os.WriteFile(target, []byte("keep"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("outside/target", dir+"/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("outside", dir+"/parent"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"Destination": dir + "/file",
+		"Parent":      dir + "/parent/new",
+	}
+	for name, filename := range tests {
+		t.Run(name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.NoFollowSymlinks = true
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); !errors.Is(err, ErrSymlinkDestination) {
+					t.Errorf("expected error: %v, got: %v", ErrSymlinkDestination, err)
+				}
+			})
+		})
+	}
+	if b, err := os.ReadFile(target); err != nil || string(b) != "keep" {
+		t.Errorf("expected symlink target to be unchanged, got: %q, %v", b, err)
+	}
+	if _, err := os.Lstat(outside + "/new"); !os.IsNotExist(err) {
+		t.Errorf("expected no file in symlinked directory, got: %v", err)
+	}
+
+	t.Run("WithoutNoFollowSymlinks", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			testComplete(t, mustDo(mustNewRequest(dir+"/parent/new", url)))
+		})
+	})
+}
+
+// TestAllowedRoot ensures that transfers are confined to Client.AllowedRoot
+// once symlinks are resolved.
+func TestAllowedRoot(t *testing.T) {
+	dir := ".testAllowedRoot"
+	defer os.RemoveAll(dir)
+	root := dir + "/root"
+	if err := os.MkdirAll(root+"/inside", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir+"/outside", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("inside", root+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", root+"/escape"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside/dangling", root+"/dangling"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient()
+	client.AllowedRoot = root
+	tests := []struct {
+		Filename string
+		Err      bool
+	}{
+		{root + "/file", false},
+		{root + "/new/file", false},
+		{root + "/link/file", false},
+		{root + "/escape/file", true},
+		{root + "/escape/new/file", true},
+		{root + "/dangling", true},
+		{root + "/../file", true},
+		{dir + "/outside/file", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Filename, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				err := client.Do(mustNewRequest(test.Filename, url)).Err()
+				if test.Err && err == nil {
+					t.Errorf("expected error for destination outside of allowed root")
+				} else if !test.Err && err != nil {
+					t.Error(err)
+				}
+				if test.Err && test.Filename != root+"/dangling" && !errors.Is(err, ErrDestinationNotAllowed) {
+					t.Errorf("expected error: %v, got: %v", ErrDestinationNotAllowed, err)
+				}
+			})
+		})
+	}
+	if entries, _ := os.ReadDir(dir + "/outside"); len(entries) != 0 {
+		t.Errorf("expected no files outside of allowed root, got: %d", len(entries))
+	}
+}
+
+// TestContentAddressedDestination ensures that the path of a file in a
+// content-addressed store is checked as any other destination before the file
+// is moved there.
+func TestContentAddressedDestination(t *testing.T) {
+	dir := ".testContentAddressedDestination"
+	defer os.RemoveAll(dir)
+	root := dir + "/root"
+	if err := os.MkdirAll(root, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir+"/outside", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", root+"/escape"); err != nil {
+		t.Fatal(err)
+	}
+	layout := func(sum []byte) string {
+		return "escape/" + hex.EncodeToString(sum)
+	}
+
+	t.Run("NoFollowSymlinks", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.ContentAddressed = &ContentAddress{Dir: root, Layout: layout}
+			req.NoFollowSymlinks = true
+			err := DefaultClient.Do(req).Err()
+			if !errors.Is(err, ErrSymlinkDestination) {
+				t.Errorf("expected error: %v, got: %v", ErrSymlinkDestination, err)
+			}
+		})
+	})
+
+	t.Run("AllowedRoot", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			client := NewClient()
+			client.AllowedRoot = root
+			req := mustNewRequest("", url)
+			req.ContentAddressed = &ContentAddress{Dir: root, Layout: layout}
+			err := client.Do(req).Err()
+			if !errors.Is(err, ErrDestinationNotAllowed) {
+				t.Errorf("expected error: %v, got: %v", ErrDestinationNotAllowed, err)
+			}
+		})
+	})
+
+	if entries, _ := os.ReadDir(dir + "/outside"); len(entries) != 0 {
+		t.Errorf("expected no files outside of the store, got: %d", len(entries))
+	}
+	if matches, _ := filepath.Glob(root + "/.grab-*"); len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, got: %v", matches)
+	}
+}
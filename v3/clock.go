@@ -0,0 +1,19 @@
+package grab
+
+import (
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/bps"
+)
+
+// Clock is the source of time of a Client, as set by Client.Clock.
+type Clock = bps.Clock
+
+// now returns the current time of the given Clock, or of the system clock if it
+// is nil.
+func now(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 
@@ -9,15 +10,32 @@ import (
 )
 
 func main() {
+	// parse command args
+	dst := flag.String("o", ".", "destination path, or - for standard output")
+	verbose := flag.Bool("v", false, "print the content type and warnings of each download")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-v] [-o dst] url...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// validate command args
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s url...\n", os.Args[0])
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	urls := flag.Args()
+	if *dst == "-" && len(urls) > 1 {
+		fmt.Fprintln(os.Stderr, "only one url can be written to standard output")
 		os.Exit(1)
 	}
-	urls := os.Args[1:]
 
 	// download files
-	respch, err := grabui.GetBatch(context.Background(), 0, ".", urls...)
+	getBatch := grabui.GetBatch
+	if *verbose {
+		getBatch = grabui.GetBatchVerbose
+	}
+	respch, err := getBatch(context.Background(), 0, *dst, urls...)
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,131 @@
+package grab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkDestination returns an error if the destination of the given transfer
+// is a symlink, or is in a symlinked directory, and Request.NoFollowSymlinks is
+// set, if it resolves to a path outside of Client.AllowedRoot, or if more
+// missing directories would be created for it than Request.MaxCreateDirDepth.
+func (c *Client) checkDestination(resp *Response) error {
+	if resp.req.NoStore || resp.Filename == "" || resp.Filename == "-" {
+		return nil
+	}
+	return c.checkDestinationPath(resp.req, resp.Filename)
+}
+
+// checkDestinationPath is checkDestination for the given path of a file that
+// is written for req.
+func (c *Client) checkDestinationPath(req *Request, filename string) error {
+	if max := req.MaxCreateDirDepth; max > 0 && !req.NoCreateDirectories {
+		dir := filepath.Dir(filename)
+		n, err := missingDirs(dir)
+		if err != nil {
+			return fmt.Errorf("error checking destination directory: %v", err)
+		}
+		if n > max {
+			return fmt.Errorf("%w: %d missing directories in %s, at most %d may be created",
+				ErrDirDepth, n, dir, max)
+		}
+	}
+	if !req.NoFollowSymlinks && c.AllowedRoot == "" {
+		return nil
+	}
+
+	name, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	base := ""
+	if c.AllowedRoot != "" {
+		root, err := filepath.Abs(c.AllowedRoot)
+		if err != nil {
+			return err
+		}
+		if isWithin(root, name) {
+			// the root itself is trusted, even if it is a symlink
+			base = root
+		}
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			return fmt.Errorf("error resolving allowed root: %v", err)
+		}
+		resolved, err := resolvePath(name)
+		if err != nil {
+			return fmt.Errorf("error resolving destination: %v", err)
+		}
+		if !isWithin(root, resolved) {
+			return fmt.Errorf("%w: %s", ErrDestinationNotAllowed, filename)
+		}
+	}
+	if req.NoFollowSymlinks {
+		return checkSymlinks(name, base)
+	}
+	return nil
+}
+
+// checkSymlinks returns ErrSymlinkDestination if the given absolute path, or
+// any existing directory that contains it, up to but excluding base, is a
+// symlink. If base is empty, all directories are checked.
+func checkSymlinks(name, base string) error {
+	for dir := name; dir != base; {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", ErrSymlinkDestination, dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return nil
+}
+
+// resolvePath returns the given absolute path with all symlinks resolved. The
+// path need not exist, in which case its deepest existing directory is
+// resolved.
+func resolvePath(name string) (string, error) {
+	rest := ""
+	for dir := name; ; {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(dir); err == nil {
+			// a dangling symlink, which would be followed to create its target
+			return "", fmt.Errorf("cannot resolve symlink: %s", dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return name, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// missingDirs returns the number of directories that would be created by
+// os.MkdirAll for the given path.
+func missingDirs(dir string) (int, error) {
+	n := 0
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			return n, nil
+		}
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		n++
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return n, nil
+		}
+		dir = parent
+	}
+}
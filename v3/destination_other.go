@@ -0,0 +1,7 @@
+//go:build !unix
+
+package grab
+
+// oNoFollow is zero, as opening a file without following symlinks is only
+// supported on Unix. Symlinks are still detected before the file is opened.
+const oNoFollow = 0
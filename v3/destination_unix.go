@@ -0,0 +1,8 @@
+//go:build unix
+
+package grab
+
+import "syscall"
+
+// oNoFollow is the flag that causes opening a symlink to fail.
+const oNoFollow = syscall.O_NOFOLLOW
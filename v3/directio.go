@@ -0,0 +1,159 @@
+package grab
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+)
+
+// directIOAlign is the alignment of the memory, file offsets and lengths of
+// writes to files opened with O_DIRECT. The page size is a multiple of the
+// logical block size of most devices.
+const directIOAlign = 4096
+
+var errDirectIOUnsupported = errors.New("direct I/O is not supported on this platform")
+
+// openFile opens the destination file of resp with the given flags and with
+// O_DIRECT if requested by Request.DirectIO and possible. The returned bool is
+// true if the file was opened with O_DIRECT. If direct I/O is not possible,
+// the file is opened normally and a Warning is raised.
+func openFile(resp *Response, flag int) (*os.File, bool, error) {
+	if resp.req.DirectIO {
+		err := errDirectIOUnsupported
+		if offset := resp.localOffset(); offset%directIOAlign != 0 {
+			err = errors.New("resume offset is not aligned")
+		} else if oDirect != 0 {
+			var f *os.File
+			f, err = os.OpenFile(resp.Filename, flag|oDirect, 0666)
+			if err == nil {
+				return f, true, nil
+			}
+		}
+		resp.warn(WarnDirectIO, err, "cannot use direct I/O, using buffered I/O")
+	}
+	f, err := os.OpenFile(resp.Filename, flag, 0666)
+	return f, false, err
+}
+
+// getAligned returns a buffer of the given size whose memory is aligned for
+// direct I/O, reusing a buffer released with putAligned if one is available.
+// Aligned buffers are pooled apart from those of get and put, so that a pooled
+// buffer of the right size is never found to be unaligned.
+func (c *bufferPool) getAligned(size int) []byte {
+	if b := pooledBuffer(&c.aligned, size); b != nil {
+		return b
+	}
+	b := make([]byte, size+directIOAlign)
+	offset := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) % directIOAlign); r != 0 {
+		offset = directIOAlign - r
+	}
+	return b[offset : offset+size : offset+size]
+}
+
+// putAligned releases a buffer returned by getAligned for reuse. The buffer
+// must no longer be used.
+func (c *bufferPool) putAligned(b []byte) {
+	releaseBuffer(&c.aligned, b)
+}
+
+func isAligned(b []byte) bool {
+	return len(b) > 0 && uintptr(unsafe.Pointer(&b[0]))%directIOAlign == 0
+}
+
+// directWriter writes to a file opened with O_DIRECT in aligned blocks. Bytes
+// are buffered until a whole block can be written and any unaligned tail is
+// written by Flush through a second file handle without O_DIRECT.
+type directWriter struct {
+	f *os.File
+
+	// b is aligned and its length is a multiple of directIOAlign.
+	b []byte
+	n int
+
+	// offset is the offset in the file of b[0].
+	offset int64
+
+	// release is called with b once the file is closed.
+	release func([]byte)
+}
+
+// newDirectWriter returns a directWriter for a file opened with O_DIRECT whose
+// file offset is the given aligned offset. The length of b must be a multiple
+// of directIOAlign.
+func newDirectWriter(f *os.File, offset int64, b []byte, release func([]byte)) *directWriter {
+	return &directWriter{f: f, b: b, offset: offset, release: release}
+}
+
+func (c *directWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(c.b[c.n:], p)
+		c.n += n
+		p = p[n:]
+		if c.n == len(c.b) {
+			if err := c.writeBlocks(c.n); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// writeBlocks writes the first n bytes of the buffer, which must be a multiple
+// of directIOAlign, and moves any remaining bytes to the start of the buffer.
+func (c *directWriter) writeBlocks(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if _, err := c.f.Write(c.b[:n]); err != nil {
+		return err
+	}
+	c.n = copy(c.b, c.b[n:c.n])
+	c.offset += int64(n)
+	return nil
+}
+
+// Flush writes all buffered bytes to the file. Once the unaligned tail of the
+// file has been written, no more bytes may be written.
+func (c *directWriter) Flush() error {
+	if err := c.writeBlocks(c.n &^ (directIOAlign - 1)); err != nil {
+		return err
+	}
+	if c.n == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(c.f.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(c.b[:c.n], c.offset); err != nil {
+		f.Close()
+		return err
+	}
+	c.offset += int64(c.n)
+	c.n = 0
+	return f.Close()
+}
+
+// Truncate truncates the file to the given size, which must be aligned, and
+// discards any buffered bytes.
+func (c *directWriter) Truncate(size int64) error {
+	c.n = 0
+	c.offset = size
+	return c.f.Truncate(size)
+}
+
+// Close flushes any buffered bytes and closes the file.
+func (c *directWriter) Close() error {
+	err := c.Flush()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	if c.b != nil {
+		c.release(c.b)
+		c.b = nil
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build linux
+
+package grab
+
+import "syscall"
+
+// oDirect is the flag used to open files for direct I/O.
+const oDirect = syscall.O_DIRECT
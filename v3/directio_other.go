@@ -0,0 +1,6 @@
+//go:build !linux
+
+package grab
+
+// oDirect is zero, as direct I/O is only supported on Linux.
+const oDirect = 0
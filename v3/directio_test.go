@@ -0,0 +1,142 @@
+package grab
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// testContent returns the content served by grabtest for the given size.
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestDirectWriter(t *testing.T) {
+	filename := ".testDirectWriter"
+	defer os.Remove(filename)
+	expect := testContent(3*directIOAlign + 123)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool bufferPool
+	b := pool.getAligned(2 * directIOAlign)
+	if !isAligned(b) || len(b) != 2*directIOAlign {
+		t.Fatalf("expected aligned buffer of %d bytes", 2*directIOAlign)
+	}
+	w := newDirectWriter(f, 0, b, pool.putAligned)
+
+	// write in chunks that straddle block boundaries
+	for p := expect; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expect) {
+		t.Errorf("expected %d bytes written, got %d bytes", len(expect), len(actual))
+	}
+}
+
+// TestAlignedBufferPool ensures that aligned buffers are reused by getAligned
+// while unaligned buffers of the same size are released with put.
+func TestAlignedBufferPool(t *testing.T) {
+	var pool bufferPool
+	size := 2 * directIOAlign
+	reused := 0
+	for i := 0; i < 100; i++ {
+		b := pool.getAligned(size)
+		if !isAligned(b) || len(b) != size {
+			t.Fatalf("expected aligned buffer of %d bytes", size)
+		}
+		pool.putAligned(b)
+
+		// an unaligned buffer of the same size
+		u := make([]byte, size+1)[1:]
+		pool.put(u)
+		pool.put(pool.get(size))
+
+		if a := pool.getAligned(size); &a[0] == &b[0] {
+			reused++
+		} else {
+			pool.putAligned(a)
+		}
+	}
+	if reused == 0 {
+		t.Errorf("expected aligned buffers to be reused")
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	filename := ".testDirectIO"
+	defer os.Remove(filename)
+
+	tests := []struct {
+		Name   string
+		Size   int
+		Resume int
+		Warn   bool
+	}{
+		{Name: "WithAlignedSize", Size: 64 * directIOAlign},
+		{Name: "WithUnalignedSize", Size: 64*directIOAlign + 123},
+		{Name: "WithSmallFile", Size: 123},
+		{Name: "WithAlignedResume", Size: 64*directIOAlign + 123, Resume: 8 * directIOAlign},
+		{Name: "WithUnalignedResume", Size: 64*directIOAlign + 123, Resume: 1000, Warn: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			expect := testContent(test.Size)
+			os.Remove(filename)
+			if test.Resume > 0 {
+				if err := os.WriteFile(filename, expect[:test.Resume], 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.DirectIO = true
+				req.BufferSize = 10000
+				resp := mustDo(req)
+
+				warned := false
+				for _, w := range resp.Warnings() {
+					if w.Code == WarnDirectIO {
+						warned = true
+						t.Logf("%v", w)
+					}
+				}
+				// other cases may warn if the filesystem does not support
+				// O_DIRECT
+				if test.Warn && !warned {
+					t.Errorf("expected direct I/O warning")
+				}
+
+				actual, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(actual, expect) {
+					t.Errorf("expected %d bytes written, got %d bytes", len(expect), len(actual))
+				}
+			}, grabtest.ContentLength(test.Size))
+		})
+	}
+}
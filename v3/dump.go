@@ -0,0 +1,112 @@
+package grab
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// dumpQueueSize is the number of wire dumps of a transfer that may be waiting
+// to be written to Request.DebugDump before further dumps are dropped.
+const dumpQueueSize = 64
+
+// redactedHeaders are the headers whose values are replaced in wire dumps,
+// unless Request.DebugDumpUnsafe is true.
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// dumper writes the wire dumps of a transfer to Request.DebugDump from its own
+// goroutine, so that a slow writer never blocks the transfer. Dumps are
+// dropped while the queue is full.
+type dumper struct {
+	queue   chan []byte
+	unsafe  bool
+	dropped bool
+}
+
+func newDumper(w io.Writer, unsafe bool) *dumper {
+	d := &dumper{
+		queue:  make(chan []byte, dumpQueueSize),
+		unsafe: unsafe,
+	}
+	go func() {
+		for b := range d.queue {
+			w.Write(b)
+		}
+	}()
+	return d
+}
+
+// request queues a dump of an outgoing request, without its body.
+func (d *dumper) request(resp *Response, req *http.Request) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = d.redact(req.Header)
+	b, err := httputil.DumpRequestOut(r, false)
+	d.send(resp, "request", b, err)
+}
+
+// response queues a dump of the headers of a response, or of the error that
+// prevented it.
+func (d *dumper) response(resp *Response, hresp *http.Response, err error) {
+	if err != nil {
+		d.send(resp, "response", nil, err)
+		return
+	}
+	r := new(http.Response)
+	*r = *hresp
+	r.Header = d.redact(hresp.Header)
+	b, err := httputil.DumpResponse(r, false)
+	if err == nil {
+		if n := hresp.ContentLength; n >= 0 {
+			b = fmt.Appendf(b, "[body elided: %d bytes]\r\n", n)
+		} else {
+			b = append(b, "[body elided: unknown length]\r\n"...)
+		}
+	}
+	d.send(resp, "response", b, err)
+}
+
+func (d *dumper) send(resp *Response, kind string, b []byte, err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- grab %s %s\r\n", kind, time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		fmt.Fprintf(&buf, "[error: %v]\r\n", err)
+	}
+	buf.Write(b)
+	buf.WriteString("\r\n")
+	select {
+	case d.queue <- buf.Bytes():
+	default:
+		if !d.dropped {
+			d.dropped = true
+			resp.warn(WarnDebugDump, nil,
+				"debug dump writer is too slow, dropping wire dumps")
+		}
+	}
+}
+
+func (d *dumper) redact(h http.Header) http.Header {
+	if d.unsafe {
+		return h
+	}
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := h[k]; ok {
+			h.Set(k, "[REDACTED]")
+		}
+	}
+	return h
+}
+
+// close stops the dumper once all queued dumps are written.
+func (d *dumper) close() {
+	close(d.queue)
+}
@@ -0,0 +1,148 @@
+package grab
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *syncBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+func (c *syncBuffer) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// waitDumps waits until n wire dumps have been written to buf, as dumps are
+// written asynchronously.
+func waitDumps(t *testing.T, buf *syncBuffer, n int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := buf.String()
+		if strings.Count(s, "--- grab ") >= n {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d wire dumps, got:\n%s", n, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDebugDump ensures that every request and response of a transfer is dumped
+// to Request.DebugDump, with sensitive headers redacted unless
+// Request.DebugDumpUnsafe is set.
+func TestDebugDump(t *testing.T) {
+	filename := ".testDebugDump"
+	defer os.Remove(filename)
+	size := 1024
+
+	t.Run("WithResume", func(t *testing.T) {
+		if err := os.WriteFile(filename, testContent(size)[:size/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			var buf syncBuffer
+			req := mustNewRequest(filename, url)
+			req.HTTPRequest.Header.Set("Authorization", "Bearer secret")
+			req.HTTPRequest.Header.Set("Cookie", "session=secret")
+			req.DebugDump = &buf
+			testComplete(t, mustDo(req))
+
+			// HEAD request and response, then ranged GET request and response
+			s := waitDumps(t, &buf, 4)
+			if strings.Contains(s, "secret") {
+				t.Errorf("expected sensitive headers to be redacted, got:\n%s", s)
+			}
+			for _, v := range []string{
+				"--- grab request ",
+				"HEAD / HTTP/1.1",
+				"GET / HTTP/1.1",
+				"Range: bytes=512-",
+				"Authorization: [REDACTED]",
+				"--- grab response ",
+				"HTTP/1.1 206 Partial Content",
+				"[body elided: 512 bytes]",
+			} {
+				if !strings.Contains(s, v) {
+					t.Errorf("expected dump to contain %q, got:\n%s", v, s)
+				}
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithUnsafe", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var buf syncBuffer
+			req := mustNewRequest("", url+"/.testDebugDumpUnsafe")
+			req.HTTPRequest.Header.Set("Authorization", "Bearer secret")
+			req.DebugDump = &buf
+			req.DebugDumpUnsafe = true
+			resp := mustDo(req)
+			defer os.Remove(resp.Filename)
+
+			s := waitDumps(t, &buf, 2)
+			if !strings.Contains(s, "Authorization: Bearer secret") {
+				t.Errorf("expected Authorization header to be dumped, got:\n%s", s)
+			}
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		var buf syncBuffer
+		req := mustNewRequest("", "http://127.0.0.1:0/.testDebugDumpError")
+		req.DebugDump = &buf
+		if err := DefaultClient.Do(req).Err(); err == nil {
+			t.Fatal("expected error")
+		}
+		if s := waitDumps(t, &buf, 2); !strings.Contains(s, "[error: ") {
+			t.Errorf("expected error to be dumped, got:\n%s", s)
+		}
+	})
+}
+
+// blockingWriter is an io.Writer that blocks until it is closed.
+type blockingWriter chan struct{}
+
+func (c blockingWriter) Write(p []byte) (int, error) {
+	<-c
+	return len(p), nil
+}
+
+// TestDebugDumpDropped ensures that wire dumps are dropped with a Warning
+// rather than blocking the transfer when Request.DebugDump falls behind.
+func TestDebugDumpDropped(t *testing.T) {
+	w := make(blockingWriter)
+	defer close(w)
+	resp := &Response{}
+	d := newDumper(w, false)
+	defer d.close()
+	hreq, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < dumpQueueSize+2; i++ {
+		d.request(resp, hreq)
+	}
+	warnings := resp.Warnings()
+	if len(warnings) != 1 || warnings[0].Code != WarnDebugDump {
+		t.Errorf("expected a single %s warning, got: %v", WarnDebugDump, warnings)
+	}
+}
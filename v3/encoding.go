@@ -0,0 +1,188 @@
+package grab
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Decoder returns a reader that decodes a response body r that is encoded
+// with a content coding, such as "br" or "zstd". If the returned reader
+// implements io.Closer, it is closed once the transfer is complete.
+type Decoder func(r io.Reader) (io.Reader, error)
+
+var decoders = struct {
+	sync.RWMutex
+	m map[string]Decoder
+}{m: map[string]Decoder{
+	"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+}}
+
+// RegisterDecoder makes a Decoder available for the given content coding, as
+// named in the Content-Encoding header. It is intended to be called from the
+// init function of packages that provide a Decoder, such as
+// github.com/3JoB/grab/v3/pkg/grabzstd, so that importing the package enables
+// the content coding without forcing its dependencies on all users.
+//
+// If a Decoder other than the builtin gzip Decoder is registered, grab
+// advertises all registered content codings in the Accept-Encoding header of
+// requests that do not set it, and decodes responses itself. Only responses
+// encoded with a registered content coding are decoded; any other response is
+// stored as it was received.
+func RegisterDecoder(encoding string, d Decoder) {
+	if d == nil {
+		panic("grab: RegisterDecoder decoder is nil")
+	}
+	decoders.Lock()
+	defer decoders.Unlock()
+	decoders.m[strings.ToLower(encoding)] = d
+}
+
+// decoder returns the Decoder registered for the given content coding, or nil.
+func decoder(encoding string) Decoder {
+	decoders.RLock()
+	defer decoders.RUnlock()
+	return decoders.m[strings.ToLower(strings.TrimSpace(encoding))]
+}
+
+// acceptEncoding returns the value of the Accept-Encoding header that
+// advertises all registered content codings, preferring gzip last, and
+// whether any content coding other than gzip is registered.
+func acceptEncoding() (string, bool) {
+	decoders.RLock()
+	defer decoders.RUnlock()
+	encodings := make([]string, 0, len(decoders.m))
+	for encoding := range decoders.m {
+		if encoding != "gzip" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	sort.Strings(encodings)
+	custom := len(encodings) > 0
+	encodings = append(encodings, "gzip")
+	return strings.Join(encodings, ", "), custom
+}
+
+// decodedBody is an encoded response body that is decoded as it is read,
+// failing with ErrCompressionRatio if the number of decoded bytes exceeds the
+// number of encoded bytes read by more than the given ratio. The decoders are
+// applied in order, so the decoder of the last content coding applied by the
+// remote server comes first.
+type decodedBody struct {
+	body     io.ReadCloser
+	raw      countingReader
+	decoders []Decoder
+	readers  []io.Reader
+	r        io.Reader
+	ratio    float64
+	n        int64
+}
+
+func newDecodedBody(body io.ReadCloser, decoders []Decoder, ratio float64) *decodedBody {
+	c := &decodedBody{body: body, decoders: decoders, ratio: ratio}
+	c.raw.r = body
+	return c
+}
+
+func (c *decodedBody) Read(p []byte) (n int, err error) {
+	if c.r == nil {
+		// deferred until the first read, as decoders may read a header from
+		// the remote server
+		var r io.Reader = &c.raw
+		for _, d := range c.decoders {
+			if r, err = d(r); err != nil {
+				return 0, err
+			}
+			c.readers = append(c.readers, r)
+		}
+		c.r = r
+	}
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	if c.ratio > 0 && float64(c.n) > c.ratio*float64(c.raw.n) {
+		return n, ErrCompressionRatio
+	}
+	return n, err
+}
+
+func (c *decodedBody) Close() error {
+	for i := len(c.readers) - 1; i >= 0; i-- {
+		if closer, ok := c.readers[i].(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return c.body.Close()
+}
+
+// negotiateEncoding returns a shallow copy of the given request that accepts
+// the registered content codings, which grab will decode itself instead of
+// relying on the transparent decompression of http.Transport. The request is
+// returned unmodified if it already specifies an encoding or a range, or if
+// grab has no reason to decode responses itself: the compression ratio is
+// not limited and no content coding other than gzip is registered.
+func negotiateEncoding(req *http.Request, ratio float64) *http.Request {
+	if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return req
+	}
+	accept, custom := acceptEncoding()
+	if ratio <= 0 && !custom {
+		return req
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	r.Header.Set("Accept-Encoding", accept)
+	return r
+}
+
+// contentCodings returns the content codings named in the Content-Encoding
+// header of the given response, in lower-case and in the order they were
+// applied, ignoring the identity coding.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// decodeBody replaces the body of an encoded response with a body that decodes
+// it, and updates the response as http.Transport would for a transparently
+// decompressed response. Stacked content codings, such as "gzip, br", are
+// decoded in the reverse order of the Content-Encoding header. It returns the
+// decoded content codings, or an empty string if the response was not encoded
+// or a content coding is not registered, in which case the response is stored
+// as received. If strict is true, an unregistered content coding fails with
+// ErrUnsupportedEncoding instead.
+func decodeBody(resp *http.Response, ratio float64, strict bool) (string, error) {
+	codings := contentCodings(resp.Header)
+	if len(codings) == 0 {
+		return "", nil
+	}
+	decoders := make([]Decoder, 0, len(codings))
+	for i := len(codings) - 1; i >= 0; i-- {
+		d := decoder(codings[i])
+		if d == nil {
+			if strict {
+				return "", fmt.Errorf("%w: %s", ErrUnsupportedEncoding, codings[i])
+			}
+			return "", nil
+		}
+		decoders = append(decoders, d)
+	}
+	resp.Body = newDecodedBody(resp.Body, decoders, ratio)
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return strings.Join(codings, ", "), nil
+}
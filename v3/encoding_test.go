@@ -0,0 +1,167 @@
+package grab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestRegisterDecoder ensures that registered content codings are negotiated
+// and decoded.
+func TestRegisterDecoder(t *testing.T) {
+	filename := ".testRegisterDecoder"
+	defer os.Remove(filename)
+
+	RegisterDecoder("X-Base64", func(r io.Reader) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	})
+	defer func() {
+		decoders.Lock()
+		delete(decoders.m, "x-base64")
+		decoders.Unlock()
+	}()
+
+	content := []byte("hello, world")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept-Encoding")
+		if v := "x-base64, gzip"; accept != v {
+			t.Errorf("expected Accept-Encoding: %q, got: %q", v, accept)
+		}
+		if strings.HasSuffix(r.URL.Path, "/unknown") {
+			// an encoding that was not requested is stored as received
+			w.Header().Set("Content-Encoding", "x-unknown")
+			w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Encoding", "x-base64")
+		io.WriteString(w, base64.StdEncoding.EncodeToString(content))
+	}))
+	defer s.Close()
+
+	for _, path := range []string{"/file", "/unknown"} {
+		os.Remove(filename)
+		resp := mustDo(mustNewRequest(filename, s.URL+path))
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("%s: expected content %q, got %q", path, content, b)
+		}
+		expect := "x-base64"
+		if path == "/unknown" {
+			expect = ""
+		}
+		if resp.ContentEncoding != expect {
+			t.Errorf("%s: expected ContentEncoding: %q, got: %q", path, expect, resp.ContentEncoding)
+		}
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	filename := ".testContentEncoding"
+	defer os.Remove(filename)
+
+	for _, ratio := range []float64{0, 10000} {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.MaxCompressionRatio = ratio
+			resp := mustDo(req)
+			if resp.ContentEncoding != "gzip" {
+				t.Errorf("expected ContentEncoding: %q, got: %q", "gzip", resp.ContentEncoding)
+			}
+		},
+			grabtest.Gzip(true),
+		)
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		os.Remove(filename)
+		resp := mustDo(mustNewRequest(filename, url))
+		if resp.ContentEncoding != "" {
+			t.Errorf("expected empty ContentEncoding, got: %q", resp.ContentEncoding)
+		}
+	})
+}
+
+// TestStackedEncodings ensures that responses encoded with several content
+// codings are decoded in reverse order, and that unsupported content codings
+// fail transfers with Request.RequireDecoding.
+func TestStackedEncodings(t *testing.T) {
+	filename := ".testStackedEncodings"
+	defer os.Remove(filename)
+
+	RegisterDecoder("x-base64", func(r io.Reader) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	})
+	defer func() {
+		decoders.Lock()
+		delete(decoders.m, "x-base64")
+		decoders.Unlock()
+	}()
+
+	content := []byte("hello, world")
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(content)
+	zw.Close()
+	encoded := base64.StdEncoding.EncodeToString(gzipped.Bytes())
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/unknown") {
+			w.Header().Set("Content-Encoding", "x-unknown, x-base64")
+		} else {
+			w.Header().Set("Content-Encoding", "gzip, X-Base64")
+		}
+		io.WriteString(w, encoded)
+	}))
+	defer s.Close()
+
+	t.Run("Default", func(t *testing.T) {
+		os.Remove(filename)
+		resp := mustDo(mustNewRequest(filename, s.URL+"/file"))
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("expected content %q, got %q", content, b)
+		}
+		if expect := "gzip, x-base64"; resp.ContentEncoding != expect {
+			t.Errorf("expected ContentEncoding: %q, got: %q", expect, resp.ContentEncoding)
+		}
+	})
+
+	t.Run("WithUnsupportedEncoding", func(t *testing.T) {
+		// stored as received, as only some of the content codings are known
+		os.Remove(filename)
+		resp := mustDo(mustNewRequest(filename, s.URL+"/unknown"))
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != encoded || resp.ContentEncoding != "" {
+			t.Errorf("expected encoded content to be stored, got %q (ContentEncoding: %q)",
+				b, resp.ContentEncoding)
+		}
+	})
+
+	t.Run("WithRequireDecoding", func(t *testing.T) {
+		os.Remove(filename)
+		req := mustNewRequest(filename, s.URL+"/unknown")
+		req.RequireDecoding = true
+		err := DefaultClient.Do(req).Err()
+		if !errors.Is(err, ErrUnsupportedEncoding) {
+			t.Errorf("expected error: %v, got: %v", ErrUnsupportedEncoding, err)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package grab
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -23,8 +24,130 @@ var (
 	// determined using the response headers from the remote server.
 	ErrNoTimestamp = errors.New("no timestamp could be determined for the remote file")
 
+	// ErrBadResumeOffset indicates that Request.ResumeFrom is beyond the end of
+	// the remote file.
+	ErrBadResumeOffset = errors.New("resume offset exceeds remote file size")
+
+	// ErrSingleUseExhausted indicates that a transfer for a Request with
+	// SingleUse enabled failed after its only request to the remote server and
+	// cannot be resumed.
+	ErrSingleUseExhausted = errors.New("single use request failed")
+
+	// ErrBadHeader indicates that the response from the remote server was
+	// missing a header specified in Request.RequireHeaders, or that the header
+	// had a different value.
+	ErrBadHeader = errors.New("missing or mismatched required header")
+
+	// ErrMaxBytes indicates that the file transfer exceeded Request.MaxBytes.
+	ErrMaxBytes = errors.New("transfer exceeds maximum size")
+
+	// ErrCompressionRatio indicates that the decompressed response body
+	// exceeded Request.MaxCompressionRatio.
+	ErrCompressionRatio = errors.New("compression ratio exceeds maximum")
+
+	// ErrDestinationChanged indicates that Request.BeforeCopy changed the
+	// destination of a transfer whose response depends on its destination,
+	// such as a resumed transfer.
+	ErrDestinationChanged = errors.New("destination cannot be changed for this transfer")
+
+	// ErrCrossHostRedirect indicates that a request was redirected to a
+	// different host more often than permitted by
+	// Client.MaxCrossHostRedirects.
+	ErrCrossHostRedirect = errors.New("too many redirects to another host")
+
+	// ErrNotResumable indicates that the remote server does not support ranged
+	// requests, so the transfer could not be resumed if it failed, and
+	// Request.RequireResumable is set.
+	ErrNotResumable = errors.New("remote server does not support resuming transfers")
+
+	// ErrUnsupportedEncoding indicates that the response body was encoded with
+	// a content coding for which no Decoder is registered, as required by
+	// Request.RequireDecoding.
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+	// ErrUnknownSize indicates that an existing file could not be resumed
+	// because the size of the remote file is unknown, as required by
+	// UnknownSizeFail.
+	ErrUnknownSize = errors.New("cannot resume file of unknown size")
+
+	// ErrBadWriteOffset indicates that Request.WriteOffset, or the range
+	// written there, is beyond the end of the destination file.
+	ErrBadWriteOffset = errors.New("write offset exceeds destination file")
+
+	// ErrRangeIgnored indicates that the remote server returned the whole file
+	// rather than the range requested for Request.WriteOffset or
+	// Request.Range.
+	ErrRangeIgnored = errors.New("remote server ignored range request")
+
+	// ErrBadContentRange indicates that the Content-Range of a response to
+	// the request for a Request.Range does not match the requested range, as
+	// when the range extends beyond the end of the remote file.
+	ErrBadContentRange = errors.New("content range does not match requested range")
+
+	// ErrRemoteChanged indicates that the remote file changed while an existing
+	// file was being resumed, as the remote server rejected the validators
+	// from a previous response with 412 Precondition Failed.
+	ErrRemoteChanged = errors.New("remote file changed")
+
+	// ErrQuotaExceeded indicates that the Client has downloaded
+	// Client.MaxTotalBytes.
+	ErrQuotaExceeded = errors.New("client download quota exceeded")
+
+	// ErrTooManyMetaRefreshes indicates that the remote server responded with
+	// more HTML pages that refresh to another URL than allowed by
+	// Request.MaxMetaRefreshes.
+	ErrTooManyMetaRefreshes = errors.New("stopped after too many meta refresh redirects")
+
+	// ErrTransferTimeout indicates that a transfer did not complete within
+	// Client.PerTransferTimeout. It wraps context.DeadlineExceeded.
+	ErrTransferTimeout = fmt.Errorf("transfer timeout: %w", context.DeadlineExceeded)
+
+	// ErrBatchDeadline indicates that a transfer did not complete before the
+	// BatchOptions.Deadline of its batch. It wraps context.DeadlineExceeded.
+	ErrBatchDeadline = fmt.Errorf("batch deadline: %w", context.DeadlineExceeded)
+
+	// ErrProxyInterference indicates that the response from the remote server
+	// may have been altered by a proxy and Request.FailOnInterference is set.
+	ErrProxyInterference = errors.New("response may have been altered by a proxy")
+
+	// ErrUnknownArchive indicates that GetAndExtract downloaded a file that is
+	// not an archive of a supported type.
+	ErrUnknownArchive = errors.New("unknown archive type")
+
+	// ErrNoFile indicates that Response.OpenFile was called for a transfer that
+	// did not produce a complete local file.
+	ErrNoFile = errors.New("no downloaded file")
+
+	// ErrSymlinkDestination indicates that the destination path, or a directory
+	// in it, is a symlink and Request.NoFollowSymlinks is set.
+	ErrSymlinkDestination = errors.New("destination is a symlink")
+
+	// ErrDestinationNotAllowed indicates that the destination path resolves to
+	// a path outside of Client.AllowedRoot.
+	ErrDestinationNotAllowed = errors.New("destination is outside of allowed root")
+
+	// ErrDirDepth indicates that more missing directories would be created for
+	// the destination path than allowed by Request.MaxCreateDirDepth.
+	ErrDirDepth = errors.New("too many missing destination directories")
+
 	// ErrFileExists indicates that the destination path already exists.
 	ErrFileExists = errors.New("file exists")
+
+	// ErrForbiddenURL indicates that a URL was not requested because it is
+	// forbidden by Client.URLPolicy.
+	ErrForbiddenURL = errors.New("forbidden URL")
+
+	// ErrCanceledByTag is the reason given to transfers canceled by
+	// Client.CancelByTag.
+	ErrCanceledByTag = errors.New("canceled by tag")
+
+	// ErrDeferred is the reason given to transfers canceled by
+	// Response.Defer.
+	ErrDeferred = errors.New("transfer deferred")
+
+	// ErrNotDeferrable is returned by Response.Defer if the transfer has
+	// already started copying the response body.
+	ErrNotDeferrable = errors.New("transfer cannot be deferred once copying has started")
 )
 
 // StatusCodeError indicates that the server response had a status code that
@@ -40,3 +163,48 @@ func IsStatusCodeError(err error) bool {
 	_, ok := err.(StatusCodeError)
 	return ok
 }
+
+// PanicError indicates that a panic occurred during a file transfer, such as a
+// panic in a user provided Hook, and was recovered. See
+// Client.PropagatePanics.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic during transfer: %v", err.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error, such as a
+// runtime.Error.
+func (err *PanicError) Unwrap() error {
+	if e, ok := err.Value.(error); ok {
+		return e
+	}
+	return nil
+}
+
+// SizeMismatchError indicates that the size of the remote file, as reported
+// by the remote server or as discovered by the transfer, does not match
+// Request.Size. errors.Is(err, ErrBadLength) is true for a SizeMismatchError.
+type SizeMismatchError struct {
+	// Expected is the size given by Request.Size.
+	Expected int64
+
+	// Reported is the size of the remote file.
+	Reported int64
+}
+
+func (err SizeMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %d bytes, remote file has %d bytes",
+		ErrBadLength, err.Expected, err.Reported)
+}
+
+// Is returns true if target is ErrBadLength.
+func (err SizeMismatchError) Is(target error) bool {
+	return target == ErrBadLength
+}
@@ -0,0 +1,258 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GetAndExtract downloads the .tar.gz, .tar or .zip archive at the given URL
+// to a temporary file and extracts it into the directory dst, which is created
+// if it does not exist. The caller is blocked until the archive is extracted.
+// The temporary file is always removed.
+//
+// The given options are applied to the Request before it is sent, for example
+// to validate the archive with Request.SetChecksum. The archive type is
+// detected from its content, or from its file extension for tar archives.
+//
+// An error is returned if the download fails, if the archive type is not
+// supported (ErrUnknownArchive) or if the archive contains a path that would
+// be extracted outside of dst.
+func GetAndExtract(dst, urlStr string, opts ...func(*Request)) error {
+	dir, err := os.MkdirTemp("", "grab-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	req, err := NewRequest(dir, urlStr)
+	if err != nil {
+		return err
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	resp := DefaultClient.Do(req)
+	if err := resp.Err(); err != nil {
+		return err
+	}
+	return extractArchive(resp.Filename, dst)
+}
+
+// extractArchive extracts the archive at the given path into the directory
+// dst.
+func extractArchive(name, dst string) error {
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		return extractZip(r, dst)
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return extractTar(tar.NewReader(gr), dst)
+
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar",
+		strings.EqualFold(filepath.Ext(name), ".tar"):
+		return extractTar(tar.NewReader(br), dst)
+	}
+	return ErrUnknownArchive
+}
+
+func extractTar(r *tar.Reader, dst string) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := extractPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, 0777)
+		case tar.TypeReg:
+			err = extractFile(name, r, hdr.FileInfo().Mode())
+		case tar.TypeSymlink:
+			err = extractSymlink(dst, name, hdr.Linkname)
+		case tar.TypeLink:
+			var target string
+			if target, err = extractPath(dst, hdr.Linkname); err == nil {
+				err = os.Link(target, name)
+			}
+		default:
+			// devices, fifos and metadata entries are not extracted
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(r *zip.Reader, dst string) error {
+	for _, f := range r.File {
+		name, err := extractPath(dst, f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(name, 0777); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			var b []byte
+			if b, err = io.ReadAll(rc); err == nil {
+				err = extractSymlink(dst, name, string(b))
+			}
+		} else {
+			err = extractFile(name, rc, mode)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractPath returns the path in dst of an archive entry, or an error if the
+// entry would be extracted outside of dst, as in a zip-slip attack. Entries are
+// never extracted through a symlink, whether it was created by an earlier entry
+// of the archive or already existed, as its target is not where the path says.
+func extractPath(dst, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry has an absolute path: %s", name)
+	}
+	path := filepath.Join(dst, name)
+	if !isWithin(dst, path) {
+		return "", fmt.Errorf("archive entry is outside of destination: %s", name)
+	}
+	if link := throughSymlink(dst, path); link != "" {
+		return "", fmt.Errorf("archive entry is extracted through symlink %s: %s", link, name)
+	}
+	return path, nil
+}
+
+// throughSymlink returns the first existing symlink among the directories
+// between dst and path, which must be within dst, or "" if there is none.
+func throughSymlink(dst, path string) string {
+	rel, err := filepath.Rel(dst, path)
+	if err != nil {
+		return ""
+	}
+	dir := dst
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			// neither it nor anything below it exists yet
+			return ""
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return dir
+		}
+	}
+	return ""
+}
+
+// isDescending returns true if the given path has no ".." element after any
+// other name.
+func isDescending(path string) bool {
+	named := false
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+		case "..":
+			if named {
+				return false
+			}
+		default:
+			named = true
+		}
+	}
+	return true
+}
+
+// isWithin returns true if path is dir or is inside dir.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func extractFile(name string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("archive entry would be written through symlink: %s", name)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractSymlink creates a symlink at name, which must be in dst, unless its
+// target is outside of dst. The target may only go up with ".." before naming
+// any directory, as a directory named in the target may later be replaced by a
+// symlink of the archive, so that its ".." would not be where it appears.
+func extractSymlink(dst, name, target string) error {
+	target = filepath.FromSlash(target)
+	resolved := target
+	if !filepath.IsAbs(target) {
+		resolved = filepath.Join(filepath.Dir(name), target)
+	}
+	if !isWithin(dst, resolved) || !isDescending(target) {
+		return fmt.Errorf("archive symlink is outside of destination: %s -> %s", name, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	return os.Symlink(target, name)
+}
@@ -0,0 +1,177 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testArchiveEntry is a file in a test archive. A Linkname makes it a symlink.
+type testArchiveEntry struct {
+	Name, Body, Linkname string
+}
+
+func newTestTarGz(t *testing.T, entries ...testArchiveEntry) []byte {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0644, Size: int64(len(e.Body)), Typeflag: tar.TypeReg}
+		if e.Linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.Linkname
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func newTestZip(t *testing.T, entries ...testArchiveEntry) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		w, err := zw.Create(e.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// withArchiveServer serves the given archive at /<name>.
+func withArchiveServer(t *testing.T, name string, archive []byte, f func(url string)) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(archive))
+	}))
+	defer s.Close()
+	f(s.URL + "/" + name)
+}
+
+func TestGetAndExtract(t *testing.T) {
+	entries := []testArchiveEntry{
+		{Name: "release/README", Body: "hello"},
+		{Name: "release/bin/tool", Body: "binary"},
+	}
+	archives := map[string][]byte{
+		"release.tar.gz": newTestTarGz(t, entries...),
+		"release.zip":    newTestZip(t, entries...),
+	}
+	for name, archive := range archives {
+		t.Run(name, func(t *testing.T) {
+			dst := ".testGetAndExtract"
+			defer os.RemoveAll(dst)
+			withArchiveServer(t, name, archive, func(url string) {
+				sum := sha256.Sum256(archive)
+				err := GetAndExtract(dst, url, func(req *Request) {
+					req.SetChecksum(sha256.New(), sum[:], false)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range entries {
+					b, err := os.ReadFile(filepath.Join(dst, e.Name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(b) != e.Body {
+						t.Errorf("expected %s to contain %q, got %q", e.Name, e.Body, b)
+					}
+				}
+			})
+		})
+	}
+
+	t.Run("WithBadChecksum", func(t *testing.T) {
+		dst := ".testGetAndExtractBadChecksum"
+		defer os.RemoveAll(dst)
+		withArchiveServer(t, "release.zip", archives["release.zip"], func(url string) {
+			err := GetAndExtract(dst, url, func(req *Request) {
+				req.SetChecksum(sha256.New(), []byte("bad"), false)
+			})
+			if err != ErrBadChecksum {
+				t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Errorf("expected nothing to be extracted")
+			}
+		})
+	})
+
+	t.Run("WithUnknownArchive", func(t *testing.T) {
+		withArchiveServer(t, "release.txt", []byte("not an archive"), func(url string) {
+			dst := ".testGetAndExtractUnknown"
+			defer os.RemoveAll(dst)
+			if err := GetAndExtract(dst, url); err != ErrUnknownArchive {
+				t.Errorf("expected error: %v, got: %v", ErrUnknownArchive, err)
+			}
+		})
+	})
+}
+
+// TestExtractSlip ensures that archive entries cannot be extracted outside of
+// the destination directory.
+func TestExtractSlip(t *testing.T) {
+	tests := map[string][]byte{
+		"ZipParent":      newTestZip(t, testArchiveEntry{Name: "../evil", Body: "x"}),
+		"TarParent":      newTestTarGz(t, testArchiveEntry{Name: "a/../../evil", Body: "x"}),
+		"TarAbsolute":    newTestTarGz(t, testArchiveEntry{Name: "/evil", Body: "x"}),
+		"TarSymlinkSlip": newTestTarGz(t, testArchiveEntry{Name: "link", Linkname: "../.."}, testArchiveEntry{Name: "link/evil", Body: "x"}),
+		"TarNestedSymlinkSlip": newTestTarGz(t,
+			testArchiveEntry{Name: "s", Linkname: "."},
+			testArchiveEntry{Name: "s/l", Linkname: ".."},
+			testArchiveEntry{Name: "s/l/evil", Body: "x"}),
+		"TarSymlinkThroughLaterSymlink": newTestTarGz(t,
+			testArchiveEntry{Name: "l", Linkname: "s/.."},
+			testArchiveEntry{Name: "s", Linkname: "."}),
+		"TarFileThroughSymlink": newTestTarGz(t,
+			testArchiveEntry{Name: "l", Linkname: "f"},
+			testArchiveEntry{Name: "l", Body: "x"}),
+	}
+	dir := ".testExtractSlip"
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+	for name, archive := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(dir, name)
+			os.RemoveAll(dst)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filename, archive, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := extractArchive(filename, dst); err == nil {
+				t.Errorf("expected error extracting malicious archive")
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+				t.Errorf("expected no file outside of destination")
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package grab
+
+import (
+	"io"
+	"time"
+)
+
+// syncer is implemented by the writers of files that can be committed to
+// stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// flushWriter periodically commits the file of a transfer to stable storage as
+// it is written, as requested by Request.FlushInterval and Request.FlushEvery,
+// and saves the hash state of the transfer, if any, to match the flushed
+// file.
+type flushWriter struct {
+	w     io.Writer
+	f     syncer
+	resp  *Response
+	clock Clock
+
+	every    int64
+	interval time.Duration
+
+	// n is the number of bytes written since the last flush, at time last.
+	n    int64
+	last time.Time
+
+	warned bool
+}
+
+// newFlushWriter returns a flushWriter that writes to the given writer of a
+// transfer, or w itself if the transfer is not flushed.
+func newFlushWriter(resp *Response, w io.Writer, clock Clock) io.Writer {
+	req := resp.req
+	if (req.FlushInterval <= 0 && req.FlushEvery <= 0) || resp.stream {
+		return w
+	}
+	f, ok := resp.writer.(syncer)
+	if !ok {
+		// not a file, or written with O_DIRECT
+		return w
+	}
+	return &flushWriter{
+		w:        w,
+		f:        f,
+		resp:     resp,
+		clock:    clock,
+		every:    req.FlushEvery,
+		interval: req.FlushInterval,
+		last:     now(clock),
+	}
+}
+
+func (c *flushWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err == nil && c.due() {
+		err = c.flush()
+	}
+	return n, err
+}
+
+// due returns true if the file should be flushed.
+func (c *flushWriter) due() bool {
+	if c.every > 0 && c.n >= c.every {
+		return true
+	}
+	return c.interval > 0 && now(c.clock).Sub(c.last) >= c.interval
+}
+
+// flush commits the file to stable storage and then saves the hash state of
+// the transfer, so that the saved state never describes bytes that may be lost.
+// Errors saving the hash state are only warnings, as the file can still be read
+// back when it is resumed.
+func (c *flushWriter) flush() error {
+	if err := c.f.Sync(); err != nil {
+		return err
+	}
+	c.n, c.last = 0, now(c.clock)
+	if c.resp.hashState == nil {
+		return nil
+	}
+	if err := writeHashState(c.resp); err != nil && !c.warned {
+		c.warned = true
+		c.resp.warn(WarnHashState, err, "cannot save checksum state of flushed file")
+	}
+	return nil
+}
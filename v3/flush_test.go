@@ -0,0 +1,114 @@
+package grab
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+type countingSyncer struct{ n int }
+
+func (c *countingSyncer) Sync() error {
+	c.n++
+	return nil
+}
+
+// TestFlushWriter ensures that a flushWriter flushes its file once the given
+// number of bytes or interval has passed since the last flush.
+func TestFlushWriter(t *testing.T) {
+	t.Run("WithFlushEvery", func(t *testing.T) {
+		f := &countingSyncer{}
+		var buf bytes.Buffer
+		w := &flushWriter{w: &buf, f: f, resp: &Response{}, every: 100}
+		for i := 0; i < 5; i++ {
+			if _, err := w.Write(make([]byte, 60)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.n != 2 || buf.Len() != 300 {
+			t.Errorf("expected 2 flushes of 300 bytes, got %d flushes of %d bytes", f.n, buf.Len())
+		}
+	})
+
+	t.Run("WithFlushInterval", func(t *testing.T) {
+		f := &countingSyncer{}
+		clock := grabtest.NewFakeClock(time.Unix(0, 0))
+		w := &flushWriter{w: &bytes.Buffer{}, f: f, resp: &Response{}, clock: clock, interval: time.Second, last: clock.Now()}
+		for _, d := range []time.Duration{0, 500 * time.Millisecond, 500 * time.Millisecond, 0, 2 * time.Second} {
+			clock.Advance(d)
+			if _, err := w.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.n != 2 {
+			t.Errorf("expected 2 flushes, got %d", f.n)
+		}
+	})
+}
+
+// TestFlushEvery ensures that the hash state saved with Request.SaveHashState
+// is updated as a file is flushed during its transfer, and matches the flushed
+// content.
+func TestFlushEvery(t *testing.T) {
+	filename := ".testFlushEvery"
+	sidecar := filename + hashStateSuffix
+	defer os.Remove(filename)
+	defer os.Remove(sidecar)
+	size := 1 << 18
+	content := testContent(size)
+
+	// serve half of the file, then stall until the transfer is canceled
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(content[:size/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := mustNewRequest(filename, ts.URL)
+	req = req.WithContext(ctx)
+	req.SaveHashState = true
+	req.FlushEvery = int64(size / 8)
+	req.SetChecksum(sha256.New(), make([]byte, sha256.Size), false)
+	resp := DefaultClient.Do(req)
+	defer func() {
+		cancel()
+		resp.Wait()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for resp.BytesComplete() < int64(size/2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d bytes to be transferred, got %d", size/2, resp.BytesComplete())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("expected hash state to be saved during the transfer, got: %v", err)
+	}
+	offset := int64(binary.BigEndian.Uint64(b))
+	if offset < int64(size/8) || offset > int64(size/2) {
+		t.Fatalf("expected hash state of a flushed offset, got offset %d", offset)
+	}
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b[8:]); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(content[:offset]); !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Errorf("expected hash state to match the first %d bytes", offset)
+	}
+}
@@ -0,0 +1,106 @@
+package grab
+
+import (
+	"encoding"
+	"encoding/binary"
+	"hash"
+	"os"
+)
+
+// hashStateSuffix is appended to the destination path of a transfer to name
+// the sidecar file that holds the state of its checksum hash, as saved for
+// Request.SaveHashState.
+const hashStateSuffix = ".grab"
+
+// hashState computes the checksum of a transfer as its body is written to the
+// destination, continuing from the state saved by a previous transfer if the
+// file is resumed.
+type hashState struct {
+	h hash.Hash
+
+	// offset is the offset in the destination file of the next byte to be
+	// hashed.
+	offset int64
+}
+
+func (c *hashState) Write(p []byte) (int, error) {
+	n, err := c.h.Write(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// newHashState returns the hashState of a transfer with Request.SaveHashState,
+// or nil if its checksum must be computed by reading back the file once it is
+// complete: if the hash cannot be saved, or a resumed file has no saved hash
+// state at its resume offset.
+func newHashState(resp *Response) *hashState {
+	req := resp.req
+	if !req.SaveHashState || req.hash == nil || req.AppendGrowing || req.NoStore ||
+		resp.stream || resp.inPlace || resp.casTemp != "" {
+		return nil
+	}
+	if _, ok := req.hash.(encoding.BinaryMarshaler); !ok {
+		return nil
+	}
+	u, ok := req.hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil
+	}
+	path := resp.Filename + hashStateSuffix
+	if !resp.DidResume || resp.localOffset() == 0 {
+		req.hash.Reset()
+		return &hashState{h: req.hash}
+	}
+	offset := resp.localOffset()
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) < 8 || int64(binary.BigEndian.Uint64(b)) != offset {
+		// saved for another offset, if at all
+		os.Remove(path)
+		return nil
+	}
+	if err := u.UnmarshalBinary(b[8:]); err != nil {
+		// the whole file is hashed again
+		req.hash.Reset()
+		os.Remove(path)
+		return nil
+	}
+	return &hashState{h: req.hash, offset: offset}
+}
+
+// saveHashState saves the hash state of a transfer that left a partially
+// downloaded file, so that a transfer resuming the file can continue its
+// checksum without reading it back, and removes it otherwise. Errors are only
+// warnings, as the checksum of the resumed file can still be computed by
+// reading it back.
+func saveHashState(resp *Response) {
+	s := resp.hashState
+	if s == nil {
+		return
+	}
+	path := resp.Filename + hashStateSuffix
+	if resp.err == nil || !resp.partial {
+		os.Remove(path)
+		return
+	}
+	if fi, err := os.Stat(resp.Filename); err != nil || fi.Size() != s.offset {
+		// the file was removed or does not end with the last hashed byte
+		os.Remove(path)
+		return
+	}
+	if err := writeHashState(resp); err != nil {
+		os.Remove(path)
+		resp.warn(WarnHashState, err, "cannot save checksum state of partially downloaded file")
+	}
+}
+
+// writeHashState writes the current hash state of a transfer and the offset of
+// the next byte to be hashed to its sidecar file.
+func writeHashState(resp *Response) error {
+	s := resp.hashState
+	state, err := s.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	b := append(binary.BigEndian.AppendUint64(nil, uint64(s.offset)), state...)
+	return os.WriteFile(resp.Filename+hashStateSuffix, b, 0644)
+}
@@ -0,0 +1,108 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"os"
+	"testing"
+)
+
+// TestSaveHashState ensures that the hash state of a partially downloaded file
+// is saved with Request.SaveHashState, and that a resumed transfer continues
+// the checksum from it rather than reading the file back.
+func TestSaveHashState(t *testing.T) {
+	filename := ".testSaveHashState"
+	sidecar := filename + hashStateSuffix
+	defer os.Remove(filename)
+	defer os.Remove(sidecar)
+	size := 1 << 16
+	content := testContent(size)
+	sum := sha256.Sum256(content)
+
+	// download part of the file, then resume it
+	download := func(t *testing.T, newHash func() hash.Hash, corrupt bool) error {
+		t.Helper()
+		os.Remove(filename)
+		s, _ := newDroppingServer(content, size/4, 1)
+		defer s.Close()
+		req := mustNewRequest(filename, s.URL)
+		req.SaveHashState = true
+		req.SetChecksum(newHash(), sum[:], false)
+		if err := DefaultClient.Do(req).Err(); err == nil {
+			t.Fatal("expected the first transfer to fail")
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if corrupt {
+			// the prefix is covered by the saved state, so the file is
+			// not read back to notice the change
+			if err := os.WriteFile(filename, make([]byte, fi.Size()), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req = mustNewRequest(filename, s.URL)
+		req.SaveHashState = true
+		req.SetChecksum(newHash(), sum[:], false)
+		resp := DefaultClient.Do(req)
+		err = resp.Err()
+		if !resp.DidResume {
+			t.Errorf("expected transfer to resume")
+		}
+		if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+			t.Errorf("expected hash state to be removed, got: %v", err)
+		}
+		return err
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		if err := download(t, sha256.New, true); err != nil {
+			t.Errorf("expected checksum to continue from saved state, got: %v", err)
+		}
+	})
+
+	t.Run("WithoutMarshaler", func(t *testing.T) {
+		// the file is read back, so the corruption is detected
+		h := func() hash.Hash { return struct{ hash.Hash }{sha256.New()} }
+		if err := download(t, h, true); err != ErrBadChecksum {
+			t.Errorf("expected %v, got: %v", ErrBadChecksum, err)
+		}
+		if err := download(t, h, false); err != nil {
+			t.Errorf("expected checksum of file read back, got: %v", err)
+		}
+	})
+
+	t.Run("WithStaleState", func(t *testing.T) {
+		// state saved for another offset is ignored
+		state, err := sha256.New().(interface{ MarshalBinary() ([]byte, error) }).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, content[:size/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+		b := append(binary.BigEndian.AppendUint64(nil, uint64(size/4)), state...)
+		if err := os.WriteFile(sidecar, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, _ := newDroppingServer(content, size, 0)
+		defer s.Close()
+		req := mustNewRequest(filename, s.URL)
+		req.SaveHashState = true
+		req.SetChecksum(sha256.New(), sum[:], false)
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		b, err = os.ReadFile(filename)
+		if err != nil || !bytes.Equal(b, content) || !resp.DidResume {
+			t.Errorf("expected resumed file content to match, got: %v", err)
+		}
+		if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+			t.Errorf("expected stale hash state to be removed, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package grab
+
+import (
+	"sync"
+	"time"
+)
+
+// rateHistorySize is the number of one-second samples of the transfer rate
+// kept for Response.RateHistory.
+const rateHistorySize = 120
+
+// rateHistory is a ring buffer of the transfer rate measured between each pair
+// of consecutive samples of a transfer. The zero value is ready to use.
+type rateHistory struct {
+	mu      sync.Mutex
+	samples [rateHistorySize]float64
+	next    int
+	count   int
+
+	// lastT and lastN are the previous sample, if sampled is true.
+	lastT   time.Time
+	lastN   int64
+	sampled bool
+}
+
+// restart discards the previous sample, so that the time between the end of a
+// copy and the start of the next, such as a reconnect, is not recorded.
+func (c *rateHistory) restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampled = false
+}
+
+// sample records the rate since the previous sample.
+func (c *rateHistory) sample(t time.Time, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sampled {
+		if d := t.Sub(c.lastT).Seconds(); d > 0 {
+			c.samples[c.next] = float64(n-c.lastN) / d
+			c.next = (c.next + 1) % rateHistorySize
+			if c.count < rateHistorySize {
+				c.count++
+			}
+		}
+	}
+	c.lastT, c.lastN, c.sampled = t, n, true
+}
+
+// last returns up to the last n samples, oldest first.
+func (c *rateHistory) last(n int) []float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n > c.count {
+		n = c.count
+	}
+	if n <= 0 {
+		return nil
+	}
+	samples := make([]float64, n)
+	start := c.next - n
+	if start < 0 {
+		start += rateHistorySize
+	}
+	for i := range samples {
+		samples[i] = c.samples[(start+i)%rateHistorySize]
+	}
+	return samples
+}
+
+// historyGauge samples both the gauge and the rate history of a transfer.
+type historyGauge struct {
+	t *transfer
+}
+
+func (c historyGauge) Sample(t time.Time, n int64) {
+	c.t.gauge.Sample(t, n)
+	c.t.history.sample(t, n)
+}
+
+func (c historyGauge) BPS() float64 { return c.t.gauge.BPS() }
@@ -0,0 +1,143 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// abortingWriter is a http.ResponseWriter that aborts the response once n
+// bytes of the body have been sent, as if the connection had dropped.
+type abortingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (c *abortingWriter) Write(p []byte) (int, error) {
+	if len(p) >= c.n {
+		c.ResponseWriter.Write(p[:c.n])
+		c.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	c.n -= len(p)
+	return c.ResponseWriter.Write(p)
+}
+
+// TestLifecycle exercises reconnection, retries, checksum verification and the
+// rename of a temporary file together, as in a download that survives a
+// dropped connection and an overloaded server:
+//
+//  1. the first response drops after 40% of a pseudorandom body
+//  2. the ranged request to reconnect is answered with 503 and Retry-After
+//  3. the ranged request is sent again after Retry-After, with If-Match so
+//     that a changed remote file is not appended, and completes the body
+//  4. the SHA-256 checksum of the whole file is verified
+//  5. the temporary file is renamed to its content address, which never refers
+//     to the partial file
+func TestLifecycle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping lifecycle test in short mode")
+	}
+	dir := ".testLifecycle"
+	defer os.RemoveAll(dir)
+
+	size, seed := 1<<20, int64(195)
+	sum := grabtest.BodyDigest(seed, size, "sha256")
+	final := filepath.Join(dir, casLayout(sum))
+	offset := size * 40 / 100
+	h, err := grabtest.NewHandler(
+		grabtest.ContentLength(size),
+		grabtest.RandomBody(seed),
+		grabtest.ETag(`"v1"`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	var unavailable atomic.Int64 // time of the 503 response
+	errs := make(chan string, 8)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, err := os.Stat(final); err == nil {
+			errs <- "expected content address not to exist before the transfer completes"
+		}
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			h.ServeHTTP(&abortingWriter{ResponseWriter: w, n: offset}, r)
+		case 2:
+			unavailable.Store(time.Now().UnixNano())
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			if d := time.Since(time.Unix(0, unavailable.Load())); d < time.Second {
+				errs <- "expected request to be retried after Retry-After, got: " + d.String()
+			}
+			if v := r.Header.Get("Range"); v != fmt.Sprintf("bytes=%d-", offset) {
+				errs <- "expected resume from the dropped offset, got Range: " + v
+			}
+			if v := r.Header.Get("If-Match"); v != `"v1"` {
+				errs <- "expected If-Match precondition, got: " + v
+			}
+			h.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	req := mustNewRequest("", ts.URL+"/image.bin")
+	req.ContentAddressed = &ContentAddress{Dir: dir}
+	req.MaxReconnects = 3
+	req.Backoff = ConstantBackoff(10 * time.Millisecond)
+	req.SetChecksum(sha256.New(), sum, true)
+	resp := DefaultClient.Do(req)
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 GET requests, got %d", n)
+	}
+	if n := resp.Reconnects(); n != 1 {
+		t.Errorf("expected 1 reconnection, got %d", n)
+	}
+	if resp.Filename != final {
+		t.Errorf("expected Filename: %s, got: %s", final, resp.Filename)
+	}
+	if !bytes.Equal(resp.Checksum(), sum) {
+		t.Errorf("expected verified checksum: %x, got: %x", sum, resp.Checksum())
+	}
+	fi, err := os.Stat(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(size) {
+		t.Errorf("expected %d bytes, got %d", size, fi.Size())
+	}
+	// only the content address is left in the store
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 1 {
+		t.Errorf("expected only the content address in the store, got: %v", files)
+	}
+}
@@ -0,0 +1,103 @@
+package grab
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// maxBytesBody is a response body that fails with ErrMaxBytes once more than n
+// bytes have been read.
+type maxBytesBody struct {
+	io.ReadCloser
+	n int64 // bytes remaining
+}
+
+func (c *maxBytesBody) Read(p []byte) (int, error) {
+	// read one byte more than allowed to detect excess content
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
+	n, err := c.ReadCloser.Read(p)
+	if int64(n) <= c.n {
+		c.n -= int64(n)
+		return n, err
+	}
+	n = int(c.n)
+	c.n = 0
+	return n, ErrMaxBytes
+}
+
+// quotaWriter counts the bytes written to w towards the cumulative total of a
+// Client, failing with ErrQuotaExceeded once the total would exceed max. Bytes
+// beyond max are discarded, so the total never exceeds max.
+type quotaWriter struct {
+	w     io.Writer
+	total *atomic.Int64
+	max   int64
+}
+
+func (c *quotaWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	var err error
+	if total := c.total.Add(n); total > c.max {
+		// give back the bytes beyond max and write the rest
+		over := total - c.max
+		if over > n {
+			over = n
+		}
+		c.total.Add(-over)
+		p = p[:n-over]
+		err = ErrQuotaExceeded
+	}
+	nw, ew := c.w.Write(p)
+	if nw < len(p) {
+		c.total.Add(int64(nw - len(p)))
+	}
+	if ew != nil {
+		err = ew
+	}
+	return nw, err
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// offsetWriter writes to a file from offset off, failing with
+// ErrBadWriteOffset rather than writing beyond end, as for a range written
+// over an existing file.
+type offsetWriter struct {
+	f        *os.File
+	off, end int64
+}
+
+func (c *offsetWriter) Write(p []byte) (int, error) {
+	var err error
+	if n := c.end - c.off; int64(len(p)) > n {
+		p = p[:n]
+		err = ErrBadWriteOffset
+	}
+	n, ew := c.f.WriteAt(p, c.off)
+	c.off += int64(n)
+	if ew != nil {
+		err = ew
+	}
+	return n, err
+}
+
+func (c *offsetWriter) Sync() error {
+	return c.f.Sync()
+}
+
+func (c *offsetWriter) Close() error {
+	return c.f.Close()
+}
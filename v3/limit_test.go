@@ -0,0 +1,39 @@
+package grab
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQuotaWriter(t *testing.T) {
+	var total atomic.Int64
+	var wg sync.WaitGroup
+	var written atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &quotaWriter{w: io.Discard, total: &total, max: 1000}
+			b := make([]byte, 30)
+			for {
+				n, err := w.Write(b)
+				written.Add(int64(n))
+				if err != nil {
+					if err != ErrQuotaExceeded {
+						t.Errorf("expected error: %v, got: %v", ErrQuotaExceeded, err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := written.Load(); n != 1000 {
+		t.Errorf("expected 1000 bytes written, got %d", n)
+	}
+	if n := total.Load(); n != 1000 {
+		t.Errorf("expected total of 1000 bytes, got %d", n)
+	}
+}
@@ -0,0 +1,343 @@
+package grab
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ManifestOptions configures the columnar format read by RequestsFromManifest.
+//
+// The zero value reads comma separated values with the columns url,
+// destination, sha256 and size, in that order unless a header row specifies
+// otherwise.
+type ManifestOptions struct {
+	// Comma is the field delimiter. It defaults to ','. Set it to '\t' to read
+	// tab separated values.
+	Comma rune
+
+	// URLColumn, FilenameColumn, SHA256Column and SizeColumn are the names of
+	// the header row columns that specify the URL, destination path, expected
+	// SHA256 checksum and expected size of each request. They default to
+	// "url", "destination", "sha256" and "size". Header names are matched
+	// case-insensitively.
+	URLColumn      string
+	FilenameColumn string
+	SHA256Column   string
+	SizeColumn     string
+
+	// NoHeader specifies that the first row should never be treated as a header
+	// row. Otherwise, the first row is a header row if one of its fields is the
+	// name of the URL column.
+	NoHeader bool
+}
+
+func (c *ManifestOptions) columns() [4]string {
+	cols := [4]string{c.URLColumn, c.FilenameColumn, c.SHA256Column, c.SizeColumn}
+	for i, def := range [4]string{"url", "destination", "sha256", "size"} {
+		if cols[i] == "" {
+			cols[i] = def
+		}
+	}
+	return cols
+}
+
+// ManifestError describes a line of a manifest that could not be parsed.
+type ManifestError struct {
+	Line int
+	Err  error
+}
+
+func (err *ManifestError) Error() string {
+	return fmt.Sprintf("manifest line %d: %v", err.Line, err.Err)
+}
+
+func (err *ManifestError) Unwrap() error {
+	return err.Err
+}
+
+// RequestsFromManifest returns a Request for each line of a manifest read from
+// r. Lines specify the URL to download and, optionally, the destination path,
+// the expected SHA256 checksum in hex and the expected size in bytes of the
+// file transfer. Blank fields are ignored.
+//
+// Lines that cannot be parsed are skipped rather than failing the whole
+// manifest. If any lines were skipped, the returned error joins a
+// *ManifestError for each of them, in addition to the Requests of all other
+// lines. A non-nil error with no Requests may also indicate that r could not
+// be read.
+func RequestsFromManifest(r io.Reader, opts ManifestOptions) ([]*Request, error) {
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	// column indices of url, destination, sha256 and size
+	names := opts.columns()
+	index := [4]int{0, 1, 2, 3}
+
+	var reqs []*Request
+	var errs []error
+	first := true
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return reqs, err
+			}
+			errs = append(errs, &ManifestError{Line: perr.StartLine, Err: perr.Err})
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+
+		if first {
+			first = false
+			if !opts.NoHeader && isManifestHeader(record, names[0]) {
+				for i, name := range names {
+					index[i] = -1
+					for j, field := range record {
+						if strings.EqualFold(strings.TrimSpace(field), name) {
+							index[i] = j
+						}
+					}
+				}
+				continue
+			}
+		}
+
+		req, err := manifestRequest(record, index)
+		if err != nil {
+			errs = append(errs, &ManifestError{Line: line, Err: err})
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, errors.Join(errs...)
+}
+
+// isManifestHeader returns true if any field of the given record is the name of
+// the URL column.
+func isManifestHeader(record []string, urlColumn string) bool {
+	for _, field := range record {
+		if strings.EqualFold(strings.TrimSpace(field), urlColumn) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestRequest returns a Request for a manifest record, given the indices of
+// the url, destination, sha256 and size columns. Negative indices are missing
+// columns.
+func manifestRequest(record []string, index [4]int) (*Request, error) {
+	field := func(i int) string {
+		if index[i] < 0 || index[i] >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[index[i]])
+	}
+
+	urlStr := field(0)
+	if urlStr == "" {
+		return nil, errors.New("missing URL")
+	}
+	req, err := NewRequest(field(1), urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if v := field(2); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA256 checksum: %q", v)
+		}
+		req.SetChecksum(sha256.New(), sum, false)
+	}
+	if v := field(3); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid size: %q", v)
+		}
+		req.Size = size
+	}
+	return req, nil
+}
+
+// WriteManifest writes a comma separated manifest describing the given
+// completed Responses to w, with a header row and the columns url,
+// destination, sha256, size and status. The status is "ok" for successful
+// transfers or the error message otherwise.
+//
+// The SHA256 checksum and size are measured from the downloaded file of each
+// successful transfer, so the manifest can be read by RequestsFromManifest to
+// verify or repeat the transfers. WriteManifest blocks until all Responses are
+// complete.
+func WriteManifest(w io.Writer, resps []*Response) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"url", "destination", "sha256", "size", "status"}); err != nil {
+		return err
+	}
+	for _, resp := range resps {
+		record := []string{resp.req.URL().String(), resp.Filename, "", "", "ok"}
+		if err := resp.Err(); err != nil {
+			record[4] = err.Error()
+		} else if !resp.req.NoStore {
+			sum, size, err := sha256File(resp.Filename)
+			if err != nil {
+				return err
+			}
+			record[2] = hex.EncodeToString(sum)
+			record[3] = strconv.FormatInt(size, 10)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sha256File returns the SHA256 checksum and size of the named file.
+func sha256File(name string) ([]byte, int64, error) {
+	return hashFile(name, sha256.New())
+}
+
+// hashFile returns the checksum computed by h and the size of the named file.
+func hashFile(name string, h hash.Hash) ([]byte, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// VerifyResult is the outcome of verifying a file listed in a checksum
+// manifest, as returned by Client.VerifyManifest.
+type VerifyResult struct {
+	// Filename is the path of the file, in the base directory.
+	Filename string
+
+	// Expected is the checksum listed in the manifest.
+	Expected []byte
+
+	// Actual is the checksum of the file, or nil if it could not be read.
+	Actual []byte
+
+	// Err is nil if the file matches its checksum, ErrBadChecksum if it does
+	// not, or the error that prevented the file from being read. If the file
+	// is missing, errors.Is(Err, fs.ErrNotExist) is true.
+	Err error
+}
+
+// Missing returns true if the file was not found.
+func (c VerifyResult) Missing() bool {
+	return errors.Is(c.Err, fs.ErrNotExist)
+}
+
+// checksumHashes are the hashes used to verify a checksum manifest, by the
+// length of their hex encoded checksums.
+var checksumHashes = map[int]func() hash.Hash{
+	hex.EncodedLen(md5.Size):    md5.New,
+	hex.EncodedLen(sha1.Size):   sha1.New,
+	hex.EncodedLen(sha256.Size): sha256.New,
+	hex.EncodedLen(sha512.Size): sha512.New,
+}
+
+// VerifyManifest verifies the files under baseDir against a checksum manifest
+// in the format of the sha256sum utility, without downloading anything. Each
+// line of the manifest is a hex encoded checksum, followed by a space, a space
+// or asterisk, and the path of the file relative to baseDir. The hash is
+// determined by the length of the checksum: MD5, SHA1, SHA256 or SHA512.
+// Blank lines and lines starting with '#' are ignored.
+//
+// A VerifyResult is returned for each file, in the order of the manifest,
+// whether or not it matches. Lines that cannot be parsed, including paths
+// outside of baseDir, are skipped; the returned error joins a *ManifestError
+// for each of them. A non-nil error with no results may also indicate that the
+// manifest could not be read.
+func (c *Client) VerifyManifest(manifest, baseDir string) ([]VerifyResult, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []VerifyResult
+	var errs []error
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, name, newHash, err := parseChecksumLine(text)
+		if err == nil {
+			name, err = manifestPath(baseDir, name)
+		}
+		if err != nil {
+			errs = append(errs, &ManifestError{Line: line, Err: err})
+			continue
+		}
+		result := VerifyResult{Filename: name, Expected: sum}
+		result.Actual, _, result.Err = hashFile(name, newHash())
+		if result.Err == nil && !bytes.Equal(result.Actual, sum) {
+			result.Err = ErrBadChecksum
+		}
+		results = append(results, result)
+	}
+	if err := sc.Err(); err != nil {
+		return results, err
+	}
+	return results, errors.Join(errs...)
+}
+
+// parseChecksumLine parses a line of a checksum manifest in the format of the
+// sha256sum utility.
+func parseChecksumLine(line string) (sum []byte, name string, newHash func() hash.Hash, err error) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 || len(line) < i+3 || (line[i+1] != ' ' && line[i+1] != '*') {
+		return nil, "", nil, errors.New("expected checksum and file name")
+	}
+	newHash = checksumHashes[i]
+	sum, err = hex.DecodeString(line[:i])
+	if err != nil || newHash == nil {
+		return nil, "", nil, fmt.Errorf("invalid checksum: %q", line[:i])
+	}
+	return sum, line[i+2:], newHash, nil
+}
+
+// manifestPath returns the path in baseDir of a file listed in a checksum
+// manifest, or an error if the file is outside of baseDir.
+func manifestPath(baseDir, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	path := filepath.Join(baseDir, name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || !isWithin(baseDir, path) {
+		return "", fmt.Errorf("file is outside of base directory: %s", name)
+	}
+	return path, nil
+}
@@ -0,0 +1,211 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+func TestRequestsFromManifest(t *testing.T) {
+	sum := grabtest.DefaultHandlerSHA256Checksum
+
+	t.Run("WithHeader", func(t *testing.T) {
+		manifest := "size,URL,destination,sha256\n" +
+			"1048576,http://example.com/a,a.bin," + sum + "\n" +
+			",http://example.com/b,,\n"
+		reqs, err := RequestsFromManifest(strings.NewReader(manifest), ManifestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reqs) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(reqs))
+		}
+		if v := reqs[0].URL().String(); v != "http://example.com/a" {
+			t.Errorf("expected URL: %q, got: %q", "http://example.com/a", v)
+		}
+		if reqs[0].Filename != "a.bin" {
+			t.Errorf("expected Filename: %q, got: %q", "a.bin", reqs[0].Filename)
+		}
+		if reqs[0].Size != 1048576 {
+			t.Errorf("expected Size: %d, got: %d", 1048576, reqs[0].Size)
+		}
+		if !bytes.Equal(reqs[0].checksum, grabtest.DefaultHandlerSHA256ChecksumBytes) {
+			t.Errorf("expected checksum: %s, got: %x", sum, reqs[0].checksum)
+		}
+		if reqs[1].Filename != "." || reqs[1].Size != 0 || reqs[1].hash != nil {
+			t.Errorf("expected blank fields to be ignored")
+		}
+	})
+
+	t.Run("WithTabsAndNoHeader", func(t *testing.T) {
+		manifest := "http://example.com/url\turl.bin\n"
+		reqs, err := RequestsFromManifest(strings.NewReader(manifest), ManifestOptions{
+			Comma:    '\t',
+			NoHeader: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reqs) != 1 || reqs[0].Filename != "url.bin" {
+			t.Fatalf("expected a request for url.bin, got: %v", reqs)
+		}
+	})
+
+	t.Run("WithCustomColumns", func(t *testing.T) {
+		manifest := "link,path\nhttp://example.com/a,a.bin\n"
+		reqs, err := RequestsFromManifest(strings.NewReader(manifest), ManifestOptions{
+			URLColumn:      "link",
+			FilenameColumn: "path",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reqs) != 1 || reqs[0].Filename != "a.bin" {
+			t.Fatalf("expected a request for a.bin, got: %v", reqs)
+		}
+	})
+
+	t.Run("WithErrors", func(t *testing.T) {
+		manifest := "url,destination,sha256,size\n" +
+			"http://example.com/a,a.bin,,\n" +
+			"http://example.com/b,b.bin,nothex,\n" +
+			"# comment\n" +
+			"http://example.com/c,c.bin,,-1\n" +
+			",d.bin,,\n" +
+			"http://example.com/e,e.bin,,\n"
+		reqs, err := RequestsFromManifest(strings.NewReader(manifest), ManifestOptions{})
+		if len(reqs) != 2 {
+			t.Errorf("expected 2 requests, got %d", len(reqs))
+		}
+		var lines []int
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var merr *ManifestError
+			if !errors.As(err, &merr) {
+				t.Fatalf("expected *ManifestError, got: %T", err)
+			}
+			lines = append(lines, merr.Line)
+		}
+		expect := []int{3, 5, 6}
+		if len(lines) != len(expect) {
+			t.Fatalf("expected errors on lines %v, got %v", expect, lines)
+		}
+		for i := range expect {
+			if lines[i] != expect[i] {
+				t.Errorf("expected errors on lines %v, got %v", expect, lines)
+				break
+			}
+		}
+	})
+}
+
+func TestWriteManifest(t *testing.T) {
+	filename := ".testWriteManifest"
+	defer os.Remove(filename)
+
+	grabtest.WithTestServer(t, func(url string) {
+		resps := []*Response{
+			mustDo(mustNewRequest(filename, url)),
+			DefaultClient.Do(mustNewRequest(".", url+"/missing")),
+		}
+		resps[1].Wait()
+
+		var b bytes.Buffer
+		if err := WriteManifest(&b, resps); err != nil {
+			t.Fatal(err)
+		}
+
+		// read the manifest back
+		reqs, err := RequestsFromManifest(&b, ManifestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reqs) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(reqs))
+		}
+		if !bytes.Equal(reqs[0].checksum, grabtest.DefaultHandlerSHA256ChecksumBytes) {
+			t.Errorf("expected measured checksum: %s, got: %x",
+				grabtest.DefaultHandlerSHA256Checksum, reqs[0].checksum)
+		}
+		if reqs[0].Size != int64(grabtest.DefaultHandlerContentLength) {
+			t.Errorf("expected measured size: %d, got: %d",
+				grabtest.DefaultHandlerContentLength, reqs[0].Size)
+		}
+		if reqs[1].hash != nil || reqs[1].Size != 0 {
+			t.Errorf("expected no checksum or size for failed transfer")
+		}
+	},
+		grabtest.StatusCode(func(req *http.Request) int {
+			if strings.HasSuffix(req.URL.Path, "/missing") {
+				return http.StatusNotFound
+			}
+			return http.StatusOK
+		}),
+	)
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	good := []byte("good content\n")
+	if err := os.WriteFile(filepath.Join(dir, "good.txt"), good, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.txt"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(good)
+	md := md5.Sum(good)
+	goodSum := hex.EncodeToString(sha[:])
+	manifest := "# checksums\n" +
+		goodSum + "  good.txt\n" +
+		hex.EncodeToString(md[:]) + " *good.txt\n" +
+		goodSum + "  bad.txt\n" +
+		goodSum + "  missing.txt\n" +
+		"\n" +
+		"not a checksum line\n" +
+		goodSum + "  ../outside.txt\n"
+	manifestPath := filepath.Join(dir, "SHA256SUMS")
+	if err := os.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := NewClient().VerifyManifest(manifestPath, dir)
+	var merr *ManifestError
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected ManifestError for malformed lines, got: %v", err)
+	}
+	if merr.Line != 7 {
+		t.Errorf("expected first malformed line: 7, got: %d", merr.Line)
+	}
+	if !strings.Contains(err.Error(), "line 8") {
+		t.Errorf("expected error for path outside of base directory, got: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got: %d", len(results))
+	}
+	for i, result := range results[:2] {
+		if result.Err != nil || !bytes.Equal(result.Actual, result.Expected) {
+			t.Errorf("result %d: expected good.txt to match, got: %v", i, result.Err)
+		}
+	}
+	if err := results[2].Err; err != ErrBadChecksum || results[2].Missing() {
+		t.Errorf("expected ErrBadChecksum for bad.txt, got: %v", err)
+	}
+	if results[2].Actual == nil || bytes.Equal(results[2].Actual, results[2].Expected) {
+		t.Errorf("expected actual checksum of bad.txt to differ, got: %x", results[2].Actual)
+	}
+	if !results[3].Missing() || results[3].Actual != nil {
+		t.Errorf("expected missing.txt to be reported missing, got: %v", results[3].Err)
+	}
+	if v := filepath.Join(dir, "missing.txt"); results[3].Filename != v {
+		t.Errorf("expected Filename: %q, got: %q", v, results[3].Filename)
+	}
+}
@@ -0,0 +1,39 @@
+package grab
+
+import "time"
+
+// MetricsCollector records metrics of the transfers of a Client, so that they
+// can be reported to any metrics system. See
+// github.com/3JoB/grab/v3/pkg/grabprom for a collector that exports them to
+// Prometheus.
+//
+// ObserveTransfer is called once for each transfer when it completes,
+// successfully or otherwise, from the goroutine that completed it. It must be
+// safe for concurrent use and should return quickly. It is called before
+// Response.Done is closed, and a panic in it is recorded as a WarnMetricsPanic
+// Warning unless Client.PropagatePanics is set, in which case Response.Done is
+// closed before the panic continues.
+type MetricsCollector interface {
+	ObserveTransfer(m TransferMetrics)
+}
+
+// TransferMetrics describes a completed transfer, as passed to
+// MetricsCollector.ObserveTransfer.
+type TransferMetrics struct {
+	// Host is the host of the request URL, as in URL.Host.
+	Host string
+
+	// Duration is the time from the start of the transfer until it completed.
+	Duration time.Duration
+
+	// BytesTransferred is the number of bytes written to the destination by
+	// the transfer, excluding the bytes of an existing file that was resumed.
+	BytesTransferred int64
+
+	// Reconnects is the number of times the transfer reconnected to the
+	// remote server, as in Response.Reconnects.
+	Reconnects int
+
+	// Err is the error that failed the transfer, or nil if it succeeded.
+	Err error
+}
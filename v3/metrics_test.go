@@ -0,0 +1,132 @@
+package grab
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// metricsRecorder is a MetricsCollector that records all observed metrics.
+type metricsRecorder struct {
+	mu      sync.Mutex
+	metrics []TransferMetrics
+}
+
+func (c *metricsRecorder) ObserveTransfer(m TransferMetrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, m)
+}
+
+// TestMetricsCollector ensures that Client.MetricsCollector observes every
+// completed transfer.
+func TestMetricsCollector(t *testing.T) {
+	size := 1024
+	var rec metricsRecorder
+	client := NewClient()
+	client.MetricsCollector = &rec
+	grabtest.WithTestServer(t, func(okURL string) {
+		grabtest.WithTestServer(t, func(failURL string) {
+			for _, u := range []string{okURL + "/a", failURL + "/b"} {
+				req := mustNewRequest("", u)
+				req.NoStore = true
+				client.Do(req).Wait()
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if len(rec.metrics) != 2 {
+			t.Fatalf("expected 2 observed transfers, got %d", len(rec.metrics))
+		}
+		ok, fail := rec.metrics[0], rec.metrics[1]
+		if ok.Err != nil || ok.BytesTransferred != int64(size) || ok.Duration <= 0 {
+			t.Errorf("expected successful transfer of %d bytes, got: %+v", size, ok)
+		}
+		if ok.Host != mustParseURL(t, okURL).Host {
+			t.Errorf("expected host %s, got: %s", mustParseURL(t, okURL).Host, ok.Host)
+		}
+		if !IsStatusCodeError(fail.Err) || fail.BytesTransferred != 0 {
+			t.Errorf("expected failed transfer, got: %+v", fail)
+		}
+	}, grabtest.ContentLength(size))
+}
+
+// panickingCollector is a MetricsCollector that always panics.
+type panickingCollector struct{}
+
+func (panickingCollector) ObserveTransfer(TransferMetrics) {
+	panic("boom")
+}
+
+// TestMetricsCollectorPanic ensures that a panic in Client.MetricsCollector is
+// recorded as a Warning of the completed transfer, which is only finalized
+// once.
+func TestMetricsCollectorPanic(t *testing.T) {
+	tests := 4
+	client := NewClient()
+	client.MaxConcurrentTransfers = 1
+	client.MetricsCollector = panickingCollector{}
+	grabtest.WithTestServer(t, func(url string) {
+		for i := 0; i < tests; i++ {
+			req := mustNewRequest("", fmt.Sprintf("%s/.testMetricsCollectorPanic%d", url, i))
+			req.NoStore = true
+			resp := client.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatalf("expected transfer to complete, got: %v", err)
+			}
+			warnings := resp.Warnings()
+			if len(warnings) != 1 || warnings[0].Code != WarnMetricsPanic {
+				t.Errorf("expected a single %s warning, got: %v", WarnMetricsPanic, warnings)
+			}
+		}
+		if n := client.ActiveTransfers(); n != 0 {
+			t.Errorf("expected no active transfers, got %d", n)
+		}
+	})
+}
+
+// TestMetricsCollectorPropagatePanics ensures that a Response is finalized
+// before a panic in Client.MetricsCollector continues while
+// Client.PropagatePanics is set.
+func TestMetricsCollectorPropagatePanics(t *testing.T) {
+	client := NewClient()
+	client.PropagatePanics = true
+	client.MetricsCollector = panickingCollector{}
+	grabtest.WithTestServer(t, func(url string) {
+		// the transfer fails while the caller of Do is blocked, so that the
+		// panic reaches it
+		var resp *Response
+		req := mustNewRequest("", url+"/.testMetricsCollectorPropagatePanics")
+		req.NoStore = true
+		req.BeforeCopy = func(r *Response) error {
+			resp = r
+			return errors.New("stop")
+		}
+		func() {
+			defer func() {
+				if v := recover(); v != "boom" {
+					t.Errorf("expected panic value: %q, got: %v", "boom", v)
+				}
+			}()
+			client.Do(req)
+			t.Errorf("expected panic")
+		}()
+		if resp == nil {
+			t.Fatal("expected BeforeCopy to be called")
+		}
+		select {
+		case <-resp.Done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected Done to be closed")
+		}
+		if n := client.ActiveTransfers(); n != 0 {
+			t.Errorf("expected no active transfers, got %d", n)
+		}
+	})
+}
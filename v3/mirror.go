@@ -0,0 +1,162 @@
+package grab
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxIndexPageSize is the maximum number of bytes of a directory index page
+// that are searched for links.
+const maxIndexPageSize = 16 << 20
+
+var indexLink = regexp.MustCompile(`(?is)<a\s[^>]*\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// MirrorOptions configures Client.MirrorIndex.
+type MirrorOptions struct {
+	// Workers is the number of concurrent workers, as in
+	// BatchOptions.Workers.
+	Workers int
+
+	// Recursive specifies that sub-indices, which are links to paths ending
+	// in a slash, should be mirrored into subdirectories of the destination.
+	// Otherwise, sub-indices are skipped.
+	Recursive bool
+
+	// MaxDepth is the maximum number of levels of sub-indices that are
+	// mirrored if Recursive is true. Zero means no limit.
+	MaxDepth int
+
+	// Links returns the links of an index page, exactly as they appear in the
+	// page. Links are resolved relative to the URL of the page and only links
+	// to paths below the index are mirrored, so links to parent directories,
+	// sort orders and other hosts may be returned. Default: the href of every
+	// <a> tag in the page.
+	Links func(page []byte) []string
+
+	// Request, if not nil, is called with each Request before it is sent, for
+	// example to set a checksum or rate limiter.
+	Request func(*Request)
+}
+
+// MirrorIndex downloads the files listed by the HTML directory index at
+// indexURL, as generated by Apache or nginx, into destDir. Each file is stored
+// at its path relative to the index. Parsing of index pages is best-effort.
+//
+// All index pages are fetched before the downloads start, so an error is
+// returned if any of them cannot be fetched. The Response of each download is
+// then sent through the returned channel, as with DoBatch, which is closed
+// once all downloads have completed or failed.
+func (c *Client) MirrorIndex(indexURL, destDir string, opts MirrorOptions) (<-chan *Response, error) {
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return nil, err
+	}
+	// links in an index are relative to its directory
+	u.Path, u.RawPath = path.Clean("/"+u.Path), ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	var reqs []*Request
+	if err := c.mirrorIndex(u, destDir, opts, 0, &reqs); err != nil {
+		return nil, err
+	}
+	if opts.Request != nil {
+		for _, req := range reqs {
+			opts.Request(req)
+		}
+	}
+	return c.DoBatchWithOptions(BatchOptions{Workers: opts.Workers}, reqs...), nil
+}
+
+// mirrorIndex appends a Request for each file listed by the index at u, and
+// by its sub-indices if requested, to reqs.
+func (c *Client) mirrorIndex(u *url.URL, dir string, opts MirrorOptions, depth int, reqs *[]*Request) error {
+	page, err := c.getIndex(u)
+	if err != nil {
+		return fmt.Errorf("error fetching index %s: %w", u, err)
+	}
+	links := opts.Links
+	if links == nil {
+		links = indexLinks
+	}
+	seen := make(map[string]bool)
+	for _, link := range links(page) {
+		ref, err := url.Parse(strings.TrimSpace(link))
+		if err != nil || ref.RawQuery != "" {
+			// sort orders and other queries are not files
+			continue
+		}
+		target := u.ResolveReference(ref)
+		target.Fragment = ""
+		name, ok := strings.CutPrefix(target.Path, u.Path)
+		if !ok || name == "" || target.Scheme != u.Scheme || target.Host != u.Host || seen[name] {
+			// not below this index
+			continue
+		}
+		seen[name] = true
+
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if !isWithin(dir, dst) {
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			if !opts.Recursive || (opts.MaxDepth > 0 && depth >= opts.MaxDepth) {
+				continue
+			}
+			if err := c.mirrorIndex(target, dst, opts, depth+1, reqs); err != nil {
+				return err
+			}
+			continue
+		}
+		req, err := NewRequest(dst, target.String())
+		if err != nil {
+			return err
+		}
+		*reqs = append(*reqs, req)
+	}
+	return nil
+}
+
+// getIndex returns the content of the index page at u.
+func (c *Client) getIndex(u *url.URL) ([]byte, error) {
+	c.wrapDials()
+	if err := c.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	resp, err := c.HTTPClient.Do(c.withDialScheme(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := c.checkURL(resp.Request.URL); err != nil {
+		// redirected to a forbidden URL
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, StatusCodeError(resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxIndexPageSize))
+}
+
+// indexLinks returns the href of every <a> tag in the given HTML page.
+func indexLinks(page []byte) []string {
+	var links []string
+	for _, m := range indexLink.FindAllSubmatch(page, -1) {
+		links = append(links, html.UnescapeString(string(m[1])+string(m[2])+string(m[3])))
+	}
+	return links
+}
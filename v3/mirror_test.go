@@ -0,0 +1,98 @@
+package grab
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestMirrorIndex ensures that the files listed by a directory index, and by
+// its sub-indices if requested, are downloaded to their relative paths.
+func TestMirrorIndex(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b c.bin", "sub/c.txt", "sub/deeper/d.txt", "other/e.txt"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir(src)))
+	defer ts.Close()
+
+	mirror := func(t *testing.T, opts MirrorOptions) []string {
+		t.Helper()
+		dst := t.TempDir()
+		respch, err := NewClient().MirrorIndex(ts.URL+"/sub/../", dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for resp := range respch {
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			rel, err := filepath.Rel(dst, resp.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.ToSlash(rel)
+			if b, err := os.ReadFile(resp.Filename); err != nil || string(b) != name {
+				t.Errorf("expected %s to contain its name, got: %q, %v", name, b, err)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	tests := []struct {
+		Name   string
+		Opts   MirrorOptions
+		Expect string
+	}{
+		{Name: "Default", Expect: "a.txt,b c.bin"},
+		{
+			Name:   "WithRecursive",
+			Opts:   MirrorOptions{Recursive: true, Workers: 2},
+			Expect: "a.txt,b c.bin,other/e.txt,sub/c.txt,sub/deeper/d.txt",
+		},
+		{
+			Name:   "WithMaxDepth",
+			Opts:   MirrorOptions{Recursive: true, MaxDepth: 1},
+			Expect: "a.txt,b c.bin,other/e.txt,sub/c.txt",
+		},
+		{
+			Name: "WithLinks",
+			Opts: MirrorOptions{
+				Recursive: true,
+				Links: func(page []byte) []string {
+					return []string{"../", "?C=N;O=D", "http://example.com/a.txt", "sub/c.txt", "a.txt#top"}
+				},
+			},
+			Expect: "a.txt,sub/c.txt",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if v := strings.Join(mirror(t, test.Opts), ","); v != test.Expect {
+				t.Errorf("expected files: %s, got: %s", test.Expect, v)
+			}
+		})
+	}
+
+	t.Run("WithMissingIndex", func(t *testing.T) {
+		_, err := NewClient().MirrorIndex(ts.URL+"/missing/", t.TempDir(), MirrorOptions{})
+		var serr StatusCodeError
+		if !errors.As(err, &serr) || serr != http.StatusNotFound {
+			t.Errorf("expected error: %v, got: %v", StatusCodeError(http.StatusNotFound), err)
+		}
+	})
+}
@@ -40,14 +40,23 @@ type SampleFunc func() (n int64)
 // To prevent the goroutine from leaking, make sure to cancel the given context
 // once the stream is completed or canceled.
 func Watch(ctx context.Context, g Gauge, f SampleFunc, interval time.Duration) {
-	g.Sample(time.Now(), f())
-	t := time.NewTicker(interval)
+	WatchWithClock(ctx, g, f, interval, SystemClock)
+}
+
+// WatchWithClock is the same as Watch, but takes samples at the times of the
+// given Clock. A nil Clock is the SystemClock.
+func WatchWithClock(ctx context.Context, g Gauge, f SampleFunc, interval time.Duration, clock Clock) {
+	if clock == nil {
+		clock = SystemClock
+	}
+	g.Sample(clock.Now(), f())
+	t := clock.NewTicker(interval)
 	defer t.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case now := <-t.C:
+		case now := <-t.C():
 			g.Sample(now, f())
 		}
 	}
@@ -0,0 +1,42 @@
+package bps
+
+import "time"
+
+// Clock is the source of time used by WatchWithClock. It may be replaced by a
+// fake clock to test rate measurements deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a Ticker that delivers the time on its channel every
+	// period d, as time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock at intervals, as time.Ticker.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. No more ticks are sent after Stop returns.
+	Stop()
+}
+
+// SystemClock is the Clock of the system, as given by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (c systemTicker) C() <-chan time.Time { return c.t.C }
+
+func (c systemTicker) Stop() { c.t.Stop() }
@@ -0,0 +1,10 @@
+module github.com/3JoB/grab/v3/pkg/grabbrotli
+
+go 1.20
+
+require (
+	github.com/3JoB/grab/v3 v3.0.0-00010101000000-000000000000
+	github.com/andybalholm/brotli v1.1.0
+)
+
+replace github.com/3JoB/grab/v3 => ../..
@@ -0,0 +1,22 @@
+/*
+Package grabbrotli registers a brotli decoder with grab, so that responses
+encoded with the "br" content coding are negotiated and decoded. It is a
+separate module so that the brotli dependency is only required by programs
+that import it:
+
+	import _ "github.com/3JoB/grab/v3/pkg/grabbrotli"
+*/
+package grabbrotli
+
+import (
+	"io"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/andybalholm/brotli"
+)
+
+func init() {
+	grab.RegisterDecoder("br", func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	})
+}
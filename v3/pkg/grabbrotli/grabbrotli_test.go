@@ -0,0 +1,42 @@
+package grabbrotli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/andybalholm/brotli"
+)
+
+func TestDecoder(t *testing.T) {
+	content := bytes.Repeat([]byte("hello, world\n"), 1024)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Accept-Encoding"); v != "br, gzip" {
+			t.Errorf("expected Accept-Encoding: %q, got: %q", "br, gzip", v)
+		}
+		w.Header().Set("Content-Encoding", "br")
+		bw := brotli.NewWriter(w)
+		bw.Write(content)
+		bw.Close()
+	}))
+	defer s.Close()
+
+	req, err := grab.NewRequest("", s.URL+"/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.NoStore = true
+	resp := grab.DefaultClient.Do(req)
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("expected %d decoded bytes, got %d", len(content), len(b))
+	}
+	if resp.ContentEncoding != "br" {
+		t.Errorf("expected ContentEncoding: %q, got: %q", "br", resp.ContentEncoding)
+	}
+}
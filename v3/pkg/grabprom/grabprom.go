@@ -0,0 +1,88 @@
+/*
+Package grabprom implements a grab.MetricsCollector that exports the metrics
+of transfers to Prometheus. It is a separate module so that the Prometheus
+client library is only required by programs that import it:
+
+	c := grabprom.New("grab")
+	prometheus.MustRegister(c)
+	client := grab.NewClient()
+	client.MetricsCollector = c
+*/
+package grabprom
+
+import (
+	"github.com/3JoB/grab/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a grab.MetricsCollector and a prometheus.Collector. It exports
+// the following metrics, with the given namespace, labeled by the host of the
+// request URL and by the result of the transfer, "success" or "failure":
+//
+//	transfer_duration_seconds  histogram of the duration of transfers
+//	transfer_bytes_total       bytes written by transfers
+//	transfer_reconnects_total  reconnects to remote servers
+//	transfers_total            completed transfers
+type Collector struct {
+	duration   *prometheus.HistogramVec
+	bytes      *prometheus.CounterVec
+	reconnects *prometheus.CounterVec
+	transfers  *prometheus.CounterVec
+}
+
+// New returns a Collector whose metrics are prefixed by the given namespace,
+// which may be empty. It must be registered with a prometheus.Registerer.
+func New(namespace string) *Collector {
+	labels := []string{"host", "result"}
+	return &Collector{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "transfer_duration_seconds",
+			Help:      "Duration of completed file transfers.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, labels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfer_bytes_total",
+			Help:      "Bytes written by completed file transfers.",
+		}, labels),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfer_reconnects_total",
+			Help:      "Reconnects to remote servers by completed file transfers.",
+		}, labels),
+		transfers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfers_total",
+			Help:      "Completed file transfers.",
+		}, labels),
+	}
+}
+
+// ObserveTransfer implements grab.MetricsCollector.
+func (c *Collector) ObserveTransfer(m grab.TransferMetrics) {
+	result := "success"
+	if m.Err != nil {
+		result = "failure"
+	}
+	c.duration.WithLabelValues(m.Host, result).Observe(m.Duration.Seconds())
+	c.bytes.WithLabelValues(m.Host, result).Add(float64(m.BytesTransferred))
+	c.reconnects.WithLabelValues(m.Host, result).Add(float64(m.Reconnects))
+	c.transfers.WithLabelValues(m.Host, result).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.duration.Describe(ch)
+	c.bytes.Describe(ch)
+	c.reconnects.Describe(ch)
+	c.transfers.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.duration.Collect(ch)
+	c.bytes.Collect(ch)
+	c.reconnects.Collect(ch)
+	c.transfers.Collect(ch)
+}
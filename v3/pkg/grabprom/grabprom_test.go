@@ -0,0 +1,59 @@
+package grabprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(make([]byte, 1024))
+	}))
+	defer s.Close()
+
+	c := New("grab")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	client := grab.NewClient()
+	client.MetricsCollector = c
+	for _, path := range []string{"/file", "/file", "/missing"} {
+		req, err := grab.NewRequest("", s.URL+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.NoStore = true
+		client.Do(req).Wait()
+	}
+
+	host := strings.TrimPrefix(s.URL, "http://")
+	expect := `
+# HELP grab_transfer_bytes_total Bytes written by completed file transfers.
+# TYPE grab_transfer_bytes_total counter
+grab_transfer_bytes_total{host="` + host + `",result="failure"} 0
+grab_transfer_bytes_total{host="` + host + `",result="success"} 2048
+# HELP grab_transfers_total Completed file transfers.
+# TYPE grab_transfers_total counter
+grab_transfers_total{host="` + host + `",result="failure"} 1
+grab_transfers_total{host="` + host + `",result="success"} 2
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expect),
+		"grab_transfer_bytes_total", "grab_transfers_total")
+	if err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(c, "grab_transfer_duration_seconds"); n != 2 {
+		t.Errorf("expected 2 duration series, got %d", n)
+	}
+}
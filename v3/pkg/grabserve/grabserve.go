@@ -0,0 +1,96 @@
+// Package grabserve serves the files downloaded by grab over HTTP, for example
+// to share them on a local network.
+package grabserve
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/3JoB/grab/v3"
+)
+
+// defaultRetryAfter is the number of seconds that clients are asked to wait
+// for a transfer in progress when its ETA is unknown.
+const defaultRetryAfter = 5
+
+// Handler returns an http.Handler that serves the downloaded file of the given
+// Response, with support for range and conditional requests.
+//
+// The Content-Type is that of the response from the remote server, and the
+// ETag is derived from the checksum verified by Request.SetChecksum, if any.
+// While the transfer is in progress, the handler responds with 503 Service
+// Unavailable and a Retry-After header derived from the ETA of the transfer.
+// If the transfer failed or did not produce a local file, the handler responds
+// with 404 Not Found.
+func Handler(resp *grab.Response) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, resp)
+	})
+}
+
+// FileServer returns an http.Handler that serves the downloaded files of the
+// given Responses as Handler does, each at the path of its base file name, as
+// in "/file.zip". Requests for any other path respond with 404 Not Found.
+func FileServer(resps []*grab.Response) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(path.Clean("/" + r.URL.Path))
+		for _, resp := range resps {
+			select {
+			case <-resp.MetadataReady():
+			default:
+				// the file name is not yet known
+				continue
+			}
+			if resp.Filename != "" && filepath.Base(resp.Filename) == name {
+				serve(w, r, resp)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func serve(w http.ResponseWriter, r *http.Request, resp *grab.Response) {
+	if !resp.IsComplete() {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(resp)))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	f, err := resp.OpenFile()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if mediaType, params := resp.ContentType(); mediaType != "" {
+		w.Header().Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+	if sum := resp.Checksum(); sum != nil {
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	}
+	modtime := resp.LastModified
+	if modtime.IsZero() {
+		modtime = resp.End
+	}
+	http.ServeContent(w, r, filepath.Base(resp.Filename), modtime, f)
+}
+
+// retryAfter returns the number of seconds until the given transfer is
+// expected to complete.
+func retryAfter(resp *grab.Response) int {
+	eta, ok := resp.ETAWithConfidence()
+	if !ok {
+		return defaultRetryAfter
+	}
+	secs := int(time.Until(eta)/time.Second) + 1
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
@@ -0,0 +1,127 @@
+package grabserve
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "grabserve-test-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func mustGet(t *testing.T, url string, header http.Header) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestFileServer ensures that completed downloads are served with their
+// metadata and support for ranges.
+func TestFileServer(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		req, err := grab.NewRequest("", url+"/served.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		resp := grab.DefaultClient.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewServer(FileServer([]*grab.Response{resp}))
+		defer s.Close()
+
+		r := mustGet(t, s.URL+"/served.bin", nil)
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("expected status: %d, got: %d", http.StatusOK, r.StatusCode)
+		}
+		if r.ContentLength != resp.Size() {
+			t.Errorf("expected Content-Length: %d, got: %d", resp.Size(), r.ContentLength)
+		}
+		if v := r.Header.Get("Content-Type"); v != "application/octet-stream" {
+			t.Errorf("expected Content-Type: application/octet-stream, got: %s", v)
+		}
+		etag := `"` + grabtest.DefaultHandlerSHA256Checksum + `"`
+		if v := r.Header.Get("ETag"); v != etag {
+			t.Errorf("expected ETag: %s, got: %s", etag, v)
+		}
+		grabtest.AssertSHA256Sum(t, grabtest.DefaultHandlerSHA256ChecksumBytes, r.Body)
+
+		// ranged request
+		r = mustGet(t, s.URL+"/served.bin", http.Header{"Range": {"bytes=10-19"}})
+		b, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		if r.StatusCode != http.StatusPartialContent || len(b) != 10 || b[0] != 10 {
+			t.Errorf("expected 10 bytes of partial content from offset 10, got: %d, %v", r.StatusCode, b)
+		}
+
+		// conditional request
+		r = mustGet(t, s.URL+"/served.bin", http.Header{"If-None-Match": {etag}})
+		r.Body.Close()
+		if r.StatusCode != http.StatusNotModified {
+			t.Errorf("expected status: %d, got: %d", http.StatusNotModified, r.StatusCode)
+		}
+
+		r = mustGet(t, s.URL+"/other.bin", nil)
+		r.Body.Close()
+		if r.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status: %d, got: %d", http.StatusNotFound, r.StatusCode)
+		}
+	}, grabtest.Header("Content-Type", "application/octet-stream"))
+}
+
+// TestHandlerInProgress ensures that transfers in progress respond with 503
+// Service Unavailable and failed transfers with 404 Not Found.
+func TestHandlerInProgress(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		req, err := grab.NewRequest("", url+"/stalled.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := grab.DefaultClient.Do(req)
+		s := httptest.NewServer(Handler(resp))
+		defer s.Close()
+
+		r := mustGet(t, s.URL, nil)
+		r.Body.Close()
+		if r.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status: %d, got: %d", http.StatusServiceUnavailable, r.StatusCode)
+		}
+		if v := r.Header.Get("Retry-After"); v == "" {
+			t.Error("expected Retry-After header")
+		}
+
+		resp.Cancel(nil)
+		r = mustGet(t, s.URL, nil)
+		r.Body.Close()
+		if r.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status: %d, got: %d", http.StatusNotFound, r.StatusCode)
+		}
+	}, grabtest.HeaderBodyDelay(time.Minute))
+}
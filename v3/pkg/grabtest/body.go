@@ -0,0 +1,48 @@
+package grabtest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// randomByte returns the byte at offset i of the pseudorandom body generated
+// from seed. Each 8 byte block is derived from its index alone, so any range
+// of the body can be generated without generating what precedes it.
+func randomByte(seed, i int64) byte {
+	// splitmix64
+	x := uint64(seed) + uint64(i>>3+1)*0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return byte(x >> (8 * uint(i&7)))
+}
+
+// BodyDigest returns the checksum of the first length bytes of the body served
+// with RandomBody(seed), computed with the given algorithm: "md5", "sha1",
+// "sha256" or "sha512". It panics if the algorithm is not supported.
+func BodyDigest(seed int64, length int, algo string) []byte {
+	var h hash.Hash
+	switch algo {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		panic(fmt.Sprintf("grabtest: unsupported digest algorithm: %q", algo))
+	}
+	bw := bufio.NewWriterSize(h, 4096)
+	for i := int64(0); i < int64(length); i++ {
+		bw.WriteByte(randomByte(seed, i))
+	}
+	bw.Flush()
+	return h.Sum(nil)
+}
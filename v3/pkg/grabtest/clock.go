@@ -0,0 +1,102 @@
+package grabtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/bps"
+)
+
+// FakeClock is a bps.Clock, such as grab.Client.Clock, whose time only changes
+// when Advance is called, so that tests can assert exact transfer rates and
+// estimates. It is safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(t time.Time) *FakeClock {
+	c := &FakeClock{now: t}
+	c.cond.L = &c.mu
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker that ticks as the clock is advanced past each
+// period d. As with time.Ticker, ticks are dropped if the receiver falls
+// behind.
+func (c *FakeClock) NewTicker(d time.Duration) bps.Ticker {
+	if d <= 0 {
+		panic("grabtest: non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, delivering the ticks of every ticker
+// that are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// BlockUntilTickers blocks until at least n tickers of the clock are running,
+// so that a test can advance the clock once the code under test is waiting for
+// ticks.
+func (c *FakeClock) BlockUntilTickers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.tickers) < n {
+		c.cond.Wait()
+	}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (c *fakeTicker) C() <-chan time.Time { return c.c }
+
+func (c *fakeTicker) Stop() {
+	f := c.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, t := range f.tickers {
+		if t == c {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			break
+		}
+	}
+	f.cond.Broadcast()
+}
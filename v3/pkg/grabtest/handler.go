@@ -2,9 +2,14 @@ package grabtest
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -23,20 +28,35 @@ type handler struct {
 	statusCodeFunc     StatusCodeFunc
 	methodWhitelist    []string
 	headerBlacklist    []string
-	contentLength      int
+	contentLength      int64
+	contentMD5         bool
 	acceptRanges       bool
+	acceptRangesNone   bool
 	attachmentFilename string
 	lastModified       time.Time
+	etagFunc           func(req *http.Request) string
+	headers            http.Header
+	gzip               bool
 	ttfb               time.Duration
+	headerBodyDelay    time.Duration
 	rateLimiter        *time.Ticker
+	infiniteChunk      int
+	infiniteDelay      time.Duration
+	infiniteCap        int64
+	corruptOffset      int64
+	corruptCount       int
+	random             bool
+	randomSeed         int64
+	done               chan struct{}
 }
 
 func NewHandler(options ...HandlerOption) (http.Handler, error) {
 	h := &handler{
 		statusCodeFunc:  func(req *http.Request) int { return http.StatusOK },
 		methodWhitelist: []string{"GET", "HEAD"},
-		contentLength:   DefaultHandlerContentLength,
+		contentLength:   int64(DefaultHandlerContentLength),
 		acceptRanges:    true,
+		done:            make(chan struct{}),
 	}
 	for _, option := range options {
 		if err := option(h); err != nil {
@@ -46,7 +66,7 @@ func NewHandler(options ...HandlerOption) (http.Handler, error) {
 	return h, nil
 }
 
-func WithTestServer(t *testing.T, f func(url string), options ...HandlerOption) {
+func WithTestServer(t testing.TB, f func(url string), options ...HandlerOption) {
 	h, err := NewHandler(options...)
 	if err != nil {
 		t.Fatalf("unable to create test server handler: %v", err)
@@ -55,15 +75,49 @@ func WithTestServer(t *testing.T, f func(url string), options ...HandlerOption)
 	s := httptest.NewServer(h)
 	defer func() {
 		h.(*handler).close()
+		if h.(*handler).infiniteChunk > 0 {
+			// a client may still be reading an infinite body, which would
+			// block s.Close forever
+			s.CloseClientConnections()
+		}
 		s.Close()
 	}()
 	f(s.URL)
 }
 
+// WithMirrors starts n test servers, calls f with their URLs and then shuts them
+// all down. Every server serves the same body unless the options given for it
+// in perMirror differ, so that mirror tests can make one server unavailable,
+// slow or corrupt. perMirror may have fewer than n elements.
+func WithMirrors(t testing.TB, n int, f func(urls []string), perMirror ...[]HandlerOption) {
+	if len(perMirror) > n {
+		t.Fatalf("options given for %d of %d mirrors", len(perMirror), n)
+		return
+	}
+	urls := make([]string, n)
+	var start func(i int)
+	start = func(i int) {
+		if i == n {
+			f(urls)
+			return
+		}
+		var options []HandlerOption
+		if i < len(perMirror) {
+			options = perMirror[i]
+		}
+		WithTestServer(t, func(url string) {
+			urls[i] = url
+			start(i + 1)
+		}, options...)
+	}
+	start(0)
+}
+
 func (h *handler) close() {
 	if h.rateLimiter != nil {
 		h.rateLimiter.Stop()
 	}
+	close(h.done)
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -72,6 +126,13 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(h.ttfb)
 	}
 
+	// set server options
+	if h.acceptRanges {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else if h.acceptRangesNone {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+
 	// validate request method
 	allowed := false
 	for _, m := range h.methodWhitelist {
@@ -85,11 +146,6 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// set server options
-	if h.acceptRanges {
-		w.Header().Set("Accept-Ranges", "bytes")
-	}
-
 	// set attachment filename
 	if h.attachmentFilename != "" {
 		w.Header().Set(
@@ -105,21 +161,71 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Last-Modified", lastMod.Format(http.TimeFormat))
 
+	// set entity tag
+	etag := ""
+	if h.etagFunc != nil {
+		etag = h.etagFunc(r)
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	// evaluate preconditions
+	if v := r.Header.Get("If-Match"); v != "" && v != "*" && v != etag {
+		httpError(w, http.StatusPreconditionFailed)
+		return
+	}
+	if v := r.Header.Get("If-Unmodified-Since"); v != "" && !h.lastModified.IsZero() {
+		if t, err := http.ParseTime(v); err == nil && h.lastModified.Truncate(time.Second).After(t) {
+			httpError(w, http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	// set arbitrary headers
+	for key, values := range h.headers {
+		w.Header()[key] = values
+	}
+
 	// set content-length
-	offset := 0
-	if h.acceptRanges {
+	offset, end := int64(0), h.contentLength
+	ranged := false
+	infinite := h.infiniteChunk > 0
+	if h.acceptRanges && !infinite {
 		if reqRange := r.Header.Get("Range"); reqRange != "" {
-			if _, err := fmt.Sscanf(reqRange, "bytes=%d-", &offset); err != nil {
+			var last int64
+			if n, _ := fmt.Sscanf(reqRange, "bytes=%d-%d", &offset, &last); n < 1 {
 				httpError(w, http.StatusBadRequest)
 				return
+			} else if n == 2 && last+1 < end {
+				end = last + 1
 			}
-			if offset >= h.contentLength {
+			if offset >= h.contentLength || offset >= end {
 				httpError(w, http.StatusRequestedRangeNotSatisfiable)
 				return
 			}
+			ranged = true
+			w.Header().Set(
+				"Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", offset, end-1, h.contentLength))
 		}
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", h.contentLength-offset))
+	if !infinite {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", end-offset))
+	}
+
+	// compress the body, if accepted by the client
+	gzipped := h.gzip && !ranged && !infinite &&
+		strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	if gzipped {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	// set content checksum
+	if h.contentMD5 && !infinite && offset == 0 && end == h.contentLength {
+		w.Header().Set("Content-MD5", h.bodyMD5())
+	}
 
 	// apply header blacklist
 	for _, key := range h.headerBlacklist {
@@ -127,27 +233,146 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// send header and status code
-	w.WriteHeader(h.statusCodeFunc(r))
+	code := h.statusCodeFunc(r)
+	if ranged && code == http.StatusOK {
+		code = http.StatusPartialContent
+	}
+	w.WriteHeader(code)
+
+	// delay body
+	if h.headerBodyDelay > 0 && r.Method == "GET" {
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(h.headerBodyDelay):
+		case <-r.Context().Done():
+			return
+		}
+	}
 
 	// send body
+	if r.Method == "GET" && infinite {
+		h.serveInfinite(w, r)
+		return
+	}
 	if r.Method == "GET" {
+		var body io.Writer = w
+		var zw *gzip.Writer
+		if gzipped {
+			zw = gzip.NewWriter(w)
+			body = zw
+		}
+
 		// use buffered io to reduce overhead on the reader
-		bw := bufio.NewWriterSize(w, 4096)
-		for i := offset; !isRequestClosed(r) && i < h.contentLength; i++ {
-			bw.Write([]byte{byte(i)})
-			if h.rateLimiter != nil {
-				bw.Flush()
-				w.(http.Flusher).Flush() // force the server to send the data to the client
+		bw := bufio.NewWriterSize(body, 4096)
+		for i := offset; !isRequestClosed(r) && i < end; i++ {
+			if h.rateLimiter != nil && i > offset {
+				// wait between bytes rather than after the last one, so a
+				// complete response never blocks on a stopped ticker
 				select {
 				case <-h.rateLimiter.C:
 				case <-r.Context().Done():
+					continue
+				}
+			}
+			bw.Write([]byte{h.byteAt(i)})
+			if h.rateLimiter != nil {
+				bw.Flush()
+				if zw != nil {
+					zw.Flush()
 				}
+				w.(http.Flusher).Flush() // force the server to send the data to the client
 			}
 		}
 		if !isRequestClosed(r) {
 			bw.Flush()
+			if zw != nil {
+				zw.Close()
+			}
+		}
+	}
+}
+
+// serveInfinite sends the deterministic body pattern in chunks until the client
+// disconnects, the server is closed or the cap, if any, is reached.
+func (h *handler) serveInfinite(w http.ResponseWriter, r *http.Request) {
+	chunk := make([]byte, h.infiniteChunk)
+	for i := int64(0); h.infiniteCap == 0 || i < h.infiniteCap; {
+		n := int64(len(chunk))
+		if h.infiniteCap > 0 && h.infiniteCap-i < n {
+			n = h.infiniteCap - i
 		}
+		for j := range chunk[:n] {
+			chunk[j] = h.byteAt(i + int64(j))
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+		i += n
+
+		if !h.wait(r, h.infiniteDelay) {
+			return
+		}
+	}
+}
+
+// wait waits for the given duration and returns true, or returns false as soon
+// as the client disconnects or the server is closed.
+func (h *handler) wait(r *http.Request, d time.Duration) bool {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	} else {
+		closed := make(chan time.Time)
+		close(closed)
+		timeout = closed
+	}
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-h.done:
+		return false
+	default:
+	}
+	select {
+	case <-timeout:
+		return true
+	case <-r.Context().Done():
+		return false
+	case <-h.done:
+		return false
+	}
+}
+
+// byteAt returns the byte of the body at the given offset.
+func (h *handler) byteAt(i int64) byte {
+	b := h.canonicalByteAt(i)
+	if i >= h.corruptOffset && i-h.corruptOffset < int64(h.corruptCount) {
+		return ^b
+	}
+	return b
+}
+
+// canonicalByteAt returns the byte of the body at the given offset, ignoring
+// CorruptBytes.
+func (h *handler) canonicalByteAt(i int64) byte {
+	if h.random {
+		return randomByte(h.randomSeed, i)
+	}
+	return byte(i)
+}
+
+// bodyMD5 returns the base64 encoded MD5 checksum of the full response body.
+func (h *handler) bodyMD5() string {
+	m := md5.New()
+	bw := bufio.NewWriterSize(m, 4096)
+	for i := int64(0); i < h.contentLength; i++ {
+		bw.WriteByte(h.canonicalByteAt(i))
 	}
+	bw.Flush()
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
 }
 
 // isRequestClosed returns true if the client request has been canceled.
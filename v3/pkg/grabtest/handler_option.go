@@ -41,6 +41,13 @@ func HeaderBlacklist(headers ...string) HandlerOption {
 }
 
 func ContentLength(n int) HandlerOption {
+	return ContentLength64(int64(n))
+}
+
+// ContentLength64 is the same as ContentLength, but accepts lengths beyond
+// 2 GiB on 32-bit platforms. The content is generated as it is sent, so large
+// lengths do not allocate memory.
+func ContentLength64(n int64) HandlerOption {
 	return func(h *handler) error {
 		if n < 0 {
 			return errors.New("content length must be zero or greater")
@@ -57,6 +64,17 @@ func AcceptRanges(enabled bool) HandlerOption {
 	}
 }
 
+// AcceptRangesNone disables ranged requests and explicitly advertises that
+// they are unsupported with the 'Accept-Ranges: none' header, in all
+// responses.
+func AcceptRangesNone() HandlerOption {
+	return func(h *handler) error {
+		h.acceptRanges = false
+		h.acceptRangesNone = true
+		return nil
+	}
+}
+
 func LastModified(t time.Time) HandlerOption {
 	return func(h *handler) error {
 		h.lastModified = t.UTC()
@@ -64,6 +82,49 @@ func LastModified(t time.Time) HandlerOption {
 	}
 }
 
+// ETag sets the ETag header of every response to the given entity tag, which
+// should include quotes. Requests with an If-Match header that does not match
+// the entity tag fail with 412 Precondition Failed.
+func ETag(tag string) HandlerOption {
+	return ETagFunc(func(req *http.Request) string {
+		return tag
+	})
+}
+
+// ETagFunc is the same as ETag, but calls the given function to determine the
+// entity tag of each response. This may be used to simulate a remote file that
+// changes between requests.
+func ETagFunc(f func(req *http.Request) string) HandlerOption {
+	return func(h *handler) error {
+		if f == nil {
+			return errors.New("entity tag function cannot be nil")
+		}
+		h.etagFunc = f
+		return nil
+	}
+}
+
+// Header sets the given header on every response. It may be given multiple
+// times to set multiple headers.
+func Header(key, value string) HandlerOption {
+	return func(h *handler) error {
+		if h.headers == nil {
+			h.headers = make(http.Header)
+		}
+		h.headers.Set(key, value)
+		return nil
+	}
+}
+
+// Gzip specifies that the response body should be gzip compressed if the
+// client accepts it. Ranged requests are never compressed.
+func Gzip(enabled bool) HandlerOption {
+	return func(h *handler) error {
+		h.gzip = enabled
+		return nil
+	}
+}
+
 func TimeToFirstByte(d time.Duration) HandlerOption {
 	return func(h *handler) error {
 		if d < 1 {
@@ -74,6 +135,18 @@ func TimeToFirstByte(d time.Duration) HandlerOption {
 	}
 }
 
+// HeaderBodyDelay delays the response body by the given duration after the
+// response header has been sent, simulating a stalled connection.
+func HeaderBodyDelay(d time.Duration) HandlerOption {
+	return func(h *handler) error {
+		if d < 1 {
+			return errors.New("header body delay must be greater than zero")
+		}
+		h.headerBodyDelay = d
+		return nil
+	}
+}
+
 func RateLimiter(bps int) HandlerOption {
 	return func(h *handler) error {
 		if bps < 1 {
@@ -90,3 +163,72 @@ func AttachmentFilename(filename string) HandlerOption {
 		return nil
 	}
 }
+
+// ContentMD5 sets the Content-MD5 header to the base64 encoded MD5 checksum of
+// the response body, for responses that include the full content.
+func ContentMD5(enabled bool) HandlerOption {
+	return func(h *handler) error {
+		h.contentMD5 = enabled
+		return nil
+	}
+}
+
+// InfiniteBody specifies that GET responses should stream the body pattern
+// forever, without a Content-Length header, in chunks of the given size that
+// are each flushed to the client and followed by the given delay. The body ends
+// when the client disconnects, the test server is closed or the cap set by
+// InfiniteBodyCap is reached. Ranged requests are not supported and are served
+// the whole body.
+func InfiniteBody(chunk int, delay time.Duration) HandlerOption {
+	return func(h *handler) error {
+		if chunk < 1 {
+			return errors.New("chunk size must be greater than zero")
+		}
+		if delay < 0 {
+			return errors.New("chunk delay must be zero or greater")
+		}
+		h.infiniteChunk = chunk
+		h.infiniteDelay = delay
+		return nil
+	}
+}
+
+// InfiniteBodyCap ends the body of InfiniteBody after n bytes, as a safeguard
+// against tests that never stop reading. It has no effect without
+// InfiniteBody.
+func InfiniteBodyCap(n int64) HandlerOption {
+	return func(h *handler) error {
+		if n < 1 {
+			return errors.New("infinite body cap must be greater than zero")
+		}
+		h.infiniteCap = n
+		return nil
+	}
+}
+
+// RandomBody specifies that the body should be generated pseudorandomly from
+// the given seed rather than repeat the default pattern, so that it does not
+// compress and misplaced blocks are detected. Any range of the body can be
+// served without generating what precedes it. The checksum of the body is
+// returned by BodyDigest.
+func RandomBody(seed int64) HandlerOption {
+	return func(h *handler) error {
+		h.random = true
+		h.randomSeed = seed
+		return nil
+	}
+}
+
+// CorruptBytes inverts the count bytes of the body starting at the given
+// offset, so that a server serves bad data with otherwise valid headers. The
+// Content-MD5 header, if enabled, is still that of the intact body.
+func CorruptBytes(offset int64, count int) HandlerOption {
+	return func(h *handler) error {
+		if offset < 0 || count < 1 {
+			return errors.New("corrupt bytes must have an offset of zero or greater and a count greater than zero")
+		}
+		h.corruptOffset = offset
+		h.corruptCount = count
+		return nil
+	}
+}
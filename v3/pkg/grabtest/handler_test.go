@@ -1,6 +1,8 @@
 package grabtest
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
@@ -111,12 +113,43 @@ func TestHandlerAcceptRanges(t *testing.T) {
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n/2))
 			resp := MustHTTPDo(req)
 			AssertHTTPResponseHeader(t, resp, header, "bytes")
+			AssertHTTPResponseStatusCode(t, resp, http.StatusPartialContent)
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes %d-%d/%d", n/2, n-1, n)
 			AssertHTTPResponseContentLength(t, resp, int64(n/2))
 		},
 			ContentLength(n),
 		)
 	})
 
+	t.Run("WithLastBytePosition", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", "bytes=0-0")
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusPartialContent)
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes 0-0/%d", n)
+			AssertHTTPResponseContentLength(t, resp, 1)
+		},
+			ContentLength(n),
+		)
+	})
+
+	t.Run("WithLargeOffset", func(t *testing.T) {
+		// offsets beyond 4 GiB must not overflow on 32-bit platforms
+		size := int64(5<<30) + int64(n)
+		offset := int64(5 << 30)
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusPartialContent)
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes %d-%d/%d", offset, size-1, size)
+			AssertHTTPResponseBodyLength(t, resp, int64(n))
+		},
+			ContentLength64(size),
+		)
+	})
+
 	t.Run("Disabled", func(t *testing.T) {
 		WithTestServer(t, func(url string) {
 			req := MustHTTPNewRequest("GET", url, nil)
@@ -149,3 +182,230 @@ func TestHandlerLastModified(t *testing.T) {
 		LastModified(time.Unix(123456789, 0)),
 	)
 }
+
+func TestHandlerContentMD5(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseHeader(t, resp, "Content-MD5", "suqff86oMaSmOyE/QaiFWw==")
+
+		// partial content should not include a checksum
+		req := MustHTTPNewRequest("GET", url, nil)
+		req.Header.Set("Range", "bytes=512-")
+		resp = MustHTTPDoWithClose(req)
+		AssertHTTPResponseHeader(t, resp, "Content-MD5", "")
+	},
+		ContentLength(1024),
+		ContentMD5(true),
+	)
+}
+
+func TestHandlerETag(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseHeader(t, resp, "ETag", `"abc"`)
+	},
+		ETag(`"abc"`),
+	)
+}
+
+func TestHandlerHeader(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseHeader(t, resp, "X-Content-Type-Options", "nosniff")
+		AssertHTTPResponseHeader(t, resp, "X-Signature", "abc")
+	},
+		Header("X-Content-Type-Options", "nosniff"),
+		Header("X-Signature", "abc"),
+	)
+}
+
+func TestHandlerGzip(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		// the default http.Transport requests and decompresses gzip encoding
+		resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+		defer resp.Body.Close()
+		if !resp.Uncompressed {
+			t.Errorf("expected response to be decompressed")
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 1024 {
+			t.Errorf("expected %d bytes, got %d", 1024, len(b))
+		}
+
+		// ranged requests are not compressed
+		req := MustHTTPNewRequest("GET", url, nil)
+		req.Header.Set("Range", "bytes=512-")
+		resp = MustHTTPDo(req)
+		defer resp.Body.Close()
+		AssertHTTPResponseHeader(t, resp, "Content-Encoding", "")
+		AssertHTTPResponseContentLength(t, resp, 512)
+	},
+		ContentLength(1024),
+		Gzip(true),
+	)
+}
+
+func TestHandlerPreconditions(t *testing.T) {
+	lastMod := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	WithTestServer(t, func(url string) {
+		tests := []struct {
+			Key, Value string
+			StatusCode int
+		}{
+			{"If-Match", `"abc"`, http.StatusOK},
+			{"If-Match", `"def"`, http.StatusPreconditionFailed},
+			{"If-Unmodified-Since", lastMod.Format(http.TimeFormat), http.StatusOK},
+			{"If-Unmodified-Since", lastMod.Add(-time.Hour).Format(http.TimeFormat), http.StatusPreconditionFailed},
+		}
+		for _, test := range tests {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set(test.Key, test.Value)
+			resp := MustHTTPDoWithClose(req)
+			AssertHTTPResponseStatusCode(t, resp, test.StatusCode)
+		}
+	},
+		ETag(`"abc"`),
+		LastModified(lastMod),
+	)
+}
+
+func TestHandlerInfiniteBody(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			defer resp.Body.Close()
+			AssertHTTPResponseHeader(t, resp, "Content-Length", "")
+			if resp.ContentLength != -1 {
+				t.Errorf("expected unknown content length, got %d", resp.ContentLength)
+			}
+			b := make([]byte, 4<<20)
+			if _, err := io.ReadFull(resp.Body, b); err != nil {
+				t.Fatal(err)
+			}
+			for i, c := range b {
+				if c != byte(i) {
+					t.Fatalf("expected byte %d to be %d, got %d", i, byte(i), c)
+				}
+			}
+		},
+			InfiniteBody(1000, 0),
+		)
+	})
+
+	t.Run("WithCap", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			AssertHTTPResponseBodyLength(t, resp, 2500)
+		},
+			InfiniteBody(1000, time.Millisecond),
+			InfiniteBodyCap(2500),
+		)
+	})
+
+	t.Run("WithShutdown", func(t *testing.T) {
+		// the server shuts down while the client is not reading the body
+		var resp *http.Response
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			WithTestServer(t, func(url string) {
+				resp = MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			},
+				InfiniteBody(32<<10, 0),
+			)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected test server to shut down")
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	})
+
+	t.Run("WithRange", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", "bytes=10-")
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusOK)
+			AssertHTTPResponseBodyLength(t, resp, 100)
+		},
+			InfiniteBody(10, 0),
+			InfiniteBodyCap(100),
+		)
+	})
+}
+
+func TestWithMirrors(t *testing.T) {
+	WithMirrors(t, 3, func(urls []string) {
+		if len(urls) != 3 || urls[0] == urls[1] || urls[1] == urls[2] {
+			t.Fatalf("expected 3 distinct URLs, got: %v", urls)
+		}
+		bodies := make([][]byte, len(urls))
+		for i, url := range urls {
+			resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies[i] = b
+		}
+		if !bytes.Equal(bodies[0], bodies[2]) || len(bodies[0]) != 1024 {
+			t.Errorf("expected identical bodies of 1024 bytes")
+		}
+		for i, c := range bodies[1] {
+			corrupt := i >= 100 && i < 110
+			if (c != bodies[0][i]) != corrupt {
+				t.Errorf("byte %d: expected corrupt: %v, got %d", i, corrupt, c)
+			}
+		}
+	},
+		[]HandlerOption{ContentLength(1024)},
+		[]HandlerOption{ContentLength(1024), CorruptBytes(100, 10)},
+		[]HandlerOption{ContentLength(1024)},
+	)
+}
+
+func TestHandlerRandomBody(t *testing.T) {
+	n := 100000
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(b)
+		if !bytes.Equal(sum[:], BodyDigest(42, n, "sha256")) {
+			t.Errorf("expected body to match its digest")
+		}
+		if bytes.Equal(b[:256], b[256:512]) {
+			t.Errorf("expected body not to repeat")
+		}
+
+		// ranges are generated from their offset
+		req := MustHTTPNewRequest("GET", url, nil)
+		req.Header.Set("Range", "bytes=12345-12399")
+		resp = MustHTTPDo(req)
+		part, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(part, b[12345:12400]) {
+			t.Errorf("expected range to match the full body")
+		}
+	},
+		ContentLength(n),
+		RandomBody(42),
+	)
+
+	if bytes.Equal(BodyDigest(1, n, "md5"), BodyDigest(2, n, "md5")) {
+		t.Errorf("expected different seeds to generate different bodies")
+	}
+}
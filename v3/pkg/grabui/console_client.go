@@ -3,6 +3,7 @@ package grabui
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -15,12 +16,43 @@ type ConsoleClient struct {
 	client                        *grab.Client
 	succeeded, failed, inProgress int
 	responses                     []*grab.Response
+
+	// Verbose specifies that the media type of a download and any warnings it
+	// raised should be printed once it is complete.
+	Verbose bool
+
+	// TerminalSize, if not nil, returns the width and height in characters of
+	// the terminal that progress is printed to, or false if the output is not
+	// a terminal. It is called before every refresh. Default: the size of the
+	// terminal of the output, which is queried again whenever it is resized.
+	TerminalSize func() (width, height int, ok bool)
+
+	// log, if not nil, receives a line for each completed download.
+	log *completionLog
+
+	// out receives the progress of all downloads. It is standard error if any
+	// download is written to standard output.
+	out io.Writer
+
+	// liveRows is the number of progress lines printed by the last refresh,
+	// which are redrawn by the next refresh.
+	liveRows int
+
+	// width and height are the last known size of the terminal, which is only
+	// queried again once resized is set, unless polled.
+	width, height int
+	sized         bool
+	resized       bool
 }
 
-func NewConsoleClient(client *grab.Client) *ConsoleClient {
-	return &ConsoleClient{
+func NewConsoleClient(client *grab.Client, options ...Option) *ConsoleClient {
+	c := &ConsoleClient{
 		client: client,
 	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
 }
 
 func (c *ConsoleClient) Do(
@@ -42,8 +74,20 @@ func (c *ConsoleClient) Do(
 		if c.client == nil {
 			c.client = grab.DefaultClient
 		}
+		c.out = os.Stdout
+		for _, req := range reqs {
+			if req.Filename == "-" {
+				c.out = os.Stderr
+				break
+			}
+		}
+
+		c.liveRows = 0
+		c.resized = true
+		winch := make(chan os.Signal, 1)
+		defer notifyResize(winch)()
 
-		fmt.Printf("Downloading %d files...\n", len(reqs))
+		fmt.Fprintf(c.out, "Downloading %d files...\n", len(reqs))
 		respch := c.client.DoBatch(workers, reqs...)
 		t := time.NewTicker(200 * time.Millisecond)
 		defer t.Stop()
@@ -58,6 +102,9 @@ func (c *ConsoleClient) Do(
 				if resp != nil {
 					// a new response has been received and has started downloading
 					c.responses = append(c.responses, resp)
+					if c.log != nil {
+						c.log.watch(resp)
+					}
 					pump <- resp // send to caller
 				} else {
 					// channel is closed - all downloads are complete
@@ -67,13 +114,21 @@ func (c *ConsoleClient) Do(
 			case <-t.C:
 				// update UI on clock tick
 				c.refresh()
+
+			case <-winch:
+				// redraw at the new size on the next tick
+				c.resized = true
 			}
 		}
 
 		c.refresh()
+		if c.log != nil && ctx.Err() == nil {
+			// all downloads are complete, so their lines are written promptly
+			c.log.wait()
+		}
 		close(pump)
 
-		fmt.Printf(
+		fmt.Fprintf(c.out,
 			"Finished %d successful, %d failed, %d incomplete.\n",
 			c.succeeded,
 			c.failed,
@@ -84,9 +139,10 @@ func (c *ConsoleClient) Do(
 
 // refresh prints the progress of all downloads to the terminal
 func (c *ConsoleClient) refresh() {
-	// clear lines for incomplete downloads
-	if c.inProgress > 0 {
-		fmt.Printf("\033[%dA\033[K", c.inProgress)
+	// clear the progress lines of the last refresh, and anything below them
+	// that a resize may have left behind
+	if c.liveRows > 0 {
+		fmt.Fprintf(c.out, "\033[%dA\033[J", c.liveRows)
 	}
 
 	// print newly completed downloads
@@ -99,30 +155,128 @@ func (c *ConsoleClient) refresh() {
 					resp.Err())
 			} else {
 				c.succeeded++
-				fmt.Printf("Finished %s %s / %s (%d%%)\n",
+				fmt.Fprintf(c.out, "Finished %s %s / %s (%d%%)",
 					resp.Filename,
 					byteString(resp.BytesComplete()),
 					byteString(resp.Size()),
 					int(100*resp.Progress()))
+				if n := resp.BytesResumed(); n > 0 {
+					fmt.Fprintf(c.out, ", resumed from %s", byteString(n))
+				}
+				fmt.Fprintln(c.out)
+			}
+			if c.Verbose {
+				if mediaType, _ := resp.ContentType(); mediaType != "" {
+					fmt.Fprintf(c.out, "  content type: %s\n", mediaType)
+				}
+				for _, w := range resp.Warnings() {
+					fmt.Fprintf(c.out, "  warning: %v\n", w)
+				}
 			}
 			c.responses[i] = nil
 		}
 	}
 
 	// print progress for incomplete downloads
-	c.inProgress = 0
+	var lines []string
+	var live []*grab.Response
 	for _, resp := range c.responses {
 		if resp != nil {
-			fmt.Printf("Downloading %s %s / %s (%d%%) - %s ETA: %s \033[K\n",
+			lines = append(lines, fmt.Sprintf("Downloading %s %s / %s (%d%%) - %s ETA: %s",
 				resp.Filename,
 				byteString(resp.BytesComplete()),
 				byteString(resp.Size()),
 				int(100*resp.Progress()),
 				bpsString(resp.BytesPerSecond()),
-				etaString(resp.ETA()))
-			c.inProgress++
+				etaString(resp.ETAWithConfidence())))
+			live = append(live, resp)
 		}
 	}
+	width, height, ok := c.terminalSize()
+	lines = layout(lines, aggregateLine(live), width, height, ok)
+	for _, line := range lines {
+		fmt.Fprintf(c.out, "%s\033[K\n", line)
+	}
+	c.liveRows = len(lines)
+	c.inProgress = len(live)
+}
+
+// terminalSize returns the current size of the terminal of the output.
+func (c *ConsoleClient) terminalSize() (width, height int, ok bool) {
+	if c.TerminalSize != nil {
+		return c.TerminalSize()
+	}
+	if c.resized || pollTerminalSize {
+		c.resized = false
+		c.width, c.height, c.sized = 0, 0, false
+		if f, ok := c.out.(*os.File); ok {
+			c.width, c.height, c.sized = terminalSize(f)
+		}
+	}
+	return c.width, c.height, c.sized
+}
+
+// layout returns the progress lines to print to a terminal of the given size,
+// so that they can be redrawn. Each line is truncated to the width so that it
+// does not wrap, and lines that do not fit below the cursor line are replaced
+// by a count of the remaining downloads. If not even one progress line and
+// that count fit, only the aggregate line is returned, until the terminal is
+// large enough again. All lines are
+// returned unchanged if the size of the terminal is not known.
+func layout(lines []string, aggregate string, width, height int, ok bool) []string {
+	if !ok || len(lines) == 0 {
+		return lines
+	}
+	rows := height - 1 // leave the cursor line
+	switch {
+	case rows >= len(lines):
+		lines = append([]string(nil), lines...)
+	case rows >= 2:
+		more := len(lines) - (rows - 1)
+		lines = append(lines[:rows-1:rows-1], fmt.Sprintf("... and %d more", more))
+	default:
+		lines = []string{aggregate}
+	}
+	for i, line := range lines {
+		lines[i] = truncate(line, width-1)
+	}
+	return lines
+}
+
+// aggregateLine returns a single line describing the progress of all of the
+// given downloads.
+func aggregateLine(live []*grab.Response) string {
+	var complete, size int64
+	var bps float64
+	for _, resp := range live {
+		complete += resp.BytesComplete()
+		if size >= 0 {
+			if n := resp.Size(); n >= 0 {
+				size += n
+			} else {
+				size = -1
+			}
+		}
+		bps += resp.BytesPerSecond()
+	}
+	total := "unknown"
+	if size >= 0 {
+		total = byteString(size)
+	}
+	return fmt.Sprintf("Downloading %d files %s / %s - %s",
+		len(live), byteString(complete), total, bpsString(bps))
+}
+
+// truncate returns s truncated to at most n characters.
+func truncate(s string, n int) string {
+	if n < 1 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
 }
 
 func bpsString(n float64) string {
@@ -154,7 +308,10 @@ func byteString(n int64) string {
 	return fmt.Sprintf("%dTB", n>>40)
 }
 
-func etaString(eta time.Time) string {
+func etaString(eta time.Time, ok bool) string {
+	if !ok {
+		return "unknown"
+	}
 	d := time.Until(eta)
 	if d < time.Second {
 		return "<1s"
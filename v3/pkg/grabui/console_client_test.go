@@ -0,0 +1,39 @@
+package grabui
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestLayout ensures that progress lines are clamped to the size of the
+// terminal, falling back to the aggregate line when too small.
+func TestLayout(t *testing.T) {
+	lines := []string{"one 1234567890", "two 1234567890", "three 1234567890"}
+	tests := []struct {
+		Width, Height int
+		Sized         bool
+		Expect        []string
+	}{
+		{Width: 80, Height: 24, Sized: true, Expect: lines},
+		{Width: 8, Height: 24, Sized: true, Expect: []string{"one 123", "two 123", "three 1"}},
+		{Width: 80, Height: 3, Sized: true, Expect: []string{"one 1234567890", "... and 2 more"}},
+		{Width: 80, Height: 2, Sized: true, Expect: []string{"aggregate"}},
+		{Width: 80, Height: 1, Sized: true, Expect: []string{"aggregate"}},
+		{Width: 4, Height: 1, Sized: true, Expect: []string{"agg"}},
+		{Width: 8, Height: 1, Expect: lines},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%dx%d", test.Width, test.Height), func(t *testing.T) {
+			got := layout(lines, "aggregate", test.Width, test.Height, test.Sized)
+			if !reflect.DeepEqual(got, test.Expect) {
+				t.Errorf("expected: %q, got: %q", test.Expect, got)
+			}
+		})
+	}
+
+	// the given lines are not modified
+	if lines[0] != "one 1234567890" {
+		t.Errorf("expected lines to be unchanged, got: %q", lines)
+	}
+}
@@ -11,6 +11,29 @@ func GetBatch(
 	workers int,
 	dst string,
 	urlStrs ...string,
+) (<-chan *grab.Response, error) {
+	return getBatch(ctx, NewConsoleClient(grab.DefaultClient), workers, dst, urlStrs...)
+}
+
+// GetBatchVerbose is the same as GetBatch, but also prints the media type of
+// each download and any warnings it raised.
+func GetBatchVerbose(
+	ctx context.Context,
+	workers int,
+	dst string,
+	urlStrs ...string,
+) (<-chan *grab.Response, error) {
+	ui := NewConsoleClient(grab.DefaultClient)
+	ui.Verbose = true
+	return getBatch(ctx, ui, workers, dst, urlStrs...)
+}
+
+func getBatch(
+	ctx context.Context,
+	ui *ConsoleClient,
+	workers int,
+	dst string,
+	urlStrs ...string,
 ) (<-chan *grab.Response, error) {
 	reqs := make([]*grab.Request, len(urlStrs))
 	for i := 0; i < len(urlStrs); i++ {
@@ -22,6 +45,5 @@ func GetBatch(
 		reqs[i] = req
 	}
 
-	ui := NewConsoleClient(grab.DefaultClient)
 	return ui.Do(ctx, workers, reqs...), nil
 }
@@ -0,0 +1,107 @@
+package grabui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/3JoB/grab/v3"
+)
+
+// Format is the format of the lines written by WithCompletionLog.
+type Format int
+
+const (
+	// FormatText writes space separated key=value pairs, as in
+	// 'status=ok url="https://example.com/file" filename="file" bytes=1024'.
+	FormatText Format = iota
+
+	// FormatJSON writes a JSON object per line.
+	FormatJSON
+)
+
+// Option configures a ConsoleClient created by NewConsoleClient.
+type Option func(*ConsoleClient)
+
+// WithCompletionLog specifies that exactly one line should be written to w for
+// each transfer as it completes, successfully or otherwise, in the order in
+// which they complete. The line describes the URL, destination, bytes
+// transferred, duration, average speed, whether the transfer was resumed and
+// any error. The log is independent of the progress printed to the terminal,
+// so that it can be kept when the progress is discarded, such as in CI. Writes
+// to w are serialized.
+func WithCompletionLog(w io.Writer, format Format) Option {
+	return func(c *ConsoleClient) {
+		c.log = &completionLog{w: w, format: format}
+	}
+}
+
+// completionLog writes a line for each completed transfer.
+type completionLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	wg     sync.WaitGroup
+}
+
+// logEntry is a line of a completion log.
+type logEntry struct {
+	Status   string  `json:"status"`
+	URL      string  `json:"url"`
+	Filename string  `json:"filename"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	BPS      float64 `json:"bytes_per_second"`
+	Resumed  bool    `json:"resumed"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// watch writes the line of the given transfer once it completes.
+func (c *completionLog) watch(resp *grab.Response) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-resp.Done
+		c.write(resp)
+	}()
+}
+
+// wait waits for the lines of all watched transfers to be written.
+func (c *completionLog) wait() {
+	c.wg.Wait()
+}
+
+// write writes the line of the given completed transfer.
+func (c *completionLog) write(resp *grab.Response) {
+	e := logEntry{
+		Status:   "ok",
+		URL:      resp.Request.URL().String(),
+		Filename: resp.Filename,
+		Bytes:    resp.BytesComplete() - resp.BytesResumed(),
+		Duration: resp.Duration().Seconds(),
+		Resumed:  resp.DidResume,
+	}
+	if e.Duration > 0 {
+		e.BPS = float64(e.Bytes) / e.Duration
+	}
+	if err := resp.Err(); err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+
+	var line []byte
+	if c.format == FormatJSON {
+		line, _ = json.Marshal(e)
+	} else {
+		line = fmt.Appendf(nil, "status=%s url=%q filename=%q bytes=%d duration=%.3fs speed=%s resumed=%t",
+			e.Status, e.URL, e.Filename, e.Bytes, e.Duration, bpsString(e.BPS), e.Resumed)
+		if e.Error != "" {
+			line = fmt.Appendf(line, " error=%q", e.Error)
+		}
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write(line)
+}
@@ -0,0 +1,85 @@
+package grabui
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestCompletionLog ensures that a completion log writes one whole line per
+// transfer, even when transfers complete concurrently.
+func TestCompletionLog(t *testing.T) {
+	var responses []*grab.Response
+	grabtest.WithTestServer(t, func(url string) {
+		grabtest.WithTestServer(t, func(missingURL string) {
+			for _, u := range []string{url, missingURL} {
+				req, err := grab.NewRequest("", u+"/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.NoStore = true
+				resp := grab.DefaultClient.Do(req)
+				resp.Wait()
+				responses = append(responses, resp)
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	}, grabtest.ContentLength(1024))
+
+	t.Run("FormatJSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		c := NewConsoleClient(nil, WithCompletionLog(&buf, FormatJSON))
+		n := 50
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(resp *grab.Response) {
+				defer wg.Done()
+				c.log.write(resp)
+			}(responses[i%2])
+		}
+		wg.Wait()
+
+		lines := 0
+		s := bufio.NewScanner(&buf)
+		for s.Scan() {
+			var e logEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				t.Fatalf("expected a JSON object per line, got: %q: %v", s.Text(), err)
+			}
+			if (e.Status == "ok") != (e.Error == "") || (e.Status == "ok" && e.Bytes != 1024) {
+				t.Errorf("unexpected entry: %+v", e)
+			}
+			lines++
+		}
+		if lines != n {
+			t.Errorf("expected %d lines, got %d", n, lines)
+		}
+	})
+
+	t.Run("FormatText", func(t *testing.T) {
+		var buf bytes.Buffer
+		c := NewConsoleClient(nil, WithCompletionLog(&buf, FormatText))
+		for _, resp := range responses {
+			c.log.watch(resp)
+		}
+		c.log.wait()
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 lines, got: %q", lines)
+		}
+		for _, line := range lines {
+			ok := strings.HasPrefix(line, "status=ok ") && strings.Contains(line, " bytes=1024 ")
+			failed := strings.HasPrefix(line, "status=failed ") && strings.Contains(line, " error=")
+			if !ok && !failed {
+				t.Errorf("unexpected line: %q", line)
+			}
+		}
+	})
+}
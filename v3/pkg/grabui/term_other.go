@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package grabui
+
+import "os"
+
+// pollTerminalSize is false as the terminal size cannot be queried.
+const pollTerminalSize = false
+
+// terminalSize returns false, as the terminal size cannot be queried on this
+// platform, so progress is never clamped to the terminal.
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	return 0, 0, false
+}
+
+// notifyResize does nothing, as the terminal size cannot be queried.
+func notifyResize(ch chan<- os.Signal) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package grabui
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// pollTerminalSize is false as resizes are signaled by SIGWINCH.
+const pollTerminalSize = false
+
+// terminalSize returns the width and height in characters of the terminal of
+// f, or false if f is not a terminal.
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	var ws struct{ row, col, xpixel, ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.col == 0 || ws.row == 0 {
+		return 0, 0, false
+	}
+	return int(ws.col), int(ws.row), true
+}
+
+// notifyResize sends to ch whenever the terminal is resized, until the
+// returned function is called.
+func notifyResize(ch chan<- os.Signal) (stop func()) {
+	signal.Notify(ch, syscall.SIGWINCH)
+	return func() { signal.Stop(ch) }
+}
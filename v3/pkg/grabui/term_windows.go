@@ -0,0 +1,40 @@
+//go:build windows
+
+package grabui
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// pollTerminalSize is true as Windows consoles do not signal resizes, so the
+// size is queried before every refresh.
+const pollTerminalSize = true
+
+var procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleScreenBufferInfo")
+
+// consoleScreenBufferInfo is CONSOLE_SCREEN_BUFFER_INFO.
+type consoleScreenBufferInfo struct {
+	size, cursorPosition struct{ x, y int16 }
+	attributes           uint16
+	window               struct{ left, top, right, bottom int16 }
+	maximumWindowSize    struct{ x, y int16 }
+}
+
+// terminalSize returns the width and height in characters of the visible
+// window of the console of f, or false if f is not a console.
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	var info consoleScreenBufferInfo
+	r, _, _ := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 0, 0, false
+	}
+	w := info.window
+	return int(w.right-w.left) + 1, int(w.bottom-w.top) + 1, true
+}
+
+// notifyResize does nothing, as the size is polled instead.
+func notifyResize(ch chan<- os.Signal) (stop func()) {
+	return func() {}
+}
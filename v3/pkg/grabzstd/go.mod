@@ -0,0 +1,10 @@
+module github.com/3JoB/grab/v3/pkg/grabzstd
+
+go 1.20
+
+require (
+	github.com/3JoB/grab/v3 v3.0.0-00010101000000-000000000000
+	github.com/klauspost/compress v1.17.9
+)
+
+replace github.com/3JoB/grab/v3 => ../..
@@ -0,0 +1,33 @@
+/*
+Package grabzstd registers a zstd decoder with grab, so that responses encoded
+with the "zstd" content coding are negotiated and decoded. It is a separate
+module so that the zstd dependency is only required by programs that import
+it:
+
+	import _ "github.com/3JoB/grab/v3/pkg/grabzstd"
+*/
+package grabzstd
+
+import (
+	"io"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxWindowSize limits the memory used to decode each response, as the window
+// size is chosen by the remote server. 8MB is the limit recommended by
+// RFC 8878 for HTTP.
+const maxWindowSize = 8 << 20
+
+func init() {
+	grab.RegisterDecoder("zstd", func(r io.Reader) (io.Reader, error) {
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+}
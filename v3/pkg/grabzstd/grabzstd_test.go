@@ -0,0 +1,46 @@
+package grabzstd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3JoB/grab/v3"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecoder(t *testing.T) {
+	content := bytes.Repeat([]byte("hello, world\n"), 1024)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Accept-Encoding"); v != "zstd, gzip" {
+			t.Errorf("expected Accept-Encoding: %q, got: %q", "zstd, gzip", v)
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		zw.Write(content)
+		zw.Close()
+	}))
+	defer s.Close()
+
+	req, err := grab.NewRequest("", s.URL+"/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.NoStore = true
+	resp := grab.DefaultClient.Do(req)
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("expected %d decoded bytes, got %d", len(content), len(b))
+	}
+	if resp.ContentEncoding != "zstd" {
+		t.Errorf("expected ContentEncoding: %q, got: %q", "zstd", resp.ContentEncoding)
+	}
+}
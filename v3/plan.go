@@ -0,0 +1,310 @@
+package grab
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// planWorkers is the number of requests probed concurrently by Client.Plan if
+// Client.MaxConcurrentTransfers is not set.
+const planWorkers = 8
+
+// PlanAction describes what a transfer planned by Client.Plan would do with
+// its destination.
+type PlanAction int
+
+const (
+	// PlanDownload indicates that the remote file would be downloaded to a
+	// new destination file.
+	PlanDownload PlanAction = iota
+
+	// PlanOverwrite indicates that an existing destination file would be
+	// overwritten by downloading the whole remote file.
+	PlanOverwrite
+
+	// PlanResume indicates that an existing destination file would be
+	// resumed.
+	PlanResume
+
+	// PlanComplete indicates that an existing destination file already has the
+	// size of the remote file, so only its checksum, if any, would be
+	// validated.
+	PlanComplete
+
+	// PlanSkip indicates that the transfer would fail without transferring
+	// anything, as described by PlanEntry.Err.
+	PlanSkip
+)
+
+func (a PlanAction) String() string {
+	switch a {
+	case PlanDownload:
+		return "download"
+	case PlanOverwrite:
+		return "overwrite"
+	case PlanResume:
+		return "resume"
+	case PlanComplete:
+		return "complete"
+	case PlanSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("PlanAction(%d)", int(a))
+}
+
+// PlanEntry describes what the transfer of a Request would do, as determined by
+// Client.Plan.
+type PlanEntry struct {
+	// Request is the planned Request, exactly as it was given to Plan.
+	Request *Request
+
+	// Filename is the destination path of the transfer. It is empty if the
+	// transfer would not be stored, or if its path depends on its content, as
+	// with Request.ContentAddressed.
+	Filename string
+
+	// Action is what the transfer would do with its destination.
+	Action PlanAction
+
+	// Size is the size of the remote file, or -1 if it is unknown.
+	Size int64
+
+	// BytesToTransfer is the number of bytes that would be downloaded, or -1
+	// if it is unknown.
+	BytesToTransfer int64
+
+	// Err is the error that would fail the transfer before it starts, such as
+	// a StatusCodeError from the remote server or ErrFileExists for
+	// Request.SkipExisting. Action is PlanSkip if Err is not nil.
+	Err error
+
+	// Warnings describes conditions that would not fail the transfer but may
+	// be of interest, such as a destination shared with another entry.
+	Warnings []Warning
+}
+
+// BatchPlan describes what the transfers of a batch of Requests would do, as
+// returned by Client.Plan.
+type BatchPlan struct {
+	// Entries describes each Request, in the order they were given to Plan.
+	Entries []PlanEntry
+
+	// TotalBytes is the sum of the known BytesToTransfer of all entries, and
+	// UnknownSizes is the number of entries whose BytesToTransfer is
+	// unknown.
+	TotalBytes   int64
+	UnknownSizes int
+
+	// Conflicts maps each destination path that is shared by several entries
+	// to the indices of those entries.
+	Conflicts map[string][]int
+}
+
+// Requests returns the Requests of all entries that would transfer any data or
+// validate an existing file, in order, so that the plan can be executed with
+// DoBatch once it has been reviewed.
+func (p BatchPlan) Requests() []*Request {
+	reqs := make([]*Request, 0, len(p.Entries))
+	for _, e := range p.Entries {
+		if e.Action != PlanSkip {
+			reqs = append(reqs, e.Request)
+		}
+	}
+	return reqs
+}
+
+// Plan determines what the transfers of the given Requests would do without
+// transferring or writing anything: their destination paths, whether existing
+// files would be resumed, overwritten or are already complete, the number of
+// bytes to transfer and any destinations shared by several Requests. Only HEAD
+// requests are sent to the remote servers, with at most
+// Client.MaxConcurrentTransfers, or 8, in progress at once.
+//
+// Plan is best-effort: a remote server may respond differently to the GET
+// requests of the transfers, or remote and local files may change before they
+// run. The plan is returned even if some entries failed, in which case the
+// returned error joins the Err of every failed entry.
+func (c *Client) Plan(reqs ...*Request) (BatchPlan, error) {
+	plan := BatchPlan{Entries: make([]PlanEntry, len(reqs))}
+	workers := c.MaxConcurrentTransfers
+	if workers < 1 {
+		workers = planWorkers
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e *PlanEntry, req *Request) {
+			defer func() { <-sem; wg.Done() }()
+			c.planEntry(e, req)
+		}(&plan.Entries[i], req)
+	}
+	wg.Wait()
+
+	// find shared destinations
+	indices := make(map[string][]int)
+	for i, e := range plan.Entries {
+		if e.Filename == "" || e.Filename == "-" || e.Err != nil {
+			continue
+		}
+		key := e.Filename
+		if abs, err := filepath.Abs(key); err == nil {
+			key = abs
+		}
+		indices[key] = append(indices[key], i)
+	}
+	for key, conflicting := range indices {
+		if len(conflicting) < 2 {
+			continue
+		}
+		if plan.Conflicts == nil {
+			plan.Conflicts = make(map[string][]int)
+		}
+		plan.Conflicts[key] = conflicting
+		for _, i := range conflicting {
+			e := &plan.Entries[i]
+			e.Warnings = append(e.Warnings, Warning{
+				Code:    WarnFilenameConflict,
+				Message: fmt.Sprintf("destination %s is shared by %d requests", key, len(conflicting)),
+			})
+		}
+	}
+
+	var errs []error
+	for _, e := range plan.Entries {
+		if e.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Request.URL(), e.Err))
+			continue
+		}
+		if e.BytesToTransfer < 0 {
+			plan.UnknownSizes++
+		} else {
+			plan.TotalBytes += e.BytesToTransfer
+		}
+	}
+	return plan, errors.Join(errs...)
+}
+
+// planEntry determines what the transfer of the given Request would do.
+func (c *Client) planEntry(e *PlanEntry, req *Request) {
+	e.Request = req
+	e.Size, e.BytesToTransfer = -1, -1
+	e.Err = c.plan(e, req)
+	if e.Err != nil {
+		e.Action = PlanSkip
+		e.BytesToTransfer = 0
+	}
+}
+
+func (c *Client) plan(e *PlanEntry, req *Request) error {
+	// probe the remote file
+	resp := &Response{Request: req, req: req}
+	hreq := req.HTTPRequest.Clone(req.Context())
+	hreq.Method = "HEAD"
+	hresp, err := c.doHTTPRequest(resp, hreq)
+	if resp.dump != nil {
+		resp.dump.close()
+	}
+	if err != nil {
+		return err
+	}
+	hresp.Body.Close()
+	resp.HTTPResponse = hresp
+	// a server that does not support HEAD requests may still serve the file
+	rejected := hresp.StatusCode == http.StatusMethodNotAllowed || hresp.StatusCode == http.StatusNotImplemented
+	if hresp.StatusCode >= 400 && !rejected && !req.IgnoreBadStatusCodes {
+		return StatusCodeError(hresp.StatusCode)
+	}
+	if hresp.StatusCode == http.StatusOK && hresp.ContentLength >= 0 {
+		e.Size = hresp.ContentLength
+	}
+	if req.Size > 0 {
+		e.Size = req.Size
+	}
+	e.BytesToTransfer = e.Size
+	canResume := hresp.StatusCode == http.StatusOK && hresp.Header.Get("Accept-Ranges") == "bytes"
+
+	// determine the destination
+	switch {
+	case req.Discard || req.NoStore || req.ContentAddressed != nil:
+		return nil
+	case req.Filename == "-":
+		e.Filename = "-"
+		return nil
+	case req.FilenameFunc != nil:
+		e.Filename, err = callFilenameFunc(resp)
+	default:
+		e.Filename = req.Filename
+		if fi, serr := os.Stat(e.Filename); e.Filename == "" || (serr == nil && fi.IsDir()) {
+			e.Filename, err = resolveFilename(e.Filename, hresp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// determine what happens to an existing file
+	fi, err := os.Stat(e.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		// the path was already resolved
+		return &os.PathError{Op: "open", Path: e.Filename, Err: syscall.EISDIR}
+	}
+	if isStream(fi) {
+		return nil
+	}
+	if req.SkipExisting {
+		return ErrFileExists
+	}
+	e.Action = PlanOverwrite
+	if req.NoResume || req.SingleUse {
+		return nil
+	}
+	offset := fi.Size()
+	if req.ResumeOffsetFunc != nil {
+		if offset, err = req.ResumeOffsetFunc(e.Filename, fi); err != nil {
+			return err
+		}
+		if offset < 0 {
+			return nil
+		}
+	} else if req.ResumeFrom > 0 {
+		offset = req.ResumeFrom
+	}
+	switch {
+	case e.Size == offset:
+		e.Action, e.BytesToTransfer = PlanComplete, 0
+	case e.Size >= 0 && e.Size < offset:
+		if req.AppendGrowing {
+			e.Warnings = append(e.Warnings, Warning{
+				Code:    WarnRemoteShrank,
+				Message: fmt.Sprintf("remote file has %d bytes, fewer than the existing %d bytes", e.Size, offset),
+			})
+			return nil
+		}
+		if offset != fi.Size() {
+			return ErrBadResumeOffset
+		}
+		return ErrBadLength
+	case !canResume:
+		// only the whole file can be downloaded
+	case e.Size >= 0:
+		e.Action, e.BytesToTransfer = PlanResume, e.Size-offset
+	case req.UnknownSizeResume == UnknownSizeFail:
+		return ErrUnknownSize
+	case req.UnknownSizeResume == UnknownSizeAppend:
+		e.Action = PlanResume
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package grab
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestPlan ensures that Client.Plan reports the destination, action and bytes
+// to transfer of each request without writing any file.
+func TestPlan(t *testing.T) {
+	size := 1024
+	dir := ".testPlan"
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for name, n := range map[string]int{"partial": size / 2, "complete": size, "existing": size} {
+		if err := os.WriteFile(path(name), testContent(size)[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		grabtest.WithTestServer(t, func(missingURL string) {
+			skip := mustNewRequest(path("existing"), url)
+			skip.SkipExisting = true
+			reqs := []*Request{
+				mustNewRequest(path("new"), url),
+				mustNewRequest(path("partial"), url),
+				mustNewRequest(path("complete"), url),
+				skip,
+				mustNewRequest(dir, url+"/shared"),
+				mustNewRequest(path("shared"), url),
+				mustNewRequest(path("missing"), missingURL),
+			}
+			plan, err := DefaultClient.Plan(reqs...)
+			var serr StatusCodeError
+			if !errors.As(err, &serr) || !errors.Is(err, ErrFileExists) {
+				t.Errorf("expected errors of skipped entries, got: %v", err)
+			}
+
+			expect := []struct {
+				Filename        string
+				Action          PlanAction
+				BytesToTransfer int64
+			}{
+				{path("new"), PlanDownload, int64(size)},
+				{path("partial"), PlanResume, int64(size / 2)},
+				{path("complete"), PlanComplete, 0},
+				{path("existing"), PlanSkip, 0},
+				{path("shared"), PlanDownload, int64(size)},
+				{path("shared"), PlanDownload, int64(size)},
+				{path("missing"), PlanSkip, 0},
+			}
+			if len(plan.Entries) != len(expect) {
+				t.Fatalf("expected %d entries, got %d", len(expect), len(plan.Entries))
+			}
+			for i, e := range plan.Entries {
+				if e.Request != reqs[i] {
+					t.Errorf("%d: expected the given Request", i)
+				}
+				x := expect[i]
+				if x.Action != PlanSkip && e.Filename != x.Filename {
+					t.Errorf("%d: expected Filename: %q, got: %q", i, x.Filename, e.Filename)
+				}
+				if e.Action != x.Action || e.BytesToTransfer != x.BytesToTransfer {
+					t.Errorf("%d: expected %v of %d bytes, got %v of %d bytes (error: %v)",
+						i, x.Action, x.BytesToTransfer, e.Action, e.BytesToTransfer, e.Err)
+				}
+			}
+			if n := plan.TotalBytes; n != int64(3*size+size/2) {
+				t.Errorf("expected %d total bytes, got %d", 3*size+size/2, n)
+			}
+			for _, i := range []int{4, 5} {
+				w := plan.Entries[i].Warnings
+				if len(w) != 1 || w[0].Code != WarnFilenameConflict {
+					t.Errorf("%d: expected a %s warning, got: %v", i, WarnFilenameConflict, w)
+				}
+			}
+			if len(plan.Conflicts) != 1 {
+				t.Errorf("expected one conflict, got: %v", plan.Conflicts)
+			}
+			if n := len(plan.Requests()); n != 5 {
+				t.Errorf("expected 5 requests to execute, got %d", n)
+			}
+
+			// nothing is written
+			for _, name := range []string{"new", "shared"} {
+				if _, err := os.Stat(path(name)); !os.IsNotExist(err) {
+					t.Errorf("expected %s not to be created, got: %v", name, err)
+				}
+			}
+			if fi, err := os.Stat(path("partial")); err != nil || fi.Size() != int64(size/2) {
+				t.Errorf("expected partial file to be unchanged, got: %v", err)
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	}, grabtest.ContentLength(size))
+}
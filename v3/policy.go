@@ -0,0 +1,187 @@
+package grab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// dialSchemeKey is the Context key of the scheme of a request, for the URL
+// policy checks of policyDialer.
+type dialSchemeKey struct{}
+
+// ssrfRules are the address ranges forbidden by DefaultSSRFPolicy, named by
+// the rule that forbids them. More specific ranges come first, so that the
+// most descriptive rule is reported.
+var ssrfRules = []struct {
+	name   string
+	prefix netip.Prefix
+}{
+	{"cloud metadata", netip.MustParsePrefix("169.254.169.254/32")},
+	{"cloud metadata", netip.MustParsePrefix("100.100.100.200/32")},
+	{"cloud metadata", netip.MustParsePrefix("fd00:ec2::254/128")},
+	{"unspecified", netip.MustParsePrefix("0.0.0.0/8")},
+	{"unspecified", netip.MustParsePrefix("::/128")},
+	{"loopback", netip.MustParsePrefix("127.0.0.0/8")},
+	{"loopback", netip.MustParsePrefix("::1/128")},
+	{"link-local", netip.MustParsePrefix("169.254.0.0/16")},
+	{"link-local", netip.MustParsePrefix("fe80::/10")},
+	{"private", netip.MustParsePrefix("10.0.0.0/8")},
+	{"private", netip.MustParsePrefix("172.16.0.0/12")},
+	{"private", netip.MustParsePrefix("192.168.0.0/16")},
+	{"private", netip.MustParsePrefix("fc00::/7")},
+	{"shared address space", netip.MustParsePrefix("100.64.0.0/10")},
+	{"multicast", netip.MustParsePrefix("224.0.0.0/4")},
+	{"multicast", netip.MustParsePrefix("ff00::/8")},
+	{"broadcast", netip.MustParsePrefix("255.255.255.255/32")},
+	{"reserved", netip.MustParsePrefix("240.0.0.0/4")},
+	// IPv6 ranges that embed IPv4 addresses, which may be translated to any
+	// of the addresses above
+	{"IPv4-compatible", netip.MustParsePrefix("::/96")},
+	{"NAT64", netip.MustParsePrefix("64:ff9b::/96")},
+	{"NAT64", netip.MustParsePrefix("64:ff9b:1::/48")},
+	{"6to4", netip.MustParsePrefix("2002::/16")},
+}
+
+// ssrfHosts are host names forbidden by DefaultSSRFPolicy, which resolve to
+// forbidden addresses on some systems without DNS.
+var ssrfHosts = map[string]string{
+	"localhost":                "loopback",
+	"metadata":                 "cloud metadata",
+	"metadata.google.internal": "cloud metadata",
+}
+
+// DefaultSSRFPolicy returns a Client.URLPolicy that protects against
+// server-side request forgery: it forbids URLs whose scheme is not https, and
+// hosts or addresses that are loopback, link-local, private, shared,
+// multicast, reserved or unspecified, that serve the metadata of cloud
+// instances, or that are IPv6 addresses embedding an IPv4 address, such as
+// those of NAT64 and 6to4. The error of a forbidden URL names the rule that
+// forbids it.
+//
+// As a host name may resolve to any address, the policy relies on the checks
+// of the addresses connected to that Client.URLPolicy describes.
+func DefaultSSRFPolicy() func(u *url.URL) error {
+	return func(u *url.URL) error {
+		if !strings.EqualFold(u.Scheme, "https") {
+			return fmt.Errorf("%w: scheme %q is not https", ErrForbiddenURL, u.Scheme)
+		}
+		host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		if rule, ok := ssrfHosts[host]; ok || strings.HasSuffix(host, ".localhost") {
+			if !ok {
+				rule = "loopback"
+			}
+			return fmt.Errorf("%w: host %s is forbidden by rule %q", ErrForbiddenURL, host, rule)
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			// a host name, whose addresses are checked when dialed
+			return nil
+		}
+		addr = addr.Unmap().WithZone("")
+		for _, r := range ssrfRules {
+			if r.prefix.Contains(addr) {
+				return fmt.Errorf("%w: address %s is forbidden by rule %q", ErrForbiddenURL, addr, r.name)
+			}
+		}
+		return nil
+	}
+}
+
+// checkURL returns an error that wraps ErrForbiddenURL if u is forbidden by
+// Client.URLPolicy.
+func (c *Client) checkURL(u *url.URL) error {
+	if c.URLPolicy == nil {
+		return nil
+	}
+	err := c.URLPolicy(u)
+	if err == nil || errors.Is(err, ErrForbiddenURL) {
+		return err
+	}
+	return fmt.Errorf("%w: %s: %w", ErrForbiddenURL, u.Redacted(), err)
+}
+
+// withDialScheme returns req with the scheme of its URL in its Context, so
+// that policyDialer checks the addresses dialed for it with that scheme, if
+// Client.URLPolicy is set.
+func (c *Client) withDialScheme(req *http.Request) *http.Request {
+	if c.URLPolicy == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), dialSchemeKey{}, req.URL.Scheme))
+}
+
+// checkRedirect returns a CheckRedirect function for an http.Client that
+// checks the URL of each redirect against Client.URLPolicy, after applying the
+// given CheckRedirect function, or the default policy of http.Client if it is
+// nil.
+func (c *Client) checkRedirect(check func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if check != nil {
+			if err := check(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return c.checkURL(req.URL)
+	}
+}
+
+// policyDialer returns a DialContext function that resolves the host of each
+// address itself, with lookup, and dials, with dial, only the first resolved
+// IP address that the given URL policy allows, so that the host cannot be
+// rebound to a forbidden address after it is checked.
+func policyDialer(policy func(u *url.URL) error, lookup func(ctx context.Context, host string) ([]string, error), dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips := []string{host}
+		if net.ParseIP(host) == nil {
+			if ips, err = lookup(ctx, host); err != nil {
+				return nil, err
+			}
+		}
+		scheme, _ := ctx.Value(dialSchemeKey{}).(string)
+		for _, ip := range ips {
+			target := net.JoinHostPort(ip, port)
+			if perr := policy(&url.URL{Scheme: scheme, Host: target}); perr != nil {
+				if !errors.Is(perr, ErrForbiddenURL) {
+					perr = fmt.Errorf("%w: %s resolves to %s: %w", ErrForbiddenURL, host, ip, perr)
+				}
+				err = perr
+				continue
+			}
+			conn, derr := dial(ctx, network, target)
+			if derr == nil || ctx.Err() != nil {
+				return conn, derr
+			}
+			err = derr
+		}
+		if err == nil {
+			err = fmt.Errorf("grab: no addresses for %s", host)
+		}
+		return nil, err
+	}
+}
+
+// policyProxy returns a Proxy function for an http.Transport that fails every
+// request that proxy would send through a proxy, as policyDialer would only
+// check the address of the proxy, rather than that of the requested host.
+func policyProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil {
+			return u, err
+		}
+		return nil, fmt.Errorf("%w: %s would be requested through proxy %s, whose connections cannot be checked",
+			ErrForbiddenURL, req.URL.Redacted(), u.Redacted())
+	}
+}
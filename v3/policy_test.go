@@ -0,0 +1,178 @@
+package grab
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestDefaultSSRFPolicy ensures that DefaultSSRFPolicy forbids URLs that are
+// not HTTPS and hosts that are not publicly routable, naming the rule.
+func TestDefaultSSRFPolicy(t *testing.T) {
+	tests := []struct {
+		URL  string
+		Rule string
+	}{
+		{"https://example.com/file", ""},
+		{"https://93.184.216.34/file", ""},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/file", ""},
+		{"http://example.com/file", "scheme"},
+		{"ftp://example.com/file", "scheme"},
+		{"https://localhost/file", "loopback"},
+		{"https://app.localhost./file", "loopback"},
+		{"https://127.0.0.1:8443/file", "loopback"},
+		{"https://[::1]/file", "loopback"},
+		{"https://[::ffff:127.0.0.1]/file", "loopback"},
+		{"https://169.254.169.254/latest/meta-data/", "cloud metadata"},
+		{"https://metadata.google.internal/", "cloud metadata"},
+		{"https://169.254.1.1/file", "link-local"},
+		{"https://[fe80::1%25eth0]/file", "link-local"},
+		{"https://10.1.2.3/file", "private"},
+		{"https://172.20.0.1/file", "private"},
+		{"https://192.168.1.1/file", "private"},
+		{"https://[fd12::1]/file", "private"},
+		{"https://0.0.0.0/file", "unspecified"},
+		{"https://240.0.0.1/file", "reserved"},
+		{"https://255.255.255.254/file", "reserved"},
+		{"https://[::127.0.0.1]/file", "IPv4-compatible"},
+		{"https://[::a00:1]/file", "IPv4-compatible"},
+		{"https://[64:ff9b::127.0.0.1]/file", "NAT64"},
+		{"https://[64:ff9b::a00:1]/file", "NAT64"},
+		{"https://[64:ff9b:1::a00:1]/file", "NAT64"},
+		{"https://[2002:7f00:1::1]/file", "6to4"},
+		{"https://[2002:a00:1::1]/file", "6to4"},
+		{"https://[::]/file", "unspecified"},
+	}
+	policy := DefaultSSRFPolicy()
+	for _, test := range tests {
+		u, err := url.Parse(test.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = policy(u)
+		if test.Rule == "" {
+			if err != nil {
+				t.Errorf("%s: expected URL to be allowed, got: %v", test.URL, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrForbiddenURL) || !strings.Contains(err.Error(), test.Rule) {
+			t.Errorf("%s: expected ErrForbiddenURL by rule %q, got: %v", test.URL, test.Rule, err)
+		}
+	}
+}
+
+// TestURLPolicy ensures that Client.URLPolicy is applied to the request URL,
+// to each redirect and to the addresses dialed, before any connection is
+// made.
+func TestURLPolicy(t *testing.T) {
+	var lookups int32
+	defer func(f func(ctx context.Context, host string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		if strings.HasSuffix(host, ".grab.test") {
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	// forbids the host forbidden.grab.test and, with loopback set, the
+	// loopback address
+	newClient := func(loopback bool) *Client {
+		client := NewClient()
+		client.URLPolicy = func(u *url.URL) error {
+			if u.Hostname() == "forbidden.grab.test" {
+				return errors.New("forbidden host")
+			}
+			if loopback && u.Hostname() == "127.0.0.1" {
+				return errors.New("loopback address")
+			}
+			return nil
+		}
+		return client
+	}
+
+	grabtest.WithTestServer(t, func(rawURL string) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(u.Host)
+
+		t.Run("Default", func(t *testing.T) {
+			atomic.StoreInt32(&lookups, 0)
+			req := mustNewRequest("", "http://forbidden.grab.test:"+port+"/file")
+			req.NoStore = true
+			if err := newClient(false).Do(req).Err(); !errors.Is(err, ErrForbiddenURL) {
+				t.Errorf("expected ErrForbiddenURL, got: %v", err)
+			}
+			if n := atomic.LoadInt32(&lookups); n != 0 {
+				t.Errorf("expected no lookups, got %d", n)
+			}
+		})
+
+		t.Run("WithRedirect", func(t *testing.T) {
+			atomic.StoreInt32(&lookups, 0)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://forbidden.grab.test:"+port+"/file", http.StatusFound)
+			}))
+			defer ts.Close()
+			req := mustNewRequest("", ts.URL)
+			req.NoStore = true
+			if err := newClient(false).Do(req).Err(); !errors.Is(err, ErrForbiddenURL) {
+				t.Errorf("expected ErrForbiddenURL, got: %v", err)
+			}
+			if n := atomic.LoadInt32(&lookups); n != 0 {
+				t.Errorf("expected no lookups, got %d", n)
+			}
+		})
+
+		t.Run("WithResolvedAddress", func(t *testing.T) {
+			// the host is allowed, but resolves to a forbidden address
+			req := mustNewRequest("", "http://rebind.grab.test:"+port+"/file")
+			req.NoStore = true
+			err := newClient(true).Do(req).Err()
+			if !errors.Is(err, ErrForbiddenURL) || !strings.Contains(err.Error(), "127.0.0.1") {
+				t.Errorf("expected ErrForbiddenURL for resolved address, got: %v", err)
+			}
+
+			req = mustNewRequest("", "http://rebind.grab.test:"+port+"/file")
+			req.NoStore = true
+			if err := newClient(false).Do(req).Err(); err != nil {
+				t.Errorf("expected allowed address to be dialed, got: %v", err)
+			}
+		})
+
+		t.Run("WithProxy", func(t *testing.T) {
+			// the proxy would be dialed instead of the requested host
+			var proxied int32
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&proxied, 1)
+			}))
+			defer proxy.Close()
+			proxyURL, err := url.Parse(proxy.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := newClient(false)
+			client.HTTPClient.(*http.Client).Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+			req := mustNewRequest("", "http://allowed.grab.test:"+port+"/file")
+			req.NoStore = true
+			err = client.Do(req).Err()
+			if !errors.Is(err, ErrForbiddenURL) || !strings.Contains(err.Error(), "proxy") {
+				t.Errorf("expected ErrForbiddenURL for proxied request, got: %v", err)
+			}
+			if n := atomic.LoadInt32(&proxied); n != 0 {
+				t.Errorf("expected no proxied requests, got %d", n)
+			}
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package grab
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// probeCache caches the responses to HEAD requests, keyed by URL, so that
+// repeated transfers of the same URL need not probe the remote server again.
+// The zero value is ready to use.
+type probeCache struct {
+	mu sync.Mutex
+	m  map[string]*probeEntry
+}
+
+type probeEntry struct {
+	// resp is the response to the HEAD request, without a body.
+	resp    *http.Response
+	expires time.Time
+}
+
+// probeKey returns the key of the given request URL in a probeCache.
+func probeKey(u *url.URL) string {
+	k := *u
+	k.Fragment = ""
+	k.RawFragment = ""
+	return k.String()
+}
+
+// get returns a copy of the cached response for the given key, or nil if there
+// is none or it expired.
+func (c *probeCache) get(key string) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.m, key)
+		return nil
+	}
+	resp := *e.resp
+	resp.Header = e.resp.Header.Clone()
+	resp.Body = http.NoBody
+	req := *e.resp.Request
+	u := *req.URL
+	req.URL = &u
+	resp.Request = &req
+	return &resp
+}
+
+// put caches the response to a HEAD request for the given duration.
+func (c *probeCache) put(key string, resp *http.Response, ttl time.Duration) {
+	u := *resp.Request.URL
+	e := &probeEntry{
+		resp: &http.Response{
+			Status:        resp.Status,
+			StatusCode:    resp.StatusCode,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        resp.Header.Clone(),
+			ContentLength: resp.ContentLength,
+			Request:       &http.Request{Method: "HEAD", URL: &u, Host: resp.Request.Host},
+		},
+		expires: time.Now().Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]*probeEntry)
+	}
+	if len(c.m) >= 1024 {
+		// drop expired entries rather than growing without bound
+		now := time.Now()
+		for k, v := range c.m {
+			if now.After(v.expires) {
+				delete(c.m, k)
+			}
+		}
+	}
+	c.m[key] = e
+}
+
+// invalidate removes the cached response for the given key.
+func (c *probeCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, key)
+}
+
+// validate removes the cached response for the given key if its validators
+// disagree with those of a subsequent response for the same URL, as the remote
+// file changed.
+func (c *probeCache) validate(key string, resp *http.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return
+	}
+	etag, cachedETag := resp.Header.Get("ETag"), e.resp.Header.Get("ETag")
+	lastmod, cachedLastmod := lastModified(resp), lastModified(e.resp)
+	if (etag != "" && cachedETag != "" && etag != cachedETag) ||
+		(!lastmod.IsZero() && !cachedLastmod.IsZero() && !lastmod.Equal(cachedLastmod)) {
+		delete(c.m, key)
+	}
+}
@@ -0,0 +1,197 @@
+package grab
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// requestQueues holds the requestQueue of each Request channel consumed by
+// DoChannel, so that every worker reading from the same channel shares one
+// queue. The zero value is ready to use.
+type requestQueues struct {
+	mu sync.Mutex
+	m  map[<-chan *Request]*requestQueue
+}
+
+// acquire returns the queue of reqch for a new worker, creating it and starting
+// to receive requests from reqch if necessary.
+func (c *requestQueues) acquire(reqch <-chan *Request) *requestQueue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, ok := c.m[reqch]
+	if !ok {
+		q = newRequestQueue()
+		go q.receive(reqch)
+		if c.m == nil {
+			c.m = make(map[<-chan *Request]*requestQueue)
+		}
+		c.m[reqch] = q
+	}
+	q.mu.Lock()
+	q.workers++
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	return q
+}
+
+// release removes a worker from the queue of reqch, and removes the queue once
+// it has no workers.
+func (c *requestQueues) release(reqch <-chan *Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q := c.m[reqch]
+	q.mu.Lock()
+	q.workers--
+	q.mu.Unlock()
+	if q.workers == 0 {
+		delete(c.m, reqch)
+	}
+}
+
+// requestQueue orders the requests received from a channel by
+// Request.Priority, highest first, and then by the order in which they were
+// received. It holds at most one request per worker, so that senders are
+// still blocked while every worker is busy.
+type requestQueue struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	items   queueItems
+	seq     int64
+	closed  bool
+	workers int // guarded by requestQueues.mu and mu
+}
+
+type queueItem struct {
+	req *Request
+	seq int64
+}
+
+func newRequestQueue() *requestQueue {
+	q := &requestQueue{}
+	q.cond.L = &q.mu
+	return q
+}
+
+// receive queues the requests received from reqch until it is closed, waiting
+// to receive each until the queue has room for it.
+func (q *requestQueue) receive(reqch <-chan *Request) {
+	for {
+		q.mu.Lock()
+		for len(q.items) >= q.workers {
+			q.cond.Wait()
+		}
+		q.mu.Unlock()
+		req, ok := <-reqch
+		if !ok {
+			break
+		}
+		q.mu.Lock()
+		heap.Push(&q.items, queueItem{req: req, seq: q.seq})
+		q.seq++
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop blocks until a request is queued and returns the request with the
+// highest priority. It returns false once the channel is closed and all of its
+// requests have been returned.
+func (q *requestQueue) pop() (*Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	req := heap.Pop(&q.items).(queueItem).req
+	q.cond.Broadcast()
+	return req, true
+}
+
+// queueItems implements heap.Interface.
+type queueItems []queueItem
+
+func (c queueItems) Len() int { return len(c) }
+
+func (c queueItems) Less(i, j int) bool {
+	if c[i].req.Priority != c[j].req.Priority {
+		return c[i].req.Priority > c[j].req.Priority
+	}
+	return c[i].seq < c[j].seq
+}
+
+func (c queueItems) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c *queueItems) Push(x any) { *c = append(*c, x.(queueItem)) }
+
+func (c *queueItems) Pop() any {
+	old := *c
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = queueItem{}
+	*c = old[:n-1]
+	return item
+}
+
+// hostQueue distributes the requests of a batch with
+// BatchOptions.SmallFileOptimization to its workers by host, so that each
+// worker keeps transferring from the same host while it has requests left.
+type hostQueue struct {
+	mu      sync.Mutex
+	hosts   []string // in the order of their first request
+	reqs    map[string][]*Request
+	workers map[string]int
+}
+
+// newHostQueue returns a hostQueue of the given requests, which are returned
+// in the given order for each host.
+func newHostQueue(reqs []*Request) *hostQueue {
+	q := &hostQueue{
+		reqs:    make(map[string][]*Request),
+		workers: make(map[string]int),
+	}
+	for _, req := range reqs {
+		host := req.URL().Host
+		if _, ok := q.reqs[host]; !ok {
+			q.hosts = append(q.hosts, host)
+		}
+		q.reqs[host] = append(q.reqs[host], req)
+	}
+	return q
+}
+
+// next returns the next request for a worker whose last request was for the
+// given host, or which has not had any if host is empty, and the host of the
+// returned request. Once no requests are left for its host, the worker moves
+// to the host with the fewest workers of those with requests left. It returns
+// false once all requests have been returned.
+func (q *hostQueue) next(host string) (*Request, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.reqs[host]) == 0 {
+		if host != "" {
+			q.workers[host]--
+		}
+		host = ""
+		for _, h := range q.hosts {
+			if len(q.reqs[h]) > 0 && (host == "" || q.workers[h] < q.workers[host]) {
+				host = h
+			}
+		}
+		if host == "" {
+			return nil, "", false
+		}
+		q.workers[host]++
+	}
+	reqs := q.reqs[host]
+	req := reqs[0]
+	reqs[0] = nil
+	q.reqs[host] = reqs[1:]
+	return req, host, true
+}
@@ -0,0 +1,142 @@
+package grab
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// ByteRange is an inclusive range of byte offsets in a remote file, as in an
+// HTTP Range header.
+type ByteRange struct {
+	// Start is the offset of the first byte of the range.
+	Start int64
+
+	// End is the offset of the last byte of the range.
+	End int64
+}
+
+// Len returns the number of bytes in the range.
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// NewRangeRequest returns a new file transfer Request that downloads only the
+// bytes from start to end, inclusive, of the remote file to dst, as with
+// Request.Range, for example to extract a member of a large remote archive.
+// The destination is named from dst as with NewRequest.
+func NewRangeRequest(dst, urlStr string, start, end int64) (*Request, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("grab: invalid byte range %d-%d", start, end)
+	}
+	req, err := NewRequest(dst, urlStr)
+	if err != nil {
+		return nil, err
+	}
+	req.Range = &ByteRange{Start: start, End: end}
+	return req, nil
+}
+
+// byteRange returns the range of the remote file to be stored as its own file,
+// if any.
+func (r *Request) byteRange() *ByteRange {
+	if r.WriteOffset > 0 {
+		return nil
+	}
+	return r.Range
+}
+
+// rangeRequest prepares to download Request.Range, resuming an existing file
+// from its end unless Request.NoResume is set, and requesting only the bytes
+// of the range that are missing.
+//
+// If the existing file already has the length of the range, the next stateFunc
+// is checksumFile. Otherwise, it is getRequest.
+func (c *Client) rangeRequest(resp *Response) stateFunc {
+	req := resp.req
+	r := req.Range
+	if resp.fi != nil && req.SkipExisting {
+		resp.skip(SkipFileExists)
+		resp.err = ErrFileExists
+		return c.closeResponse
+	}
+	var offset int64
+	if resp.fi != nil && !req.NoResume && !req.SingleUse {
+		offset = resp.fi.Size()
+	}
+	if offset > r.Len() {
+		resp.err = ErrBadLength
+		return c.closeResponse
+	}
+	if offset > 0 {
+		resp.DidResume = true
+		resp.bytesResumed.Store(offset)
+	}
+	if offset == r.Len() {
+		// the range is already complete
+		resp.skip(SkipComplete)
+		atomic.StoreInt64(&resp.sizeUnsafe, offset)
+		resp.sizeKnown.Store(true)
+		return c.checksumFile
+	}
+	req.HTTPRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Start+offset, r.End))
+	return c.getRequest
+}
+
+// readRange checks that the response to the request of rangeRequest is the
+// requested part of the range or, if the remote server responded with the
+// whole file as permitted by Request.RangeFallback, replaces its body with
+// the range.
+func readRange(resp *Response) error {
+	r := resp.req.Range
+	hresp := resp.HTTPResponse
+	if hresp.StatusCode != http.StatusPartialContent {
+		hresp.Body = &rangeBody{ReadCloser: hresp.Body, skip: r.Start, n: r.Len()}
+		resp.rangeSliced = true
+		return nil
+	}
+	start := r.Start + resp.bytesResumed.Load()
+	if contentRangeStart(hresp) != start || contentRangeEnd(hresp) != r.End {
+		return fmt.Errorf("%w: requested bytes %d-%d, got %q",
+			ErrBadContentRange, start, r.End, hresp.Header.Get("Content-Range"))
+	}
+	resp.CanResume = true
+	return nil
+}
+
+// rangeBody is the body of a response with the whole remote file, from which
+// only the n bytes after skip are read.
+type rangeBody struct {
+	io.ReadCloser
+	skip int64
+	n    int64 // bytes remaining
+}
+
+func (c *rangeBody) Read(p []byte) (int, error) {
+	if c.skip > 0 {
+		n, err := io.CopyN(io.Discard, c.ReadCloser, c.skip)
+		c.skip -= n
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if c.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.n -= int64(n)
+	if err == io.EOF && c.n > 0 {
+		// the remote file ends before the range
+		err = io.ErrUnexpectedEOF
+	} else if err == nil && c.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRangeRequest ensures that only the requested range of a remote file is
+// downloaded, resumed and verified, and that servers that ignore ranges are
+// refused unless Request.RangeFallback is set.
+func TestRangeRequest(t *testing.T) {
+	filename := ".testRangeRequest"
+	defer os.Remove(filename)
+	content := testContent(1 << 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	}))
+	defer noRanges.Close()
+
+	start, end := int64(1000), int64(4999)
+	want := content[start : end+1]
+	sum := sha256.Sum256(want)
+	newRequest := func(t *testing.T, url string) *Request {
+		t.Helper()
+		req, err := NewRangeRequest(filename, url, start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetChecksum(sha256.New(), sum[:], false)
+		return req
+	}
+	check := func(t *testing.T, resp *Response) {
+		t.Helper()
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if size := resp.Size(); size != int64(len(want)) {
+			t.Errorf("expected size: %d, got: %d", len(want), size)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("expected file content to match range, got %d bytes", len(b))
+		}
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		os.Remove(filename)
+		check(t, DefaultClient.Do(newRequest(t, ts.URL)))
+	})
+
+	t.Run("WithResume", func(t *testing.T) {
+		if err := os.Truncate(filename, 300); err != nil {
+			t.Fatal(err)
+		}
+		resp := DefaultClient.Do(newRequest(t, ts.URL))
+		check(t, resp)
+		if !resp.DidResume || resp.BytesResumed() != 300 {
+			t.Errorf("expected 300 bytes resumed, got: %d", resp.BytesResumed())
+		}
+	})
+
+	t.Run("WithReconnect", func(t *testing.T) {
+		os.Remove(filename)
+		s, requests := newDroppingServer(content, 500, 1)
+		defer s.Close()
+		req := newRequest(t, s.URL)
+		req.MaxReconnects = 1
+		resp := DefaultClient.Do(req)
+		check(t, resp)
+		if resp.Reconnects() != 1 || atomic.LoadInt32(requests) != 2 {
+			t.Errorf("expected 1 reconnect, got %d in %d requests", resp.Reconnects(), atomic.LoadInt32(requests))
+		}
+	})
+
+	t.Run("WithRangeIgnored", func(t *testing.T) {
+		os.Remove(filename)
+		if err := DefaultClient.Do(newRequest(t, noRanges.URL)).Err(); err != ErrRangeIgnored {
+			t.Errorf("expected %v, got: %v", ErrRangeIgnored, err)
+		}
+	})
+
+	t.Run("WithRangeFallback", func(t *testing.T) {
+		os.Remove(filename)
+		req := newRequest(t, noRanges.URL)
+		req.RangeFallback = true
+		check(t, DefaultClient.Do(req))
+	})
+
+	t.Run("WithRangeBeyondEnd", func(t *testing.T) {
+		os.Remove(filename)
+		req, err := NewRangeRequest(filename, ts.URL, start, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := DefaultClient.Do(req).Err(); !errors.Is(err, ErrBadContentRange) {
+			t.Errorf("expected %v, got: %v", ErrBadContentRange, err)
+		}
+	})
+
+	t.Run("WithInvalidRange", func(t *testing.T) {
+		if _, err := NewRangeRequest(filename, ts.URL, 10, 9); err == nil {
+			t.Errorf("expected error for invalid range")
+		}
+	})
+}
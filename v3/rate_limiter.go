@@ -1,12 +1,76 @@
 package grab
 
-import "context"
+import (
+	"context"
+	"math"
+	"reflect"
+)
 
 // RateLimiter is an interface that must be satisfied by any third-party rate
 // limiters that may be used to limit download transfer speeds.
 //
 // A recommended token bucket implementation can be found at
 // https://godoc.org/golang.org/x/time/rate#Limiter.
+//
+// If the rate limiter also has a Limit method that returns its limit in bytes
+// per second as a floating-point number, as rate.Limiter does, the limit caps
+// the transfer rate assumed by Response.ETA.
 type RateLimiter interface {
 	WaitN(ctx context.Context, n int) (err error)
 }
+
+// burster is implemented by rate limiters that report the maximum number of
+// tokens that may be consumed by a single call to WaitN, such as
+// golang.org/x/time/rate.Limiter.
+type burster interface {
+	Burst() int
+}
+
+// rateLimit returns the limit in bytes per second of the given RateLimiter, if
+// it reports one with a Limit method that returns a floating-point number, such
+// as golang.org/x/time/rate.Limiter. Zero is returned otherwise, or if there
+// is no limit.
+func rateLimit(lim RateLimiter) float64 {
+	if lim == nil {
+		return 0
+	}
+	m := reflect.ValueOf(lim).MethodByName("Limit")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return 0
+	}
+	if k := m.Type().Out(0).Kind(); k != reflect.Float64 && k != reflect.Float32 {
+		return 0
+	}
+	limit := m.Call(nil)[0].Float()
+	if math.IsInf(limit, 0) || math.IsNaN(limit) || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// rateLimitQuantum returns the maximum number of bytes that should be read and
+// passed to the given RateLimiter in each iteration of the copy loop. The
+// result is never larger than the given buffer size.
+//
+// If quantum is not positive, it is a tenth of the limit of the limiter, if it
+// reports one, so that it is polled about ten times per second, and otherwise
+// the full buffer. In either case it is capped to the burst size of the
+// limiter, if available, which must not be exceeded by a single call to WaitN.
+func rateLimitQuantum(lim RateLimiter, quantum, bufferSize int) int {
+	if lim == nil {
+		return bufferSize
+	}
+	if quantum < 1 {
+		quantum = bufferSize
+		if limit := rateLimit(lim); limit > 0 {
+			quantum = int(math.Max(1, math.Min(limit/10, float64(bufferSize))))
+		}
+		if b, ok := lim.(burster); ok && b.Burst() > 0 && b.Burst() < quantum {
+			quantum = b.Burst()
+		}
+	}
+	if quantum > bufferSize {
+		return bufferSize
+	}
+	return quantum
+}
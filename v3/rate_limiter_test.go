@@ -3,6 +3,7 @@ package grab
 import (
 	"context"
 	"log"
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -52,6 +53,170 @@ func TestRateLimiter(t *testing.T) {
 			// BUG: this test can pass if the transfer was slow for unrelated reasons
 			t.Errorf("expected transfer to take >250ms, took %v", resp.Duration())
 		}
+		if wait := resp.RateLimitWait(); wait < 250*time.Millisecond || wait > resp.Duration() {
+			t.Errorf("expected rate limit wait between 250ms and %v, got %v", resp.Duration(), wait)
+		}
+		if wait := resp.Stats().RateLimitWait; wait != resp.RateLimitWait() {
+			t.Errorf("expected stats rate limit wait: %v, got: %v", resp.RateLimitWait(), wait)
+		}
+	}, grabtest.ContentLength(filesize))
+}
+
+// recordingRateLimiter records the largest number of tokens requested in a
+// single call to WaitN, and optionally reports a burst size.
+type recordingRateLimiter struct {
+	testRateLimiter
+	burst, max int
+}
+
+func (c *recordingRateLimiter) WaitN(ctx context.Context, n int) (err error) {
+	if n > c.max {
+		c.max = n
+	}
+	return c.testRateLimiter.WaitN(ctx, n)
+}
+
+type burstRateLimiter struct {
+	recordingRateLimiter
+}
+
+func (c *burstRateLimiter) Burst() int { return c.burst }
+
+// limitBurstRateLimiter reports a limit, and a burst size unless it is zero.
+type limitBurstRateLimiter struct {
+	burstRateLimiter
+	limit testLimit
+}
+
+func (c *limitBurstRateLimiter) Limit() testLimit { return c.limit }
+
+// TestRateLimitQuantum ensures that reads are capped to the rate limit quantum
+// so traffic is not sent in bursts the size of the transfer buffer.
+func TestRateLimitQuantum(t *testing.T) {
+	filesize := 4096
+	filename := ".testRateLimitQuantum"
+	defer os.Remove(filename)
+
+	tests := []struct {
+		Name    string
+		Limiter RateLimiter
+		Quantum int
+		Expect  int
+	}{
+		{
+			Name:    "WithQuantum",
+			Limiter: &recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}},
+			Quantum: 64,
+			Expect:  64,
+		},
+		{
+			Name:    "WithBurst",
+			Limiter: &burstRateLimiter{recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}, burst: 128}},
+			Expect:  128,
+		},
+		{
+			Name:    "WithQuantumAndBurst",
+			Limiter: &burstRateLimiter{recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}, burst: 128}},
+			Quantum: 32,
+			Expect:  32,
+		},
+		{
+			Name:    "WithLimit",
+			Limiter: &limitBurstRateLimiter{burstRateLimiter{recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}}}, 2560},
+			Expect:  256,
+		},
+		{
+			Name:    "WithLimitAndBurst",
+			Limiter: &limitBurstRateLimiter{burstRateLimiter{recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}, burst: 128}}, 2560},
+			Expect:  128,
+		},
+		{
+			Name:    "WithLimitLargerThanBuffer",
+			Limiter: &limitBurstRateLimiter{burstRateLimiter{recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}}}, 1 << 20},
+			Expect:  1024,
+		},
+		{
+			Name:    "WithQuantumLargerThanBuffer",
+			Limiter: &recordingRateLimiter{testRateLimiter: testRateLimiter{r: 1 << 20}},
+			Quantum: 1 << 20,
+			Expect:  1024,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.NoResume = true
+				req.BufferSize = 1024
+				req.RateLimiter = test.Limiter
+				req.RateLimitQuantum = test.Quantum
+				resp := mustDo(req)
+				testComplete(t, resp)
+
+				var lim *recordingRateLimiter
+				switch v := test.Limiter.(type) {
+				case *recordingRateLimiter:
+					lim = v
+				case *burstRateLimiter:
+					lim = &v.recordingRateLimiter
+				case *limitBurstRateLimiter:
+					lim = &v.recordingRateLimiter
+				}
+				if lim.n != filesize {
+					t.Errorf("expected %d bytes to pass through limiter, got %d", filesize, lim.n)
+				}
+				if lim.max > test.Expect {
+					t.Errorf("expected bursts of at most %d bytes, got %d", test.Expect, lim.max)
+				}
+				if v := resp.Stats().MaxRead; v > int64(test.Expect) {
+					t.Errorf("expected reads of at most %d bytes, got %d", test.Expect, v)
+				}
+			}, grabtest.ContentLength(filesize))
+		})
+	}
+}
+
+// timingRateLimiter is a limiter with a limit that records the time of each
+// call to WaitN, after which the chunk that was read is written.
+type timingRateLimiter struct {
+	limitRateLimiter
+	times []time.Time
+}
+
+func (c *timingRateLimiter) WaitN(ctx context.Context, n int) (err error) {
+	c.times = append(c.times, time.Now())
+	return c.limitRateLimiter.WaitN(ctx, n)
+}
+
+// TestRateLimitQuantumTiming ensures that the default quantum of a limiter
+// with a limit spreads the chunks of a transfer evenly over time, rather than
+// reading a full buffer at once and then waiting for all of it.
+func TestRateLimitQuantumTiming(t *testing.T) {
+	filesize := 4096
+	limit := 10240
+
+	grabtest.WithTestServer(t, func(url string) {
+		lim := &timingRateLimiter{
+			limitRateLimiter: limitRateLimiter{
+				testRateLimiter: testRateLimiter{r: limit},
+				limit:           testLimit(limit),
+			},
+		}
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		req.RateLimiter = lim
+		resp := mustDo(req)
+		testComplete(t, resp)
+
+		// a chunk of a tenth of the limit is expected every 100ms
+		if n := len(lim.times); n < filesize/(limit/10) {
+			t.Fatalf("expected at least %d chunks, got %d", filesize/(limit/10), n)
+		}
+		for i := 1; i < len(lim.times); i++ {
+			if gap := lim.times[i].Sub(lim.times[i-1]); gap > 250*time.Millisecond {
+				t.Errorf("expected chunks at most 250ms apart, got %v between chunks %d and %d", gap, i-1, i)
+			}
+		}
 	}, grabtest.ContentLength(filesize))
 }
 
@@ -67,3 +232,35 @@ func ExampleRateLimiter() {
 		log.Fatal(err)
 	}
 }
+
+// testLimit is a named floating-point type, as golang.org/x/time/rate.Limit.
+type testLimit float64
+
+type limitRateLimiter struct {
+	testRateLimiter
+	limit testLimit
+}
+
+func (c *limitRateLimiter) Limit() testLimit { return c.limit }
+
+// TestRateLimitReported ensures that the limit of rate limiters with a Limit
+// method is detected.
+func TestRateLimitReported(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Limiter RateLimiter
+		Expect  float64
+	}{
+		{"Nil", nil, 0},
+		{"WithoutLimit", &testRateLimiter{r: 512}, 0},
+		{"WithLimit", &limitRateLimiter{limit: 512}, 512},
+		{"WithInfiniteLimit", &limitRateLimiter{limit: testLimit(math.Inf(1))}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if limit := rateLimit(test.Limiter); limit != test.Expect {
+				t.Errorf("expected limit: %v, got: %v", test.Expect, limit)
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package grab
 
 import (
 	"context"
+	"fmt"
 	"hash"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"time"
 )
 
 // A Hook is a user provided callback function that can be called by grab at
@@ -18,7 +22,61 @@ import (
 // download from a callback, simply return a non-nil error.
 type Hook func(*Response) error
 
+// UnknownSizePolicy determines how an existing file is resumed when the remote
+// server does not report the size of the remote file, so that it cannot be
+// known whether the existing file is complete. See Request.UnknownSizeResume.
+type UnknownSizePolicy int
+
+const (
+	// UnknownSizeRestart restarts the transfer, overwriting the existing file.
+	UnknownSizeRestart UnknownSizePolicy = iota
+
+	// UnknownSizeAppend sends a ranged request from the size of the existing
+	// file and appends the response, trusting the remote server to honor the
+	// range. The transfer is restarted if the remote server ignores the range
+	// or advertises 'Accept-Ranges: none'.
+	UnknownSizeAppend
+
+	// UnknownSizeFail fails the transfer with ErrUnknownSize.
+	UnknownSizeFail
+)
+
+func (p UnknownSizePolicy) String() string {
+	switch p {
+	case UnknownSizeRestart:
+		return "restart"
+	case UnknownSizeAppend:
+		return "append"
+	case UnknownSizeFail:
+		return "fail"
+	}
+	return fmt.Sprintf("UnknownSizePolicy(%d)", int(p))
+}
+
+// ContentAddress describes where a file transfer is stored in a
+// content-addressed store, such as a build cache, where the path of each file
+// is derived from its checksum. See Request.ContentAddressed.
+type ContentAddress struct {
+	// Dir is the root directory of the store. An empty string means the
+	// current working directory.
+	Dir string
+
+	// Hash returns the hash used to compute the checksum of the file.
+	// Default: sha256.New.
+	Hash func() hash.Hash
+
+	// Layout returns the path of a file with the given checksum, relative to
+	// Dir. Default: the hex encoded checksum, with the first two characters
+	// as a subdirectory, as in "ab/cdef...".
+	Layout func(sum []byte) string
+}
+
 // A Request represents an HTTP file transfer request to be sent by a Client.
+//
+// A Request must not be modified once it is passed to Client.Do, as the
+// transfer may be reading it from another goroutine. Setters such as
+// SetChecksum panic if called on a submitted Request. Use Clone to derive a
+// modified Request instead.
 type Request struct {
 	// Label is an arbitrary string which may used to label a Request with a
 	// user friendly name.
@@ -28,19 +86,84 @@ type Request struct {
 	// other data.
 	Tag any
 
+	// Tags are arbitrary strings which relate a Request to logical groups of
+	// transfers, such as the job that requested them, so that every transfer
+	// in progress of a group can be canceled with Client.CancelByTag.
+	Tags []string
+
+	// Priority orders the Requests queued by DoBatch and DoChannel, which
+	// start queued Requests with a higher Priority first. Requests of equal
+	// Priority start in the order they were queued. Priority only affects the
+	// order in which transfers start and never preempts a transfer in
+	// progress. DoChannel only orders the Requests it has received while its
+	// workers are busy, of which it holds one per worker. Default: 0.
+	Priority int
+
 	// HTTPRequest specifies the http.Request to be sent to the remote server to
 	// initiate a file transfer. It includes request configuration such as URL,
 	// protocol version, HTTP method, request headers and authentication.
 	HTTPRequest *http.Request
 
+	// Transport specifies the http.RoundTripper used for every request sent
+	// for this transfer, including any HEAD request used to probe the remote
+	// server, instead of the transport of Client.HTTPClient. Connection pooling
+	// is left to the given transport.
+	//
+	// If Client.HTTPClient is a *http.Client, its redirect policy, cookie jar
+	// and timeout still apply, as they are implemented above the transport.
+	// Otherwise, a http.Client with the default configuration is used.
+	//
+	// Nil means the transport of Client.HTTPClient is used.
+	Transport http.RoundTripper
+
 	// Filename specifies the path where the file transfer will be stored in
 	// local storage. If Filename is empty or a directory, the true Filename will
 	// be resolved using Content-Disposition headers or the request URL.
 	//
 	// An empty string means the transfer will be stored in the current working
 	// directory.
+	//
+	// A Filename of "-" means the transfer will be written to standard output.
+	// Standard output and existing named pipes or devices are written
+	// sequentially: they are never resumed, truncated or removed, and
+	// FilenameFunc is not called for standard output.
 	Filename string
 
+	// FilenameFunc is an optional callback that replaces the default
+	// resolution of the path where the file transfer will be stored. It is
+	// called once the response headers from the remote server are available,
+	// with the path that grab would otherwise have used as suggested. The
+	// suggestion is empty if no reasonable filename could be determined.
+	//
+	// The returned path is used instead of the suggested path and is subject to
+	// the same sanitization as filenames found in response headers, unless
+	// NoSanitizeFilename is set. If an error is returned, the transfer fails
+	// with the same error before any file is created.
+	//
+	// FilenameFunc is called only once per transfer but, as the returned path
+	// determines whether an existing file can be resumed, it may be called with
+	// the response to the HEAD request used to probe the remote server rather
+	// than the response that carries the file content.
+	FilenameFunc func(resp *http.Response, suggested string) (string, error)
+
+	// ContentAddressed specifies that the file transfer should be stored in a
+	// content-addressed store rather than at Filename. The file is downloaded
+	// to a temporary file in ContentAddressed.Dir and hashed as it is
+	// transferred. Once the transfer has been verified, the temporary file is
+	// renamed to the path derived from its checksum and Response.Filename is
+	// updated. If that path already exists, it is assumed to have the same
+	// content and the temporary file is removed instead.
+	//
+	// Filename, FilenameFunc, SkipExisting and the resume options are ignored
+	// and the temporary file is always removed if the transfer fails. Hooks
+	// and Validate are called with the temporary file. ContentAddressed is
+	// ignored if NoStore is set.
+	ContentAddressed *ContentAddress
+
+	// NoSanitizeFilename specifies that the path returned by FilenameFunc
+	// should be used as-is, without sanitization.
+	NoSanitizeFilename bool
+
 	// SkipExisting specifies that ErrFileExists should be returned if the
 	// destination path already exists. The existing file will not be checked for
 	// completeness.
@@ -51,45 +174,377 @@ type Request struct {
 	// completed in full, it will not be restarted.
 	NoResume bool
 
+	// ResumeFrom specifies the byte offset from which an existing destination
+	// file should be resumed, overriding the size of the local file. Any local
+	// content beyond the offset is discarded. The offset is trusted as-is; it
+	// is only validated against the size of the remote file.
+	//
+	// ResumeFrom is ignored if the destination file does not exist or if
+	// NoResume is true.
+	ResumeFrom int64
+
+	// ResumeOffsetFunc, if not nil, is called with the path and FileInfo of an
+	// existing destination file to compute the offset in the remote file from
+	// which the transfer should resume, for partial files that are not a
+	// plain prefix of the remote file, such as files with a header written by
+	// another tool. The transfer continues writing at the end of the existing
+	// file, which is never truncated, and any checksum set with SetChecksum is
+	// computed over the whole local file.
+	//
+	// A negative offset restarts the transfer, overwriting the existing file.
+	// If ResumeOffsetFunc returns an error, the transfer fails with the same
+	// error. If nil, the size of the existing file is used. ResumeFrom is
+	// ignored if ResumeOffsetFunc is set.
+	ResumeOffsetFunc func(localPath string, info os.FileInfo) (offset int64, err error)
+
+	// AppendGrowing specifies that the remote file is appended to over time,
+	// such as a log, so that an existing destination file is resumed to fetch
+	// only the bytes added since it was last downloaded. The remote file is
+	// not required to be unchanged since the existing file was downloaded, so
+	// no preconditions are sent with the range request, and any checksum set
+	// with SetChecksum is ignored as it cannot match a file that grows. If the
+	// remote file is now smaller than the existing file, as when a log is
+	// rotated, the transfer restarts from the beginning with a
+	// WarnRemoteShrank Warning.
+	AppendGrowing bool
+
+	// RequireResumable specifies that the transfer should fail with
+	// ErrNotResumable before any of the response body is transferred if the
+	// remote server does not support ranged requests, so that a long download
+	// is not started when it could not be resumed after a failure. Support is
+	// detected from the 'Accept-Ranges: bytes' header or, if the remote server
+	// does not advertise it, by sending a ranged request for the first byte.
+	// Response.CanResume is set if the transfer proceeds.
+	RequireResumable bool
+
+	// UnknownSizeResume determines how an existing file is resumed if the
+	// size of the remote file is not known, as neither Size nor the remote
+	// server report it. The policy that was applied is reported by a Warning
+	// with the code WarnUnknownSize. Default: UnknownSizeRestart.
+	UnknownSizeResume UnknownSizePolicy
+
+	// WriteOffset, if greater than zero, specifies that a range of the remote
+	// file should be written over the existing destination file at this
+	// offset, leaving the rest of the file intact, as for tools that patch
+	// regions of a local file. The range is given by the Range header of
+	// HTTPRequest or, if there is none, is from WriteOffset to the end of the
+	// existing file.
+	//
+	// The destination file must exist, and the range must end within it, or
+	// the transfer fails with ErrBadWriteOffset. If the remote server returns
+	// the whole file rather than the range, the transfer fails with
+	// ErrRangeIgnored. The file is never resumed, truncated or removed, and
+	// any checksum set with SetChecksum is computed over the whole file.
+	// WriteOffset is ignored if NoStore is set or the transfer is written to
+	// standard output, a named pipe or a device.
+	WriteOffset int64
+
+	// Range, if not nil, specifies that only the given range of the remote
+	// file should be downloaded and stored as the destination file, as
+	// created by NewRangeRequest. The range is requested with a Range header
+	// and the Content-Range of the response must match it, or the transfer
+	// fails with ErrBadContentRange. Response.Size is the length of the
+	// range, and any checksum set with SetChecksum is computed over the bytes
+	// of the range. An existing file that is shorter than the range is
+	// resumed from its end, unless NoResume is set; ResumeFrom,
+	// ResumeOffsetFunc and AppendGrowing do not apply.
+	//
+	// If the remote server responds with the whole file rather than the
+	// range, the transfer fails with ErrRangeIgnored unless RangeFallback is
+	// set, in which case the range is read from the whole file, discarding
+	// the bytes before and after it. Range is ignored if WriteOffset is set.
+	Range *ByteRange
+
+	// RangeFallback specifies that Range should be read from the whole remote
+	// file if the remote server does not support ranged requests.
+	RangeFallback bool
+
+	// SingleUse specifies that the request URL may only be used once, as is the
+	// case for download portals that invalidate a URL after the first GET
+	// request. No HEAD request is sent to probe the remote server and, as
+	// support for ranged requests cannot be determined, an existing partial file
+	// is restarted rather than resumed.
+	//
+	// Because the URL cannot be requested again, a failure once the file
+	// transfer has started is terminal and is reported as an error for which
+	// errors.Is(err, ErrSingleUseExhausted) is true.
+	SingleUse bool
+
+	// RemovePartialOnCancel specifies that a partially downloaded file should
+	// be removed if the transfer is canceled.
+	//
+	// If the transfer was resuming an existing file, the file is instead
+	// truncated back to the length it had before the transfer started.
+	RemovePartialOnCancel bool
+
+	// RemovePartialOnError is the same as RemovePartialOnCancel, but applies
+	// if the transfer fails for any reason other than cancelation.
+	RemovePartialOnError bool
+
 	// NoStore specifies that grab should not write to the local file system.
 	// Instead, the download will be stored in memory and accessible only via
-	// Response.Open or Response.Bytes.
+	// Response.Open or Response.Bytes. Set Discard to keep nothing.
 	NoStore bool
 
+	// Discard specifies that the downloaded bytes should be discarded rather
+	// than written to the local file system or kept in memory, for example to
+	// measure the speed of a download or to warm a cache. Discard implies
+	// NoStore. Progress is reported and any checksum set with SetChecksum is
+	// verified as usual, but Filename and FilenameFunc are ignored,
+	// Response.Filename is empty and Response.Bytes returns no data.
+	Discard bool
+
 	// NoCreateDirectories specifies that any missing directories in the given
 	// Filename path should not be created automatically, if they do not already
 	// exist.
 	NoCreateDirectories bool
 
+	// MaxCreateDirDepth is the maximum number of missing directories that may
+	// be created in the given Filename path. If more are missing, which usually
+	// indicates a misconfigured destination, the transfer fails with
+	// ErrDirDepth before the file is downloaded. Zero means no limit.
+	// MaxCreateDirDepth is ignored if NoCreateDirectories is true.
+	MaxCreateDirDepth int
+
+	// MaxReconnects is the number of times that the transfer may reconnect to
+	// the remote server if the connection fails while the response body is
+	// being read. Each reconnection sends a ranged request for the rest of the
+	// file and continues writing to the open destination, so the transfer
+	// continues as one download rather than failing. If the remote server
+	// responds with 503 Service Unavailable or 429 Too Many Requests, the
+	// ranged request is sent again after the delay of its Retry-After header,
+	// up to 5 minutes, or Backoff, whichever is longer, and the attempt counts
+	// towards MaxReconnects. The transfer fails as usual if the remote server
+	// does not respond with the requested range or if the remote file changed.
+	//
+	// Transfers with SingleUse or WriteOffset set, or whose response is
+	// decoded by grab, are never reconnected. Zero means no reconnections.
+	MaxReconnects int
+
+	// Backoff determines the delay before each reconnection permitted by
+	// MaxReconnects. If nil, the transfer reconnects immediately.
+	Backoff Backoff
+
+	// FailOnInterference specifies that the transfer should fail with
+	// ErrProxyInterference if the response may have been altered by a proxy,
+	// as detected by Client.DetectProxyInterference, rather than raising a
+	// warning. It applies even if Client.DetectProxyInterference is not set.
+	FailOnInterference bool
+
+	// NoFollowSymlinks specifies that the transfer should fail with
+	// ErrSymlinkDestination if the destination path, or any existing
+	// directory in it, is a symlink, rather than writing to the target of the
+	// symlink. The destination is opened with O_NOFOLLOW where supported.
+	// Directories above Client.AllowedRoot, if set, are not checked.
+	NoFollowSymlinks bool
+
 	// IgnoreBadStatusCodes specifies that grab should accept any status code in
 	// the response from the remote server. Otherwise, grab expects the response
 	// status code to be within the 2XX range (after following redirects).
 	IgnoreBadStatusCodes bool
 
+	// FollowMetaRefresh specifies that grab should follow HTML pages that
+	// redirect to the requested file with a <meta http-equiv="refresh"> tag,
+	// as served by some file hosts. Only the first 64KB of a text/html response
+	// is searched for the tag and, if none is found, the page is downloaded as
+	// the requested file. JavaScript redirects are not followed.
+	//
+	// Once a page refreshes to another URL, the transfer starts over with the
+	// new URL, so any existing file is resumed against the file at that URL.
+	FollowMetaRefresh bool
+
+	// MaxMetaRefreshes specifies the maximum number of meta refresh redirects
+	// followed if FollowMetaRefresh is set, after which the transfer fails
+	// with ErrTooManyMetaRefreshes. HTTP redirects are governed by the
+	// CheckRedirect policy of the HTTP client instead.
+	//
+	// Default: 10.
+	MaxMetaRefreshes int
+
+	// MaxBytes specifies the maximum size in bytes of the file transfer. If the
+	// remote server reports a larger size, or sends more bytes than allowed,
+	// the transfer fails with ErrMaxBytes. If the response is decompressed while
+	// it is transferred, the limit applies to the decompressed bytes.
+	//
+	// Zero means no limit.
+	MaxBytes int64
+
+	// MaxCompressionRatio specifies the maximum ratio of decompressed bytes to
+	// compressed bytes, to protect against decompression bombs. If the ratio is
+	// exceeded at any point during the transfer, the transfer fails with
+	// ErrCompressionRatio.
+	//
+	// As the ratio cannot be measured for responses decompressed transparently
+	// by http.Transport, grab requests and decompresses encoded responses
+	// itself if MaxCompressionRatio is set and the Accept-Encoding and Range
+	// headers of HTTPRequest are unset. The ratio also applies to content
+	// codings registered with RegisterDecoder.
+	//
+	// Zero means no limit.
+	MaxCompressionRatio float64
+
+	// RequireDecoding specifies that a response body encoded with a content
+	// coding, as named in the Content-Encoding header, must be decoded before
+	// it is stored. The transfer fails with ErrUnsupportedEncoding if no
+	// Decoder is registered for any of the content codings of the response,
+	// rather than storing the encoded body as received. Responses to requests
+	// that set the Accept-Encoding header are also decoded.
+	RequireDecoding bool
+
+	// RequireHeaders specifies headers that the response from the remote server
+	// must include, mapped to their required values. An empty value accepts
+	// any value. If a required header is missing or has a different value, the
+	// transfer fails with ErrBadHeader before anything is written.
+	RequireHeaders map[string]string
+
 	// IgnoreRemoteTime specifies that grab should not attempt to set the
 	// timestamp of the local file to match the remote file.
+	//
+	// Otherwise, the timestamp of a downloaded file is only set once the
+	// transfer has been verified, so a file that fails checksum validation
+	// keeps the time it was downloaded. A partially downloaded file is also
+	// set to the timestamp of the remote file, so that when it is resumed, the
+	// remote server can be asked via If-Unmodified-Since whether the file
+	// changed since the partial download.
 	IgnoreRemoteTime bool
 
 	// Size specifies the expected size of the file transfer if known. If the
-	// server response size does not match, the transfer is cancelled and
-	// ErrBadLength returned.
+	// size reported by the remote server in the Content-Length or
+	// Content-Range headers does not match, the transfer fails with a
+	// SizeMismatchError before anything is copied. If the remote server does
+	// not report the size, Size is used to report progress and the transfer
+	// fails with a SizeMismatchError once it completes with a different size.
+	// An existing file larger than Size cannot be resumed and fails with
+	// ErrBadLength.
+	//
+	// Zero means the size is unknown.
 	Size int64
 
 	// BufferSize specifies the size in bytes of the buffer that is used for
 	// transferring the requested file. Larger buffers may result in faster
 	// throughput but will use more memory and result in less frequent updates
 	// to the transfer progress statistics. If a RateLimiter is configured,
-	// BufferSize should be much lower than the rate limit. Default: 32KB.
+	// BufferSize or RateLimitQuantum should be much lower than the rate limit.
+	// Default: 32KB.
 	BufferSize int
 
+	// MaxBufferSize caps the size in bytes of the transfer buffer, whether it
+	// is given by BufferSize, Client.BufferSize or the default, to limit the
+	// memory used by a transfer on constrained devices. The buffer size in use
+	// is reported by Response.CurrentBufferSize. Zero means no cap.
+	MaxBufferSize int
+
+	// SparseWrites specifies that 4 KiB blocks of the downloaded file that
+	// contain only zeros should be skipped rather than written, so that the
+	// file is stored as a sparse file on file systems that support it, such
+	// as for disk images that are mostly zeros. The file is extended to its
+	// full length once the transfer is complete or fails, so its content,
+	// checksum and resume offset are unaffected.
+	//
+	// SparseWrites is ignored if DirectIO or NoStore is set or the transfer is
+	// written to standard output, a named pipe or a device.
+	SparseWrites bool
+
+	// SaveHashState specifies that the checksum given to SetChecksum should be
+	// computed as the file is written, and that the state of its hash should
+	// be saved next to a partially downloaded file, with the suffix ".grab",
+	// so that a transfer resuming the file continues the checksum rather than
+	// reading the whole file back once it is complete. The sidecar file is
+	// removed once the transfer completes.
+	//
+	// The hash must implement encoding.BinaryMarshaler and
+	// encoding.BinaryUnmarshaler, as do the hashes of crypto/sha256 and other
+	// standard library packages. Otherwise, or if a resumed file has no saved
+	// state at its resume offset, the file is read back as usual. The saved
+	// state is trusted to describe the existing content of the file.
+	SaveHashState bool
+
+	// FlushInterval and FlushEvery specify that a partially downloaded file
+	// should be flushed to stable storage with fsync once FlushInterval has
+	// elapsed, or once FlushEvery bytes have been written, since the last
+	// flush, so that a crash loses a bounded amount of progress of a transfer
+	// that is then resumed. With SaveHashState, the saved hash state is
+	// updated on each flush to match the flushed file. Either or both may be
+	// set, and they are checked as the file is written rather than by a timer.
+	//
+	// Each flush waits for the written data to reach the disk, which can
+	// reduce throughput considerably if flushes are frequent, especially on
+	// spinning disks and network file systems. Default: zero, the file is
+	// written back only by the operating system.
+	//
+	// Flushing is ignored if DirectIO, NoStore or Discard is set or the
+	// transfer is written to standard output, a named pipe or a device.
+	FlushInterval time.Duration
+	FlushEvery    int64
+
+	// DirectIO specifies that the downloaded file should be written with
+	// O_DIRECT, bypassing the page cache, so that large transfers do not evict
+	// other cached files. Writes are buffered in page-aligned blocks of at
+	// least BufferSize bytes and the unaligned tail of the file is written
+	// without O_DIRECT once the transfer is complete.
+	//
+	// DirectIO is only supported on Linux. If the file cannot be opened with
+	// O_DIRECT, as some filesystems do not support it, or the file is resumed
+	// at an unaligned offset, it is written with buffered I/O and a Warning is
+	// raised instead. DirectIO is ignored if NoStore is set or the transfer is
+	// written to standard output, a named pipe or a device.
+	DirectIO bool
+
 	// RateLimiter allows the transfer rate of a download to be limited. The given
-	// Request.BufferSize determines how frequently the RateLimiter will be
-	// polled.
+	// Request.BufferSize and Request.RateLimitQuantum determine how frequently
+	// the RateLimiter will be polled.
 	RateLimiter RateLimiter
 
-	// BeforeCopy is a user provided callback that is called immediately before
-	// a request starts downloading. If BeforeCopy returns an error, the request
-	// is cancelled and the same error is returned on the Response object.
+	// RateLimitQuantum specifies the maximum number of bytes that will be read
+	// from the remote server and passed to the RateLimiter at once. Smaller
+	// quanta result in smoother traffic, with more frequent calls to the
+	// RateLimiter. The quantum is never larger than BufferSize.
+	//
+	// If zero, a tenth of the limit of the RateLimiter is used if it has a
+	// Limit method, as golang.org/x/time/rate.Limiter does, so that it is
+	// polled about ten times per second. Otherwise, BufferSize is used. The
+	// default is capped to the burst size of the RateLimiter if it has a Burst
+	// method.
+	RateLimitQuantum int
+
+	// VerifyContentMD5 specifies that the downloaded file should be validated
+	// against the base64 encoded MD5 checksum in the Content-MD5 header of the
+	// server response, if present, as described in RFC 1864.
+	//
+	// The header only describes the full content of a file, so it is ignored in
+	// partial (206) responses. When resuming a download, the file is only
+	// validated if the HEAD request sent before resuming included the header.
+	// Any checksum set via SetChecksum takes precedence.
+	VerifyContentMD5 bool
+
+	// Validate is an optional callback that is called with the path of the
+	// downloaded file once the transfer is complete, to check that the file is
+	// valid, for example with zip.OpenReader or by checking its magic bytes. It
+	// is also called for an existing file that is already complete.
+	//
+	// Validate is called after AfterCopy and after checksum validation, so it
+	// is not called if either fails, and before the timestamp of the file is
+	// set. If Validate returns an error, the same error is returned on the
+	// Response object and, if deleteOnError was given to SetChecksum, the file
+	// is deleted. To delete invalid files without checksum validation, call
+	// SetChecksum with a nil hash.
+	//
+	// Validate is not called if NoStore is set or if the transfer is written to
+	// standard output, a named pipe or a device.
+	Validate func(path string) error
+
+	// BeforeCopy is a user provided callback that is called once the response
+	// headers are received, immediately before the destination is opened and
+	// the request starts downloading. If BeforeCopy returns an error, the
+	// request is cancelled, no destination file is created or truncated and
+	// the same error is returned on the Response object.
+	//
+	// BeforeCopy may change the destination by setting Response.Filename,
+	// which is sanitized unless NoSanitizeFilename is set and is then created
+	// as usual, overwriting any existing file. The destination of a transfer
+	// that resumes or writes over an existing file, is written to a stream or
+	// is content-addressed cannot be changed and fails with
+	// ErrDestinationChanged.
 	BeforeCopy Hook
 
 	// AfterCopy is a user provided callback that is called immediately after a
@@ -99,6 +554,39 @@ type Request struct {
 	// the Response object.
 	AfterCopy Hook
 
+	// OnFinish is a user provided callback that is called exactly once when
+	// the transfer is complete, whether it succeeded, failed, was canceled or
+	// panicked, for example to release resources held for the transfer.
+	// Unlike AfterCopy, it is also called for transfers that fail before the
+	// copy starts. The Response is complete when OnFinish is called, so Err
+	// returns immediately, but other goroutines waiting for the transfer may
+	// resume before OnFinish returns.
+	//
+	// If a panic occurs during the transfer while Client.PropagatePanics is
+	// set, OnFinish is called before the panic continues. A panic in OnFinish
+	// itself is recorded as a WarnOnFinishPanic Warning unless
+	// Client.PropagatePanics is set, so Response.Warnings may change after
+	// Response.Done is closed.
+	OnFinish func(resp *Response)
+
+	// DebugDump, if not nil, receives a timestamped dump of every HTTP request
+	// sent for the transfer, including the HEAD request, any ranged probe and
+	// any reconnects, and of the headers of every response. Request and
+	// response bodies are not dumped; the length of a response body is noted
+	// instead. Redirects followed by the HTTP client are included in the
+	// dump of the final response only.
+	//
+	// Dumps are written from another goroutine, so that the transfer is never
+	// blocked by DebugDump, and may be written after the transfer is complete.
+	// If DebugDump falls behind, further dumps are dropped and a Warning with
+	// the code WarnDebugDump is raised.
+	DebugDump io.Writer
+
+	// DebugDumpUnsafe specifies that the values of the Authorization, Cookie,
+	// Proxy-Authorization and Set-Cookie headers should be included in
+	// DebugDump rather than redacted.
+	DebugDumpUnsafe bool
+
 	// hash, checksum and deleteOnError - set via SetChecksum.
 	hash hash.Hash
 
@@ -107,10 +595,14 @@ type Request struct {
 
 	// Context for cancellation and timeout - set via WithContext
 	ctx context.Context
+
+	// sealed is set once the Request is passed to Client.Do, after which it
+	// must not be modified.
+	sealed bool
 }
 
 // NewRequest returns a new file transfer Request suitable for use with
-// Client.Do.
+// Client.Do. If dst is "-", the transfer is written to standard output.
 func NewRequest(dst, urlStr string) (*Request, error) {
 	if dst == "" {
 		dst = "."
@@ -150,9 +642,61 @@ func (r *Request) WithContext(ctx context.Context) *Request {
 	*r2 = *r
 	r2.ctx = ctx
 	r2.HTTPRequest = r2.HTTPRequest.WithContext(ctx)
+	r2.sealed = false
+	return r2
+}
+
+// Clone returns a deep copy of r, which may be modified and passed to
+// Client.Do even if r has already been passed to Client.Do. This is the
+// sanctioned way to derive a modified Request from a submitted one.
+//
+// The HTTPRequest, including its headers, RequireHeaders, Tags and Range are
+// copied.
+// Callbacks, RateLimiter, Backoff, Transport, DebugDump and ContentAddressed
+// are shared with r. The hash given to SetChecksum is not copied, as it must
+// not be shared by requests, so SetChecksum must be called again on the clone
+// to validate its checksum.
+func (r *Request) Clone() *Request {
+	r2 := new(Request)
+	*r2 = *r
+	r2.HTTPRequest = r.HTTPRequest.Clone(r.Context())
+	if r.RequireHeaders != nil {
+		r2.RequireHeaders = make(map[string]string, len(r.RequireHeaders))
+		for k, v := range r.RequireHeaders {
+			r2.RequireHeaders[k] = v
+		}
+	}
+	if r.Tags != nil {
+		r2.Tags = append([]string(nil), r.Tags...)
+	}
+	if r.Range != nil {
+		rng := *r.Range
+		r2.Range = &rng
+	}
+	r2.hash, r2.checksum, r2.deleteOnError = nil, nil, false
+	r2.sealed = false
+	return r2
+}
+
+// seal marks r as submitted and returns the copy of r, with the given context
+// and its own HTTPRequest, that is used by the transfer, so that the transfer
+// never races with changes the caller makes to r or its headers.
+func (r *Request) seal(ctx context.Context) *Request {
+	r.sealed = true
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	r2.HTTPRequest = r.HTTPRequest.Clone(ctx)
 	return r2
 }
 
+// mustNotBeSealed panics if r has been passed to Client.Do.
+func (r *Request) mustNotBeSealed(method string) {
+	if r.sealed {
+		panic("grab: Request." + method + " called after the Request was passed to Client.Do; use Request.Clone to derive a modified Request")
+	}
+}
+
 // URL returns the URL to be downloaded.
 func (r *Request) URL() *url.URL {
 	return r.HTTPRequest.URL
@@ -165,13 +709,20 @@ func (r *Request) URL() *url.URL {
 // Response.Err method.
 //
 // If deleteOnError is true, the downloaded file will be deleted automatically
-// if it fails checksum validation.
+// if it fails checksum validation or Request.Validate.
 //
 // To prevent corruption of the computed checksum, the given hash must not be
 // used by any other request or goroutines.
 //
 // To disable checksum validation, call SetChecksum with a nil hash.
+//
+// SetChecksum panics if r has already been passed to Client.Do.
 func (r *Request) SetChecksum(h hash.Hash, sum []byte, deleteOnError bool) {
+	r.mustNotBeSealed("SetChecksum")
+	r.setChecksum(h, sum, deleteOnError)
+}
+
+func (r *Request) setChecksum(h hash.Hash, sum []byte, deleteOnError bool) {
 	r.hash = h
 	r.checksum = sum
 	r.deleteOnError = deleteOnError
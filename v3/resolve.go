@@ -0,0 +1,204 @@
+package grab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultPreresolveTTL is how long addresses resolved by PreresolveHosts are
+// used if Client.PreresolveTTL is not set.
+const defaultPreresolveTTL = 5 * time.Minute
+
+// lookupHost resolves the addresses of a host for PreresolveHosts. It is a
+// variable so that tests can resolve hosts without DNS.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// hostCache holds the addresses resolved by PreresolveHosts.
+type hostCache struct {
+	mu    sync.Mutex
+	hosts map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+// get returns the unexpired addresses of host, if any.
+func (c *hostCache) get(host string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.hosts[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.hosts, host)
+		return nil
+	}
+	return e.addrs
+}
+
+func (c *hostCache) put(host string, addrs []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]resolvedHost)
+	}
+	c.hosts[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(ttl)}
+}
+
+// dialer returns a DialContext function that connects to the addresses of a
+// resolved host in order, until one succeeds, and dials any other address
+// with dial.
+func (c *hostCache) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs := c.get(host)
+		if len(addrs) == 0 {
+			return dial(ctx, network, addr)
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+		}
+		return nil, err
+	}
+}
+
+// dialLimiter is a semaphore of Client.MaxConcurrentDials slots, which limits
+// the connections being established at once.
+type dialLimiter chan struct{}
+
+// dialer returns a DialContext function that waits for a slot before dialing
+// with dial, and releases it once the connection is established or failed.
+func (c dialLimiter) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case c <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-c }()
+		return dial(ctx, network, addr)
+	}
+}
+
+// wrapDials wraps the DialContext function of the Client.HTTPClient the first
+// time it is called, to check the addresses connected to against URLPolicy and
+// to limit them to MaxConcurrentDials, if either is set and the HTTPClient can
+// be configured. With URLPolicy, its Proxy function is also wrapped to fail
+// requests sent through a proxy.
+func (c *Client) wrapDials() {
+	c.dialsOnce.Do(func() {
+		if c.MaxConcurrentDials < 1 && c.URLPolicy == nil {
+			return
+		}
+		t, err := c.httpTransport("configure dials of")
+		if err != nil {
+			// documented as ignored
+			return
+		}
+		if c.MaxConcurrentDials > 0 {
+			c.dials = make(dialLimiter, c.MaxConcurrentDials)
+		}
+		c.dialPolicy = c.URLPolicy
+		if c.dialPolicy != nil && t.Proxy != nil {
+			t.Proxy = policyProxy(t.Proxy)
+		}
+		t.DialContext = c.wrapDial(dialContext(t))
+	})
+}
+
+// resolveHost returns the addresses of host resolved by PreresolveHosts, if
+// they have not expired, and resolves it again otherwise, so that the
+// addresses checked against URLPolicy are those that would be dialed.
+func (c *Client) resolveHost(ctx context.Context, host string) ([]string, error) {
+	if c.hosts != nil {
+		if addrs := c.hosts.get(host); len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return lookupHost(ctx, host)
+}
+
+// wrapDial returns dial wrapped as configured by wrapDials.
+func (c *Client) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.dialPolicy != nil {
+		dial = policyDialer(c.dialPolicy, c.resolveHost, dial)
+	}
+	if c.dials != nil {
+		dial = c.dials.dialer(dial)
+	}
+	return dial
+}
+
+// PreresolveHosts resolves the addresses of the given hosts, which may include
+// a port, and connects to those addresses instead of resolving the hosts again
+// for each connection, until Client.PreresolveTTL has elapsed. This avoids
+// repeated DNS lookups in a large batch of transfers from a few hosts. Hosts
+// are resolved concurrently and the errors of all hosts that could not be
+// resolved are returned, joined. Resolution stops once ctx is done.
+//
+// PreresolveHosts is opt-in because it pins the addresses of each host for the
+// TTL, which defeats DNS-based round-robin load balancing and failover: a host
+// whose addresses change is still connected to at its previous addresses,
+// although each address is tried in turn if a connection fails.
+//
+// The Client.HTTPClient must be an *http.Client that uses an *http.Transport,
+// as created by NewClient, whose DialContext function is wrapped. It must not
+// be called for the first time while transfers are in progress.
+func (c *Client) PreresolveHosts(ctx context.Context, hosts ...string) error {
+	t, err := c.httpTransport("pre-resolve hosts of")
+	if err != nil {
+		return err
+	}
+	if c.hosts == nil {
+		c.hosts = new(hostCache)
+		t.DialContext = c.hosts.dialer(dialContext(t))
+	}
+	ttl := c.PreresolveTTL
+	if ttl <= 0 {
+		ttl = defaultPreresolveTTL
+	}
+
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) != nil {
+			// nothing to resolve
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			addrs, err := lookupHost(ctx, host)
+			if err == nil && len(addrs) == 0 {
+				err = errors.New("no addresses")
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("grab: resolving %s: %w", host, err)
+				return
+			}
+			c.hosts.put(host, addrs, ttl)
+		}(i, host)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
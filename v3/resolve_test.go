@@ -0,0 +1,162 @@
+package grab
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestPreresolveHosts ensures that transfers connect to the addresses resolved
+// by Client.PreresolveHosts without resolving their hosts again.
+func TestPreresolveHosts(t *testing.T) {
+	var lookups int32
+	defer func(f func(ctx context.Context, host string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		switch host {
+		case "pinned.grab.test":
+			return []string{"127.0.0.1"}, nil
+		case "slow.grab.test":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	grabtest.WithTestServer(t, func(rawURL string) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(u.Host)
+		pinned := "pinned.grab.test:" + port
+
+		t.Run("Default", func(t *testing.T) {
+			atomic.StoreInt32(&lookups, 0)
+			client := NewClient()
+			if err := client.PreresolveHosts(context.Background(), pinned); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				req := mustNewRequest("", "http://"+pinned+"/file")
+				req.NoStore = true
+				if err := client.Do(req).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := atomic.LoadInt32(&lookups); n != 1 {
+				t.Errorf("expected 1 lookup, got %d", n)
+			}
+		})
+
+		t.Run("WithURLPolicy", func(t *testing.T) {
+			// the policy checks the pinned addresses instead of resolving
+			// the host again
+			client := NewClient()
+			client.URLPolicy = func(u *url.URL) error { return nil }
+			if err := client.PreresolveHosts(context.Background(), pinned); err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&lookups, 0)
+			for i := 0; i < 2; i++ {
+				req := mustNewRequest("", "http://"+pinned+"/file")
+				req.NoStore = true
+				req.NoResume = true
+				if err := client.Do(req).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := atomic.LoadInt32(&lookups); n != 0 {
+				t.Errorf("expected no lookups, got %d", n)
+			}
+		})
+
+		t.Run("WithUnresolvableHost", func(t *testing.T) {
+			client := NewClient()
+			err := client.PreresolveHosts(context.Background(), pinned, "missing.grab.test", "127.0.0.1")
+			if err == nil || !strings.Contains(err.Error(), "missing.grab.test") {
+				t.Fatalf("expected error resolving missing host, got: %v", err)
+			}
+			if addrs := client.hosts.get("pinned.grab.test"); len(addrs) != 1 {
+				t.Errorf("expected other hosts to be resolved, got: %v", addrs)
+			}
+		})
+
+		t.Run("WithCanceledContext", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := NewClient().PreresolveHosts(ctx, "slow.grab.test")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected error: %v, got: %v", context.DeadlineExceeded, err)
+			}
+		})
+
+		t.Run("WithExpiredAddresses", func(t *testing.T) {
+			client := NewClient()
+			client.PreresolveTTL = time.Nanosecond
+			if err := client.PreresolveHosts(context.Background(), pinned); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+			if addrs := client.hosts.get("pinned.grab.test"); addrs != nil {
+				t.Errorf("expected addresses to expire, got: %v", addrs)
+			}
+		})
+
+		t.Run("WithCustomTransport", func(t *testing.T) {
+			client := NewClient()
+			client.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("unused")
+			})}
+			if err := client.PreresolveHosts(context.Background(), pinned); err == nil {
+				t.Errorf("expected error for a custom http.RoundTripper")
+			}
+		})
+	})
+}
+
+// TestMaxConcurrentDials ensures that no more than Client.MaxConcurrentDials
+// connections are established at once.
+func TestMaxConcurrentDials(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		var dialing, maxDialing int32
+		dialer := &net.Dialer{}
+		client := NewClient()
+		client.MaxConcurrentDials = 2
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				n := atomic.AddInt32(&dialing, 1)
+				defer atomic.AddInt32(&dialing, -1)
+				for m := atomic.LoadInt32(&maxDialing); n > m; m = atomic.LoadInt32(&maxDialing) {
+					if atomic.CompareAndSwapInt32(&maxDialing, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}}
+
+		reqs := make([]*Request, 8)
+		for i := range reqs {
+			reqs[i] = mustNewRequest("", url)
+			reqs[i].NoStore = true
+		}
+		for resp := range client.DoBatch(0, reqs...) {
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := atomic.LoadInt32(&maxDialing); n != 2 {
+			t.Errorf("expected at most 2 concurrent dials, got %d", n)
+		}
+	})
+}
@@ -3,13 +3,160 @@ package grab
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// State describes the stage of its lifecycle that a file transfer has reached.
+type State int32
+
+const (
+	// StatePending indicates that the transfer is waiting for one of the
+	// Client.MaxConcurrentTransfers slots to become available.
+	StatePending State = iota
+
+	// StateConnecting indicates that the transfer is sending requests to the
+	// remote server and inspecting any existing local file.
+	StateConnecting
+
+	// StateTransferring indicates that the response body is being copied to
+	// its destination.
+	StateTransferring
+
+	// StateComplete indicates that the transfer has completed, successfully or
+	// otherwise.
+	StateComplete
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateConnecting:
+		return "connecting"
+	case StateTransferring:
+		return "transferring"
+	case StateComplete:
+		return "complete"
+	}
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// WarningCode identifies the condition described by a Warning.
+type WarningCode string
+
+const (
+	// WarnRangeIgnored indicates that the remote server ignored the range of a
+	// resumed transfer, so the existing file was restarted.
+	WarnRangeIgnored WarningCode = "range_ignored"
+
+	// WarnRemoteTime indicates that the timestamp of a partially downloaded
+	// file could not be set to that of the remote file, so changes to the
+	// remote file may not be detected when it is resumed.
+	WarnRemoteTime WarningCode = "remote_time"
+
+	// WarnDirectIO indicates that direct I/O was requested by Request.DirectIO
+	// but that the file was written with buffered I/O instead.
+	WarnDirectIO WarningCode = "direct_io"
+
+	// WarnProxyInterference indicates that the response may have been altered
+	// by a proxy, as detected by Client.DetectProxyInterference.
+	WarnProxyInterference WarningCode = "proxy_interference"
+
+	// WarnUnknownSize indicates that an existing file was resumed without
+	// knowing the size of the remote file, as determined by
+	// Request.UnknownSizeResume.
+	WarnUnknownSize WarningCode = "unknown_size"
+
+	// WarnDebugDump indicates that wire dumps were dropped because
+	// Request.DebugDump could not keep up with the transfer.
+	WarnDebugDump WarningCode = "debug_dump"
+
+	// WarnOnFinishPanic indicates that Request.OnFinish panicked, which does
+	// not fail the already completed transfer unless Client.PropagatePanics
+	// is set. As OnFinish is called once the transfer is complete, the
+	// Warning is added after Response.Done is closed.
+	WarnOnFinishPanic WarningCode = "on_finish_panic"
+
+	// WarnMetricsPanic indicates that Client.MetricsCollector panicked, which
+	// does not fail the already completed transfer unless
+	// Client.PropagatePanics is set.
+	WarnMetricsPanic WarningCode = "metrics_panic"
+
+	// WarnRemoteShrank indicates that an existing file was downloaded again
+	// from the start because the remote file became smaller than it, as
+	// permitted by Request.AppendGrowing.
+	WarnRemoteShrank WarningCode = "remote_shrank"
+
+	// WarnFilenameConflict indicates that the destination of a transfer
+	// planned by Client.Plan is shared by other transfers of the batch.
+	WarnFilenameConflict WarningCode = "filename_conflict"
+
+	// WarnHashState indicates that the state of the checksum hash of a
+	// partially downloaded file could not be saved for Request.SaveHashState,
+	// so the file will be read back to compute its checksum once it is
+	// resumed.
+	WarnHashState WarningCode = "hash_state"
+)
+
+// SkipReason identifies why the download of a file transfer was skipped, as
+// reported by Response.SkipReason.
+type SkipReason string
+
+const (
+	// SkipFileExists indicates that the destination already existed and
+	// Request.SkipExisting was set, in which case the transfer fails with
+	// ErrFileExists.
+	SkipFileExists SkipReason = "file_exists"
+
+	// SkipComplete indicates that the existing destination file already had
+	// the size of the remote file, or of Request.Range, so only its checksum,
+	// if any, was validated.
+	SkipComplete SkipReason = "complete"
+)
+
+// A Warning describes a condition that did not fail a file transfer but may
+// be of interest, such as a resumed transfer that had to be restarted.
+type Warning struct {
+	// Code identifies the condition.
+	Code WarningCode
+
+	// Message is a human readable description of the condition.
+	Message string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (w Warning) String() string {
+	if w.Err != nil {
+		return fmt.Sprintf("%s: %v", w.Message, w.Err)
+	}
+	return w.Message
+}
+
+// ConnInfo describes the connection used by one HTTP request of a file
+// transfer, as reported by httptrace.GotConnInfo.
+type ConnInfo struct {
+	// Method is the method of the HTTP request, such as HEAD for a probe.
+	Method string
+
+	// Reused is true if the connection was previously used for another HTTP
+	// request, rather than newly established.
+	Reused bool
+
+	// WasIdle is true if the connection was obtained from a pool of idle
+	// connections, and IdleTime is how long it had been idle.
+	WasIdle  bool
+	IdleTime time.Duration
+}
+
 // Response represents the response to a completed or in-progress download
 // request.
 //
@@ -28,12 +175,37 @@ type Response struct {
 	HTTPResponse *http.Response
 
 	// Filename specifies the path where the file transfer is stored in local
-	// storage.
+	// storage. On Windows, paths that exceed MAX_PATH are converted to their
+	// extended-length form, as in \\?\C:\path\to\file.
 	Filename string
 
-	// Size specifies the total expected size of the file transfer.
+	// Size specifies the total expected size of the file transfer. It is
+	// accessed atomically, so it must remain 64bit aligned on 386.
 	sizeUnsafe int64
 
+	// StatusCode is the status code of the HTTP response that carried the file
+	// content, which may be outside the 2XX range if
+	// Request.IgnoreBadStatusCodes is set. It is zero if no content was
+	// requested, such as when an existing file was already complete.
+	StatusCode int
+
+	// ContentEncoding is the content coding of the response body that was
+	// decoded before it was stored, such as "gzip", "br" or "zstd", or the
+	// list of content codings in the order they were applied, such as
+	// "gzip, br", if several were stacked. It is empty if the response body
+	// was stored as it was received.
+	ContentEncoding string
+
+	// LastModified specifies the modification time of the remote file, as
+	// reported by the Last-Modified header of the remote server. It is zero if
+	// the header was missing or could not be parsed.
+	LastModified time.Time
+
+	// ETag specifies the entity tag of the remote file, as reported by the ETag
+	// header of the remote server, including any quotes and weak validator
+	// prefix. It is empty if the header was missing.
+	ETag string
+
 	// Start specifies the time at which the file transfer started.
 	Start time.Time
 
@@ -43,32 +215,141 @@ type Response struct {
 	End time.Time
 
 	// CanResume specifies that the remote server advertised that it can resume
-	// previous downloads, as the 'Accept-Ranges: bytes' header is set.
+	// previous downloads, as the 'Accept-Ranges: bytes' header is set. It is
+	// false if the remote server advertised 'Accept-Ranges: none', in which
+	// case no ranged request is sent and any existing file is restarted.
 	CanResume bool
 
 	// DidResume specifies that the file transfer resumed a previously incomplete
 	// transfer.
 	DidResume bool
 
+	// Skipped specifies that no content of the remote file was downloaded, as
+	// the destination did not need to be, and SkipReason describes why.
+	// Skipped transfers do not fail unless the reason says so, or an existing
+	// file fails to validate. Both are set by the time Client.Do returns.
+	Skipped    bool
+	SkipReason SkipReason
+
+	// CreatedFile specifies that the destination file did not exist before
+	// the transfer and was created by it. It is false if an existing file was
+	// resumed or overwritten, for content that was already in a
+	// Request.ContentAddressed store, and for transfers that are not written
+	// to a file. It is set once the destination is opened, and is reset if
+	// the file is removed because the transfer failed.
+	CreatedFile bool
+
 	// Done is closed once the transfer is finalized, either successfully or with
 	// errors. Errors are available via Response.Err
 	Done chan struct{}
 
+	// metadata is closed once the metadata of the transfer is known, or the
+	// transfer has failed.
+	metadata     chan struct{}
+	metadataOnce sync.Once
+
 	// ctx is a Context that controls cancelation of an inprogress transfer
 	ctx context.Context
 
+	// state is the current State of the transfer.
+	state atomic.Int32
+
+	// timers cancel the transfer at the Client.PerTransferTimeout or the
+	// BatchOptions.Deadline, and are stopped once the transfer is complete.
+	timers []*time.Timer
+
+	// slots is the semaphore of the Client from which this Response holds a
+	// transfer slot, if any.
+	slots chan struct{}
+
 	// cancel is a cancel func that can be used to cancel the context of this
 	// Response.
-	cancel context.CancelFunc
+	cancel context.CancelCauseFunc
+
+	// req is the copy of Request that is used by the transfer, so that it
+	// never races with changes the caller makes to Request. It is mutated as
+	// the transfer progresses, for example to follow the redirect of a HEAD
+	// request, while Request is left as it was submitted.
+	req *Request
+
+	// deferred is set by Defer to stop the transfer before copyFile starts
+	// writing to the destination. deferMu orders it with the transition to
+	// StateTransferring.
+	deferMu  sync.Mutex
+	deferred bool
 
 	// fi is the FileInfo for the destination file if it already existed before
 	// transfer started.
 	fi os.FileInfo
 
+	// probe indicates that HTTPResponse is the response to a HEAD request, or
+	// the ranged request that replaces it, rather than the file content.
+	probe bool
+
+	// probeResponse is the response to the HEAD request, or the ranged request
+	// that replaces it, if any.
+	probeResponse *http.Response
+
+	// customOffset indicates that the offset in the remote file from which
+	// the transfer resumes was computed by Request.ResumeOffsetFunc, so that
+	// the existing file is appended to regardless of its size.
+	customOffset bool
+
+	// inPlace indicates that a range of the remote file is written over the
+	// existing file at Request.WriteOffset.
+	inPlace bool
+
+	// dump writes wire dumps to Request.DebugDump, once the first request is
+	// sent.
+	dump *dumper
+
+	// probeKey is the key of the response to the HEAD request in the probe
+	// cache of the Client, if enabled.
+	probeKey string
+
 	// optionsKnown indicates that a HEAD request has been completed and the
 	// capabilities of the remote server are known.
 	optionsKnown bool
 
+	// stream indicates that the destination is standard output, a named pipe
+	// or a device, which is written sequentially and cannot be resumed, read
+	// back or removed.
+	stream bool
+
+	// rangeSliced indicates that Request.Range is read from a response with
+	// the whole remote file, as permitted by Request.RangeFallback.
+	rangeSliced bool
+
+	// partial indicates that the transfer failed while copying the response
+	// body, leaving a partially downloaded file.
+	partial bool
+
+	// worker is the batch worker that runs the transfer, if it is part of a
+	// batch with BatchOptions.SmallFileOptimization.
+	worker *batchWorker
+
+	// partialPath is the path of the file that holds the bytes counted by
+	// BytesComplete, as returned by PartialPath.
+	partialPath atomic.Pointer[string]
+
+	// casTemp is the temporary file of a transfer to a content-addressed
+	// store, which is hashed by casHash as it is written.
+	casTemp string
+	casHash hash.Hash
+
+	// hashState computes the checksum as the body is written, if
+	// Request.SaveHashState is set and the hash state can be saved.
+	hashState *hashState
+
+	// mediaType and mediaParams are parsed from the Content-Type header of the
+	// response to the GET request.
+	mediaType   string
+	mediaParams map[string]string
+
+	// metaRefreshes is the number of meta refresh redirects that have been
+	// followed.
+	metaRefreshes int
+
 	// writer is the file handle used to write the downloaded file to local
 	// storage
 	writer io.Writer
@@ -77,17 +358,40 @@ type Response struct {
 	// enabled.
 	storeBuffer bytes.Buffer
 
+	// sizeKnown indicates that sizeUnsafe is the size of the remote file.
+	sizeKnown atomic.Bool
+
 	// bytesCompleted specifies the number of bytes which were already
 	// transferred before this transfer began.
-	bytesResumed int64
+	bytesResumed atomic.Int64
+
+	// reconnects is the number of times the transfer reconnected to the
+	// remote server after a connection failure.
+	reconnects atomic.Int32
+
+	// bytesDiscarded specifies the number of bytes of an existing local file
+	// that were discarded when the transfer was restarted.
+	bytesDiscarded atomic.Int64
+
+	// warnings are appended during the transfer, guarded by warningsMu.
+	warningsMu sync.Mutex
+	warnings   []Warning
+
+	// conns are appended as HTTP requests obtain connections, guarded by
+	// connsMu.
+	connsMu sync.Mutex
+	conns   []ConnInfo
 
 	// transfer is responsible for copying data from the remote server to a local
 	// file, tracking progress and allowing for cancelation.
-	transfer *transfer
+	transfer atomic.Pointer[transfer]
 
 	// bufferSize specifies the size in bytes of the transfer buffer.
 	bufferSize int
 
+	// clock is the Client.Clock of the transfer.
+	clock Clock
+
 	// Error contains any error that may have occurred during the file transfer.
 	// This should not be read until IsComplete returns true.
 	err error
@@ -104,14 +408,85 @@ func (c *Response) IsComplete() bool {
 	}
 }
 
+// State returns the current stage of the lifecycle of the file transfer.
+func (c *Response) State() State {
+	return State(c.state.Load())
+}
+
 // Cancel cancels the file transfer by canceling the underlying Context for
-// this Response. Cancel blocks until the transfer is closed and returns any
-// error - typically context.Canceled.
-func (c *Response) Cancel() error {
-	c.cancel()
+// this Response, without affecting any other transfer. Cancel blocks until the
+// transfer is closed and returns any error - typically context.Canceled.
+// Pending transfers may also be canceled.
+//
+// If reason is not nil, the error returned by Err wraps both context.Canceled
+// and reason. Cancel may be called multiple times; calls after the transfer has
+// completed have no effect and return the existing error.
+func (c *Response) Cancel(reason error) error {
+	c.cancel(reason)
 	return c.Err()
 }
 
+// Defer cancels a transfer that has not yet started copying the response body,
+// so that its Request can be resubmitted later, possibly modified with
+// Request.Clone. It may only be called while the transfer is in StatePending
+// or StateConnecting; a destination file created for the transfer is removed
+// and an existing file is left unchanged. Defer blocks until the transfer is
+// closed, releasing its transfer slot and any DoBatch or DoChannel worker, and
+// returns the Request that was passed to Client.Do.
+//
+// A transfer that is not held in StatePending starts copying soon after
+// Client.Do returns, so Defer is most useful with
+// Client.MaxConcurrentTransfers. Hooks such as Request.BeforeCopy must call
+// Defer from another goroutine, as it blocks until the transfer is closed.
+//
+// The error returned by Err wraps both context.Canceled and ErrDeferred. If
+// the transfer has already started copying the response body, or is complete,
+// it is not affected and ErrNotDeferrable is returned.
+func (c *Response) Defer() (*Request, error) {
+	c.deferMu.Lock()
+	if !c.deferred && c.State() > StateConnecting {
+		c.deferMu.Unlock()
+		return nil, ErrNotDeferrable
+	}
+	c.deferred = true
+	c.cancel(ErrDeferred)
+	c.deferMu.Unlock()
+	<-c.Done
+	return c.Request, nil
+}
+
+// skip marks the transfer as skipped for the given reason.
+func (c *Response) skip(reason SkipReason) {
+	c.Skipped = true
+	c.SkipReason = reason
+}
+
+// ctxErr returns the error of the Context of this Response, wrapping the
+// reason given to Cancel, if any, or the deadline that canceled it.
+func (c *Response) ctxErr() error {
+	err := c.ctx.Err()
+	if err == nil {
+		return nil
+	}
+	cause := context.Cause(c.ctx)
+	if cause == ErrTransferTimeout || cause == ErrBatchDeadline {
+		// the transfer was canceled by a deadline of the Client or batch
+		return cause
+	}
+	if cause != nil && cause != err {
+		return fmt.Errorf("%w: %w", err, cause)
+	}
+	return err
+}
+
+// MetadataReady returns a channel that is closed once the metadata of the
+// transfer, such as Filename and Size, is known or the transfer has failed.
+// This is always the case by the time Client.Do returns, unless the transfer
+// is in StatePending.
+func (c *Response) MetadataReady() <-chan struct{} {
+	return c.metadata
+}
+
 // Wait blocks until the download is completed.
 func (c *Response) Wait() {
 	<-c.Done
@@ -120,23 +495,82 @@ func (c *Response) Wait() {
 // Err blocks the calling goroutine until the underlying file transfer is
 // completed and returns any error that may have occurred. If the download is
 // already completed, Err returns immediately.
+//
+// If the transfer was canceled or its Context deadline exceeded, Err returns
+// the Context's error rather than any network error caused by the
+// cancelation, wrapping any reason given to Cancel. If the transfer exceeded
+// Client.PerTransferTimeout or BatchOptions.Deadline, Err returns
+// ErrTransferTimeout or ErrBatchDeadline.
 func (c *Response) Err() error {
 	<-c.Done
 	return c.err
 }
 
-// Size returns the size of the file transfer. If the remote server does not
-// specify the total size and the transfer is incomplete, the return value is
-// -1.
+// IsErrorStatus returns true if the remote server responded with a status code
+// outside the 2XX range. This is only possible if Request.IgnoreBadStatusCodes
+// is set, in which case the body of the error response is downloaded as usual.
+func (c *Response) IsErrorStatus() bool {
+	return c.StatusCode != 0 && (c.StatusCode < 200 || c.StatusCode > 299)
+}
+
+// Size returns the size of the file transfer. It is -1 while the size is
+// unknown, such as before the response headers of the remote server are
+// received or if the remote server does not specify the total size and the
+// transfer is incomplete. If the remote server does not specify the size,
+// Request.Size is returned instead, if set. Use SizeKnown to distinguish a
+// size of 0 or Request.Size from the size of the remote file.
 func (c *Response) Size() int64 {
 	return atomic.LoadInt64(&c.sizeUnsafe)
 }
 
+// SizeKnown returns true if Size is the size of the remote file, as reported
+// by the remote server in the Content-Length or Content-Range headers, as
+// discovered once the transfer completed, or as matched by an existing file.
+// User interfaces may use it to choose between a determinate and indeterminate
+// progress indicator.
+func (c *Response) SizeKnown() bool {
+	return c.sizeKnown.Load()
+}
+
 // BytesComplete returns the total number of bytes which have been copied to
 // the destination, including any bytes that were resumed from a previous
 // download.
 func (c *Response) BytesComplete() int64 {
-	return c.bytesResumed + c.transfer.N()
+	return c.bytesResumed.Load() + c.transfer.Load().N()
+}
+
+// WroteBytes returns the number of bytes written to the destination by this
+// transfer, which is BytesComplete without the bytes resumed from a previous
+// download. It is zero if the transfer was skipped or failed before writing
+// anything.
+func (c *Response) WroteBytes() int64 {
+	return c.transfer.Load().N()
+}
+
+// PartialPath returns the path of the file that holds the bytes counted by
+// BytesComplete, which is the temporary file of a transfer to a
+// Request.ContentAddressed store and Filename otherwise. It is set once the
+// destination file is opened, and is empty before then and for transfers that
+// are not written to a file, such as with Request.NoStore or to standard
+// output.
+//
+// Once the transfer has completed successfully, PartialPath is empty. If it
+// failed, PartialPath remains the path of the partially downloaded file, so
+// that it can be resumed or removed, unless the file was removed.
+func (c *Response) PartialPath() string {
+	if p := c.partialPath.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// BytesResumed returns the offset at which this transfer started writing to an
+// existing file, which is the number of bytes that did not need to be
+// downloaded again because a previous download was resumed. It is zero if the
+// transfer did not resume, including if resuming was attempted but the
+// transfer had to be restarted.
+func (c *Response) BytesResumed() int64 {
+	return c.bytesResumed.Load()
 }
 
 // BytesPerSecond returns the number of bytes per second transferred using a
@@ -144,9 +578,19 @@ func (c *Response) BytesComplete() int64 {
 // complete, the average bytes/sec for the life of the download is returned.
 func (c *Response) BytesPerSecond() float64 {
 	if c.IsComplete() {
-		return float64(c.transfer.N()) / c.Duration().Seconds()
+		return float64(c.transfer.Load().N()) / c.Duration().Seconds()
 	}
-	return c.transfer.BPS()
+	return c.transfer.Load().BPS()
+}
+
+// RateHistory returns up to the last n samples of the transfer rate in bytes
+// per second, oldest first, as for a sparkline of recent throughput. The rate
+// is sampled every second while the response body is being copied, so the
+// history does not include time spent pending, connecting or reconnecting, and
+// it no longer changes once the transfer is complete. At most the last 120
+// samples are kept.
+func (c *Response) RateHistory(n int) []float64 {
+	return c.transfer.Load().RateHistory(n)
 }
 
 // Progress returns the ratio of total bytes that have been downloaded. Multiply
@@ -168,23 +612,174 @@ func (c *Response) Duration() time.Duration {
 		return c.End.Sub(c.Start)
 	}
 
-	return time.Since(c.Start)
+	return c.now().Sub(c.Start)
+}
+
+// now returns the current time of the Client.Clock of the transfer.
+func (c *Response) now() time.Time {
+	return now(c.clock)
 }
 
-// ETA returns the estimated time at which the the download will complete, given
-// the current BytesPerSecond. If the transfer has already completed, the actual
-// end time will be returned.
+// ETA returns the estimated time at which the the download will complete, as
+// returned by ETAWithConfidence. The zero time is returned if it cannot be
+// estimated.
 func (c *Response) ETA() time.Time {
+	eta, _ := c.ETAWithConfidence()
+	return eta
+}
+
+// ETAWithConfidence returns the estimated time at which the download will
+// complete, given the bytes remaining and the current BytesPerSecond, which
+// excludes any bytes resumed from a previous download. If Request.RateLimiter
+// reports its limit, the estimate is never faster than the limit allows. If the
+// transfer has already completed, the actual end time is returned.
+//
+// If the size of the transfer is unknown or nothing has been transferred
+// recently, the zero time and false are returned, so that user interfaces can
+// show that the ETA is unknown.
+func (c *Response) ETAWithConfidence() (eta time.Time, ok bool) {
 	if c.IsComplete() {
-		return c.End
+		return c.End, true
+	}
+	size := c.Size()
+	if size < 0 {
+		return time.Time{}, false
+	}
+	bps := c.transfer.Load().BPS()
+	if limit := rateLimit(c.req.RateLimiter); limit > 0 && limit < bps {
+		bps = limit
+	}
+	if bps < 1 {
+		return time.Time{}, false
 	}
-	bt := c.BytesComplete()
-	bps := c.transfer.BPS()
-	if bps == 0 {
-		return time.Time{}
+	secs := float64(size-c.BytesComplete()) / bps
+	if secs < 0 {
+		secs = 0
+	}
+	return c.now().Add(time.Duration(secs * float64(time.Second))), true
+}
+
+// Stats returns statistics collected by the copy loop of the file transfer,
+// such as the number of read and write calls made. Stats may be called while
+// the transfer is in progress.
+func (c *Response) Stats() TransferStats {
+	stats := c.transfer.Load().Stats()
+	if stats.BufferSize == 0 {
+		stats.BufferSize = c.bufferSize
 	}
-	secs := float64(c.Size()-bt) / bps
-	return time.Now().Add(time.Duration(secs) * time.Second)
+	stats.BytesResumed = c.bytesResumed.Load()
+	stats.BytesDiscarded = c.bytesDiscarded.Load()
+	return stats
+}
+
+// CurrentBufferSize returns the size in bytes of the buffer used by the copy
+// loop of the file transfer, or zero if the transfer has not started copying.
+// CurrentBufferSize may be called while the transfer is in progress.
+func (c *Response) CurrentBufferSize() int {
+	return c.transfer.Load().Stats().BufferSize
+}
+
+// Reconnects returns the number of times that the transfer has reconnected to
+// the remote server to continue after a connection failure, as permitted by
+// Request.MaxReconnects.
+func (c *Response) Reconnects() int {
+	return int(c.reconnects.Load())
+}
+
+// RateLimitWait returns the total time that the transfer has spent waiting for
+// Request.RateLimiter, so that it can be compared with Duration to tell
+// whether the limiter or the network limits the transfer rate. It is zero if no
+// RateLimiter is set.
+func (c *Response) RateLimitWait() time.Duration {
+	return c.transfer.Load().Stats().RateLimitWait
+}
+
+// ContentType returns the media type and parameters, such as charset, of the
+// Content-Type header of the response to the GET request. The media type is
+// lower-case. It returns an empty media type if the header is missing or could
+// not be parsed, or if no response has been received.
+//
+// ContentType is set once MetadataReady is closed.
+func (c *Response) ContentType() (mediaType string, params map[string]string) {
+	if c.mediaType == "" {
+		return "", nil
+	}
+	params = make(map[string]string, len(c.mediaParams))
+	for k, v := range c.mediaParams {
+		params[k] = v
+	}
+	return c.mediaType, params
+}
+
+// Header returns a copy of the headers of HTTPResponse, so that callers need
+// not check whether it is nil. It returns an empty Header if no response has
+// been received, such as when an existing file was validated by
+// Request.Size without contacting the remote server.
+//
+// Header is set once MetadataReady is closed.
+func (c *Response) Header() http.Header {
+	if c.HTTPResponse == nil || c.HTTPResponse.Header == nil {
+		return make(http.Header)
+	}
+	return c.HTTPResponse.Header.Clone()
+}
+
+// CacheControl returns the directives of the Cache-Control header of
+// HTTPResponse, keyed by lower-case name. Directives without a
+// value, such as no-cache, map to an empty string, and quoted values are
+// unquoted. It returns nil if the header is missing or no response has been
+// received.
+//
+// CacheControl is set once MetadataReady is closed.
+func (c *Response) CacheControl() map[string]string {
+	if c.HTTPResponse == nil {
+		return nil
+	}
+	return cacheControl(c.HTTPResponse.Header)
+}
+
+// Connections returns a copy of the connection details of each HTTP request
+// sent so far for the transfer, in order, including HEAD requests, redirects
+// and reconnects, so that it can be seen whether connections were reused.
+// Requests that failed before obtaining a connection are not included.
+func (c *Response) Connections() []ConnInfo {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	if len(c.conns) == 0 {
+		return nil
+	}
+	return append([]ConnInfo(nil), c.conns...)
+}
+
+// gotConn records the connection obtained by an HTTP request.
+func (c *Response) gotConn(info ConnInfo) {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	c.conns = append(c.conns, info)
+}
+
+// Warnings returns a copy of the warnings raised so far during the transfer.
+// The warnings are complete once the transfer is complete, except for a
+// WarnOnFinishPanic Warning, which is only added once Request.OnFinish has
+// panicked, after Done is closed.
+func (c *Response) Warnings() []Warning {
+	c.warningsMu.Lock()
+	defer c.warningsMu.Unlock()
+	if len(c.warnings) == 0 {
+		return nil
+	}
+	return append([]Warning(nil), c.warnings...)
+}
+
+// warn appends a warning to the Response.
+func (c *Response) warn(code WarningCode, err error, format string, a ...any) {
+	c.warningsMu.Lock()
+	defer c.warningsMu.Unlock()
+	c.warnings = append(c.warnings, Warning{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+		Err:     err,
+	})
 }
 
 // Open blocks the calling goroutine until the underlying file transfer is
@@ -194,6 +789,8 @@ func (c *Response) ETA() time.Time {
 // If an error occurred during the transfer, it will be returned.
 //
 // It is the callers responsibility to close the returned file handle.
+//
+// Transfers written to standard output or a named pipe cannot be opened.
 func (c *Response) Open() (io.ReadCloser, error) {
 	if err := c.Err(); err != nil {
 		return nil, err
@@ -202,12 +799,37 @@ func (c *Response) Open() (io.ReadCloser, error) {
 }
 
 func (c *Response) openUnsafe() (io.ReadCloser, error) {
-	if c.Request.NoStore {
+	if c.req.NoStore {
 		return io.NopCloser(bytes.NewReader(c.storeBuffer.Bytes())), nil
 	}
 	return os.Open(c.Filename)
 }
 
+// OpenFile opens the downloaded file read-only. Unlike Open, it does not block
+// until the transfer is complete. ErrNoFile is returned if the transfer is not
+// complete, failed, or did not write to a regular file because Request.NoStore
+// was enabled or the destination is a stream.
+//
+// It is the callers responsibility to close the returned file.
+func (c *Response) OpenFile() (*os.File, error) {
+	if !c.IsComplete() {
+		return nil, fmt.Errorf("%w: transfer is not complete", ErrNoFile)
+	}
+	if c.err != nil {
+		return nil, fmt.Errorf("%w: transfer failed: %v", ErrNoFile, c.err)
+	}
+	if c.req.Discard {
+		return nil, fmt.Errorf("%w: transfer was discarded", ErrNoFile)
+	}
+	if c.req.NoStore {
+		return nil, fmt.Errorf("%w: transfer was stored in memory", ErrNoFile)
+	}
+	if c.stream || c.Filename == "" {
+		return nil, fmt.Errorf("%w: transfer was written to a stream", ErrNoFile)
+	}
+	return os.Open(c.Filename)
+}
+
 // Bytes blocks the calling goroutine until the underlying file transfer is
 // completed and then reads all bytes from the completed tranafer. If
 // Request.NoStore was enabled, the bytes will be read from memory.
@@ -217,7 +839,7 @@ func (c *Response) Bytes() ([]byte, error) {
 	if err := c.Err(); err != nil {
 		return nil, err
 	}
-	if c.Request.NoStore {
+	if c.req.NoStore {
 		return c.storeBuffer.Bytes(), nil
 	}
 	f, err := c.Open()
@@ -228,11 +850,26 @@ func (c *Response) Bytes() ([]byte, error) {
 	return io.ReadAll(f)
 }
 
-func (c *Response) requestMethod() string {
-	if c == nil || c.HTTPResponse == nil || c.HTTPResponse.Request == nil {
-		return ""
+// Checksum returns the checksum of the downloaded file that was verified as
+// set by Request.SetChecksum or Request.VerifyContentMD5. It returns nil if no
+// checksum was verified, including if the transfer is not complete or failed.
+func (c *Response) Checksum() []byte {
+	if !c.IsComplete() || c.err != nil || c.req.hash == nil {
+		return nil
+	}
+	return append([]byte(nil), c.req.checksum...)
+}
+
+// readValidators records the validators of the remote file from the given HTTP
+// response, if set. Validators from previous responses are retained if the
+// given response does not include them, as may be the case for a 304.
+func (c *Response) readValidators(resp *http.Response) {
+	if lastmod := lastModified(resp); !lastmod.IsZero() {
+		c.LastModified = lastmod
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		c.ETag = etag
 	}
-	return c.HTTPResponse.Request.Method
 }
 
 func (c *Response) checksumUnsafe() ([]byte, error) {
@@ -241,11 +878,11 @@ func (c *Response) checksumUnsafe() ([]byte, error) {
 		return nil, err
 	}
 	defer f.Close()
-	t := newTransfer(c.Request.Context(), nil, c.Request.hash, f, nil)
+	t := newTransfer(c.req.Context(), nil, c.req.hash, f, nil)
 	if _, err = t.copy(); err != nil {
 		return nil, err
 	}
-	sum := c.Request.hash.Sum(nil)
+	sum := c.req.hash.Sum(nil)
 	return sum, nil
 }
 
@@ -255,3 +892,13 @@ func (c *Response) closeResponseBody() error {
 	}
 	return c.HTTPResponse.Body.Close()
 }
+
+// localOffset returns the offset in the destination file from which a resumed
+// transfer continues writing. It differs from the offset in the remote file,
+// bytesResumed, if that was computed by Request.ResumeOffsetFunc.
+func (c *Response) localOffset() int64 {
+	if c.customOffset && c.DidResume {
+		return c.fi.Size()
+	}
+	return c.bytesResumed.Load()
+}
@@ -2,7 +2,14 @@ package grab
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -101,6 +108,47 @@ func TestResponseOpen(t *testing.T) {
 	})
 }
 
+// TestResponseOpenFile ensures that Response.OpenFile only opens complete
+// downloaded files.
+func TestResponseOpenFile(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest("", url+"/.testResponseOpenFile"))
+		defer os.Remove(resp.Filename)
+		f, err := resp.OpenFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		grabtest.AssertSHA256Sum(t, grabtest.DefaultHandlerSHA256ChecksumBytes, f)
+	})
+
+	t.Run("WithNoStore", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			if _, err := mustDo(req).OpenFile(); !errors.Is(err, ErrNoFile) {
+				t.Errorf("expected error: %v, got: %v", ErrNoFile, err)
+			}
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := DefaultClient.Do(mustNewRequest(".testResponseOpenFileError", url))
+			if _, err := resp.OpenFile(); !errors.Is(err, ErrNoFile) {
+				t.Errorf("expected error: %v, got: %v", ErrNoFile, err)
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	})
+
+	t.Run("WithIncomplete", func(t *testing.T) {
+		resp := &Response{Done: make(chan struct{}), Filename: ".testResponseOpenFile"}
+		if _, err := resp.OpenFile(); !errors.Is(err, ErrNoFile) {
+			t.Errorf("expected error: %v, got: %v", ErrNoFile, err)
+		}
+	})
+}
+
 func TestResponseBytes(t *testing.T) {
 	grabtest.WithTestServer(t, func(url string) {
 		resp := mustDo(mustNewRequest("", url+"/someFilename"))
@@ -116,3 +164,626 @@ func TestResponseBytes(t *testing.T) {
 		)
 	})
 }
+
+// TestResponseCreatedFile ensures that Response.CreatedFile and
+// Response.WroteBytes distinguish downloaded files from existing ones.
+func TestResponseCreatedFile(t *testing.T) {
+	filename := ".testResponseCreatedFile"
+	dir := ".testResponseCreatedFileStore"
+	defer os.Remove(filename)
+	defer os.RemoveAll(dir)
+	size := 1024
+
+	grabtest.WithTestServer(t, func(url string) {
+		tests := []struct {
+			Name    string
+			Setup   func(req *Request)
+			Created bool
+			Wrote   int
+			Err     error
+		}{
+			{"New", nil, true, size, nil},
+			{"WithCompleteFile", nil, false, 0, nil},
+			{"WithSkipExisting", func(req *Request) { req.SkipExisting = true }, false, 0, ErrFileExists},
+			{"WithOverwrite", func(req *Request) { req.NoResume = true }, false, size, nil},
+			{"WithResume", func(req *Request) {
+				if err := os.Truncate(filename, int64(size/4)); err != nil {
+					t.Fatal(err)
+				}
+			}, false, size - size/4, nil},
+			{"WithContentAddressed", func(req *Request) {
+				req.ContentAddressed = &ContentAddress{Dir: dir}
+			}, true, size, nil},
+			{"WithContentAlreadyStored", func(req *Request) {
+				req.ContentAddressed = &ContentAddress{Dir: dir}
+			}, false, size, nil},
+			{"WithNoStore", func(req *Request) { req.NoStore = true }, false, size, nil},
+		}
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				req := mustNewRequest(filename, url)
+				if test.Setup != nil {
+					test.Setup(req)
+				}
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Fatalf("expected error: %v, got: %v", test.Err, err)
+				}
+				if resp.CreatedFile != test.Created {
+					t.Errorf("expected CreatedFile: %v, got: %v", test.Created, resp.CreatedFile)
+				}
+				if n := resp.WroteBytes(); n != int64(test.Wrote) {
+					t.Errorf("expected %d bytes written, got %d", test.Wrote, n)
+				}
+				if test.Err == nil && resp.BytesComplete() != int64(size) {
+					t.Errorf("expected %d bytes complete, got %d", size, resp.BytesComplete())
+				}
+			})
+		}
+	}, grabtest.ContentLength(size))
+}
+
+// TestResponseValidators tests that the Last-Modified and ETag headers of the
+// remote server are reported on the Response.
+func TestResponseValidators(t *testing.T) {
+	lastmod := time.Unix(123456789, 0)
+	etag := `"abc123"`
+
+	t.Run("WithHeaders", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest("", url+"/.testResponseValidators"))
+			defer os.Remove(resp.Filename)
+			if !resp.LastModified.Equal(lastmod) {
+				t.Errorf("expected Response.LastModified: %v, got: %v", lastmod, resp.LastModified)
+			}
+			if resp.ETag != etag {
+				t.Errorf("expected Response.ETag: %s, got: %s", etag, resp.ETag)
+			}
+		}, grabtest.LastModified(lastmod), grabtest.ETag(etag))
+	})
+
+	t.Run("WithoutHeaders", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest("", url+"/.testResponseValidators"))
+			defer os.Remove(resp.Filename)
+			if !resp.LastModified.IsZero() {
+				t.Errorf("expected zero Response.LastModified, got: %v", resp.LastModified)
+			}
+			if resp.ETag != "" {
+				t.Errorf("expected empty Response.ETag, got: %s", resp.ETag)
+			}
+		}, grabtest.HeaderBlacklist("Last-Modified"))
+	})
+
+	t.Run("WithNotModified", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(".testResponseValidators", url)
+			req.HTTPRequest.Header.Set("If-None-Match", etag)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != StatusCodeError(http.StatusNotModified) {
+				t.Errorf("expected error: %v, got: %v", StatusCodeError(http.StatusNotModified), err)
+			}
+			if resp.ETag != etag {
+				t.Errorf("expected Response.ETag: %s, got: %s", etag, resp.ETag)
+			}
+			if !resp.LastModified.Equal(lastmod) {
+				t.Errorf("expected Response.LastModified: %v, got: %v", lastmod, resp.LastModified)
+			}
+		},
+			grabtest.LastModified(lastmod),
+			grabtest.ETag(etag),
+			grabtest.StatusCodeStatic(http.StatusNotModified),
+		)
+	})
+}
+
+// TestResponseBytesResumed tests that Response.BytesResumed reports the offset
+// at which a transfer resumed, or zero if it had to be restarted.
+func TestResponseBytesResumed(t *testing.T) {
+	filename := ".testResponseBytesResumed"
+	defer os.Remove(filename)
+
+	size := 1024
+	partial := make([]byte, size/4)
+	for i := range partial {
+		partial[i] = byte(i)
+	}
+
+	t.Run("WithNewFile", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if n := resp.BytesResumed(); n != 0 {
+				t.Errorf("expected 0 bytes resumed, got %d", n)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithPartialFile", func(t *testing.T) {
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if n := resp.BytesResumed(); n != int64(len(partial)) {
+				t.Errorf("expected %d bytes resumed, got %d", len(partial), n)
+			}
+			if n := resp.Stats().BytesResumed; n != int64(len(partial)) {
+				t.Errorf("expected %d bytes resumed in stats, got %d", len(partial), n)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithRangeIgnored", func(t *testing.T) {
+		// the remote server advertises ranges but responds with the full file
+		if err := os.WriteFile(filename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
+			}
+			if n := resp.BytesResumed(); n != 0 {
+				t.Errorf("expected 0 bytes resumed, got %d", n)
+			}
+			if n := resp.Stats().BytesDiscarded; n != int64(len(partial)) {
+				t.Errorf("expected %d bytes discarded, got %d", len(partial), n)
+			}
+			testComplete(t, resp)
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != size {
+				t.Errorf("expected file of %d bytes, got %d", size, len(b))
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.AcceptRanges(false),
+			grabtest.Header("Accept-Ranges", "bytes"),
+		)
+	})
+}
+
+// TestResponseWarnings ensures that conditions that do not fail a transfer are
+// reported by Response.Warnings.
+func TestResponseWarnings(t *testing.T) {
+	filename := ".testResponseWarnings"
+	defer os.Remove(filename)
+
+	t.Run("WithNoWarnings", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			if w := resp.Warnings(); w != nil {
+				t.Errorf("expected no warnings, got: %v", w)
+			}
+		})
+	})
+
+	t.Run("WithRangeIgnored", func(t *testing.T) {
+		if err := os.WriteFile(filename, []byte{0, 1, 2, 3}, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp := mustDo(mustNewRequest(filename, url))
+			w := resp.Warnings()
+			if len(w) != 1 || w[0].Code != WarnRangeIgnored {
+				t.Fatalf("expected %s warning, got: %v", WarnRangeIgnored, w)
+			}
+
+			// the returned warnings are a copy
+			w[0].Code = ""
+			if resp.Warnings()[0].Code != WarnRangeIgnored {
+				t.Errorf("expected Warnings to return a copy")
+			}
+		},
+			grabtest.AcceptRanges(false),
+			grabtest.Header("Accept-Ranges", "bytes"),
+		)
+	})
+}
+
+// TestResponseSizeKnown ensures that Response.SizeKnown distinguishes the size
+// of the remote file from an unknown or expected size.
+func TestResponseSizeKnown(t *testing.T) {
+	size := int64(grabtest.DefaultHandlerContentLength)
+	tests := []struct {
+		Name          string
+		RequestSize   int64
+		ContentLength bool
+		ExpectSize    int64
+		ExpectKnown   bool
+	}{
+		{Name: "WithContentLength", ContentLength: true, ExpectSize: size, ExpectKnown: true},
+		{Name: "WithoutContentLength", ExpectSize: -1},
+		{Name: "WithRequestSize", RequestSize: size, ExpectSize: size},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			opts := []grabtest.HandlerOption{}
+			if !test.ContentLength {
+				opts = append(opts, grabtest.HeaderBlacklist("Content-Length"))
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url+"/.testResponseSizeKnown")
+				req.NoStore = true
+				req.Size = test.RequestSize
+				req.BeforeCopy = func(resp *Response) error {
+					if resp.Size() != test.ExpectSize {
+						t.Errorf("expected Size: %d, got: %d", test.ExpectSize, resp.Size())
+					}
+					if resp.SizeKnown() != test.ExpectKnown {
+						t.Errorf("expected SizeKnown: %v, got: %v", test.ExpectKnown, resp.SizeKnown())
+					}
+					return nil
+				}
+				resp := mustDo(req)
+
+				// the size is discovered once the transfer completes
+				if resp.Size() != size || !resp.SizeKnown() {
+					t.Errorf("expected known Size: %d, got: %d (known: %v)",
+						size, resp.Size(), resp.SizeKnown())
+				}
+			}, opts...)
+		})
+	}
+}
+
+// TestResponseContentType ensures that the Content-Type header of the remote
+// server is parsed.
+func TestResponseContentType(t *testing.T) {
+	tests := []struct {
+		Header    string
+		MediaType string
+		Charset   string
+	}{
+		{"Text/Plain; charset=UTF-8", "text/plain", "UTF-8"},
+		{"application/json", "application/json", ""},
+		{"/", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Header, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				mediaType, params := mustDo(req).ContentType()
+				if mediaType != test.MediaType {
+					t.Errorf("expected media type: %q, got: %q", test.MediaType, mediaType)
+				}
+				if params["charset"] != test.Charset {
+					t.Errorf("expected charset: %q, got: %q", test.Charset, params["charset"])
+				}
+			}, grabtest.Header("Content-Type", test.Header))
+		})
+	}
+}
+
+// TestResponseHeader ensures that the response headers and Cache-Control
+// directives are available without HTTPResponse.
+func TestResponseHeader(t *testing.T) {
+	t.Run("WithResponse", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := mustDo(req)
+			if v := resp.Header().Get("X-Custom"); v != "value" {
+				t.Errorf("expected header X-Custom: %q, got: %q", "value", v)
+			}
+			cc := resp.CacheControl()
+			expect := map[string]string{"no-cache": "", "max-age": "60", "private": "Set-Cookie"}
+			if len(cc) != len(expect) {
+				t.Errorf("expected directives: %v, got: %v", expect, cc)
+			}
+			for k, v := range expect {
+				if got, ok := cc[k]; !ok || got != v {
+					t.Errorf("expected directive %s=%q, got: %q (present: %v)", k, v, got, ok)
+				}
+			}
+		},
+			grabtest.Header("X-Custom", "value"),
+			grabtest.Header("Cache-Control", `No-Cache, max-age=60, private="Set-Cookie"`),
+		)
+	})
+
+	t.Run("WithoutResponse", func(t *testing.T) {
+		resp := &Response{req: &Request{}}
+		if h := resp.Header(); h == nil || len(h) != 0 {
+			t.Errorf("expected empty Header, got: %v", h)
+		}
+		if cc := resp.CacheControl(); cc != nil {
+			t.Errorf("expected no directives, got: %v", cc)
+		}
+	})
+}
+
+// TestResponseETA ensures that the ETA of a transfer is only reported when it
+// can be estimated.
+func TestResponseETA(t *testing.T) {
+	t.Run("WithUnknownSize", func(t *testing.T) {
+		resp := &Response{req: &Request{}, Done: make(chan struct{}), sizeUnsafe: -1}
+		if eta, ok := resp.ETAWithConfidence(); ok || !eta.IsZero() {
+			t.Errorf("expected unknown ETA, got: %v, %v", eta, ok)
+		}
+		if eta := resp.ETA(); !eta.IsZero() {
+			t.Errorf("expected zero ETA, got: %v", eta)
+		}
+	})
+
+	t.Run("WithNoProgress", func(t *testing.T) {
+		resp := &Response{req: &Request{}, Done: make(chan struct{}), sizeUnsafe: 1024}
+		if eta, ok := resp.ETAWithConfidence(); ok || !eta.IsZero() {
+			t.Errorf("expected unknown ETA, got: %v, %v", eta, ok)
+		}
+	})
+
+	t.Run("WithCompleteTransfer", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := mustDo(req)
+			if eta, ok := resp.ETAWithConfidence(); !ok || eta != resp.End {
+				t.Errorf("expected ETA: %v, got: %v, %v", resp.End, eta, ok)
+			}
+		})
+	})
+
+	t.Run("WithFakeClock", func(t *testing.T) {
+		// send 1000 of 5000 bytes, then wait
+		send, release := make(chan struct{}), make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "5000")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-send
+			w.Write(testContent(1000))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write(testContent(4000))
+		}))
+		defer ts.Close()
+
+		clock := grabtest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		client := NewClient()
+		client.Clock = clock
+		req := mustNewRequest("", ts.URL)
+		req.NoStore = true
+		resp := client.Do(req)
+
+		// the transfer rate is sampled from the start of the copy loop
+		clock.BlockUntilTickers(1)
+		close(send)
+		deadline := time.Now().Add(5 * time.Second)
+		for resp.BytesComplete() < 1000 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second)
+		for resp.BytesPerSecond() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if bps := resp.BytesPerSecond(); bps != 1000 {
+			t.Errorf("expected 1000 bytes per second, got: %v", bps)
+		}
+		if expect, eta := clock.Now().Add(4*time.Second), resp.ETA(); !eta.Equal(expect) {
+			t.Errorf("expected ETA: %v, got: %v", expect, eta)
+		}
+		if d := resp.Duration(); d != time.Second {
+			t.Errorf("expected duration: %v, got: %v", time.Second, d)
+		}
+
+		close(release)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Start.Equal(clock.Now().Add(-time.Second)) || !resp.End.Equal(clock.Now()) {
+			t.Errorf("expected transfer to start and end at the time of the clock, got: %v, %v", resp.Start, resp.End)
+		}
+	})
+}
+
+// TestResponseRateHistory ensures that the transfer rate of each second of the
+// copy loop is recorded, oldest first, and frozen once the transfer completes.
+func TestResponseRateHistory(t *testing.T) {
+	// send 1000 bytes, then 3000 bytes, then the remaining 1000 bytes
+	steps := []chan struct{}{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5000")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i, n := range []int{1000, 3000, 1000} {
+			<-steps[i]
+			w.Write(testContent(n))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	clock := grabtest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	client := NewClient()
+	client.Clock = clock
+	req := mustNewRequest("", ts.URL)
+	req.NoStore = true
+	resp := client.Do(req)
+	if h := resp.RateHistory(60); len(h) != 0 {
+		t.Errorf("expected no history before the first second, got: %v", h)
+	}
+
+	clock.BlockUntilTickers(1)
+	deadline := time.Now().Add(5 * time.Second)
+	for i, n := range []int64{1000, 4000} {
+		close(steps[i])
+		for resp.BytesComplete() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second)
+		for len(resp.RateHistory(60)) < i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(steps[2])
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last bytes were not sampled before the transfer completed
+	clock.Advance(time.Second)
+	if h := resp.RateHistory(60); len(h) != 2 || h[0] != 1000 || h[1] != 3000 {
+		t.Errorf("expected history: [1000 3000], got: %v", h)
+	}
+	if h := resp.RateHistory(1); len(h) != 1 || h[0] != 3000 {
+		t.Errorf("expected history: [3000], got: %v", h)
+	}
+}
+
+// TestRateHistoryWraps ensures that only the most recent samples are kept once
+// the ring buffer of a rateHistory is full.
+func TestRateHistoryWraps(t *testing.T) {
+	var h rateHistory
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= rateHistorySize+10; i++ {
+		h.sample(start.Add(time.Duration(i)*time.Second), int64(i*(i+1)/2))
+	}
+	samples := h.last(2 * rateHistorySize)
+	if len(samples) != rateHistorySize {
+		t.Fatalf("expected %d samples, got %d", rateHistorySize, len(samples))
+	}
+	if samples[0] != 11 || samples[len(samples)-1] != rateHistorySize+10 {
+		t.Errorf("expected samples from 11 to %d, got %v to %v", rateHistorySize+10, samples[0], samples[len(samples)-1])
+	}
+}
+
+// TestResponseChecksum ensures that the verified checksum of a transfer is
+// reported.
+func TestResponseChecksum(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		if sum := mustDo(req).Checksum(); sum != nil {
+			t.Errorf("expected no checksum, got: %x", sum)
+		}
+
+		req = mustNewRequest("", url)
+		req.NoStore = true
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		if sum := mustDo(req).Checksum(); !bytes.Equal(sum, grabtest.DefaultHandlerSHA256ChecksumBytes) {
+			t.Errorf("expected checksum: %x, got: %x", grabtest.DefaultHandlerSHA256ChecksumBytes, sum)
+		}
+
+		req = mustNewRequest("", url)
+		req.NoStore = true
+		req.SetChecksum(sha256.New(), []byte("bad"), false)
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != ErrBadChecksum {
+			t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+		}
+		if sum := resp.Checksum(); sum != nil {
+			t.Errorf("expected no checksum for failed transfer, got: %x", sum)
+		}
+	})
+}
+
+// TestResponsePartialPath ensures that Response.PartialPath is the path of the
+// file holding the transferred bytes while the transfer is running, and that it
+// is only kept once the transfer completes if a partial file was left.
+func TestResponsePartialPath(t *testing.T) {
+	filename := ".testResponsePartialPath"
+	dir := ".testResponsePartialPathStore"
+	defer os.Remove(filename)
+	defer os.RemoveAll(dir)
+	size := 1 << 16
+	content := testContent(size)
+
+	// serve half of the file, then stall until a value is sent to release
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(content[:size/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			w.Write(content[size/2:])
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	// running returns the PartialPath of a transfer once half of it is
+	// transferred.
+	running := func(t *testing.T, resp *Response) string {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for resp.BytesComplete() < int64(size/2) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d bytes to be transferred, got %d", size/2, resp.BytesComplete())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return resp.PartialPath()
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		resp := DefaultClient.Do(mustNewRequest(filename, ts.URL))
+		if p := running(t, resp); p != filename {
+			t.Errorf("expected partial path: %q, got: %q", filename, p)
+		}
+		release <- struct{}{}
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if p := resp.PartialPath(); p != "" {
+			t.Errorf("expected no partial path once complete, got: %q", p)
+		}
+	})
+
+	t.Run("WithCancel", func(t *testing.T) {
+		os.Remove(filename)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		resp := DefaultClient.Do(mustNewRequest(filename, ts.URL).WithContext(ctx))
+		running(t, resp)
+		cancel()
+		if err := resp.Err(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v, got: %v", context.Canceled, err)
+		}
+		if p := resp.PartialPath(); p != filename {
+			t.Errorf("expected partial path of the partial file: %q, got: %q", filename, p)
+		}
+	})
+
+	t.Run("WithContentAddressed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req := mustNewRequest("", ts.URL).WithContext(ctx)
+		req.ContentAddressed = &ContentAddress{Dir: dir}
+		resp := DefaultClient.Do(req)
+		p := running(t, resp)
+		if p == "" || filepath.Dir(p) != dir {
+			t.Errorf("expected partial path of a temporary file in %s, got: %q", dir, p)
+		}
+		if fi, err := os.Stat(p); err != nil || fi.Size() != int64(size/2) {
+			t.Errorf("expected partial file to hold %d bytes, got: %v", size/2, err)
+		}
+		cancel()
+		resp.Wait()
+		if p := resp.PartialPath(); p != "" {
+			t.Errorf("expected no partial path once the temporary file is removed, got: %q", p)
+		}
+	})
+
+	t.Run("WithNoStore", func(t *testing.T) {
+		req := mustNewRequest("", ts.URL)
+		req.NoStore = true
+		resp := DefaultClient.Do(req)
+		if p := running(t, resp); p != "" {
+			t.Errorf("expected no partial path, got: %q", p)
+		}
+		release <- struct{}{}
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package grab
+
+import (
+	"bytes"
+	"os"
+)
+
+// zeroBlock is compared to the writes of a sparseWriter to detect zeros.
+var zeroBlock [4096]byte
+
+// isZero returns true if p contains only zero bytes.
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := len(p)
+		if n > len(zeroBlock) {
+			n = len(zeroBlock)
+		}
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// sparseWriter writes to a file at increasing offsets, skipping blocks that
+// contain only zeros so that the skipped regions are left as holes on file
+// systems that support sparse files. Blocks are the size of zeroBlock and
+// aligned to the logical offset, so that zeros are skipped wherever they occur
+// in a write, not only in writes of zeros alone. The file is extended to its
+// logical size when the sparseWriter is closed, so that skipped zeros at the
+// end of the file are not lost.
+//
+// The file must not be opened with O_APPEND.
+type sparseWriter struct {
+	f *os.File
+
+	// off is the logical offset of the next write and size is the size of
+	// the file on disk, which is smaller than off if zeros were skipped at
+	// the end of the file.
+	off, size int64
+}
+
+func newSparseWriter(f *os.File, offset int64) *sparseWriter {
+	return &sparseWriter{f: f, off: offset, size: offset}
+}
+
+func (c *sparseWriter) Write(p []byte) (int, error) {
+	bs := int64(len(zeroBlock))
+	start := 0 // start of the data in p that is not yet written
+	for i := 0; i < len(p); {
+		n := int(bs - (c.off+int64(i))%bs)
+		if n > len(p)-i {
+			n = len(p) - i
+		}
+		if isZero(p[i : i+n]) {
+			if nw, err := c.writeAt(p[start:i], start); err != nil {
+				c.off += int64(start + nw)
+				return start + nw, err
+			}
+			start = i + n
+		}
+		i += n
+	}
+	nw, err := c.writeAt(p[start:], start)
+	if err != nil {
+		c.off += int64(start + nw)
+		return start + nw, err
+	}
+	c.off += int64(len(p))
+	return len(p), nil
+}
+
+// writeAt writes b at the given offset from the logical offset.
+func (c *sparseWriter) writeAt(b []byte, off int) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := c.f.WriteAt(b, c.off+int64(off))
+	if end := c.off + int64(off+n); end > c.size {
+		c.size = end
+	}
+	return n, err
+}
+
+// Truncate truncates the file to the given size and continues writing from
+// there.
+func (c *sparseWriter) Truncate(size int64) error {
+	if err := c.f.Truncate(size); err != nil {
+		return err
+	}
+	c.off, c.size = size, size
+	return nil
+}
+
+// Sync extends the file to its logical size and commits it to stable storage.
+func (c *sparseWriter) Sync() error {
+	if c.off > c.size {
+		if err := c.f.Truncate(c.off); err != nil {
+			return err
+		}
+		c.size = c.off
+	}
+	return c.f.Sync()
+}
+
+// Close extends the file to its logical size and closes it.
+func (c *sparseWriter) Close() error {
+	var err error
+	if c.off > c.size {
+		err = c.f.Truncate(c.off)
+	}
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSparseWrites ensures that a file downloaded with Request.SparseWrites has
+// the same content and length as the remote file, including zeros at the end
+// of the file, whether or not it is resumed.
+func TestSparseWrites(t *testing.T) {
+	filename := ".testSparseWrites"
+	defer os.Remove(filename)
+
+	// mostly zeros, with data in the middle
+	content := make([]byte, 1<<20)
+	copy(content[300<<10:], testContent(64<<10))
+	sum := sha256.Sum256(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	check := func(t *testing.T, resp *Response) {
+		t.Helper()
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("expected file content to match remote file, got %d bytes", len(b))
+		}
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		req := mustNewRequest(filename, ts.URL)
+		req.SparseWrites = true
+		req.BufferSize = 4096
+		req.SetChecksum(sha256.New(), sum[:], false)
+		check(t, DefaultClient.Do(req))
+	})
+
+	t.Run("WithResume", func(t *testing.T) {
+		if err := os.Truncate(filename, 200<<10); err != nil {
+			t.Fatal(err)
+		}
+		req := mustNewRequest(filename, ts.URL)
+		req.SparseWrites = true
+		req.SetChecksum(sha256.New(), sum[:], false)
+		resp := DefaultClient.Do(req)
+		check(t, resp)
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+	})
+
+	t.Run("WithRestart", func(t *testing.T) {
+		// an existing file larger than the remote file is overwritten
+		if err := os.WriteFile(filename, bytes.Repeat([]byte{1}, 2<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+		req := mustNewRequest(filename, ts.URL)
+		req.SparseWrites = true
+		req.NoResume = true
+		check(t, DefaultClient.Do(req))
+	})
+}
+
+// TestSparseWriter ensures that skipped zeros, including those at the end of
+// the file, are restored when a sparseWriter is closed.
+func TestSparseWriter(t *testing.T) {
+	f, err := os.CreateTemp("", "grab-sparse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newSparseWriter(f, 3)
+	for _, p := range [][]byte{make([]byte, 8192), []byte("def"), make([]byte, 100)} {
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := append(append(append([]byte("abc"), make([]byte, 8192)...), "def"...), make([]byte, 100)...)
+	if !bytes.Equal(b, expect) {
+		t.Errorf("expected %d bytes with skipped zeros, got %d bytes", len(expect), len(b))
+	}
+}
+
+// TestSparseWriterMixedWrites ensures that zero blocks within writes that also
+// contain data are skipped without losing any content, whatever the alignment
+// of the writes.
+func TestSparseWriterMixedWrites(t *testing.T) {
+	f, err := os.CreateTemp("", "grab-sparse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// data, 3 blocks of zeros and data, written from an unaligned offset
+	content := append(append(testContent(5000), make([]byte, 3*4096)...), testContent(100)...)
+	w := newSparseWriter(f, 0)
+	for _, p := range [][]byte{content[:10], content[10:]} {
+		if n, err := w.Write(p); err != nil || n != len(p) {
+			t.Fatalf("expected %d bytes written, got %d: %v", len(p), n, err)
+		}
+	}
+	if w.size != int64(len(content)) {
+		t.Errorf("expected %d bytes on disk, got %d", len(content), w.size)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("expected %d bytes of content, got %d bytes", len(content), len(b))
+	}
+}
@@ -0,0 +1,82 @@
+package grab
+
+import "sync"
+
+// tagIndex holds the transfers in progress of a Client whose Request has any
+// Tags, so that they can be canceled by tag. The zero value is ready to use.
+type tagIndex struct {
+	mu sync.Mutex
+	m  map[string]map[*Response]struct{}
+}
+
+// add records resp under each of the Tags of its Request.
+func (c *tagIndex) add(resp *Response) {
+	tags := resp.req.Tags
+	if len(tags) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]map[*Response]struct{})
+	}
+	for _, tag := range tags {
+		set, ok := c.m[tag]
+		if !ok {
+			set = make(map[*Response]struct{})
+			c.m[tag] = set
+		}
+		set[resp] = struct{}{}
+	}
+}
+
+// remove removes resp from each of the Tags of its Request.
+func (c *tagIndex) remove(resp *Response) {
+	tags := resp.req.Tags
+	if len(tags) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		if set, ok := c.m[tag]; ok {
+			delete(set, resp)
+			if len(set) == 0 {
+				delete(c.m, tag)
+			}
+		}
+	}
+}
+
+// get returns the transfers in progress that carry the given tag.
+func (c *tagIndex) get(tag string) []*Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set := c.m[tag]
+	resps := make([]*Response, 0, len(set))
+	for resp := range set {
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+// CancelByTag cancels every transfer in progress, including pending
+// transfers, whose Request carries the given tag in Request.Tags and returns
+// the number of transfers that were canceled. The error returned by the Err
+// method of each canceled Response wraps both context.Canceled and
+// ErrCanceledByTag.
+//
+// Unlike Response.Cancel, CancelByTag does not wait for the transfers to
+// close. It is safe to call concurrently with Do and with other transfers of
+// the Client; transfers that start after CancelByTag has returned are not
+// affected.
+func (c *Client) CancelByTag(tag string) int {
+	n := 0
+	for _, resp := range c.tags.get(tag) {
+		if resp.ctx.Err() == nil {
+			n++
+		}
+		resp.cancel(ErrCanceledByTag)
+	}
+	return n
+}
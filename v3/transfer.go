@@ -3,46 +3,149 @@ package grab
 import (
 	"context"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/3JoB/grab/v3/pkg/bps"
 )
 
+// TransferStats describes the work performed by the copy loop of a file
+// transfer. It is intended to help tune Request.BufferSize.
+type TransferStats struct {
+	// BufferSize is the size in bytes of the buffer used for the transfer.
+	BufferSize int
+
+	// Reads is the number of read calls made on the remote response body.
+	Reads int64
+
+	// Writes is the number of write calls made on the destination.
+	Writes int64
+
+	// MaxRead is the largest number of bytes returned by a single read.
+	MaxRead int64
+
+	// ReadBlocked is the total time spent blocked in reads from the remote
+	// response body. It is only measured if Client.DetailedStats is enabled.
+	ReadBlocked time.Duration
+
+	// WriteBlocked is the total time spent blocked in writes to the
+	// destination. It is only measured if Client.DetailedStats is enabled.
+	WriteBlocked time.Duration
+
+	// RateLimitWait is the total time spent waiting for Request.RateLimiter,
+	// as returned by Response.RateLimitWait.
+	RateLimitWait time.Duration
+
+	// BytesResumed is the number of bytes of an existing local file that were
+	// kept because the transfer was resumed, as returned by
+	// Response.BytesResumed.
+	BytesResumed int64
+
+	// BytesDiscarded is the number of bytes of an existing local file that were
+	// discarded because the transfer was restarted instead of resumed.
+	BytesDiscarded int64
+
+	// ReadFrom indicates that the transfer was copied by the ReadFrom method
+	// of the destination rather than the copy loop, because no rate limit,
+	// buffer size, detailed statistics or other feature that inspects each
+	// write was in use and the destination has one. Writes is not counted in
+	// this case. The response body is not a socket, so the destination still
+	// copies it through a buffer of its own.
+	ReadFrom bool
+}
+
 type transfer struct {
-	n     int64 // must be 64bit aligned on 386
+	// counters must be 64bit aligned on 386
+	n         int64
+	reads     int64
+	writes    int64
+	maxRead   int64
+	readWait  int64
+	writeWait int64
+	rateWait  int64
+
 	ctx   context.Context
+	clock bps.Clock
 	gauge bps.Gauge
 	lim   RateLimiter
 	w     io.Writer
 	r     io.Reader
 	b     []byte
+
+	// history holds the rate sampled every second, for Response.RateHistory.
+	history rateHistory
+
+	// quantum is the maximum number of bytes read at once, if lim is set.
+	quantum int
+
+	// timed specifies that the time spent blocked in each read and write call
+	// should be measured.
+	timed bool
+
+	// readFrom specifies that the data should be copied by the ReadFrom method
+	// of w, if it has one, rather than the copy loop, and copiedFrom that it
+	// was.
+	readFrom   bool
+	copiedFrom atomic.Bool
+
+	// readFailed indicates that the last call to copy failed reading from r,
+	// rather than writing to w.
+	readFailed bool
 }
 
 func newTransfer(ctx context.Context, lim RateLimiter, dst io.Writer, src io.Reader, buf []byte) *transfer {
+	if buf == nil {
+		buf = make([]byte, 32*1024)
+	}
 	return &transfer{
-		ctx:   ctx,
-		gauge: bps.NewSMA(6), // five second moving average sampling every second
-		lim:   lim,
-		w:     dst,
-		r:     src,
-		b:     buf,
+		ctx:     ctx,
+		gauge:   bps.NewSMA(6), // five second moving average sampling every second
+		lim:     lim,
+		w:       dst,
+		r:       src,
+		b:       buf,
+		quantum: len(buf),
 	}
 }
 
 // copy behaves similarly to io.CopyBuffer except that it checks for cancelation
 // of the given context.Context, reports progress in a thread-safe manner and
 // tracks the transfer rate.
+//
+// copy may be called again with a new source once it has failed, in which case
+// written includes the bytes written by previous calls.
 func (c *transfer) copy() (written int64, err error) {
+	written = atomic.LoadInt64(&c.n)
+	c.readFailed = false
+
 	// maintain a bps gauge in another goroutine
 	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
-	go bps.Watch(ctx, c.gauge, c.N, time.Second)
+	c.history.restart()
+	go bps.WatchWithClock(ctx, historyGauge{c}, c.N, time.Second, c.clock)
+
+	// close the source if the transfer is canceled so that a read blocked on a
+	// stalled connection returns promptly
+	if rc, ok := c.r.(io.Closer); ok {
+		go func() {
+			<-ctx.Done()
+			if c.ctx.Err() != nil {
+				rc.Close()
+			}
+		}()
+	}
+
+	if rf, ok := c.w.(io.ReaderFrom); ok && c.readFrom {
+		return c.copyFrom(rf, written)
+	}
 
 	// start the transfer
-	if c.b == nil {
-		c.b = make([]byte, 32*1024)
+	b := c.b
+	if c.quantum > 0 && c.quantum < len(b) {
+		b = b[:c.quantum]
 	}
+	var t time.Time
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -51,9 +154,26 @@ func (c *transfer) copy() (written int64, err error) {
 		default:
 			// keep working
 		}
-		nr, er := c.r.Read(c.b)
+		if c.timed {
+			t = time.Now()
+		}
+		nr, er := c.r.Read(b)
+		if c.timed {
+			atomic.AddInt64(&c.readWait, int64(time.Since(t)))
+		}
+		atomic.AddInt64(&c.reads, 1)
+		if int64(nr) > atomic.LoadInt64(&c.maxRead) {
+			atomic.StoreInt64(&c.maxRead, int64(nr))
+		}
 		if nr > 0 {
-			nw, ew := c.w.Write(c.b[0:nr])
+			if c.timed {
+				t = time.Now()
+			}
+			nw, ew := c.w.Write(b[0:nr])
+			if c.timed {
+				atomic.AddInt64(&c.writeWait, int64(time.Since(t)))
+			}
+			atomic.AddInt64(&c.writes, 1)
 			if nw > 0 {
 				written += int64(nw)
 				atomic.StoreInt64(&c.n, written)
@@ -68,7 +188,9 @@ func (c *transfer) copy() (written int64, err error) {
 			}
 			// wait for rate limiter
 			if c.lim != nil {
+				t = time.Now()
 				err = c.lim.WaitN(c.ctx, nr)
+				atomic.AddInt64(&c.rateWait, int64(time.Since(t)))
 				if err != nil {
 					return
 				}
@@ -77,6 +199,7 @@ func (c *transfer) copy() (written int64, err error) {
 		if er != nil {
 			if er != io.EOF {
 				err = er
+				c.readFailed = true
 			}
 			break
 		}
@@ -84,6 +207,41 @@ func (c *transfer) copy() (written int64, err error) {
 	return written, err
 }
 
+// copyFrom copies the source with the ReadFrom method of the destination,
+// counting progress as the destination reads from the source.
+func (c *transfer) copyFrom(rf io.ReaderFrom, written int64) (int64, error) {
+	c.copiedFrom.Store(true)
+	n, err := rf.ReadFrom(transferSource{c})
+	written += n
+	atomic.StoreInt64(&c.n, written)
+	if err != nil && c.ctx.Err() != nil {
+		// the source was closed because the transfer was canceled
+		err = c.ctx.Err()
+	}
+	return written, err
+}
+
+// transferSource is the source of a transfer copied by copyFrom. It counts the
+// bytes read as transferred, as they are written as soon as they are read.
+type transferSource struct {
+	t *transfer
+}
+
+func (c transferSource) Read(p []byte) (int, error) {
+	n, err := c.t.r.Read(p)
+	atomic.AddInt64(&c.t.reads, 1)
+	if int64(n) > atomic.LoadInt64(&c.t.maxRead) {
+		atomic.StoreInt64(&c.t.maxRead, int64(n))
+	}
+	if n > 0 {
+		atomic.AddInt64(&c.t.n, int64(n))
+	}
+	if err != nil && err != io.EOF {
+		c.t.readFailed = true
+	}
+	return n, err
+}
+
 // N returns the number of bytes transferred.
 func (c *transfer) N() (n int64) {
 	if c == nil {
@@ -101,3 +259,72 @@ func (c *transfer) BPS() (bps float64) {
 	}
 	return c.gauge.BPS()
 }
+
+// RateHistory returns up to the last n samples of the transfer rate.
+func (c *transfer) RateHistory(n int) []float64 {
+	if c == nil {
+		return nil
+	}
+	return c.history.last(n)
+}
+
+// Stats returns the statistics collected by the copy loop so far.
+func (c *transfer) Stats() TransferStats {
+	if c == nil {
+		return TransferStats{}
+	}
+	return TransferStats{
+		BufferSize:    len(c.b),
+		Reads:         atomic.LoadInt64(&c.reads),
+		Writes:        atomic.LoadInt64(&c.writes),
+		MaxRead:       atomic.LoadInt64(&c.maxRead),
+		ReadBlocked:   time.Duration(atomic.LoadInt64(&c.readWait)),
+		WriteBlocked:  time.Duration(atomic.LoadInt64(&c.writeWait)),
+		RateLimitWait: time.Duration(atomic.LoadInt64(&c.rateWait)),
+		ReadFrom:      c.copiedFrom.Load(),
+	}
+}
+
+// bufferPool reuses transfer buffers, keyed by their size so that requests with
+// different buffer sizes can share a pool. The zero value is ready to use.
+type bufferPool struct {
+	pools sync.Map // map[int]*sync.Pool
+
+	// aligned holds the buffers of getAligned apart from pools, so that
+	// neither is drawn in place of the other.
+	aligned sync.Map // map[int]*sync.Pool
+}
+
+// get returns a buffer of the given size, reusing a previously released buffer
+// if one is available.
+func (c *bufferPool) get(size int) []byte {
+	if b := pooledBuffer(&c.pools, size); b != nil {
+		return b
+	}
+	return make([]byte, size)
+}
+
+// put releases a buffer for reuse. The buffer must no longer be used.
+func (c *bufferPool) put(b []byte) {
+	releaseBuffer(&c.pools, b)
+}
+
+// pooledBuffer returns a buffer of the given size from the pools of m, or nil
+// if none is available.
+func pooledBuffer(m *sync.Map, size int) []byte {
+	if p, ok := m.Load(size); ok {
+		if b, ok := p.(*sync.Pool).Get().(*[]byte); ok {
+			return *b
+		}
+	}
+	return nil
+}
+
+// releaseBuffer puts b in the pool of its size in m.
+func releaseBuffer(m *sync.Map, b []byte) {
+	p, ok := m.Load(len(b))
+	if !ok {
+		p, _ = m.LoadOrStore(len(b), new(sync.Pool))
+	}
+	p.(*sync.Pool).Put(&b)
+}
@@ -0,0 +1,378 @@
+package grab
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+// TestTransferStats ensures that the copy loop statistics reported by
+// Response.Stats are consistent with the completed transfer.
+func TestTransferStats(t *testing.T) {
+	filename := ".testTransferStats"
+	defer os.Remove(filename)
+
+	size := 1 << 16
+	bufferSize := 1024
+
+	t.Run("Default", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.BufferSize = bufferSize
+			resp := mustDo(req)
+			stats := resp.Stats()
+			if stats.BufferSize != bufferSize {
+				t.Errorf("expected buffer size: %d, got: %d", bufferSize, stats.BufferSize)
+			}
+			if min := int64(size / bufferSize); stats.Reads < min {
+				t.Errorf("expected at least %d reads, got: %d", min, stats.Reads)
+			}
+			if stats.Writes < 1 || stats.Writes > stats.Reads {
+				t.Errorf("expected between 1 and %d writes, got: %d", stats.Reads, stats.Writes)
+			}
+			if stats.MaxRead < 1 || stats.MaxRead > int64(bufferSize) {
+				t.Errorf("expected largest read between 1 and %d bytes, got: %d", bufferSize, stats.MaxRead)
+			}
+			if stats.ReadBlocked != 0 || stats.WriteBlocked != 0 {
+				t.Errorf("expected no blocked time without Client.DetailedStats, got: %v, %v", stats.ReadBlocked, stats.WriteBlocked)
+			}
+			if stats.BytesDiscarded != 0 {
+				t.Errorf("expected no discarded bytes, got: %d", stats.BytesDiscarded)
+			}
+			if stats.RateLimitWait != 0 {
+				t.Errorf("expected no rate limit wait without a RateLimiter, got: %v", stats.RateLimitWait)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithRestart", func(t *testing.T) {
+		// download over the existing file without resuming
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.NoResume = true
+			resp := mustDo(req)
+			if v := resp.Stats().BytesDiscarded; v != int64(size) {
+				t.Errorf("expected %d discarded bytes, got: %d", size, v)
+			}
+		}, grabtest.ContentLength(size/2))
+	})
+
+	t.Run("WithDetailedStats", func(t *testing.T) {
+		client := NewClient()
+		client.DetailedStats = true
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/.testTransferStatsDetailed")
+			resp := client.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(resp.Filename)
+			if stats := resp.Stats(); stats.ReadBlocked <= 0 {
+				t.Errorf("expected blocked read time to be measured, got: %v", stats.ReadBlocked)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithReadFrom", func(t *testing.T) {
+		// the default buffer size and no per-write features use the
+		// destination's ReadFrom method
+		client := NewClient()
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/.testTransferStatsReadFrom")
+			resp := client.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(resp.Filename)
+			testComplete(t, resp)
+			stats := resp.Stats()
+			if !stats.ReadFrom {
+				t.Errorf("expected transfer to be copied with ReadFrom")
+			}
+			if stats.Reads < 1 || stats.Writes != 0 {
+				t.Errorf("expected reads and no counted writes, got %d reads and %d writes", stats.Reads, stats.Writes)
+			}
+			if n := client.Usage().BytesWritten; n != int64(size) {
+				t.Errorf("expected %d bytes written in usage, got: %d", size, n)
+			}
+
+			// a rate limiter needs the copy loop
+			req = mustNewRequest("", url+"/.testTransferStatsReadFrom")
+			req.NoResume = true
+			req.RateLimiter = NewLimiter(1 << 30)
+			resp = client.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Stats().ReadFrom {
+				t.Errorf("expected rate limited transfer to use the copy loop")
+			}
+
+			// a discarded transfer that is hashed as it is written has no
+			// destination with a ReadFrom method
+			req = mustNewRequest("", url+"/.testTransferStatsReadFrom")
+			req.Discard = true
+			sum := sha256.Sum256(testContent(size))
+			req.SetChecksum(sha256.New(), sum[:], false)
+			resp = client.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if stats := resp.Stats(); stats.ReadFrom || stats.Writes < 1 {
+				t.Errorf("expected hashed transfer to use the copy loop, got ReadFrom: %v and %d writes", stats.ReadFrom, stats.Writes)
+			}
+		}, grabtest.ContentLength(size))
+	})
+}
+
+// TestMaxBufferSize ensures that Request.MaxBufferSize caps the buffer size
+// reported by Response.CurrentBufferSize, whether it is given or the default.
+func TestMaxBufferSize(t *testing.T) {
+	tests := []struct {
+		Name       string
+		BufferSize int
+		Max        int
+		Expect     int
+	}{
+		{Name: "WithDefault", Expect: 32 * 1024},
+		{Name: "WithCappedDefault", Max: 4096, Expect: 4096},
+		{Name: "WithCappedBufferSize", BufferSize: 8192, Max: 2048, Expect: 2048},
+		{Name: "WithSmallerBufferSize", BufferSize: 1024, Max: 2048, Expect: 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				req.BufferSize = test.BufferSize
+				req.MaxBufferSize = test.Max
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if v := resp.CurrentBufferSize(); v != test.Expect {
+					t.Errorf("expected buffer size: %d, got: %d", test.Expect, v)
+				}
+			}, grabtest.ContentLength(1<<16))
+		})
+	}
+}
+
+// TestBufferPool ensures that buffers are only reused for transfers with the
+// same buffer size.
+func TestBufferPool(t *testing.T) {
+	var pool bufferPool
+	for _, size := range []int{1024, 4096} {
+		b := pool.get(size)
+		if len(b) != size {
+			t.Fatalf("expected buffer size: %d, got: %d", size, len(b))
+		}
+		pool.put(b)
+	}
+	for _, size := range []int{1024, 4096, 8192} {
+		if b := pool.get(size); len(b) != size {
+			t.Errorf("expected buffer size: %d, got: %d", size, len(b))
+		}
+	}
+}
+
+// BenchmarkBufferSize compares the copy loop behavior of small and large
+// transfer buffers.
+func BenchmarkBufferSize(b *testing.B) {
+	size := 16 << 20
+	client := NewClient()
+	client.DetailedStats = true
+	for _, bufferSize := range []int{32 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize>>10), func(b *testing.B) {
+			grabtest.WithTestServer(b, func(url string) {
+				filename := fmt.Sprintf(".benchBufferSize%d", bufferSize)
+				defer os.Remove(filename)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				var stats TransferStats
+				for i := 0; i < b.N; i++ {
+					req := mustNewRequest(filename, url)
+					req.NoResume = true
+					req.BufferSize = bufferSize
+					resp := client.Do(req)
+					if err := resp.Err(); err != nil {
+						b.Fatal(err)
+					}
+					stats = resp.Stats()
+				}
+				b.ReportMetric(float64(stats.Reads), "reads/op")
+				b.ReportMetric(float64(stats.Writes), "writes/op")
+				b.ReportMetric(float64(stats.MaxRead), "maxread-bytes")
+				b.ReportMetric(float64(stats.ReadBlocked.Microseconds()), "read-blocked-µs")
+				b.ReportMetric(float64(stats.WriteBlocked.Microseconds()), "write-blocked-µs")
+			}, grabtest.ContentLength(size))
+		})
+	}
+}
+
+// zeroReader is an io.Reader that fills every read with zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// BenchmarkTransferHot measures the throughput of the copy loop from memory to
+// a null writer with a small buffer, so that the cost of updating the progress
+// counters dominates. The Polled case reads the progress from another
+// goroutine as fast as possible, to measure any contention with the copy
+// loop.
+func BenchmarkTransferHot(b *testing.B) {
+	size := int64(64 << 20)
+	for _, polled := range []bool{false, true} {
+		name := "Idle"
+		if polled {
+			name = "Polled"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				t := newTransfer(
+					context.Background(),
+					nil,
+					io.Discard,
+					io.LimitReader(zeroReader{}, size),
+					make([]byte, 4096))
+				done := make(chan struct{})
+				if polled {
+					go func() {
+						for {
+							select {
+							case <-done:
+								return
+							default:
+								t.N()
+								t.BPS()
+								t.Stats()
+							}
+						}
+					}()
+				}
+				if _, err := t.copy(); err != nil {
+					b.Fatal(err)
+				}
+				close(done)
+			}
+		})
+	}
+}
+
+// BenchmarkBufferPool measures allocations of batches of small transfers using
+// a shared Client, which reuses transfer buffers, and a new Client per transfer,
+// which must allocate a buffer for every transfer. Both use four workers and
+// share a http.Client.
+func BenchmarkBufferPool(b *testing.B) {
+	tests := 32
+	workers := 4
+	b.Run("SharedClient", func(b *testing.B) {
+		grabtest.WithTestServer(b, func(url string) {
+			client := NewClient()
+			reqs := make([]*Request, tests)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range reqs {
+					reqs[j] = mustNewRequest("", url)
+					reqs[j].NoStore = true
+				}
+				for resp := range client.DoBatch(workers, reqs...) {
+					if err := resp.Err(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}, grabtest.ContentLength(1024))
+	})
+	b.Run("ClientPerTransfer", func(b *testing.B) {
+		grabtest.WithTestServer(b, func(url string) {
+			httpClient := NewClient().HTTPClient
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				reqch := make(chan *Request, tests)
+				for j := 0; j < tests; j++ {
+					req := mustNewRequest("", url)
+					req.NoStore = true
+					reqch <- req
+				}
+				close(reqch)
+				for j := 0; j < workers; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for req := range reqch {
+							client := &Client{HTTPClient: httpClient}
+							if err := client.Do(req).Err(); err != nil {
+								b.Error(err)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		}, grabtest.ContentLength(1024))
+	})
+}
+
+// BenchmarkSmallFiles measures batches of 10 KB files downloaded into a
+// directory by four workers, with and without
+// BatchOptions.SmallFileOptimization, and reports the number of HTTP requests
+// sent per batch.
+func BenchmarkSmallFiles(b *testing.B) {
+	tests := 64
+	for _, optimize := range []bool{false, true} {
+		name := "Default"
+		if optimize {
+			name = "WithSmallFileOptimization"
+		}
+		b.Run(name, func(b *testing.B) {
+			var requests int64
+			count := grabtest.StatusCode(func(r *http.Request) int {
+				atomic.AddInt64(&requests, 1)
+				return http.StatusOK
+			})
+			grabtest.WithTestServer(b, func(url string) {
+				dir := b.TempDir()
+				opts := BatchOptions{Workers: 4, SmallFileOptimization: optimize}
+				reqs := make([]*Request, tests)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					if err := os.RemoveAll(dir); err != nil {
+						b.Fatal(err)
+					}
+					if err := os.Mkdir(dir, 0777); err != nil {
+						b.Fatal(err)
+					}
+					for j := range reqs {
+						reqs[j] = mustNewRequest(dir, fmt.Sprintf("%s/file_%d", url, j))
+					}
+					b.StartTimer()
+					for resp := range DefaultClient.DoBatchWithOptions(opts, reqs...) {
+						if err := resp.Err(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.ReportMetric(float64(atomic.LoadInt64(&requests))/float64(b.N), "requests/op")
+			}, grabtest.ContentLength(10<<10), count)
+		})
+	}
+}
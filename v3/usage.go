@@ -0,0 +1,234 @@
+package grab
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Usage describes the bandwidth used by the transfers of a Client.
+type Usage struct {
+	// BytesReceived is the number of bytes read from response bodies, before
+	// any decompression by grab but after any transparent decompression by
+	// http.Transport.
+	BytesReceived int64
+
+	// BytesWritten is the number of bytes written to the destinations of
+	// transfers.
+	BytesWritten int64
+
+	// Transfers is the number of completed transfers, successful or
+	// otherwise.
+	Transfers int64
+
+	// Failures is the number of transfers that completed with an error.
+	Failures int64
+
+	// ProbeCacheHits and ProbeCacheMisses are the number of HEAD requests that
+	// were and were not avoided by Client.ProbeCacheTTL.
+	ProbeCacheHits   int64
+	ProbeCacheMisses int64
+
+	// Connections is the number of connections obtained by HTTP requests, of
+	// which ReusedConnections were previously used by another request.
+	Connections       int64
+	ReusedConnections int64
+}
+
+// ReuseRatio returns the fraction of Connections that were reused, or zero if
+// no connections were obtained.
+func (u Usage) ReuseRatio() float64 {
+	if u.Connections == 0 {
+		return 0
+	}
+	return float64(u.ReusedConnections) / float64(u.Connections)
+}
+
+// UsageReport describes the cumulative bandwidth used by the transfers of a
+// Client, as returned by Client.Usage.
+type UsageReport struct {
+	// Usage is the total for all transfers.
+	Usage
+
+	// ByHost is the usage of the transfers of each request host, as in
+	// URL.Host.
+	ByHost map[string]Usage
+}
+
+// usageCounters counts the bandwidth used by a set of transfers.
+type usageCounters struct {
+	received  atomic.Int64
+	written   atomic.Int64
+	transfers atomic.Int64
+	failures  atomic.Int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	conns     atomic.Int64
+	reused    atomic.Int64
+}
+
+func (c *usageCounters) load() Usage {
+	return Usage{
+		BytesReceived:     c.received.Load(),
+		BytesWritten:      c.written.Load(),
+		Transfers:         c.transfers.Load(),
+		Failures:          c.failures.Load(),
+		ProbeCacheHits:    c.hits.Load(),
+		ProbeCacheMisses:  c.misses.Load(),
+		Connections:       c.conns.Load(),
+		ReusedConnections: c.reused.Load(),
+	}
+}
+
+func (c *usageCounters) reset() {
+	c.received.Store(0)
+	c.written.Store(0)
+	c.transfers.Store(0)
+	c.failures.Store(0)
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.conns.Store(0)
+	c.reused.Store(0)
+}
+
+// usage counts the bandwidth used by all transfers of a Client, in total and
+// for each request host. The counters of a host are never removed, so that
+// transfers in progress can keep a reference to them.
+type usage struct {
+	total usageCounters
+	hosts sync.Map // map[string]*usageCounters
+}
+
+func (u *usage) host(host string) *usageCounters {
+	if v, ok := u.hosts.Load(host); ok {
+		return v.(*usageCounters)
+	}
+	v, _ := u.hosts.LoadOrStore(host, new(usageCounters))
+	return v.(*usageCounters)
+}
+
+func (u *usage) report() UsageReport {
+	report := UsageReport{
+		Usage:  u.total.load(),
+		ByHost: make(map[string]Usage),
+	}
+	u.hosts.Range(func(k, v any) bool {
+		if usage := v.(*usageCounters).load(); usage != (Usage{}) {
+			report.ByHost[k.(string)] = usage
+		}
+		return true
+	})
+	return report
+}
+
+func (u *usage) reset() {
+	u.total.reset()
+	u.hosts.Range(func(_, v any) bool {
+		v.(*usageCounters).reset()
+		return true
+	})
+}
+
+// done counts a completed transfer.
+func (u *usage) done(host string, err error) {
+	h := u.host(host)
+	u.total.transfers.Add(1)
+	h.transfers.Add(1)
+	if err != nil {
+		u.total.failures.Add(1)
+		h.failures.Add(1)
+	}
+}
+
+// probe counts a lookup in the probe cache.
+func (u *usage) probe(host string, hit bool) {
+	h := u.host(host)
+	if hit {
+		u.total.hits.Add(1)
+		h.hits.Add(1)
+	} else {
+		u.total.misses.Add(1)
+		h.misses.Add(1)
+	}
+}
+
+// conn counts a connection obtained by an HTTP request.
+func (u *usage) conn(host string, reused bool) {
+	h := u.host(host)
+	u.total.conns.Add(1)
+	h.conns.Add(1)
+	if reused {
+		u.total.reused.Add(1)
+		h.reused.Add(1)
+	}
+}
+
+// body returns a response body that counts the bytes read from it.
+func (u *usage) body(body io.ReadCloser, host string) io.ReadCloser {
+	return &usageBody{ReadCloser: body, total: &u.total, host: u.host(host)}
+}
+
+// writer returns an io.Writer that counts the bytes written to it. It has a
+// ReadFrom method only if w has one.
+func (u *usage) writer(w io.Writer, host string) io.Writer {
+	uw := &usageWriter{w: w, total: &u.total, host: u.host(host)}
+	if _, ok := w.(io.ReaderFrom); ok {
+		return usageReaderFrom{uw}
+	}
+	return uw
+}
+
+type usageBody struct {
+	io.ReadCloser
+	total, host *usageCounters
+}
+
+func (c *usageBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.total.received.Add(int64(n))
+		c.host.received.Add(int64(n))
+	}
+	return n, err
+}
+
+type usageWriter struct {
+	w           io.Writer
+	total, host *usageCounters
+}
+
+func (c *usageWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.add(n)
+	return n, err
+}
+
+func (c *usageWriter) add(n int) {
+	if n > 0 {
+		c.total.written.Add(int64(n))
+		c.host.written.Add(int64(n))
+	}
+}
+
+// usageReaderFrom is a usageWriter whose underlying writer has a ReadFrom
+// method.
+type usageReaderFrom struct {
+	*usageWriter
+}
+
+// ReadFrom copies r with the ReadFrom method of the underlying writer,
+// counting the bytes read from r as written.
+func (c usageReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return c.w.(io.ReaderFrom).ReadFrom(usageSource{r: r, w: c.usageWriter})
+}
+
+type usageSource struct {
+	r io.Reader
+	w *usageWriter
+}
+
+func (c usageSource) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.w.add(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package grab
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+func TestUsage(t *testing.T) {
+	size := int64(grabtest.DefaultHandlerContentLength)
+	client := NewClient()
+	grabtest.WithTestServer(t, func(okURL string) {
+		grabtest.WithTestServer(t, func(failURL string) {
+			var resps []*Response
+			for _, u := range []string{okURL + "/a", okURL + "/b", failURL + "/c"} {
+				req := mustNewRequest("", u)
+				req.NoStore = true
+				resp := client.Do(req)
+				resp.Wait()
+				resps = append(resps, resp)
+			}
+
+			// the second request to okURL reuses the idle connection of the
+			// first
+			for i, reused := range []bool{false, true, false} {
+				conns := resps[i].Connections()
+				if len(conns) != 1 || conns[0].Reused != reused || conns[0].WasIdle != reused || conns[0].Method != "GET" {
+					t.Errorf("expected one GET connection with Reused: %v, got: %+v", reused, conns)
+				}
+			}
+
+			okHost := mustParseURL(t, okURL).Host
+			failHost := mustParseURL(t, failURL).Host
+			report := client.Usage()
+			expect := Usage{BytesReceived: 2 * size, BytesWritten: 2 * size, Transfers: 3, Failures: 1, Connections: 3, ReusedConnections: 1}
+			if report.Usage != expect {
+				t.Errorf("expected total usage: %+v, got: %+v", expect, report.Usage)
+			}
+			expect = Usage{BytesReceived: 2 * size, BytesWritten: 2 * size, Transfers: 2, Connections: 2, ReusedConnections: 1}
+			if u := report.ByHost[okHost]; u != expect {
+				t.Errorf("expected usage of %s: %+v, got: %+v", okHost, expect, u)
+			}
+			expect = Usage{Transfers: 1, Failures: 1, Connections: 1}
+			if u := report.ByHost[failHost]; u != expect {
+				t.Errorf("expected usage of %s: %+v, got: %+v", failHost, expect, u)
+			}
+			if r := report.ByHost[okHost].ReuseRatio(); r != 0.5 {
+				t.Errorf("expected reuse ratio of %s: 0.5, got: %v", okHost, r)
+			}
+			if _, err := json.Marshal(report); err != nil {
+				t.Errorf("error marshaling report: %v", err)
+			}
+
+			// the report is a copy
+			delete(report.ByHost, okHost)
+			if _, ok := client.Usage().ByHost[okHost]; !ok {
+				t.Errorf("expected Usage to return a copy")
+			}
+
+			client.ResetUsage()
+			report = client.Usage()
+			if report.Usage != (Usage{}) || len(report.ByHost) != 0 {
+				t.Errorf("expected no usage after reset, got: %+v", report)
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	})
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
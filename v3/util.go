@@ -1,33 +1,209 @@
 package grab
 
 import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"html"
 	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// setLastModified sets the last modified timestamp of a local file according to
-// the Last-Modified header returned by a remote server.
-func setLastModified(resp *http.Response, filename string) error {
+// setRemoteTime sets the modification time of the destination file of the
+// given Response to Response.LastModified, unless Request.IgnoreRemoteTime is
+// set or the remote server did not report a timestamp.
+func setRemoteTime(resp *Response) error {
+	req := resp.req
+	if req.NoStore || resp.stream || req.IgnoreRemoteTime || resp.LastModified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(resp.Filename, resp.LastModified, resp.LastModified)
+}
+
+// rangesUnsupported returns true if the remote server explicitly advertised
+// that it does not support ranged requests with the 'Accept-Ranges: none'
+// header.
+func rangesUnsupported(resp *http.Response) bool {
+	return strings.EqualFold(strings.TrimSpace(resp.Header.Get("Accept-Ranges")), "none")
+}
+
+// contentType returns the media type and parameters in the Content-Type header
+// returned by a remote server. An empty media type is returned if the header is
+// missing or invalid.
+func contentType(resp *http.Response) (string, map[string]string) {
+	v := resp.Header.Get("Content-Type")
+	if v == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// limitCrossHostRedirects returns a CheckRedirect function for an http.Client
+// that fails with ErrCrossHostRedirect once a request has been redirected to a
+// different host more than max times, after applying the given CheckRedirect
+// function, or the default policy of http.Client if it is nil.
+func limitCrossHostRedirects(check func(*http.Request, []*http.Request) error, max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if check != nil {
+			if err := check(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		n := 0
+		for i, prev := range via {
+			next := req.URL
+			if i+1 < len(via) {
+				next = via[i+1].URL
+			}
+			if !strings.EqualFold(prev.URL.Host, next.Host) {
+				n++
+			}
+		}
+		if n > max {
+			return fmt.Errorf("%w: %s", ErrCrossHostRedirect, req.URL.Host)
+		}
+		return nil
+	}
+}
+
+// cacheControl parses the directives of the Cache-Control headers in h.
+func cacheControl(h http.Header) map[string]string {
+	var directives map[string]string
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if s, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+				value = s
+			}
+			if directives == nil {
+				directives = make(map[string]string)
+			}
+			directives[name] = value
+		}
+	}
+	return directives
+}
+
+// proxyInterference returns a description of each sign that the response to
+// the GET request of the given transfer was altered by a proxy, such as
+// headers added by a proxy or headers that disagree with the response to the
+// HEAD request.
+func proxyInterference(resp *Response) []string {
+	var signs []string
+	get := resp.HTTPResponse
+	for _, key := range []string{"Via", "X-Cache"} {
+		if v := get.Header.Get(key); v != "" {
+			signs = append(signs, fmt.Sprintf("response has proxy header %s: %s", key, v))
+		}
+	}
+	head := resp.probeResponse
+	if head == nil || head.StatusCode/100 != 2 || get.StatusCode/100 != 2 {
+		return signs
+	}
+	size := get.ContentLength
+	if get.StatusCode == http.StatusPartialContent {
+		size = contentRangeSize(get)
+	}
+	if head.ContentLength >= 0 && size >= 0 && head.ContentLength != size &&
+		get.Header.Get("Content-Encoding") == "" && !get.Uncompressed {
+		signs = append(signs, fmt.Sprintf(
+			"size of %d bytes differs from the %d bytes of the HEAD response",
+			size, head.ContentLength))
+	}
+	if h, g := head.Header.Get("ETag"), get.Header.Get("ETag"); h != "" && g != "" && h != g {
+		signs = append(signs, fmt.Sprintf("ETag %s differs from the ETag %s of the HEAD response", g, h))
+	}
+	if head.Header.Get("Accept-Ranges") == "bytes" && get.StatusCode == http.StatusOK &&
+		get.Header.Get("Accept-Ranges") != "bytes" {
+		signs = append(signs, "Accept-Ranges header of the HEAD response is missing")
+	}
+	return signs
+}
+
+// lastModified returns the timestamp in the Last-Modified header returned by a
+// remote server. A zero time is returned if the header is missing or invalid.
+func lastModified(resp *http.Response) time.Time {
 	// https://tools.ietf.org/html/rfc7232#section-2.2
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Last-Modified
 	header := resp.Header.Get("Last-Modified")
 	if header == "" {
-		return nil
+		return time.Time{}
 	}
-	lastmod, err := time.Parse(http.TimeFormat, header)
+	lastmod, err := http.ParseTime(header)
 	if err != nil {
+		return time.Time{}
+	}
+	return lastmod
+}
+
+// contentMD5 returns the MD5 checksum of the full content of a remote file
+// according to the Content-MD5 header returned by a remote server. Nil is
+// returned if the header is missing, invalid or only describes part of the
+// content.
+func contentMD5(resp *http.Response) []byte {
+	// https://tools.ietf.org/html/rfc1864
+	if resp.StatusCode != http.StatusOK || resp.Uncompressed {
+		return nil
+	}
+	header := resp.Header.Get("Content-MD5")
+	if header == "" {
+		return nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(sum) != md5.Size {
 		return nil
 	}
-	return os.Chtimes(filename, lastmod, lastmod)
+	return sum
 }
 
 // mkdirp creates all missing parent directories for the destination file path.
+// casTempName returns a unique path for the temporary file of a transfer to
+// the content-addressed store in dir.
+func casTempName(dir string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return filepath.Join(dir, ".grab-"+hex.EncodeToString(b)+".tmp")
+}
+
+// casHash returns a new hash for the given content-addressed store.
+func casHash(cas *ContentAddress) hash.Hash {
+	if cas.Hash != nil {
+		return cas.Hash()
+	}
+	return sha256.New()
+}
+
+// casLayout is the default ContentAddress.Layout.
+func casLayout(sum []byte) string {
+	s := hex.EncodeToString(sum)
+	return filepath.Join(s[:2], s[2:])
+}
+
 func mkdirp(path string) error {
 	dir := filepath.Dir(path)
 	if fi, err := os.Stat(dir); err != nil {
@@ -57,7 +233,12 @@ func guessFilename(resp *http.Response) (string, error) {
 		}
 	}
 
-	// sanitize
+	return sanitizeFilename(filename)
+}
+
+// sanitizeFilename returns the base name of the given slash-separated path. If
+// the path does not name a file, ErrNoFilename is returned.
+func sanitizeFilename(filename string) (string, error) {
 	if filename == "" || strings.HasSuffix(filename, "/") || strings.Contains(filename, "\x00") {
 		return "", ErrNoFilename
 	}
@@ -66,6 +247,189 @@ func guessFilename(resp *http.Response) (string, error) {
 	if filename == "" || filename == "." || filename == "/" {
 		return "", ErrNoFilename
 	}
+	if filename = sanitizePlatformFilename(filename); filename == "" {
+		return "", ErrNoFilename
+	}
 
 	return filename, nil
 }
+
+// sanitizePath sanitizes the final element of the given local file path. If the
+// path does not name a file, ErrNoFilename is returned.
+func sanitizePath(name string) (string, error) {
+	dir, file := filepath.Split(name)
+	file, err := sanitizeFilename(filepath.ToSlash(file))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, file), nil
+}
+
+// isStream returns true if the given local file is a named pipe or a device,
+// which can only be written sequentially.
+func isStream(fi os.FileInfo) bool {
+	return fi.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) != 0
+}
+
+// checkRequiredHeaders returns ErrBadHeader if the given response is missing any
+// of the required headers or has a different value for any of them. An empty
+// required value accepts any value.
+func checkRequiredHeaders(required map[string]string, resp *http.Response) error {
+	keys := make([]string, 0, len(required))
+	for key := range required {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // report errors deterministically
+	for _, key := range keys {
+		values, ok := resp.Header[http.CanonicalHeaderKey(key)]
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrBadHeader, key)
+		}
+		want := required[key]
+		if want == "" {
+			continue
+		}
+		if got := strings.Join(values, ", "); got != want {
+			return fmt.Errorf("%w: %s is %q, expected %q", ErrBadHeader, key, got, want)
+		}
+	}
+	return nil
+}
+
+// setPreconditions sets the If-Match and If-Unmodified-Since headers of the
+// given request using the validators of a previous response, so that the remote
+// server rejects the request if the remote file has changed since. Weak entity
+// tags are ignored, as If-Match requires a strong comparison. Headers that are
+// already set are not modified.
+func setPreconditions(req *http.Request, etag string, lastModified time.Time) {
+	if etag != "" && !strings.HasPrefix(etag, "W/") && req.Header.Get("If-Match") == "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if !lastModified.IsZero() && req.Header.Get("If-Unmodified-Since") == "" {
+		req.Header.Set("If-Unmodified-Since", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// maxRetryAfter is the longest Retry-After delay that is waited for, so that a
+// remote server cannot stall a transfer indefinitely.
+const maxRetryAfter = 5 * time.Minute
+
+// parseRetryAfter returns the delay given by a Retry-After header, in seconds or
+// as an HTTP date relative to now, or zero if it is missing or invalid. The
+// delay is capped to maxRetryAfter.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		if secs > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d <= 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// contentRangeSize returns the complete length of the remote file from the
+// Content-Range header of a partial content response, or -1 if it is unknown.
+func contentRangeSize(resp *http.Response) int64 {
+	v := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(v, '/')
+	if !strings.HasPrefix(v, "bytes ") || i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(v[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// contentRangeStart returns the offset of the first byte of a partial content
+// response from its Content-Range header, or -1 if it is unknown.
+func contentRangeStart(resp *http.Response) int64 {
+	v, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	i := strings.IndexByte(v, '-')
+	if !ok || i < 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(v[:i], 10, 64)
+	if err != nil || start < 0 {
+		return -1
+	}
+	return start
+}
+
+// maxMetaRefreshPageSize is the maximum number of bytes of an HTML page that
+// are searched for a meta refresh.
+const maxMetaRefreshPageSize = 64 << 10
+
+var (
+	metaRefreshTag     = regexp.MustCompile(`(?is)<meta\s[^>]*http-equiv\s*=\s*["']?refresh\b[^>]*>`)
+	metaRefreshContent = regexp.MustCompile(`(?is)\bcontent\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// isHTML returns true if the given response has an HTML media type.
+func isHTML(resp *http.Response) bool {
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediatype == "text/html" || mediatype == "application/xhtml+xml")
+}
+
+// metaRefreshURL returns the URL that the given HTML page refreshes to with a
+// <meta http-equiv="refresh"> tag, exactly as it appears in the page. An empty
+// string is returned if the page does not refresh to another URL.
+func metaRefreshURL(page []byte) string {
+	tag := metaRefreshTag.Find(page)
+	if tag == nil {
+		return ""
+	}
+	m := metaRefreshContent.FindSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	content := html.UnescapeString(string(m[1]) + string(m[2]) + string(m[3]))
+
+	// content is a delay in seconds, optionally followed by the URL, as in
+	// "5; url=https://example.com/file"
+	_, target, ok := strings.Cut(content, ";")
+	if !ok {
+		_, target, ok = strings.Cut(content, ",")
+	}
+	if !ok {
+		return ""
+	}
+	target = strings.TrimSpace(target)
+	if len(target) > 3 && strings.EqualFold(target[:3], "url") {
+		if v := strings.TrimSpace(target[3:]); strings.HasPrefix(v, "=") {
+			target = strings.TrimSpace(v[1:])
+		}
+	}
+	return strings.Trim(target, `"'`)
+}
+
+// contentRangeEnd returns the offset of the last byte of a partial content
+// response from its Content-Range header, or -1 if it is unknown.
+func contentRangeEnd(resp *http.Response) int64 {
+	v, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	i, j := strings.IndexByte(v, '-'), strings.IndexByte(v, '/')
+	if !ok || i < 0 || j < i {
+		return -1
+	}
+	end, err := strconv.ParseInt(v[i+1:j], 10, 64)
+	if err != nil || end < 0 {
+		return -1
+	}
+	return end
+}
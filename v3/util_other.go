@@ -0,0 +1,15 @@
+//go:build !windows
+
+package grab
+
+// longPath returns the given local file path unchanged, as only Windows limits
+// the length of paths.
+func longPath(name string) string {
+	return name
+}
+
+// sanitizePlatformFilename returns the given file name unchanged, as only
+// Windows reserves file names beyond those rejected by sanitizeFilename.
+func sanitizePlatformFilename(filename string) string {
+	return filename
+}
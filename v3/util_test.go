@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestURLFilenames(t *testing.T) {
@@ -165,3 +166,67 @@ func TestHeaderWithMissingDirective(t *testing.T) {
 		}
 	})
 }
+
+func TestContentRangeSize(t *testing.T) {
+	testCases := []struct {
+		Header string
+		Expect int64
+	}{
+		{"bytes 0-0/1024", 1024},
+		{"bytes 512-1023/1024", 1024},
+		{"bytes 0-0/*", -1},
+		{"bytes */1024", 1024},
+		{"items 0-0/1024", -1},
+		{"", -1},
+	}
+	for _, tc := range testCases {
+		resp := &http.Response{Header: make(http.Header)}
+		resp.Header.Set("Content-Range", tc.Header)
+		if actual := contentRangeSize(resp); actual != tc.Expect {
+			t.Errorf("expected size for %q: %d, got: %d", tc.Header, tc.Expect, actual)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Header string
+		Expect time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-1", 0},
+		{"soon", 0},
+		{"", 0},
+		{"86400", maxRetryAfter},
+		{"9223372036854775807", maxRetryAfter},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(time.Hour).Format(http.TimeFormat), maxRetryAfter},
+	}
+	for _, tc := range testCases {
+		if actual := parseRetryAfter(tc.Header, now); actual != tc.Expect {
+			t.Errorf("expected delay for %q: %v, got: %v", tc.Header, tc.Expect, actual)
+		}
+	}
+}
+
+func TestMetaRefreshURL(t *testing.T) {
+	testCases := []struct {
+		Page   string
+		Expect string
+	}{
+		{`<meta http-equiv="refresh" content="0; url=/file.bin">`, "/file.bin"},
+		{`<META HTTP-EQUIV=Refresh CONTENT="5;URL='https://example.com/a?b=1&amp;c=2'">`, "https://example.com/a?b=1&c=2"},
+		{`<head><meta content='3, file.bin' http-equiv='refresh' /></head>`, "file.bin"},
+		{`<meta http-equiv="refresh" content="30">`, ""},
+		{`<meta http-equiv="content-type" content="text/html; charset=utf-8">`, ""},
+		{`<p>no refresh</p>`, ""},
+	}
+	for _, tc := range testCases {
+		if actual := metaRefreshURL([]byte(tc.Page)); actual != tc.Expect {
+			t.Errorf("expected URL for %q: %q, got: %q", tc.Page, tc.Expect, actual)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+//go:build windows
+
+package grab
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length at which paths must be converted to extended-length
+// form to be used with the Windows API. MAX_PATH is 260 characters, but
+// directories are limited to 248 characters to leave room for an 8.3 file
+// name.
+const maxPath = 248
+
+// longPath returns the extended-length form of the given local file path if
+// its absolute form exceeds MAX_PATH. Shorter paths are returned unchanged.
+func longPath(name string) string {
+	if strings.HasPrefix(name, `\\?\`) {
+		return name
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil || len(abs) < maxPath {
+		return name
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path, as in \\server\share\file
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// reservedNames are the names of DOS devices, which Windows reserves in every
+// directory, regardless of any extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizePlatformFilename transforms the given file name into a name that can
+// be created on Windows. Trailing dots and spaces, which Windows silently
+// strips, are removed and reserved device names, such as "aux.log", are
+// prefixed with an underscore. An empty string is returned if nothing remains
+// of the name.
+func sanitizePlatformFilename(filename string) string {
+	filename = strings.TrimRight(filename, ". ")
+	stem, _, _ := strings.Cut(filename, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		filename = "_" + filename
+	}
+	return filename
+}
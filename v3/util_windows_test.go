@@ -0,0 +1,83 @@
+//go:build windows
+
+package grab
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3JoB/grab/v3/pkg/grabtest"
+)
+
+func TestSanitizeReservedFilename(t *testing.T) {
+	testCases := []struct {
+		Filename string
+		Expect   string
+	}{
+		{"aux.log", "_aux.log"},
+		{"CON", "_CON"},
+		{"nul.tar.gz", "_nul.tar.gz"},
+		{"com1", "_com1"},
+		{"Lpt9.txt", "_Lpt9.txt"},
+		{"com10.txt", "com10.txt"},
+		{"console.txt", "console.txt"},
+		{"file.txt. . ", "file.txt"},
+		{"aux .log", "_aux .log"},
+	}
+	for _, tc := range testCases {
+		actual, err := sanitizeFilename(tc.Filename)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.Filename, err)
+			continue
+		}
+		if actual != tc.Expect {
+			t.Errorf("expected %q for %q, got %q", tc.Expect, tc.Filename, actual)
+		}
+	}
+	for _, filename := range []string{"...", ". ."} {
+		if _, err := sanitizeFilename(filename); err != ErrNoFilename {
+			t.Errorf("expected %v for %q, got: %v", ErrNoFilename, filename, err)
+		}
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	if v := longPath(`short\file.txt`); v != `short\file.txt` {
+		t.Errorf("expected short path to be unchanged, got: %q", v)
+	}
+	long := strings.Repeat(`a\`, 150) + "file.txt"
+	abs, err := filepath.Abs(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := longPath(long); v != `\\?\`+abs {
+		t.Errorf("expected %q, got: %q", `\\?\`+abs, v)
+	}
+	if v := longPath(`\\?\` + abs); v != `\\?\`+abs {
+		t.Errorf("expected extended-length path to be unchanged, got: %q", v)
+	}
+	unc := `\\server\share\` + long
+	if v := longPath(unc); v != `\\?\UNC\server\share\`+long {
+		t.Errorf("expected UNC path in extended-length form, got: %q", v)
+	}
+}
+
+// TestLongPathTransfer ensures that files can be downloaded to destinations
+// that exceed MAX_PATH.
+func TestLongPathTransfer(t *testing.T) {
+	dir, err := filepath.Abs(".testLongPathTransfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, strings.Repeat("directory\\", 30), "file.bin")
+	grabtest.WithTestServer(t, func(url string) {
+		resp := mustDo(mustNewRequest(filename, url))
+		testComplete(t, resp)
+		if !strings.HasPrefix(resp.Filename, `\\?\`) {
+			t.Errorf("expected extended-length Filename, got: %q", resp.Filename)
+		}
+	})
+}